@@ -1,19 +1,24 @@
 package config
 
 import (
-	"log"
+	"fmt"
+	"log/slog"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 // SourceConfig holds upstream API configuration
 type SourceConfig struct {
-	Protocol string
-	Host     string
-	Token    string
+	Protocol     string
+	Host         string
+	Token        string
+	MaxEventSize int
 }
 
 // APIConfig holds API server configuration
@@ -23,6 +28,8 @@ type APIConfig struct {
 	DebugMsg  bool
 	Think     string
 	Anonymous bool
+	// UnknownFields is "ignore" to drop unrecognized request fields or "reject" to fail with 400
+	UnknownFields string
 }
 
 // ModelConfig holds model configuration
@@ -31,12 +38,188 @@ type ModelConfig struct {
 	Mapping map[string]string
 }
 
+// APIKeyConfig holds a proxy API key declared in the environment
+type APIKeyConfig struct {
+	ID            string
+	Key           string
+	UpstreamToken string
+}
+
+// AuthConfig holds client authentication and upstream credential configuration
+type AuthConfig struct {
+	Keys              []APIKeyConfig
+	KeysFile          string
+	AllowClientTokens bool
+	TokenHeader       string
+	UserCacheSize     int
+}
+
+// StorageConfig holds local persistence configuration
+type StorageConfig struct {
+	DataDir string
+}
+
+// UsageConfig holds usage ledger configuration
+type UsageConfig struct {
+	Enabled     bool
+	MaxFileSize int64
+}
+
+// TranscriptConfig holds DEBUG_MSG transcript capture configuration
+type TranscriptConfig struct {
+	OptInHeader   string
+	MaxRecordSize int
+	MaxFileSize   int64
+	MaxFiles      int
+}
+
+// BudgetConfig holds default per-key token budgets
+type BudgetConfig struct {
+	DailyTokens   int64
+	MonthlyTokens int64
+	SoftThreshold float64
+	WebhookURL    string
+}
+
+// AdminConfig holds admin API configuration
+type AdminConfig struct {
+	Key  string
+	Port int
+}
+
+// RetryPolicy holds retry settings for one kind of upstream call
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// RetryConfig holds retry policies per upstream call type
+type RetryConfig struct {
+	Chat   RetryPolicy
+	Models RetryPolicy
+	Auth   RetryPolicy
+	Upload RetryPolicy
+}
+
+// BreakerConfig holds upstream circuit breaker configuration
+type BreakerConfig struct {
+	Enabled               bool
+	WindowSize            int
+	MinRequests           int
+	ErrorRateThreshold    float64
+	SlowCallThreshold     time.Duration
+	SlowCallRateThreshold float64
+	OpenDuration          time.Duration
+	HalfOpenProbes        int
+}
+
+// TransportConfig holds the pooled HTTP transport shared by all upstream calls
+type TransportConfig struct {
+	// Proxy is an http, https, socks5 or socks5h URL; empty uses HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+	Proxy string
+	// CABundle is a PEM file of extra root certificates trusted for upstream TLS
+	CABundle              string
+	HTTP2                 bool
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	Timeouts              TimeoutConfig
+}
+
+// TimeoutConfig holds the overall timeout per upstream call type; zero means none
+type TimeoutConfig struct {
+	Auth   time.Duration
+	Models time.Duration
+	Upload time.Duration
+	Chat   time.Duration
+}
+
+// ImageConfig holds image fetching and upload configuration
+type ImageConfig struct {
+	// FetchRemote allows http(s) image URLs, which are downloaded and uploaded like inline images
+	FetchRemote bool
+	// AllowedHosts limits remote image hosts, "*.example.com" matches subdomains; empty allows any public host
+	AllowedHosts []string
+	MaxBytes     int64
+	FetchTimeout time.Duration
+	// CacheTTL and CacheSize bound the cache of uploaded file IDs by image content
+	CacheTTL  time.Duration
+	CacheSize int
+	// Resize re-encodes images that are rotated, too large or over TargetBytes before upload
+	Resize bool
+	// MaxDimension bounds the longer side of images, LowDetailDimension that of detail "low" images
+	MaxDimension       int
+	LowDetailDimension int
+	TargetBytes        int64
+	JPEGQuality        int
+}
+
+// DocumentConfig holds document and file content configuration
+type DocumentConfig struct {
+	MaxBytes int64
+	// InlineMaxBytes is the largest plain-text document sent as message text instead of being uploaded
+	InlineMaxBytes int
+}
+
+// FileConfig holds Files API configuration
+type FileConfig struct {
+	// TTL is how long uploaded files are kept; zero keeps them until deleted
+	TTL       time.Duration
+	MaxPerKey int
+}
+
+// SessionConfig holds session affinity configuration
+type SessionConfig struct {
+	// Enabled reuses the upstream chat of a client conversation across requests
+	Enabled bool
+	// TTL and MaxSessions bound the local session store
+	TTL         time.Duration
+	MaxSessions int
+}
+
+// ContextConfig holds context window configuration
+type ContextConfig struct {
+	// Policy handles requests over the context limit: off, reject, truncate or summarize
+	Policy string
+	// Limits maps model IDs to context lengths in tokens, overriding upstream metadata
+	Limits map[string]int
+	// DefaultLimit applies to models without a known limit; zero skips the check
+	DefaultLimit int
+	// OutputReserve is kept free for the completion of requests without max_tokens
+	OutputReserve int
+	// SummaryModel summarizes dropped turns, empty for the request's model
+	SummaryModel     string
+	SummaryMaxTokens int
+	// SummaryMaxInputTokens caps the dropped history sent for summarizing, newest turns first
+	SummaryMaxInputTokens int
+}
+
 // Config holds all configuration
 type Config struct {
-	Source  SourceConfig
-	API     APIConfig
-	Model   ModelConfig
-	Headers map[string]string
+	Source     SourceConfig
+	API        APIConfig
+	Model      ModelConfig
+	Auth       AuthConfig
+	Storage    StorageConfig
+	Usage      UsageConfig
+	Transcript TranscriptConfig
+	Budget     BudgetConfig
+	Admin      AdminConfig
+	Retry      RetryConfig
+	Breaker    BreakerConfig
+	Transport  TransportConfig
+	Images     ImageConfig
+	Documents  DocumentConfig
+	Files      FileConfig
+	Sessions   SessionConfig
+	Context    ContextConfig
+	Headers    map[string]string
 }
 
 var cfg *Config
@@ -55,23 +238,138 @@ func loadConfig() *Config {
 
 	c := &Config{
 		Source: SourceConfig{
-			Protocol: "https:",
-			Host:     "chat.z.ai",
-			Token:    strings.TrimSpace(getEnv("TOKEN", "")),
+			Protocol:     "https:",
+			Host:         "chat.z.ai",
+			Token:        strings.TrimSpace(getEnv("TOKEN", "")),
+			MaxEventSize: getEnvInt("SSE_MAX_EVENT_SIZE", 8<<20),
 		},
 		API: APIConfig{
-			Port:     getEnvInt("PORT", 8080),
-			Debug:    getEnvBool("DEBUG", false),
-			DebugMsg: getEnvBool("DEBUG_MSG", false),
-			Think:    getEnv("THINK_TAGS_MODE", "reasoning"),
+			Port:          getEnvInt("PORT", 8080),
+			Debug:         getEnvBool("DEBUG", false),
+			DebugMsg:      getEnvBool("DEBUG_MSG", false),
+			Think:         getEnv("THINK_TAGS_MODE", "reasoning"),
+			UnknownFields: strings.ToLower(getEnv("UNKNOWN_FIELDS", "ignore")),
 		},
 		Model: ModelConfig{
 			Default: getEnv("MODEL", "glm-4.6"),
 			Mapping: make(map[string]string),
 		},
+		Auth: AuthConfig{
+			Keys:              parseAPIKeys(getEnv("API_KEYS", "")),
+			KeysFile:          getEnv("API_KEYS_FILE", ""),
+			AllowClientTokens: getEnvBool("ALLOW_CLIENT_TOKENS", false),
+			TokenHeader:       getEnv("UPSTREAM_TOKEN_HEADER", "X-Zai-Token"),
+			UserCacheSize:     getEnvInt("USER_CACHE_SIZE", 256),
+		},
+		Storage: StorageConfig{
+			DataDir: getEnv("DATA_DIR", "data"),
+		},
+		Usage: UsageConfig{
+			Enabled:     getEnvBool("USAGE_LEDGER", true),
+			MaxFileSize: int64(getEnvInt("USAGE_MAX_FILE_SIZE", 50<<20)),
+		},
+		Transcript: TranscriptConfig{
+			OptInHeader:   strings.TrimSpace(getEnv("DEBUG_MSG_HEADER", "X-Debug-Transcript")),
+			MaxRecordSize: getEnvInt("DEBUG_MSG_MAX_RECORD_SIZE", 1<<20),
+			MaxFileSize:   int64(getEnvInt("DEBUG_MSG_MAX_FILE_SIZE", 50<<20)),
+			MaxFiles:      getEnvInt("DEBUG_MSG_MAX_FILES", 5),
+		},
+		Budget: BudgetConfig{
+			DailyTokens:   int64(getEnvInt("BUDGET_DAILY_TOKENS", 0)),
+			MonthlyTokens: int64(getEnvInt("BUDGET_MONTHLY_TOKENS", 0)),
+			SoftThreshold: getEnvFloat("BUDGET_SOFT_THRESHOLD", 0.8),
+			WebhookURL:    strings.TrimSpace(getEnv("BUDGET_WEBHOOK_URL", "")),
+		},
+		Admin: AdminConfig{
+			Key:  strings.TrimSpace(getEnv("ADMIN_KEY", "")),
+			Port: getEnvInt("ADMIN_PORT", 0),
+		},
+		Retry: RetryConfig{
+			Chat:   getRetryPolicy("CHAT"),
+			Models: getRetryPolicy("MODELS"),
+			Auth:   getRetryPolicy("AUTH"),
+			Upload: getRetryPolicy("UPLOAD"),
+		},
+		Breaker: BreakerConfig{
+			Enabled:               getEnvBool("BREAKER_ENABLED", true),
+			WindowSize:            getEnvInt("BREAKER_WINDOW", 20),
+			MinRequests:           getEnvInt("BREAKER_MIN_REQUESTS", 10),
+			ErrorRateThreshold:    getEnvFloat("BREAKER_ERROR_RATE", 0.5),
+			SlowCallThreshold:     getEnvDuration("BREAKER_SLOW_CALL_MS", 30*time.Second),
+			SlowCallRateThreshold: getEnvFloat("BREAKER_SLOW_CALL_RATE", 0.8),
+			OpenDuration:          getEnvDuration("BREAKER_OPEN_MS", 30*time.Second),
+			HalfOpenProbes:        getEnvInt("BREAKER_HALF_OPEN_PROBES", 1),
+		},
+		Transport: TransportConfig{
+			Proxy:                 strings.TrimSpace(getEnv("UPSTREAM_PROXY", "")),
+			CABundle:              strings.TrimSpace(getEnv("UPSTREAM_CA_BUNDLE", "")),
+			HTTP2:                 getEnvBool("UPSTREAM_HTTP2", true),
+			MaxIdleConns:          getEnvInt("UPSTREAM_MAX_IDLE_CONNS", 100),
+			MaxIdleConnsPerHost:   getEnvInt("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", 32),
+			MaxConnsPerHost:       getEnvInt("UPSTREAM_MAX_CONNS_PER_HOST", 0),
+			IdleConnTimeout:       getEnvDuration("UPSTREAM_IDLE_CONN_TIMEOUT_MS", 90*time.Second),
+			DialTimeout:           getEnvDuration("UPSTREAM_DIAL_TIMEOUT_MS", 10*time.Second),
+			KeepAlive:             getEnvDuration("UPSTREAM_KEEP_ALIVE_MS", 30*time.Second),
+			TLSHandshakeTimeout:   getEnvDuration("UPSTREAM_TLS_HANDSHAKE_TIMEOUT_MS", 10*time.Second),
+			ResponseHeaderTimeout: getEnvDuration("UPSTREAM_RESPONSE_HEADER_TIMEOUT_MS", 60*time.Second),
+			Timeouts: TimeoutConfig{
+				Auth:   getEnvDuration("UPSTREAM_TIMEOUT_AUTH_MS", 10*time.Second),
+				Models: getEnvDuration("UPSTREAM_TIMEOUT_MODELS_MS", 10*time.Second),
+				Upload: getEnvDuration("UPSTREAM_TIMEOUT_UPLOAD_MS", 30*time.Second),
+				Chat:   getEnvDuration("UPSTREAM_TIMEOUT_CHAT_MS", 0),
+			},
+		},
+		Images: ImageConfig{
+			FetchRemote:  getEnvBool("IMAGE_FETCH_REMOTE", false),
+			AllowedHosts: parseHosts(getEnv("IMAGE_URL_ALLOWLIST", "")),
+			MaxBytes:     int64(getEnvInt("IMAGE_MAX_BYTES", 20<<20)),
+			FetchTimeout: getEnvDuration("IMAGE_FETCH_TIMEOUT_MS", 10*time.Second),
+			CacheTTL:     getEnvDuration("IMAGE_UPLOAD_CACHE_TTL_MS", time.Hour),
+			CacheSize:    getEnvInt("IMAGE_UPLOAD_CACHE_SIZE", 1024),
+
+			Resize:             getEnvBool("IMAGE_RESIZE", true),
+			MaxDimension:       getEnvInt("IMAGE_MAX_DIMENSION", 2048),
+			LowDetailDimension: getEnvInt("IMAGE_LOW_DETAIL_DIMENSION", 512),
+			TargetBytes:        int64(getEnvInt("IMAGE_TARGET_BYTES", 4<<20)),
+			JPEGQuality:        getEnvInt("IMAGE_JPEG_QUALITY", 85),
+		},
+		Documents: DocumentConfig{
+			MaxBytes:       int64(getEnvInt("DOCUMENT_MAX_BYTES", 32<<20)),
+			InlineMaxBytes: getEnvInt("DOCUMENT_INLINE_MAX_BYTES", 100<<10),
+		},
+		Files: FileConfig{
+			TTL:       getEnvDuration("FILES_TTL_MS", 7*24*time.Hour),
+			MaxPerKey: getEnvInt("FILES_MAX_PER_KEY", 100),
+		},
+		Sessions: SessionConfig{
+			Enabled:     getEnvBool("SESSION_AFFINITY", false),
+			TTL:         getEnvDuration("SESSION_TTL_MS", time.Hour),
+			MaxSessions: getEnvInt("SESSION_MAX", 10000),
+		},
+		Context: ContextConfig{
+			Policy:                strings.ToLower(getEnv("CONTEXT_POLICY", "reject")),
+			Limits:                parseLimits(getEnv("CONTEXT_LIMITS", "")),
+			DefaultLimit:          getEnvInt("CONTEXT_DEFAULT_LIMIT", 0),
+			OutputReserve:         getEnvInt("CONTEXT_OUTPUT_RESERVE", 4096),
+			SummaryModel:          getEnv("CONTEXT_SUMMARY_MODEL", ""),
+			SummaryMaxTokens:      getEnvInt("CONTEXT_SUMMARY_MAX_TOKENS", 1024),
+			SummaryMaxInputTokens: getEnvInt("CONTEXT_SUMMARY_MAX_INPUT_TOKENS", 16384),
+		},
 		Headers: make(map[string]string),
 	}
 
+	// Keys created through the admin API live in the data directory by default
+	if c.Auth.KeysFile == "" {
+		c.Auth.KeysFile = filepath.Join(c.Storage.DataDir, "keys.json")
+	}
+
+	// Point at another upstream, e.g. a staging site or a local fake
+	if baseURL := strings.TrimSpace(getEnv("UPSTREAM_URL", "")); baseURL != "" {
+		if err := c.Source.setBaseURL(baseURL); err != nil {
+			slog.Warn("Invalid UPSTREAM_URL, using default", "value", baseURL, "error", err)
+		}
+	}
+
 	// Set anonymous mode based on token presence
 	c.API.Anonymous = (c.Source.Token == "")
 
@@ -84,6 +382,33 @@ func loadConfig() *Config {
 	return c
 }
 
+// BaseURL returns the upstream origin, e.g. https://chat.z.ai
+func (s SourceConfig) BaseURL() string {
+	return s.Protocol + "//" + s.Host
+}
+
+// SetBaseURL points all upstream calls at another origin and updates the browser headers
+func (c *Config) SetBaseURL(baseURL string) error {
+	if err := c.Source.setBaseURL(baseURL); err != nil {
+		return err
+	}
+	c.initHeaders()
+	return nil
+}
+
+func (s *SourceConfig) setBaseURL(baseURL string) error {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("expected an http(s) origin, got %q", baseURL)
+	}
+	s.Protocol = u.Scheme + ":"
+	s.Host = u.Host
+	return nil
+}
+
 func (c *Config) initHeaders() {
 	c.Headers = map[string]string{
 		"Accept":             "*/*",
@@ -99,31 +424,160 @@ func (c *Config) initHeaders() {
 		"Sec-Fetch-Site":     "same-origin",
 		"User-Agent":         "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/141.0.0.0 Safari/537.36 Edg/141.0.0.0",
 		"X-FE-Version":       "prod-fe-1.0.117",
-		"Origin":             c.Source.Protocol + "//" + c.Source.Host,
-		"Referer":            c.Source.Protocol + "//" + c.Source.Host + "/",
+		"Origin":             c.Source.BaseURL(),
+		"Referer":            c.Source.BaseURL() + "/",
 	}
 }
 
 func (c *Config) validate() {
 	// Validate think mode
-	validThinkModes := []string{"reasoning", "think", "strip", "details"}
-	valid := false
-	for _, mode := range validThinkModes {
-		if c.API.Think == mode {
-			valid = true
-			break
+	if !isValidThinkMode(c.API.Think) {
+		slog.Warn("Invalid THINK_TAGS_MODE, using reasoning", "value", c.API.Think)
+		c.API.Think = "reasoning"
+	}
+
+	// Validate unknown field policy
+	if c.API.UnknownFields != "ignore" && c.API.UnknownFields != "reject" {
+		slog.Warn("Invalid UNKNOWN_FIELDS, using ignore", "value", c.API.UnknownFields)
+		c.API.UnknownFields = "ignore"
+	}
+
+	// Validate SSE event size
+	if c.Source.MaxEventSize < 1024 {
+		slog.Warn("Invalid SSE_MAX_EVENT_SIZE, using default", "value", c.Source.MaxEventSize, "default", 8<<20)
+		c.Source.MaxEventSize = 8 << 20
+	}
+
+	// Validate user cache size
+	if c.Auth.UserCacheSize < 1 {
+		slog.Warn("Invalid USER_CACHE_SIZE, using 256", "value", c.Auth.UserCacheSize)
+		c.Auth.UserCacheSize = 256
+	}
+
+	// Validate transcript limits
+	if c.Transcript.MaxRecordSize < 1024 {
+		slog.Warn("Invalid DEBUG_MSG_MAX_RECORD_SIZE, using default", "value", c.Transcript.MaxRecordSize, "default", 1<<20)
+		c.Transcript.MaxRecordSize = 1 << 20
+	}
+
+	// Validate budgets
+	if c.Budget.DailyTokens < 0 {
+		c.Budget.DailyTokens = 0
+	}
+	if c.Budget.MonthlyTokens < 0 {
+		c.Budget.MonthlyTokens = 0
+	}
+	if c.Budget.SoftThreshold < 0 || c.Budget.SoftThreshold > 1 {
+		slog.Warn("Invalid BUDGET_SOFT_THRESHOLD, using 0.8", "value", c.Budget.SoftThreshold)
+		c.Budget.SoftThreshold = 0.8
+	}
+
+	// Validate circuit breaker
+	if c.Breaker.WindowSize < 1 {
+		c.Breaker.WindowSize = 20
+	}
+	if c.Breaker.MinRequests < 1 || c.Breaker.MinRequests > c.Breaker.WindowSize {
+		c.Breaker.MinRequests = c.Breaker.WindowSize
+	}
+	if c.Breaker.HalfOpenProbes < 1 {
+		c.Breaker.HalfOpenProbes = 1
+	}
+
+	// Validate upstream transport
+	if c.Transport.Proxy != "" {
+		if u, err := url.Parse(c.Transport.Proxy); err != nil || u.Host == "" || !isValidProxyScheme(u.Scheme) {
+			slog.Warn("Invalid UPSTREAM_PROXY, connecting directly", "scheme", proxyScheme(c.Transport.Proxy))
+			c.Transport.Proxy = ""
 		}
 	}
-	if !valid {
-		log.Printf("Warning: Invalid THINK_TAGS_MODE '%s', using 'reasoning'", c.API.Think)
-		c.API.Think = "reasoning"
+	if c.Transport.MaxIdleConns < 0 {
+		c.Transport.MaxIdleConns = 100
+	}
+	if c.Transport.MaxIdleConnsPerHost < 1 {
+		c.Transport.MaxIdleConnsPerHost = 32
+	}
+	if c.Transport.MaxConnsPerHost < 0 {
+		c.Transport.MaxConnsPerHost = 0
+	}
+
+	// Validate image limits
+	if c.Images.MaxBytes < 1024 {
+		slog.Warn("Invalid IMAGE_MAX_BYTES, using default", "value", c.Images.MaxBytes, "default", 20<<20)
+		c.Images.MaxBytes = 20 << 20
+	}
+	if c.Images.CacheSize < 0 {
+		c.Images.CacheSize = 0
+	}
+	if c.Images.MaxDimension < 64 {
+		slog.Warn("Invalid IMAGE_MAX_DIMENSION, using 2048", "value", c.Images.MaxDimension)
+		c.Images.MaxDimension = 2048
+	}
+	if c.Images.LowDetailDimension < 64 || c.Images.LowDetailDimension > c.Images.MaxDimension {
+		slog.Warn("Invalid IMAGE_LOW_DETAIL_DIMENSION, using the smaller of 512 and IMAGE_MAX_DIMENSION", "value", c.Images.LowDetailDimension)
+		c.Images.LowDetailDimension = min(512, c.Images.MaxDimension)
+	}
+	if c.Images.TargetBytes < 1024 || c.Images.TargetBytes > c.Images.MaxBytes {
+		slog.Warn("Invalid IMAGE_TARGET_BYTES, using the smaller of 4 MiB and IMAGE_MAX_BYTES", "value", c.Images.TargetBytes)
+		c.Images.TargetBytes = min(4<<20, c.Images.MaxBytes)
+	}
+	if c.Images.JPEGQuality < 1 || c.Images.JPEGQuality > 100 {
+		slog.Warn("Invalid IMAGE_JPEG_QUALITY, using 85", "value", c.Images.JPEGQuality)
+		c.Images.JPEGQuality = 85
+	}
+
+	// Validate document limits
+	if c.Documents.MaxBytes < 1024 {
+		slog.Warn("Invalid DOCUMENT_MAX_BYTES, using default", "value", c.Documents.MaxBytes, "default", 32<<20)
+		c.Documents.MaxBytes = 32 << 20
+	}
+	if c.Documents.InlineMaxBytes < 0 {
+		c.Documents.InlineMaxBytes = 0
+	}
+	if c.Files.MaxPerKey < 0 {
+		c.Files.MaxPerKey = 0
+	}
+
+	// Validate session affinity
+	if c.Sessions.TTL <= 0 {
+		slog.Warn("Invalid SESSION_TTL_MS, using 1 hour", "value", c.Sessions.TTL)
+		c.Sessions.TTL = time.Hour
+	}
+	if c.Sessions.MaxSessions < 1 {
+		slog.Warn("Invalid SESSION_MAX, using 10000", "value", c.Sessions.MaxSessions)
+		c.Sessions.MaxSessions = 10000
+	}
+
+	// Validate context window management
+	switch c.Context.Policy {
+	case "off", "reject", "truncate", "summarize":
+	default:
+		slog.Warn("Invalid CONTEXT_POLICY, using reject", "value", c.Context.Policy)
+		c.Context.Policy = "reject"
+	}
+	if c.Context.DefaultLimit < 0 {
+		c.Context.DefaultLimit = 0
+	}
+	if c.Context.OutputReserve < 0 {
+		c.Context.OutputReserve = 0
+	}
+	if c.Context.SummaryMaxTokens < 64 {
+		slog.Warn("Invalid CONTEXT_SUMMARY_MAX_TOKENS, using 1024", "value", c.Context.SummaryMaxTokens)
+		c.Context.SummaryMaxTokens = 1024
+	}
+	if c.Context.SummaryMaxInputTokens < 256 {
+		slog.Warn("Invalid CONTEXT_SUMMARY_MAX_INPUT_TOKENS, using 16384", "value", c.Context.SummaryMaxInputTokens)
+		c.Context.SummaryMaxInputTokens = 16384
 	}
 
 	// Validate port
 	if c.API.Port < 1 || c.API.Port > 65535 {
-		log.Printf("Warning: Invalid PORT %d, using 8080", c.API.Port)
+		slog.Warn("Invalid PORT, using 8080", "value", c.API.Port)
 		c.API.Port = 8080
 	}
+	if c.Admin.Port < 0 || c.Admin.Port > 65535 || c.Admin.Port == c.API.Port {
+		slog.Warn("Invalid ADMIN_PORT, serving admin API on PORT", "value", c.Admin.Port)
+		c.Admin.Port = 0
+	}
 }
 
 // Helper functions
@@ -149,4 +603,103 @@ func getEnvBool(key string, defaultValue bool) bool {
 		return strings.ToLower(value) == "true"
 	}
 	return defaultValue
-}
\ No newline at end of file
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+	}
+	return defaultValue
+}
+
+// getRetryPolicy reads RETRY_<NAME>_* variables, falling back to the shared RETRY_* defaults
+func getRetryPolicy(name string) RetryPolicy {
+	attempts := getEnvInt("RETRY_MAX_ATTEMPTS", 3)
+	baseDelay := getEnvDuration("RETRY_BASE_DELAY_MS", 500*time.Millisecond)
+	maxDelay := getEnvDuration("RETRY_MAX_DELAY_MS", 8*time.Second)
+
+	return RetryPolicy{
+		MaxAttempts: getEnvInt("RETRY_"+name+"_MAX_ATTEMPTS", attempts),
+		BaseDelay:   getEnvDuration("RETRY_"+name+"_BASE_DELAY_MS", baseDelay),
+		MaxDelay:    getEnvDuration("RETRY_"+name+"_MAX_DELAY_MS", maxDelay),
+	}
+}
+
+// isValidProxyScheme reports whether net/http can dial through a proxy of this scheme
+func isValidProxyScheme(scheme string) bool {
+	switch scheme {
+	case "http", "https", "socks5", "socks5h":
+		return true
+	}
+	return false
+}
+
+// proxyScheme returns the scheme of a proxy URL without logging its credentials
+func proxyScheme(raw string) string {
+	if scheme, _, ok := strings.Cut(raw, "://"); ok {
+		return scheme
+	}
+	return ""
+}
+
+// parseHosts parses a comma-separated list of host names, dropping empty entries
+func parseHosts(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseLimits parses a comma-separated list of "model=tokens", dropping invalid entries
+func parseLimits(value string) map[string]int {
+	limits := make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		model, tokens, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(tokens))
+		if err != nil || limit < 1 {
+			slog.Warn("Invalid CONTEXT_LIMITS entry, ignoring it", "entry", entry)
+			continue
+		}
+		limits[strings.TrimSpace(model)] = limit
+	}
+	return limits
+}
+
+// parseAPIKeys parses a comma-separated list of "key", "id:key" or "id:key:upstream_token"
+func parseAPIKeys(value string) []APIKeyConfig {
+	keys := []APIKeyConfig{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 3)
+		switch len(parts) {
+		case 1:
+			keys = append(keys, APIKeyConfig{Key: parts[0]})
+		case 2:
+			keys = append(keys, APIKeyConfig{ID: parts[0], Key: parts[1]})
+		default:
+			keys = append(keys, APIKeyConfig{ID: parts[0], Key: parts[1], UpstreamToken: parts[2]})
+		}
+	}
+	return keys
+}
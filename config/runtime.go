@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ValidThinkModes are the supported thinking tags modes
+var ValidThinkModes = []string{"reasoning", "think", "strip", "details"}
+
+// runtimeMutex guards settings that can be changed while the server runs
+var runtimeMutex sync.RWMutex
+
+// ThinkMode returns the current thinking tags mode
+func (c *Config) ThinkMode() string {
+	runtimeMutex.RLock()
+	defer runtimeMutex.RUnlock()
+	return c.API.Think
+}
+
+// SetThinkMode changes the thinking tags mode at runtime
+func (c *Config) SetThinkMode(mode string) error {
+	if !isValidThinkMode(mode) {
+		return fmt.Errorf("invalid think mode %q, expected one of %s", mode, strings.Join(ValidThinkModes, ", "))
+	}
+
+	runtimeMutex.Lock()
+	defer runtimeMutex.Unlock()
+	c.API.Think = mode
+	return nil
+}
+
+// DefaultModel returns the model used when a request does not name one
+func (c *Config) DefaultModel() string {
+	runtimeMutex.RLock()
+	defer runtimeMutex.RUnlock()
+	return c.Model.Default
+}
+
+// SetDefaultModel changes the default model at runtime
+func (c *Config) SetDefaultModel(model string) error {
+	model = strings.TrimSpace(model)
+	if model == "" {
+		return fmt.Errorf("default model must not be empty")
+	}
+
+	runtimeMutex.Lock()
+	defer runtimeMutex.Unlock()
+	c.Model.Default = model
+	return nil
+}
+
+// Redacted returns a copy of the config that is safe to display, with secrets masked
+func (c *Config) Redacted() Config {
+	runtimeMutex.RLock()
+	redacted := *c
+	runtimeMutex.RUnlock()
+
+	redacted.Source.Token = redact(redacted.Source.Token)
+	redacted.Admin.Key = redact(redacted.Admin.Key)
+	redacted.Budget.WebhookURL = redactURL(redacted.Budget.WebhookURL)
+	redacted.Transport.Proxy = redactURL(redacted.Transport.Proxy)
+
+	redacted.Auth.Keys = make([]APIKeyConfig, len(c.Auth.Keys))
+	for i, key := range c.Auth.Keys {
+		redacted.Auth.Keys[i] = APIKeyConfig{
+			ID:            key.ID,
+			Key:           redact(key.Key),
+			UpstreamToken: redact(key.UpstreamToken),
+		}
+	}
+
+	redacted.Model.Mapping = make(map[string]string, len(c.Model.Mapping))
+	for k, v := range c.Model.Mapping {
+		redacted.Model.Mapping[k] = v
+	}
+	redacted.Headers = make(map[string]string, len(c.Headers))
+	for k, v := range c.Headers {
+		redacted.Headers[k] = v
+	}
+	return redacted
+}
+
+func isValidThinkMode(mode string) bool {
+	for _, valid := range ValidThinkModes {
+		if mode == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// redact masks a secret, keeping whether it is set
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// redactURL masks credentials and query parameters of a URL
+func redactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redact(raw)
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	return u.String()
+}
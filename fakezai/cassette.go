@@ -0,0 +1,162 @@
+package fakezai
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+// Cassette is a recorded upstream session
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is one recorded request/response pair
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedRequest is the part of a request kept in a cassette
+type RecordedRequest struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Query  string `json:"query,omitempty"`
+	Body   string `json:"body,omitempty"`
+}
+
+// RecordedResponse is a recorded upstream response
+type RecordedResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        string `json:"body"`
+}
+
+// secretQueryParams are dropped from recorded query strings
+var secretQueryParams = []string{"token", "signature", "signature_timestamp", "user_id"}
+
+// LoadCassette reads a cassette file
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cassette Cassette
+	if err := json.Unmarshal(data, &cassette); err != nil {
+		return nil, fmt.Errorf("failed to parse cassette %s: %w", path, err)
+	}
+	return &cassette, nil
+}
+
+// Save writes the cassette as indented JSON
+func (c *Cassette) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Replay queues the recorded responses of a cassette on the server, in order
+func (s *Server) Replay(c *Cassette) {
+	for _, interaction := range c.Interactions {
+		response := Response{
+			Status: interaction.Response.Status,
+			Body:   interaction.Response.Body,
+		}
+		if interaction.Response.ContentType != "" {
+			response.Header = http.Header{"Content-Type": []string{interaction.Response.ContentType}}
+		}
+		s.Queue(interaction.Request.Path, response)
+	}
+}
+
+// Recorder is an http.RoundTripper that records upstream traffic into a cassette
+//
+// Bearer tokens, JWTs and signature parameters are redacted, so cassettes can
+// be committed. Response bodies are read fully before being handed back,
+// which is fine for recording but defeats streaming.
+type Recorder struct {
+	Transport http.RoundTripper
+
+	mutex    sync.Mutex
+	cassette Cassette
+}
+
+// NewRecorder wraps a transport; nil uses http.DefaultTransport
+func NewRecorder(transport http.RoundTripper) *Recorder {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return &Recorder{Transport: transport}
+}
+
+// RoundTrip implements http.RoundTripper
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		if reqBody, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := r.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	r.mutex.Lock()
+	r.cassette.Interactions = append(r.cassette.Interactions, Interaction{
+		Request: RecordedRequest{
+			Method: req.Method,
+			Path:   req.URL.Path,
+			Query:  redactQuery(req.URL.Query()),
+			Body:   utils.RedactString(string(reqBody)),
+		},
+		Response: RecordedResponse{
+			Status:      resp.StatusCode,
+			ContentType: resp.Header.Get("Content-Type"),
+			Body:        utils.RedactString(string(respBody)),
+		},
+	})
+	r.mutex.Unlock()
+
+	return resp, nil
+}
+
+// Cassette returns a copy of what has been recorded so far
+func (r *Recorder) Cassette() *Cassette {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return &Cassette{Interactions: append([]Interaction(nil), r.cassette.Interactions...)}
+}
+
+func redactQuery(query url.Values) string {
+	for _, param := range secretQueryParams {
+		if query.Has(param) {
+			query.Set(param, "[redacted]")
+		}
+	}
+	return query.Encode()
+}
@@ -0,0 +1,112 @@
+package fakezai
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// DefaultModels is the model list served by default
+const DefaultModels = `{"data":[
+{"id":"0727-360B-API","name":"GLM-4.5","info":{"is_active":true,"created_at":1753574400,"meta":{"description":"Fake GLM-4.5","capabilities":{"vision":false,"think":true}}}},
+{"id":"glm-4.6","name":"GLM-4.6","info":{"is_active":true,"created_at":1759190400,"meta":{"description":"Fake GLM-4.6","capabilities":{"vision":false,"think":true}}}},
+{"id":"glm-4.5v","name":"GLM-4.5V","info":{"is_active":true,"created_at":1754956800,"meta":{"description":"Fake GLM-4.5V","capabilities":{"vision":true,"think":true}}}}
+]}`
+
+// JSON returns a response with a JSON body
+func JSON(status int, body string) Response {
+	return Response{
+		Status: status,
+		Header: http.Header{"Content-Type": []string{"application/json"}},
+		Body:   body,
+	}
+}
+
+// Chat returns a successful SSE chat response made of the given frames
+func Chat(events ...string) Response {
+	return Response{Status: http.StatusOK, Events: events}
+}
+
+// Frame builds a Z.ai chat frame with delta content in the given phase
+func Frame(phase, delta string) string {
+	return marshal(map[string]interface{}{
+		"type": "chat:completion",
+		"data": map[string]interface{}{
+			"phase":         phase,
+			"delta_content": delta,
+		},
+	})
+}
+
+// EditFrame builds a Z.ai chat frame carrying edit_content instead of a delta
+func EditFrame(phase, edit string) string {
+	return marshal(map[string]interface{}{
+		"type": "chat:completion",
+		"data": map[string]interface{}{
+			"phase":        phase,
+			"edit_content": edit,
+		},
+	})
+}
+
+// Thinking builds a frame in the thinking phase
+func Thinking(delta string) string {
+	return Frame("thinking", delta)
+}
+
+// Answer builds a frame in the answer phase
+func Answer(delta string) string {
+	return Frame("answer", delta)
+}
+
+// ToolCall builds the frames of an MCP tool call the way Z.ai splits them
+//
+// The opening glm_block arrives in the tool_call phase and its closing half,
+// after the arguments, in the following "other" phase frame.
+func ToolCall(id, name, arguments string) []string {
+	argumentsJSON, _ := json.Marshal(arguments)
+	open := `<glm_block view="">{"type": "mcp", "data": {"metadata": {"id": "` + id + `", "name": "` + name +
+		`", "arguments": ` + string(argumentsJSON) + `, "result": "", "status": "running"}}}</glm_block>`
+	end := `null, "display_result": "", "status": "completed"}}}</glm_block>`
+	return []string{Frame("tool_call", open), Frame("other", end)}
+}
+
+// Done builds the final frame of a chat
+func Done() string {
+	return marshal(map[string]interface{}{
+		"type": "chat:completion",
+		"data": map[string]interface{}{
+			"phase": "done",
+			"done":  true,
+		},
+	})
+}
+
+// DoneWith builds a final frame of a chat that still carries answer content
+func DoneWith(delta string) string {
+	return marshal(map[string]interface{}{
+		"type": "chat:completion",
+		"data": map[string]interface{}{
+			"phase":         "done",
+			"delta_content": delta,
+			"done":          true,
+		},
+	})
+}
+
+// ErrorFrame builds an in-stream Z.ai error frame
+func ErrorFrame(code interface{}, detail string) string {
+	return marshal(map[string]interface{}{
+		"type": "chat:completion",
+		"data": map[string]interface{}{
+			"error": map[string]interface{}{
+				"code":   code,
+				"detail": detail,
+			},
+		},
+	})
+}
+
+func marshal(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
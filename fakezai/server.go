@@ -0,0 +1,184 @@
+// Package fakezai provides a scripted stand-in for the Z.ai web API and a
+// cassette recorder for capturing real upstream sessions as test fixtures
+package fakezai
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// Upstream paths served by the fake
+const (
+	PathAuth   = "/api/v1/auths/"
+	PathModels = "/api/models"
+	PathFiles  = "/api/v1/files/"
+	PathChat   = "/api/chat/completions"
+)
+
+// Response is a scripted upstream response
+//
+// Chat responses usually set Events, which are sent as SSE data frames;
+// otherwise Body is written as is.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   string
+	Events []string
+	// Delay is applied between SSE events, or before Body
+	Delay time.Duration
+}
+
+// Request is an upstream request received by the fake
+type Request struct {
+	Method   string
+	Path     string
+	RawQuery string
+	Header   http.Header
+	Body     []byte
+}
+
+// Server is a fake Z.ai upstream
+//
+// Responses queued for a path are served in order; once a queue is empty the
+// default response for that path is used.
+type Server struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	queues   map[string][]Response
+	defaults map[string]Response
+	requests []Request
+}
+
+// NewServer starts a fake upstream with working defaults for every path
+func NewServer() *Server {
+	s := &Server{
+		queues: make(map[string][]Response),
+		defaults: map[string]Response{
+			PathAuth:   JSON(http.StatusOK, `{"id":"fake-user","name":"Fake User","token":"fake-token"}`),
+			PathModels: JSON(http.StatusOK, DefaultModels),
+			PathFiles:  JSON(http.StatusOK, `{"id":"fake-file","filename":"upload.png"}`),
+			PathChat:   Chat(Answer("Hello from the fake upstream"), Done()),
+		},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Queue adds responses for a path, served before its default
+func (s *Server) Queue(path string, responses ...Response) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queues[path] = append(s.queues[path], responses...)
+}
+
+// SetDefault replaces the response served for a path once its queue is empty
+func (s *Server) SetDefault(path string, response Response) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.defaults[path] = response
+}
+
+// Requests returns the requests received so far, optionally only those for a path
+func (s *Server) Requests(path string) []Request {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	requests := []Request{}
+	for _, r := range s.requests {
+		if path == "" || r.Path == path {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+// Reset clears queued responses and recorded requests
+func (s *Server) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queues = make(map[string][]Response)
+	s.requests = nil
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	s.mutex.Lock()
+	s.requests = append(s.requests, Request{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+		Header:   r.Header.Clone(),
+		Body:     body,
+	})
+	response, ok := s.next(r.URL.Path)
+	s.mutex.Unlock()
+
+	if !ok {
+		http.Error(w, `{"detail":"Not Found"}`, http.StatusNotFound)
+		return
+	}
+	s.write(w, r, response)
+}
+
+// next pops the queued response for a path; the caller must hold the mutex
+func (s *Server) next(path string) (Response, bool) {
+	if queue := s.queues[path]; len(queue) > 0 {
+		s.queues[path] = queue[1:]
+		return queue[0], true
+	}
+	response, ok := s.defaults[path]
+	return response, ok
+}
+
+func (s *Server) write(w http.ResponseWriter, r *http.Request, response Response) {
+	for k, values := range response.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	status := response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	if response.Events == nil {
+		sleep(r, response.Delay)
+		w.WriteHeader(status)
+		io.WriteString(w, response.Body)
+		return
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
+	w.WriteHeader(status)
+	flusher, _ := w.(http.Flusher)
+	for _, event := range response.Events {
+		if !sleep(r, response.Delay) {
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", event)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// sleep waits for d unless the client goes away first
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/google/uuid v1.6.0
 	github.com/joho/godotenv v1.5.1
 	github.com/pkoukk/tiktoken-go v0.1.8
+	golang.org/x/image v0.18.0
 )
 
 require github.com/dlclark/regexp2 v1.11.5 // indirect
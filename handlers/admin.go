@@ -0,0 +1,423 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/services"
+	"github.com/Tyler-Dinh/z2api-go/usage"
+)
+
+// AdminUsage reports recorded usage with optional filters and grouping
+//
+// Query parameters: key, model, dialect, from, to (RFC 3339 or YYYY-MM-DD),
+// group_by (comma-separated key, model, day), format (json or csv) and
+// limit (records only, default 1000).
+func AdminUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrMethodNotAllow, "Method not allowed"))
+		return
+	}
+
+	query := r.URL.Query()
+	filter := usage.Filter{
+		KeyID:   query.Get("key"),
+		Model:   query.Get("model"),
+		Dialect: query.Get("dialect"),
+	}
+
+	var err error
+	if filter.From, err = parseTimeParam(query.Get("from"), false); err != nil {
+		writeError(w, r, services.DialectOpenAI, services.InvalidParam("from", "Invalid from: %v", err))
+		return
+	}
+	if filter.To, err = parseTimeParam(query.Get("to"), true); err != nil {
+		writeError(w, r, services.DialectOpenAI, services.InvalidParam("to", "Invalid to: %v", err))
+		return
+	}
+
+	groupBy := []string{}
+	if value := query.Get("group_by"); value != "" {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if !contains(usage.ValidGroupFields, field) {
+				writeError(w, r, services.DialectOpenAI, services.InvalidParam("group_by", "Invalid group_by: unknown field %q", field))
+				return
+			}
+			groupBy = append(groupBy, field)
+		}
+	}
+
+	limit := 1000
+	if value := query.Get("limit"); value != "" {
+		if _, err := fmt.Sscanf(value, "%d", &limit); err != nil || limit < 1 {
+			writeError(w, r, services.DialectOpenAI, services.InvalidParam("limit", "Invalid limit: must be a positive integer"))
+			return
+		}
+	}
+
+	records, err := usage.GetLedger().Query(filter)
+	if err != nil {
+		writeError(w, r, services.DialectOpenAI, err)
+		return
+	}
+
+	asCSV := query.Get("format") == "csv"
+	if asCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	// Grouped report
+	if len(groupBy) > 0 {
+		groups := usage.Summarize(records, groupBy)
+		if asCSV {
+			usage.WriteGroupsCSV(w, groups, groupBy)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object":   "list",
+			"group_by": groupBy,
+			"data":     groups,
+		})
+		return
+	}
+
+	// Raw records, most recent last
+	if len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	if asCSV {
+		usage.WriteRecordsCSV(w, records)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   records,
+	})
+}
+
+// AdminBudgets lists, sets and removes per-key token budgets
+//
+// GET lists every known key (or one with ?key=), PUT/POST takes a budget
+// object and DELETE ?key= reverts a key to the default budget.
+func AdminBudgets(w http.ResponseWriter, r *http.Request) {
+	budgets := usage.GetBudgets()
+
+	switch r.Method {
+	case http.MethodGet:
+		if keyID, ok := r.URL.Query()["key"]; ok {
+			writeJSON(w, budgets.Status(keyID[0]))
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"object": "list",
+			"data":   budgets.List(),
+		})
+
+	case http.MethodPut, http.MethodPost:
+		var budget usage.Budget
+		if err := json.NewDecoder(r.Body).Decode(&budget); err != nil {
+			writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrInvalidRequest, "Invalid JSON: "+err.Error()))
+			return
+		}
+		if err := budgets.Set(budget); err != nil {
+			writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrInvalidRequest, err.Error()))
+			return
+		}
+		writeJSON(w, budgets.Status(budget.KeyID))
+
+	case http.MethodDelete:
+		keyID := r.URL.Query().Get("key")
+		deleted, err := budgets.Delete(keyID)
+		if err != nil {
+			writeError(w, r, services.DialectOpenAI, err)
+			return
+		}
+		if !deleted {
+			writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrNotFound, fmt.Sprintf("No budget set for key %q", keyID)))
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"key_id":  keyID,
+			"deleted": true,
+		})
+
+	default:
+		writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrMethodNotAllow, "Method not allowed"))
+	}
+}
+
+// AdminCache clears or refreshes the models, user, image upload and session caches
+//
+// POST /admin/cache/clear drops cached entries, POST /admin/cache/refresh also
+// fetches them again. The cache parameter selects models, users, uploads,
+// sessions or all (default); uploads and sessions are only cleared, never
+// refetched.
+func AdminCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrMethodNotAllow, "Method not allowed"))
+		return
+	}
+
+	refresh := strings.HasSuffix(r.URL.Path, "/refresh")
+	target := r.URL.Query().Get("cache")
+	if target == "" {
+		target = "all"
+	}
+	if target != "all" && target != "models" && target != "users" && target != "uploads" && target != "sessions" {
+		writeError(w, r, services.DialectOpenAI, services.InvalidParam("cache", "Invalid cache: expected models, users, uploads, sessions or all"))
+		return
+	}
+
+	result := map[string]interface{}{"refreshed": refresh}
+
+	// User cache first, so a model refresh runs with a fresh identity
+	if target == "all" || target == "users" {
+		services.GetUserService().ClearCache()
+		result["users"] = "cleared"
+		if refresh {
+			if _, err := services.GetUserService().GetUser(r.Context()); err != nil {
+				writeError(w, r, services.DialectOpenAI, err)
+				return
+			}
+			result["users"] = "refreshed"
+		}
+	}
+
+	if target == "all" || target == "models" {
+		services.GetModelsService().ClearCache()
+		result["models"] = "cleared"
+		if refresh {
+			models, err := services.GetModelsService().GetModels(r.Context())
+			if err != nil {
+				writeError(w, r, services.DialectOpenAI, err)
+				return
+			}
+			result["models"] = fmt.Sprintf("refreshed (%d models)", len(models.Data))
+		}
+	}
+
+	if target == "all" || target == "uploads" {
+		services.GetUploadCache().Clear()
+		result["uploads"] = "cleared"
+	}
+
+	if target == "all" || target == "sessions" {
+		services.GetSessionStore().Clear()
+		result["sessions"] = "cleared"
+	}
+
+	writeJSON(w, result)
+}
+
+// AdminConfig returns the effective configuration with secrets redacted
+func AdminConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrMethodNotAllow, "Method not allowed"))
+		return
+	}
+	writeJSON(w, config.GetConfig().Redacted())
+}
+
+// AdminSettings reads and changes settings that can be adjusted at runtime
+//
+// PATCH/PUT accepts think_mode and default_model; changes last until restart.
+func AdminSettings(w http.ResponseWriter, r *http.Request) {
+	cfg := config.GetConfig()
+
+	switch r.Method {
+	case http.MethodGet:
+		// Report the current settings below
+
+	case http.MethodPatch, http.MethodPut, http.MethodPost:
+		var update struct {
+			ThinkMode    *string `json:"think_mode"`
+			DefaultModel *string `json:"default_model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrInvalidRequest, "Invalid JSON: "+err.Error()))
+			return
+		}
+
+		if update.ThinkMode != nil {
+			if err := cfg.SetThinkMode(*update.ThinkMode); err != nil {
+				writeError(w, r, services.DialectOpenAI, services.InvalidParam("think_mode", "Invalid think_mode: %v", err))
+				return
+			}
+			slog.InfoContext(r.Context(), "Think mode changed", "think_mode", *update.ThinkMode)
+		}
+		if update.DefaultModel != nil {
+			if err := cfg.SetDefaultModel(*update.DefaultModel); err != nil {
+				writeError(w, r, services.DialectOpenAI, services.InvalidParam("default_model", "Invalid default_model: %v", err))
+				return
+			}
+			slog.InfoContext(r.Context(), "Default model changed", "model", cfg.DefaultModel())
+		}
+
+	default:
+		writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrMethodNotAllow, "Method not allowed"))
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"think_mode":    cfg.ThinkMode(),
+		"default_model": cfg.DefaultModel(),
+	})
+}
+
+// adminKeyView is an API key as listed by the admin API, without its secret
+type adminKeyView struct {
+	ID               string    `json:"id"`
+	Hint             string    `json:"hint"`
+	HasUpstreamToken bool      `json:"has_upstream_token"`
+	CreatedAt        time.Time `json:"created_at"`
+	Revoked          bool      `json:"revoked"`
+}
+
+// AdminKeys lists, creates and revokes proxy API keys
+//
+// GET lists keys without their secrets, POST {"id", "upstream_token"} creates
+// a key and returns its secret once, DELETE ?id= revokes it.
+func AdminKeys(w http.ResponseWriter, r *http.Request) {
+	keyStore := services.GetKeyStore()
+
+	switch r.Method {
+	case http.MethodGet:
+		keys := []adminKeyView{}
+		for _, key := range keyStore.List() {
+			keys = append(keys, adminKeyView{
+				ID:               key.ID,
+				Hint:             keyHint(key.Key),
+				HasUpstreamToken: key.UpstreamToken != "",
+				CreatedAt:        key.CreatedAt,
+				Revoked:          key.Revoked,
+			})
+		}
+		writeJSON(w, map[string]interface{}{
+			"object": "list",
+			"data":   keys,
+		})
+
+	case http.MethodPost:
+		var request struct {
+			ID            string `json:"id"`
+			UpstreamToken string `json:"upstream_token"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrInvalidRequest, "Invalid JSON: "+err.Error()))
+				return
+			}
+		}
+
+		key, err := keyStore.Create(request.ID, request.UpstreamToken)
+		if err != nil {
+			writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrInvalidRequest, err.Error()))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, map[string]interface{}{
+			"id":                 key.ID,
+			"key":                key.Key,
+			"has_upstream_token": key.UpstreamToken != "",
+			"created_at":         key.CreatedAt,
+		})
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		revoked, err := keyStore.Revoke(id)
+		if err != nil {
+			writeError(w, r, services.DialectOpenAI, err)
+			return
+		}
+		if !revoked {
+			writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrNotFound, fmt.Sprintf("No active key with ID %q", id)))
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"id":      id,
+			"revoked": true,
+		})
+
+	default:
+		writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrMethodNotAllow, "Method not allowed"))
+	}
+}
+
+// AdminRequests lists the requests currently being served
+func AdminRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrMethodNotAllow, "Method not allowed"))
+		return
+	}
+
+	type inFlightView struct {
+		services.RequestSnapshot
+		ElapsedMs int64 `json:"elapsed_ms"`
+	}
+
+	requests := []inFlightView{}
+	for _, snapshot := range services.InFlightRequests() {
+		requests = append(requests, inFlightView{
+			RequestSnapshot: snapshot,
+			ElapsedMs:       time.Since(snapshot.StartedAt).Milliseconds(),
+		})
+	}
+	writeJSON(w, map[string]interface{}{
+		"object": "list",
+		"data":   requests,
+	})
+}
+
+// Helper functions
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+// keyHint shows enough of a key to recognize it
+func keyHint(key string) string {
+	if len(key) <= 8 {
+		return "****"
+	}
+	return key[:4] + "..." + key[len(key)-4:]
+}
+
+func parseTimeParam(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC 3339 time or YYYY-MM-DD")
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
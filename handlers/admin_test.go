@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/services"
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+// adminRequest calls an admin handler and decodes its JSON response
+func adminRequest(t *testing.T, handler http.HandlerFunc, method, target, body string) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s %s: decode %s: %v", method, target, rec.Body, err)
+	}
+	return rec.Code, response
+}
+
+// errorParam returns the param of an OpenAI error response
+func errorParam(response map[string]interface{}) interface{} {
+	body, _ := response["error"].(map[string]interface{})
+	return body["param"]
+}
+
+func TestAdminKeys(t *testing.T) {
+	// Revoked IDs stay taken, so every run uses a new one
+	id := "admin-test-" + utils.GenerateID()[:8]
+
+	status, created := adminRequest(t, AdminKeys, http.MethodPost, "/admin/keys", `{"id": "`+id+`", "upstream_token": "upstream"}`)
+	secret, _ := created["key"].(string)
+	if status != http.StatusCreated || created["id"] != id || !strings.HasPrefix(secret, "sk-z2a-") || created["has_upstream_token"] != true {
+		t.Fatalf("create = %d %v", status, created)
+	}
+	if key, ok := services.GetKeyStore().Lookup(secret); !ok || key.ID != id {
+		t.Errorf("created key is not usable")
+	}
+	if status, _ := adminRequest(t, AdminKeys, http.MethodPost, "/admin/keys", `{"id": "`+id+`"}`); status != http.StatusBadRequest {
+		t.Errorf("duplicate ID: status = %d, want 400", status)
+	}
+
+	// Listed keys never show their secret
+	_, list := adminRequest(t, AdminKeys, http.MethodGet, "/admin/keys", "")
+	listed, _ := json.Marshal(list)
+	if !strings.Contains(string(listed), `"id":"`+id+`"`) || strings.Contains(string(listed), secret) {
+		t.Errorf("list = %s", listed)
+	}
+
+	if status, revoked := adminRequest(t, AdminKeys, http.MethodDelete, "/admin/keys?id="+id, ""); status != http.StatusOK || revoked["revoked"] != true {
+		t.Errorf("revoke = %d %v", status, revoked)
+	}
+	if _, ok := services.GetKeyStore().Lookup(secret); ok {
+		t.Errorf("revoked key is still usable")
+	}
+	if status, _ := adminRequest(t, AdminKeys, http.MethodDelete, "/admin/keys?id="+id, ""); status != http.StatusNotFound {
+		t.Errorf("revoking twice: status = %d, want 404", status)
+	}
+}
+
+func TestAdminBudgets(t *testing.T) {
+	status, budget := adminRequest(t, AdminBudgets, http.MethodPut, "/admin/budgets", `{"key_id": "budget-test", "daily_tokens": 100, "soft_threshold": 0.5}`)
+	if status != http.StatusOK || budget["daily_tokens"] != float64(100) || budget["default"] != false {
+		t.Fatalf("set = %d %v", status, budget)
+	}
+	if status, _ := adminRequest(t, AdminBudgets, http.MethodPut, "/admin/budgets", `{"key_id": "budget-test", "daily_tokens": -1}`); status != http.StatusBadRequest {
+		t.Errorf("negative budget: status = %d, want 400", status)
+	}
+	if _, budget := adminRequest(t, AdminBudgets, http.MethodGet, "/admin/budgets?key=budget-test", ""); budget["daily_tokens"] != float64(100) {
+		t.Errorf("get = %v", budget)
+	}
+
+	if status, deleted := adminRequest(t, AdminBudgets, http.MethodDelete, "/admin/budgets?key=budget-test", ""); status != http.StatusOK || deleted["deleted"] != true {
+		t.Errorf("delete = %d %v", status, deleted)
+	}
+	if _, budget := adminRequest(t, AdminBudgets, http.MethodGet, "/admin/budgets?key=budget-test", ""); budget["default"] != true {
+		t.Errorf("budget after delete = %v", budget)
+	}
+	if status, _ := adminRequest(t, AdminBudgets, http.MethodDelete, "/admin/budgets?key=budget-test", ""); status != http.StatusNotFound {
+		t.Errorf("deleting twice: status = %d, want 404", status)
+	}
+}
+
+func TestAdminSettings(t *testing.T) {
+	cfg := config.GetConfig()
+	defer cfg.SetThinkMode(cfg.ThinkMode())
+
+	status, settings := adminRequest(t, AdminSettings, http.MethodPatch, "/admin/settings", `{"think_mode": "strip"}`)
+	if status != http.StatusOK || settings["think_mode"] != "strip" || cfg.ThinkMode() != "strip" {
+		t.Errorf("patch = %d %v", status, settings)
+	}
+
+	status, response := adminRequest(t, AdminSettings, http.MethodPatch, "/admin/settings", `{"think_mode": "loud"}`)
+	if status != http.StatusBadRequest || errorParam(response) != "think_mode" || cfg.ThinkMode() != "strip" {
+		t.Errorf("invalid think mode = %d %v", status, response)
+	}
+	if status, _ := adminRequest(t, AdminSettings, http.MethodDelete, "/admin/settings", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: status = %d, want 405", status)
+	}
+}
+
+func TestAdminCache(t *testing.T) {
+	status, result := adminRequest(t, AdminCache, http.MethodPost, "/admin/cache/clear?cache=sessions", "")
+	if status != http.StatusOK || result["sessions"] != "cleared" || result["models"] != nil {
+		t.Errorf("clear sessions = %d %v", status, result)
+	}
+
+	status, result = adminRequest(t, AdminCache, http.MethodPost, "/admin/cache/clear?cache=everything", "")
+	if status != http.StatusBadRequest || errorParam(result) != "cache" {
+		t.Errorf("unknown cache = %d %v", status, result)
+	}
+}
+
+func TestAdminUsageInvalidParams(t *testing.T) {
+	for _, query := range []string{"from=yesterday", "group_by=key,week", "limit=0"} {
+		param := strings.SplitN(query, "=", 2)[0]
+		status, response := adminRequest(t, AdminUsage, http.MethodGet, "/admin/usage?"+query, "")
+		if status != http.StatusBadRequest || errorParam(response) != param {
+			t.Errorf("%s: %d %v", query, status, response)
+		}
+	}
+}
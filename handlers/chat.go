@@ -7,8 +7,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/Tyler-Dinh/z2api-go/config"
 	"github.com/Tyler-Dinh/z2api-go/services"
+	"github.com/Tyler-Dinh/z2api-go/types"
 	"github.com/Tyler-Dinh/z2api-go/utils"
 )
 
@@ -20,163 +20,170 @@ func ChatCompletions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Rejected requests are recorded too, before their model is known
+	info := services.RequestInfoFromContext(r.Context())
+	info.SetDialect(services.DialectOpenAI)
+
 	// Parse request body
-	var requestData map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": 400, "message": "Invalid JSON: %v"}`, err), http.StatusBadRequest)
+	var req types.ChatRequest
+	if err := services.DecodeRequest(r.Body, &req); err != nil {
+		writeError(w, r, services.DialectOpenAI, err)
 		return
 	}
 
-	// Generate IDs
-	chatID := utils.GenerateID()
-	messageID := utils.GenerateID()
-
-	// Get stream and include_usage options
-	stream := false
-	if s, ok := requestData["stream"].(bool); ok {
-		stream = s
+	// Select the thinking tags mode, removing a mode suffix from the model
+	thinkMode, err := services.RequestThinkMode(r.Header.Get(services.ThinkModeHeader), req.ThinkMode, &req.Model)
+	if err != nil {
+		writeError(w, r, services.DialectOpenAI, err)
+		return
 	}
 
+	// Resume the upstream chat of the conversation, if known
+	session := services.GetSessionStore().Resolve(r.Context(), r.Header.Get(services.ConversationHeader), "", nil, req.Messages)
+
+	// Usage is included unless the client opts out
 	includeUsage := true
-	if streamOpts, ok := requestData["stream_options"].(map[string]interface{}); ok {
-		if iu, ok := streamOpts["include_usage"].(bool); ok {
-			includeUsage = iu
-		}
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage != nil {
+		includeUsage = *req.StreamOptions.IncludeUsage
 	}
 
-	// Format request for Z.ai
-	formattedData, err := services.FormatRequest(requestData, "OpenAI")
+	// Format request for Z.ai, fitting it into the model's context window
+	zaiReq, err := services.FormatOpenAIRequest(r.Context(), &req, session.ChatID)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": 500, "message": "Failed to format request: %v"}`, err), http.StatusInternalServerError)
+		writeError(w, r, services.DialectOpenAI, err)
 		return
 	}
+	session.Apply(zaiReq)
+	model := zaiReq.Model
 
-	formattedData["chat_id"] = chatID
-	formattedData["id"] = messageID
+	info.SetRequest(services.DialectOpenAI, model, session.ChatID, req.Stream)
 
-	// Get model and messages
-	cfg := config.GetConfig()
-	model := cfg.Model.Default
-	if m, ok := formattedData["model"].(string); ok && m != "" {
-		model = m
-	}
-
-	messages := []map[string]interface{}{}
-	if msgs, ok := formattedData["messages"].([]map[string]interface{}); ok {
-		messages = msgs
-	}
-
-	// Calculate prompt tokens if needed
-	promptTokens := 0
-	if includeUsage {
-		promptText := services.ExtractTextFromMessages(messages)
-		promptTokens = services.CountTokens(promptText)
-	}
+	// Calculate prompt tokens (always needed for the usage ledger)
+	promptTokens := services.EstimatePromptTokens(zaiReq)
 
 	// Send request to Z.ai
-	resp, err := services.SendChatRequest(formattedData, chatID)
+	resp, err := services.SendChatRequest(r.Context(), zaiReq)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": 500, "message": "Failed to send request: %v"}`, err), http.StatusInternalServerError)
+		writeError(w, r, services.DialectOpenAI, err)
 		return
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		http.Error(w, fmt.Sprintf(`{"error": %d, "message": "Z.ai API error"}`, resp.StatusCode), resp.StatusCode)
-		return
-	}
+	// One ID and timestamp (in seconds) for every chunk of the completion
+	completionID := utils.GenerateChatCompletionID()
+	created := time.Now().Unix()
+	formatter := services.NewResponseFormatter(thinkMode)
 
 	// Handle streaming response
-	if stream {
+	if req.Stream {
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Connection", "keep-alive")
 
 		flusher, ok := w.(http.Flusher)
 		if !ok {
-			http.Error(w, `{"error": 500, "message": "Streaming not supported"}`, http.StatusInternalServerError)
+			writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrInternal, "Streaming not supported"))
 			return
 		}
 
+		sendChunk := func(choices []types.Choice, usage *types.Usage) {
+			chunkJSON, _ := json.Marshal(types.ChatResponse{
+				ID:      completionID,
+				Object:  "chat.completion.chunk",
+				Created: created,
+				Model:   model,
+				Choices: choices,
+				Usage:   usage,
+			})
+			fmt.Fprintf(w, "data: %s\n\n", chunkJSON)
+			flusher.Flush()
+		}
+		sendDelta := func(delta types.ChatDelta, finishReason *string) {
+			sendChunk([]types.Choice{{Index: 0, Delta: &delta, FinishReason: finishReason}}, nil)
+		}
+
 		completionParts := []string{}
+		toolCallParts := []string{}
+		var call *toolCall
 
-		// Stream responses
-		for zaiResp := range services.ParseSSEStream(resp) {
-			delta := services.FormatResponse(zaiResp, "OpenAI")
-			if delta == nil {
-				continue
+		// The role is only sent in the first chunk
+		sendDelta(types.ChatDelta{Role: "assistant", Content: stringPtr("")}, nil)
+
+		emit := func(delta services.Delta) {
+			// Nothing follows a complete tool call
+			if call != nil {
+				return
 			}
 
-			// Collect content for token counting
-			if includeUsage {
-				if content, ok := delta["content"].(string); ok {
-					completionParts = append(completionParts, content)
-				}
-				if reasoningContent, ok := delta["reasoning_content"].(string); ok {
-					completionParts = append(completionParts, reasoningContent)
+			switch delta.Kind {
+			case services.DeltaToolCall:
+				toolCallParts = append(toolCallParts, delta.Text)
+				parsed, ok := parseToolCall(toolCallParts)
+				if !ok {
+					return
 				}
+				call = parsed
+
+				toolCallDelta := call.openAI()
+				toolCallDelta.Index = new(int)
+				sendDelta(types.ChatDelta{ToolCalls: []types.ToolCall{toolCallDelta}}, nil)
+
+			case services.DeltaReasoning:
+				completionParts = append(completionParts, delta.Text)
+				sendDelta(types.ChatDelta{ReasoningContent: delta.Text}, nil)
+
+			default:
+				completionParts = append(completionParts, delta.Text)
+				sendDelta(types.ChatDelta{Content: stringPtr(delta.Text)}, nil)
 			}
+		}
 
-			// Send chunk
-			chunk := map[string]interface{}{
-				"id":      utils.GenerateID(),
-				"object":  "chat.completion.chunk",
-				"created": time.Now().UnixMilli(),
-				"model":   model,
-				"choices": []map[string]interface{}{
-					{
-						"index":         0,
-						"delta":         delta,
-						"message":       delta,
-						"finish_reason": nil,
-					},
-				},
+		// Stream responses
+		done := false
+		for event := range services.ParseSSEStream(resp) {
+			if event.Err != nil {
+				info.SetError(event.Err)
+				writeStreamError(r.Context(), w, flusher, services.DialectOpenAI, event.Err)
+				return
 			}
 
-			chunkJSON, _ := json.Marshal(chunk)
-			fmt.Fprintf(w, "data: %s\n\n", chunkJSON)
-			flusher.Flush()
+			// The Done frame may still carry content
+			zaiResp := event.Response
+			done = zaiResp.Data != nil && zaiResp.Data.Done
+			for _, delta := range formatter.Format(zaiResp) {
+				emit(delta)
+			}
+
+			// Stop reading at Done or once a tool call is complete
+			if done || call != nil {
+				break
+			}
+		}
+		if call == nil {
+			for _, delta := range formatter.Flush() {
+				emit(delta)
+			}
 		}
+		commitSession(session, done, call)
 
 		// Send finish_reason
-		finishChunk := map[string]interface{}{
-			"id":      utils.GenerateID(),
-			"object":  "chat.completion.chunk",
-			"created": time.Now().UnixMilli(),
-			"model":   model,
-			"choices": []map[string]interface{}{
-				{
-					"index":         0,
-					"delta":         map[string]interface{}{"role": "assistant"},
-					"message":       map[string]interface{}{"role": "assistant"},
-					"finish_reason": "stop",
-				},
-			},
+		finishReason := "stop"
+		if call != nil {
+			finishReason = "tool_calls"
 		}
-		finishJSON, _ := json.Marshal(finishChunk)
-		fmt.Fprintf(w, "data: %s\n\n", finishJSON)
-		flusher.Flush()
+		sendDelta(types.ChatDelta{}, &finishReason)
+
+		completionStr := strings.Join(completionParts, "")
+		completionTokens := services.CountTokens(completionStr)
+		info.SetUsage(promptTokens, completionTokens)
 
 		// Send usage if requested
 		if includeUsage {
-			completionStr := strings.Join(completionParts, "")
-			completionTokens := services.CountTokens(completionStr)
-
-			usageChunk := map[string]interface{}{
-				"id":      utils.GenerateID(),
-				"object":  "chat.completion.chunk",
-				"created": time.Now().UnixMilli(),
-				"model":   model,
-				"choices": []map[string]interface{}{},
-				"usage": map[string]interface{}{
-					"prompt_tokens":     promptTokens,
-					"completion_tokens": completionTokens,
-					"total_tokens":      promptTokens + completionTokens,
-				},
-			}
-			usageJSON, _ := json.Marshal(usageChunk)
-			fmt.Fprintf(w, "data: %s\n\n", usageJSON)
-			flusher.Flush()
+			sendChunk([]types.Choice{}, &types.Usage{
+				PromptTokens:     promptTokens,
+				CompletionTokens: completionTokens,
+				TotalTokens:      promptTokens + completionTokens,
+			})
 		}
 
 		// Send [DONE]
@@ -189,67 +196,108 @@ func ChatCompletions(w http.ResponseWriter, r *http.Request) {
 	// Handle non-streaming response
 	contentParts := []string{}
 	reasoningParts := []string{}
+	toolCallParts := []string{}
+	var call *toolCall
 
-	for zaiResp := range services.ParseSSEStream(resp) {
-		if zaiResp.Data != nil && zaiResp.Data.Done {
-			break
+	collect := func(delta services.Delta) {
+		// Nothing follows a complete tool call
+		if call != nil {
+			return
+		}
+
+		switch delta.Kind {
+		case services.DeltaToolCall:
+			toolCallParts = append(toolCallParts, delta.Text)
+			if parsed, ok := parseToolCall(toolCallParts); ok {
+				call = parsed
+			}
+		case services.DeltaReasoning:
+			reasoningParts = append(reasoningParts, delta.Text)
+		default:
+			contentParts = append(contentParts, delta.Text)
+		}
+	}
+
+	done := false
+	for event := range services.ParseSSEStream(resp) {
+		if event.Err != nil {
+			writeError(w, r, services.DialectOpenAI, event.Err)
+			return
 		}
 
-		delta := services.FormatResponse(zaiResp, "OpenAI")
-		if delta == nil {
-			continue
+		// The Done frame may still carry content
+		zaiResp := event.Response
+		done = zaiResp.Data != nil && zaiResp.Data.Done
+		for _, delta := range formatter.Format(zaiResp) {
+			collect(delta)
 		}
 
-		if content, ok := delta["content"].(string); ok {
-			contentParts = append(contentParts, content)
+		if done || call != nil {
+			break
 		}
-		if reasoningContent, ok := delta["reasoning_content"].(string); ok {
-			reasoningParts = append(reasoningParts, reasoningContent)
+	}
+	if call == nil {
+		for _, delta := range formatter.Flush() {
+			collect(delta)
 		}
 	}
+	commitSession(session, done, call)
 
-	// Build final message
-	finalMessage := map[string]interface{}{
-		"role": "assistant",
-	}
-	completionStr := ""
+	// Build final message; content is null when the model only called a tool
+	finalMessage := &types.ChatMessage{Role: "assistant"}
+	reasoningText := strings.Join(reasoningParts, "")
+	contentText := strings.Join(contentParts, "")
 
-	if len(reasoningParts) > 0 {
-		reasoningText := strings.Join(reasoningParts, "")
-		finalMessage["reasoning_content"] = reasoningText
-		completionStr += reasoningText
+	finalMessage.ReasoningContent = reasoningText
+	if len(contentParts) > 0 || call == nil {
+		finalMessage.Content = &contentText
 	}
-	if len(contentParts) > 0 {
-		contentText := strings.Join(contentParts, "")
-		finalMessage["content"] = contentText
-		completionStr += contentText
+
+	finishReason := "stop"
+	if call != nil {
+		finalMessage.ToolCalls = []types.ToolCall{call.openAI()}
+		finishReason = "tool_calls"
 	}
 
 	// Build response
-	result := map[string]interface{}{
-		"id":      utils.GenerateID(),
-		"object":  "chat.completion",
-		"created": time.Now().UnixMilli(),
-		"model":   model,
-		"choices": []map[string]interface{}{
+	result := types.ChatResponse{
+		ID:      completionID,
+		Object:  "chat.completion",
+		Created: created,
+		Model:   model,
+		Choices: []types.Choice{
 			{
-				"index":         0,
-				"message":       finalMessage,
-				"finish_reason": "stop",
+				Index:        0,
+				Message:      finalMessage,
+				FinishReason: &finishReason,
 			},
 		},
 	}
 
+	completionTokens := services.CountTokens(reasoningText + contentText)
+	info.SetUsage(promptTokens, completionTokens)
+
 	// Add usage if requested
 	if includeUsage {
-		completionTokens := services.CountTokens(completionStr)
-		result["usage"] = map[string]interface{}{
-			"prompt_tokens":     promptTokens,
-			"completion_tokens": completionTokens,
-			"total_tokens":      promptTokens + completionTokens,
+		result.Usage = &types.Usage{
+			PromptTokens:     promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      promptTokens + completionTokens,
 		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+// commitSession lets the next turn resume the upstream chat once the response is complete
+func commitSession(session *services.Session, done bool, call *toolCall) {
+	// Reading stops at a complete tool call, which ends the turn before Done arrives
+	if done || call != nil {
+		services.GetSessionStore().Commit(session)
+	}
+}
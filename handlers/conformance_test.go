@@ -0,0 +1,637 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/fakezai"
+	"github.com/Tyler-Dinh/z2api-go/services"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+// conformanceCase is an upstream script replayed through both handlers
+type conformanceCase struct {
+	name      string
+	thinkMode string
+	upstream  []fakezai.Response
+}
+
+// thinkingFrames is a reasoning model answer as Z.ai streams it
+func thinkingFrames() []string {
+	return []string{
+		fakezai.Thinking(`<details type="reasoning" done="false">` + "\n> Two plus two"),
+		fakezai.Thinking("\n> is four."),
+		fakezai.EditFrame("answer", "\n<summary>Thought for 2 seconds</summary>\n</details>\nThe answer"),
+		fakezai.Answer(" is 4."),
+		fakezai.Done(),
+	}
+}
+
+func conformanceCases() []conformanceCase {
+	cases := []conformanceCase{
+		{
+			name: "text",
+			upstream: []fakezai.Response{fakezai.Chat(
+				fakezai.Answer("Hello"),
+				fakezai.Answer(", world!"),
+				fakezai.Done(),
+			)},
+		},
+		{
+			name: "text_in_done",
+			upstream: []fakezai.Response{fakezai.Chat(
+				fakezai.Answer("Hello"),
+				fakezai.DoneWith(", world!"),
+			)},
+		},
+		{
+			name: "tool",
+			upstream: []fakezai.Response{fakezai.Chat(append(
+				fakezai.ToolCall("call_1", "get_weather", `{"city":"Paris"}`),
+				fakezai.Done(),
+			)...)},
+		},
+		{
+			name: "error_upstream",
+			upstream: []fakezai.Response{
+				fakezai.JSON(http.StatusTooManyRequests, `{"detail":"Too many requests"}`),
+			},
+		},
+		{
+			name: "error_midstream",
+			upstream: []fakezai.Response{fakezai.Chat(
+				fakezai.Answer("Partial"),
+				fakezai.ErrorFrame(500, "Internal server error"),
+			)},
+		},
+	}
+
+	for _, mode := range config.ValidThinkModes {
+		cases = append(cases, conformanceCase{
+			name:      "reasoning_" + mode,
+			thinkMode: mode,
+			upstream:  []fakezai.Response{fakezai.Chat(thinkingFrames()...)},
+		})
+	}
+	return cases
+}
+
+func TestConformance(t *testing.T) {
+	cfg := config.GetConfig()
+	defaultThinkMode := cfg.ThinkMode()
+
+	for _, tc := range conformanceCases() {
+		for _, dialect := range []string{services.DialectOpenAI, services.DialectAnthropic} {
+			for _, stream := range []bool{false, true} {
+				name := fmt.Sprintf("%s_%s", strings.ToLower(dialect), tc.name)
+				if stream {
+					name += "_stream"
+				}
+
+				t.Run(name, func(t *testing.T) {
+					thinkMode := tc.thinkMode
+					if thinkMode == "" {
+						thinkMode = defaultThinkMode
+					}
+					if err := cfg.SetThinkMode(thinkMode); err != nil {
+						t.Fatal(err)
+					}
+					defer cfg.SetThinkMode(defaultThinkMode)
+
+					fake.Reset()
+					fake.Queue(fakezai.PathChat, tc.upstream...)
+
+					rec := serveChat(t, dialect, stream)
+					body := rec.Body.String()
+
+					switch {
+					case dialect == services.DialectOpenAI && stream:
+						checkOpenAIStream(t, rec.Code, body)
+					case dialect == services.DialectOpenAI:
+						checkOpenAICompletion(t, rec.Code, body)
+					case stream:
+						checkAnthropicStream(t, rec.Code, body)
+					default:
+						checkAnthropicMessage(t, rec.Code, body)
+					}
+
+					compareGolden(t, name, rec.Code, body, !stream)
+				})
+			}
+		}
+	}
+}
+
+// serveChat sends a one-message request through the dialect's handler
+func serveChat(t *testing.T, dialect string, stream bool) *httptest.ResponseRecorder {
+	t.Helper()
+
+	request := map[string]interface{}{
+		"model":    "glm-4.6",
+		"messages": []interface{}{map[string]interface{}{"role": "user", "content": "What is 2+2?"}},
+		"stream":   stream,
+	}
+	handler, path := ChatCompletions, "/v1/chat/completions"
+	if dialect == services.DialectAnthropic {
+		request["max_tokens"] = 1024
+		handler, path = AnthropicMessages, "/v1/messages"
+	}
+
+	body, _ := json.Marshal(request)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// Volatile values replaced before comparing with the golden files
+var (
+	completionIDPattern = regexp.MustCompile(`chatcmpl-[0-9a-f-]{36}`)
+	messageIDPattern    = regexp.MustCompile(`msg_[0-9a-f]{32}`)
+	createdPattern      = regexp.MustCompile(`("created":\s*)\d+`)
+)
+
+func normalize(body string) string {
+	body = completionIDPattern.ReplaceAllString(body, "chatcmpl-ID")
+	body = messageIDPattern.ReplaceAllString(body, "msg_ID")
+	body = createdPattern.ReplaceAllString(body, "${1}0")
+	return body
+}
+
+// compareGolden checks the normalized response against testdata/golden/<name>.golden
+func compareGolden(t *testing.T, name string, status int, body string, indent bool) {
+	t.Helper()
+
+	if indent {
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, []byte(body), "", "  "); err == nil {
+			body = buf.String()
+		}
+	}
+	got := fmt.Sprintf("HTTP %d\n\n%s", status, normalize(body))
+
+	path := filepath.Join(testdataDir, "golden", name+".golden")
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("missing golden file, run go test ./handlers -update: %v", err)
+	}
+	if got != string(want) {
+		t.Errorf("response differs from %s\n--- got ---\n%s\n--- want ---\n%s", path, got, want)
+	}
+}
+
+// sseEvent is one parsed server-sent event
+type sseEvent struct {
+	name string
+	data string
+}
+
+func parseSSE(t *testing.T, body string) []sseEvent {
+	t.Helper()
+
+	events := []sseEvent{}
+	for _, block := range strings.Split(strings.TrimSuffix(body, "\n\n"), "\n\n") {
+		event := sseEvent{}
+		for _, line := range strings.Split(block, "\n") {
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			default:
+				t.Fatalf("malformed SSE line %q", line)
+			}
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func decodeObject(t *testing.T, data string) map[string]interface{} {
+	t.Helper()
+
+	var object map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &object); err != nil {
+		t.Fatalf("invalid JSON %q: %v", data, err)
+	}
+	return object
+}
+
+// checkCreated requires a Unix timestamp in seconds close to now
+func checkCreated(t *testing.T, value interface{}) {
+	t.Helper()
+
+	created, ok := value.(float64)
+	if !ok || created != float64(int64(created)) {
+		t.Fatalf("created = %v, want an integer", value)
+	}
+	if diff := time.Since(time.Unix(int64(created), 0)); diff < -time.Minute || diff > time.Minute {
+		t.Fatalf("created = %v, want seconds since the epoch", value)
+	}
+}
+
+func checkUsage(t *testing.T, usage interface{}, fields ...string) {
+	t.Helper()
+
+	object, ok := usage.(map[string]interface{})
+	if !ok {
+		t.Fatalf("usage = %v, want an object", usage)
+	}
+	for _, field := range fields {
+		if _, ok := object[field].(float64); !ok {
+			t.Errorf("usage.%s = %v, want a number", field, object[field])
+		}
+	}
+}
+
+func checkOpenAIError(t *testing.T, object map[string]interface{}) {
+	t.Helper()
+
+	apiErr, ok := object["error"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("error = %v, want an object", object["error"])
+	}
+	if _, ok := apiErr["message"].(string); !ok {
+		t.Errorf("error.message = %v, want a string", apiErr["message"])
+	}
+	if _, ok := apiErr["type"].(string); !ok {
+		t.Errorf("error.type = %v, want a string", apiErr["type"])
+	}
+}
+
+func checkAnthropicError(t *testing.T, object map[string]interface{}) {
+	t.Helper()
+
+	if object["type"] != "error" {
+		t.Errorf("type = %v, want error", object["type"])
+	}
+	apiErr, ok := object["error"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("error = %v, want an object", object["error"])
+	}
+	if _, ok := apiErr["type"].(string); !ok {
+		t.Errorf("error.type = %v, want a string", apiErr["type"])
+	}
+	if _, ok := apiErr["message"].(string); !ok {
+		t.Errorf("error.message = %v, want a string", apiErr["message"])
+	}
+}
+
+func checkOpenAIToolCall(t *testing.T, call interface{}, stream bool) {
+	t.Helper()
+
+	object, ok := call.(map[string]interface{})
+	if !ok {
+		t.Fatalf("tool call = %v, want an object", call)
+	}
+	if _, ok := object["index"].(float64); stream && !ok {
+		t.Errorf("tool call index = %v, want a number", object["index"])
+	}
+	if id, _ := object["id"].(string); id == "" {
+		t.Errorf("tool call id = %v, want a string", object["id"])
+	}
+	if object["type"] != "function" {
+		t.Errorf("tool call type = %v, want function", object["type"])
+	}
+	function, _ := object["function"].(map[string]interface{})
+	if name, _ := function["name"].(string); name == "" {
+		t.Errorf("function.name = %v, want a string", function["name"])
+	}
+	arguments, ok := function["arguments"].(string)
+	if !ok || !json.Valid([]byte(arguments)) {
+		t.Errorf("function.arguments = %v, want a JSON string", function["arguments"])
+	}
+}
+
+// checkOpenAICompletion validates a chat.completion object or an error body
+func checkOpenAICompletion(t *testing.T, status int, body string) {
+	t.Helper()
+
+	object := decodeObject(t, body)
+	if status != http.StatusOK {
+		checkOpenAIError(t, object)
+		return
+	}
+
+	if id, _ := object["id"].(string); !strings.HasPrefix(id, "chatcmpl-") {
+		t.Errorf("id = %v, want a chatcmpl- ID", object["id"])
+	}
+	if object["object"] != "chat.completion" {
+		t.Errorf("object = %v, want chat.completion", object["object"])
+	}
+	checkCreated(t, object["created"])
+	checkUsage(t, object["usage"], "prompt_tokens", "completion_tokens", "total_tokens")
+
+	choices, _ := object["choices"].([]interface{})
+	if len(choices) != 1 {
+		t.Fatalf("got %d choices, want 1", len(choices))
+	}
+	choice := choices[0].(map[string]interface{})
+	message, _ := choice["message"].(map[string]interface{})
+	if message["role"] != "assistant" {
+		t.Errorf("message.role = %v, want assistant", message["role"])
+	}
+
+	toolCalls, hasToolCalls := message["tool_calls"].([]interface{})
+	for _, call := range toolCalls {
+		checkOpenAIToolCall(t, call, false)
+	}
+	if _, ok := message["content"].(string); !ok && !(message["content"] == nil && hasToolCalls) {
+		t.Errorf("message.content = %v, want a string, or null with tool_calls", message["content"])
+	}
+
+	want := "stop"
+	if hasToolCalls {
+		want = "tool_calls"
+	}
+	if choice["finish_reason"] != want {
+		t.Errorf("finish_reason = %v, want %s", choice["finish_reason"], want)
+	}
+}
+
+// checkOpenAIStream validates chat.completion.chunk events and their ordering
+func checkOpenAIStream(t *testing.T, status int, body string) {
+	t.Helper()
+
+	if status != http.StatusOK {
+		checkOpenAIError(t, decodeObject(t, body))
+		return
+	}
+
+	events := parseSSE(t, body)
+	if len(events) == 0 || events[len(events)-1].data != "[DONE]" {
+		t.Fatalf("stream does not end with [DONE]")
+	}
+
+	allowedDelta := map[string]bool{"role": true, "content": true, "reasoning_content": true, "tool_calls": true, "refusal": true}
+	var id, created interface{}
+	finished := false
+	usageSeen := false
+
+	for i, event := range events[:len(events)-1] {
+		if event.name != "" {
+			t.Errorf("chunk %d has event name %q, OpenAI streams are unnamed", i, event.name)
+		}
+		chunk := decodeObject(t, event.data)
+
+		// A mid-stream error is the last event before [DONE]
+		if _, ok := chunk["error"]; ok {
+			checkOpenAIError(t, chunk)
+			if i != len(events)-2 {
+				t.Errorf("error chunk %d is not the last event before [DONE]", i)
+			}
+			return
+		}
+
+		if chunk["object"] != "chat.completion.chunk" {
+			t.Errorf("chunk %d object = %v, want chat.completion.chunk", i, chunk["object"])
+		}
+		checkCreated(t, chunk["created"])
+		if i == 0 {
+			id, created = chunk["id"], chunk["created"]
+			if s, _ := id.(string); !strings.HasPrefix(s, "chatcmpl-") {
+				t.Errorf("id = %v, want a chatcmpl- ID", id)
+			}
+		} else if chunk["id"] != id || chunk["created"] != created {
+			t.Errorf("chunk %d id/created = %v/%v, want %v/%v for every chunk", i, chunk["id"], chunk["created"], id, created)
+		}
+
+		choices, ok := chunk["choices"].([]interface{})
+		if !ok {
+			t.Fatalf("chunk %d choices = %v, want an array", i, chunk["choices"])
+		}
+		if usage, ok := chunk["usage"]; ok {
+			if !finished || len(choices) != 0 {
+				t.Errorf("usage chunk %d must follow the finish chunk and have no choices", i)
+			}
+			checkUsage(t, usage, "prompt_tokens", "completion_tokens", "total_tokens")
+			usageSeen = true
+			continue
+		}
+		if usageSeen || finished {
+			t.Errorf("chunk %d follows the finish or usage chunk", i)
+		}
+		if len(choices) != 1 {
+			t.Fatalf("chunk %d has %d choices, want 1", i, len(choices))
+		}
+
+		choice := choices[0].(map[string]interface{})
+		if _, ok := choice["message"]; ok {
+			t.Errorf("chunk %d carries message, stream choices only have delta", i)
+		}
+		delta, ok := choice["delta"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("chunk %d delta = %v, want an object", i, choice["delta"])
+		}
+		for key := range delta {
+			if !allowedDelta[key] {
+				t.Errorf("chunk %d delta has unknown field %q", i, key)
+			}
+		}
+		if role, ok := delta["role"]; ok != (i == 0) || (ok && role != "assistant") {
+			t.Errorf("chunk %d delta.role = %v, want assistant in the first chunk only", i, role)
+		}
+		if calls, ok := delta["tool_calls"].([]interface{}); ok {
+			for _, call := range calls {
+				checkOpenAIToolCall(t, call, true)
+			}
+		}
+
+		switch reason := choice["finish_reason"].(type) {
+		case nil:
+		case string:
+			if reason != "stop" && reason != "length" && reason != "tool_calls" && reason != "content_filter" {
+				t.Errorf("chunk %d finish_reason = %q", i, reason)
+			}
+			finished = true
+		default:
+			t.Errorf("chunk %d finish_reason = %v, want a string or null", i, reason)
+		}
+	}
+
+	if !finished {
+		t.Errorf("stream has no finish_reason")
+	}
+}
+
+// checkAnthropicMessage validates a message object or an error body
+func checkAnthropicMessage(t *testing.T, status int, body string) {
+	t.Helper()
+
+	object := decodeObject(t, body)
+	if status != http.StatusOK {
+		checkAnthropicError(t, object)
+		return
+	}
+
+	if id, _ := object["id"].(string); !strings.HasPrefix(id, "msg_") {
+		t.Errorf("id = %v, want a msg_ ID", object["id"])
+	}
+	if object["type"] != "message" || object["role"] != "assistant" {
+		t.Errorf("type/role = %v/%v, want message/assistant", object["type"], object["role"])
+	}
+	checkUsage(t, object["usage"], "input_tokens", "output_tokens")
+
+	content, ok := object["content"].([]interface{})
+	if !ok {
+		t.Fatalf("content = %v, want an array", object["content"])
+	}
+	hasToolUse := false
+	for i, item := range content {
+		block := item.(map[string]interface{})
+		switch block["type"] {
+		case "text":
+			if _, ok := block["text"].(string); !ok {
+				t.Errorf("content[%d].text = %v, want a string", i, block["text"])
+			}
+		case "thinking":
+			if _, ok := block["thinking"].(string); !ok {
+				t.Errorf("content[%d].thinking = %v, want a string", i, block["thinking"])
+			}
+		case "tool_use":
+			hasToolUse = true
+			if _, ok := block["input"].(map[string]interface{}); !ok {
+				t.Errorf("content[%d].input = %v, want an object", i, block["input"])
+			}
+		default:
+			t.Errorf("content[%d] has unknown type %v", i, block["type"])
+		}
+	}
+
+	want := "end_turn"
+	if hasToolUse {
+		want = "tool_use"
+	}
+	if object["stop_reason"] != want {
+		t.Errorf("stop_reason = %v, want %s", object["stop_reason"], want)
+	}
+}
+
+// checkAnthropicStream validates the Messages streaming event grammar:
+// message_start, then content blocks (start, deltas, stop) with increasing
+// indexes, then message_delta and message_stop, with ping allowed anywhere
+func checkAnthropicStream(t *testing.T, status int, body string) {
+	t.Helper()
+
+	if status != http.StatusOK {
+		checkAnthropicError(t, decodeObject(t, body))
+		return
+	}
+
+	deltaTypes := map[string]string{"text": "text_delta", "thinking": "thinking_delta", "tool_use": "input_json_delta"}
+	events := parseSSE(t, body)
+	state := "start"
+	index := -1
+	blockType := ""
+
+	for i, event := range events {
+		data := decodeObject(t, event.data)
+		if data["type"] != event.name {
+			t.Fatalf("event %d is named %q but has type %v", i, event.name, data["type"])
+		}
+		eventIndex, _ := data["index"].(float64)
+
+		switch event.name {
+		case "ping":
+			if state == "start" {
+				t.Errorf("ping before message_start")
+			}
+		case "error":
+			checkAnthropicError(t, data)
+			if i != len(events)-1 {
+				t.Errorf("error event %d is not the last event", i)
+			}
+			return
+		case "message_start":
+			if state != "start" {
+				t.Fatalf("unexpected message_start at event %d", i)
+			}
+			message, _ := data["message"].(map[string]interface{})
+			if id, _ := message["id"].(string); !strings.HasPrefix(id, "msg_") {
+				t.Errorf("message.id = %v, want a msg_ ID", message["id"])
+			}
+			if content, ok := message["content"].([]interface{}); !ok || len(content) != 0 {
+				t.Errorf("message.content = %v, want an empty array", message["content"])
+			}
+			checkUsage(t, message["usage"], "input_tokens", "output_tokens")
+			state = "message"
+		case "content_block_start":
+			if state != "message" {
+				t.Fatalf("content_block_start at event %d while %s", i, state)
+			}
+			if int(eventIndex) != index+1 {
+				t.Errorf("content block index = %v, want %d", eventIndex, index+1)
+			}
+			index = int(eventIndex)
+			block, _ := data["content_block"].(map[string]interface{})
+			blockType, _ = block["type"].(string)
+			if _, ok := deltaTypes[blockType]; !ok {
+				t.Fatalf("unknown content block type %q", blockType)
+			}
+			if blockType == "tool_use" {
+				if _, ok := block["input"].(map[string]interface{}); !ok {
+					t.Errorf("tool_use input = %v, want an object", block["input"])
+				}
+			}
+			state = "block"
+		case "content_block_delta":
+			if state != "block" || int(eventIndex) != index {
+				t.Fatalf("content_block_delta for index %v at event %d while %s %d", eventIndex, i, state, index)
+			}
+			delta, _ := data["delta"].(map[string]interface{})
+			if delta["type"] != deltaTypes[blockType] {
+				t.Errorf("%s block got a %v delta", blockType, delta["type"])
+			}
+		case "content_block_stop":
+			if state != "block" || int(eventIndex) != index {
+				t.Fatalf("content_block_stop for index %v at event %d while %s %d", eventIndex, i, state, index)
+			}
+			state = "message"
+		case "message_delta":
+			if state != "message" || index < 0 {
+				t.Fatalf("message_delta at event %d while %s", i, state)
+			}
+			delta, _ := data["delta"].(map[string]interface{})
+			switch delta["stop_reason"] {
+			case "end_turn", "max_tokens", "stop_sequence", "tool_use":
+			default:
+				t.Errorf("stop_reason = %v", delta["stop_reason"])
+			}
+			checkUsage(t, data["usage"], "output_tokens")
+			state = "delta"
+		case "message_stop":
+			if state != "delta" {
+				t.Fatalf("message_stop at event %d while %s", i, state)
+			}
+			state = "stop"
+		default:
+			t.Errorf("unknown event %q", event.name)
+		}
+	}
+
+	if state != "stop" {
+		t.Errorf("stream ended while %s, want message_stop last", state)
+	}
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/fakezai"
+	"github.com/Tyler-Dinh/z2api-go/services"
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+// setContextPolicy limits glm-4.6 to a small context window for one test
+func setContextPolicy(t *testing.T, policy string) {
+	t.Helper()
+	cfg := config.GetConfig()
+	saved := cfg.Context
+	cfg.Context.Policy = policy
+	cfg.Context.Limits = map[string]int{"glm-4.6": 700}
+	cfg.Context.SummaryMaxTokens = 64
+	t.Cleanup(func() { cfg.Context = saved })
+	fake.Reset()
+}
+
+// postLongConversation sends a conversation whose oldest turn must go to fit the window
+func postLongConversation(t *testing.T) (*httptest.ResponseRecorder, *services.RequestInfo) {
+	t.Helper()
+	long := strings.Repeat("word ", 400)
+	request := map[string]interface{}{
+		"model":      "glm-4.6",
+		"max_tokens": 100,
+		"messages": []map[string]interface{}{
+			{"role": "system", "content": "Be brief"},
+			{"role": "user", "content": "First " + long},
+			{"role": "assistant", "content": "Noted."},
+			{"role": "user", "content": "Second " + long},
+			{"role": "assistant", "tool_calls": []map[string]interface{}{
+				{"id": "call_1", "type": "function", "function": map[string]interface{}{"name": "lookup", "arguments": "{}"}},
+			}},
+			{"role": "tool", "tool_call_id": "call_1", "content": "Found it"},
+			{"role": "user", "content": "Third question"},
+		},
+	}
+	body, _ := json.Marshal(request)
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(body))
+	info := services.NewRequestInfo(req.Context())
+	rec := httptest.NewRecorder()
+	ChatCompletions(rec, req.WithContext(services.WithRequestInfo(req.Context(), info)))
+	return rec, info
+}
+
+// upstreamMessages returns the messages of the nth chat request the fake received
+func upstreamMessages(t *testing.T, n int) []types.Message {
+	t.Helper()
+	requests := fake.Requests(fakezai.PathChat)
+	if len(requests) <= n {
+		t.Fatalf("fake received %d chat requests, want more than %d", len(requests), n)
+	}
+	var zaiReq types.ZaiRequest
+	if err := json.Unmarshal(requests[n].Body, &zaiReq); err != nil {
+		t.Fatalf("decode upstream request: %v", err)
+	}
+	return zaiReq.Messages
+}
+
+func TestContextPolicyReject(t *testing.T) {
+	setContextPolicy(t, "reject")
+
+	rec, _ := postLongConversation(t)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400; body %s", rec.Code, rec.Body)
+	}
+	var body types.OpenAIErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	if body.Error.Code == nil || *body.Error.Code != "context_length_exceeded" || !strings.Contains(body.Error.Message, "maximum context length is 700 tokens") {
+		t.Errorf("error = %+v", body.Error)
+	}
+	if n := len(fake.Requests(fakezai.PathChat)); n != 0 {
+		t.Errorf("rejected request reached upstream %d times", n)
+	}
+}
+
+func TestContextPolicyTruncate(t *testing.T) {
+	setContextPolicy(t, "truncate")
+
+	if rec, _ := postLongConversation(t); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	messages := upstreamMessages(t, 0)
+	roles := []string{}
+	for _, msg := range messages {
+		roles = append(roles, msg.Role)
+	}
+	if got := strings.Join(roles, ","); got != "system,user,assistant,tool,user" {
+		t.Fatalf("upstream roles = %s", got)
+	}
+	if !strings.HasPrefix(messages[1].Content.String(), "Second") || messages[2].ToolCalls[0].ID != "call_1" {
+		t.Errorf("upstream messages = %+v", messages)
+	}
+}
+
+func TestContextPolicySummarize(t *testing.T) {
+	setContextPolicy(t, "summarize")
+	fake.Queue(fakezai.PathChat, fakezai.Chat(
+		fakezai.Thinking(`<details type="reasoning" done="false">`+"\n> Let me condense this."),
+		fakezai.EditFrame("answer", "\n<summary>Thought for 1 seconds</summary>\n</details>\nThe user introduced a long text."),
+		fakezai.Done(),
+	))
+
+	rec, info := postLongConversation(t)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+
+	// The side call summarizes the dropped turn
+	summaryRequest := upstreamMessages(t, 0)
+	if len(summaryRequest) != 2 || !strings.Contains(summaryRequest[1].Content.String(), "user: First word") {
+		t.Errorf("summary request = %+v", summaryRequest)
+	}
+
+	messages := upstreamMessages(t, 1)
+	if len(messages) != 6 || messages[0].Content.String() != "Be brief" {
+		t.Fatalf("upstream messages = %+v", messages)
+	}
+	if got := messages[1].Content.String(); messages[1].Role != "system" || !strings.HasSuffix(got, "\n\nThe user introduced a long text.") {
+		t.Errorf("summary message = %s: %q", messages[1].Role, got)
+	}
+	if !strings.HasPrefix(messages[2].Content.String(), "Second") {
+		t.Errorf("first kept message = %q", messages[2].Content.String())
+	}
+
+	// The summary's tokens count towards the request's usage
+	var completion types.ChatResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &completion); err != nil || completion.Usage == nil {
+		t.Fatalf("decode completion %s: %v", rec.Body, err)
+	}
+	usage := info.Snapshot()
+	if usage.PromptTokens <= completion.Usage.PromptTokens || usage.CompletionTokens <= completion.Usage.CompletionTokens {
+		t.Errorf("recorded usage %d+%d does not include the summary call, response usage %+v", usage.PromptTokens, usage.CompletionTokens, completion.Usage)
+	}
+}
+
+func TestContextSummaryInputCap(t *testing.T) {
+	setContextPolicy(t, "summarize")
+	config.GetConfig().Context.SummaryMaxInputTokens = 256
+
+	fake.Queue(fakezai.PathChat, fakezai.Chat(fakezai.Answer("The assistant took note."), fakezai.Done()))
+
+	// Only the newest dropped messages that fit the cap are summarized
+	if rec, _ := postLongConversation(t); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	history := upstreamMessages(t, 0)[1].Content.String()
+	if !strings.Contains(history, "assistant: Noted.") || strings.Contains(history, "First word") {
+		t.Errorf("summarized history = %q", history)
+	}
+}
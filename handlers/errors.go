@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/Tyler-Dinh/z2api-go/services"
+)
+
+// writeError writes an error response in the client's dialect
+func writeError(w http.ResponseWriter, r *http.Request, dialect string, err error) {
+	services.RequestInfoFromContext(r.Context()).SetError(err)
+
+	apiErr := services.AsAPIError(err)
+	if status := apiErr.StatusCode(dialect); status >= 500 {
+		slog.ErrorContext(r.Context(), "Request failed", "dialect", dialect, "status", status, "error", err)
+	} else {
+		slog.DebugContext(r.Context(), "Request rejected", "dialect", dialect, "status", status, "error", err)
+	}
+	apiErr.Write(w, dialect)
+}
+
+// writeStreamError sends a mid-stream error event in the client's dialect
+func writeStreamError(ctx context.Context, w io.Writer, flusher http.Flusher, dialect string, err error) {
+	apiErr := services.AsAPIError(err)
+	slog.ErrorContext(ctx, "Stream failed", "dialect", dialect, "error", err)
+
+	apiErr.WriteEvent(w, dialect)
+	flusher.Flush()
+}
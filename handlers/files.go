@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/services"
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+// Files handles the OpenAI-compatible Files API
+//
+// POST /v1/files takes a multipart upload with file and purpose fields,
+// GET /v1/files lists files (optionally by ?purpose=), and
+// GET/DELETE /v1/files/{id} retrieve and delete one file;
+// GET /v1/files/{id}/content returns its content. Files are scoped to the
+// API key of the request.
+func Files(w http.ResponseWriter, r *http.Request) {
+	store := services.GetFileStore()
+	keyID := services.CredentialsFromContext(r.Context()).KeyID
+	id, content := strings.CutSuffix(strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/files"), "/"), "/content")
+
+	switch {
+	case id == "" && !content && r.Method == http.MethodPost:
+		createFile(w, r, store)
+
+	case id == "" && !content && r.Method == http.MethodGet:
+		purpose := r.URL.Query().Get("purpose")
+		files := []types.FileObject{}
+		for _, file := range store.List(keyID) {
+			if purpose == "" || file.Purpose == purpose {
+				files = append(files, file.FileObject)
+			}
+		}
+		writeJSON(w, types.FileList{Object: "list", Data: files})
+
+	case id == "" || strings.Contains(id, "/"):
+		writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrNotFound, "Not found"))
+
+	case content && r.Method == http.MethodGet:
+		file, data, err := store.Open(r.Context(), id)
+		if err != nil {
+			writeError(w, r, services.DialectOpenAI, fileNotFound(id, err))
+			return
+		}
+		w.Header().Set("Content-Type", file.MediaType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, file.Filename))
+		w.Write(data)
+
+	case !content && r.Method == http.MethodGet:
+		file, ok := store.Get(keyID, id)
+		if !ok {
+			writeError(w, r, services.DialectOpenAI, fileNotFound(id, nil))
+			return
+		}
+		writeJSON(w, file.FileObject)
+
+	case !content && r.Method == http.MethodDelete:
+		deleted, err := store.Delete(keyID, id)
+		if err != nil {
+			writeError(w, r, services.DialectOpenAI, err)
+			return
+		}
+		if !deleted {
+			writeError(w, r, services.DialectOpenAI, fileNotFound(id, nil))
+			return
+		}
+		writeJSON(w, types.FileDeleted{ID: id, Object: "file", Deleted: true})
+
+	default:
+		writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrMethodNotAllow, "Method not allowed"))
+	}
+}
+
+// createFile stores a multipart file upload
+func createFile(w http.ResponseWriter, r *http.Request, store *services.FileStore) {
+	cfg := config.GetConfig()
+
+	// Allow the largest accepted file plus room for the multipart envelope
+	limit := max(cfg.Images.MaxBytes, cfg.Documents.MaxBytes)
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1<<20)
+
+	upload, header, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrInvalidRequest, fmt.Sprintf("File exceeds the maximum size of %d bytes", limit)))
+			return
+		}
+		writeError(w, r, services.DialectOpenAI, services.InvalidParam("file", "Invalid file: a multipart file field is required: %v", err))
+		return
+	}
+	defer upload.Close()
+
+	data, err := io.ReadAll(upload)
+	if err != nil {
+		writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrInvalidRequest, "Failed to read upload: "+err.Error()))
+		return
+	}
+
+	purpose := r.FormValue("purpose")
+	if purpose == "" {
+		purpose = "user_data"
+	}
+
+	file, err := store.Create(r.Context(), path.Base(header.Filename), purpose, data)
+	if err != nil {
+		slog.DebugContext(r.Context(), "File upload rejected", "filename", header.Filename, "error", err)
+		writeError(w, r, services.DialectOpenAI, err)
+		return
+	}
+	writeJSON(w, file.FileObject)
+}
+
+// fileNotFound reports a file that does not exist for the caller, passing other errors through
+func fileNotFound(id string, err error) error {
+	if err != nil && services.AsAPIError(err).Kind != services.ErrInvalidRequest {
+		return err
+	}
+	return services.NewAPIError(services.ErrNotFound, fmt.Sprintf("No such file: %s", id))
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+func TestFilesLifecycle(t *testing.T) {
+	// Upload
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "notes.md")
+	part.Write([]byte("# Notes\nShip on Friday\n"))
+	form.WriteField("purpose", "assistants")
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/files", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	Files(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST status = %d, body %s", rec.Code, rec.Body)
+	}
+	var file types.FileObject
+	if err := json.Unmarshal(rec.Body.Bytes(), &file); err != nil {
+		t.Fatalf("decode file: %v", err)
+	}
+	if file.Filename != "notes.md" || file.Purpose != "assistants" || file.Bytes != 23 {
+		t.Errorf("created file = %+v", file)
+	}
+
+	// List, by purpose
+	rec = httptest.NewRecorder()
+	Files(rec, httptest.NewRequest(http.MethodGet, "/v1/files?purpose=assistants", nil))
+	var list types.FileList
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("decode list: %v", err)
+	}
+	if len(list.Data) != 1 || list.Data[0].ID != file.ID {
+		t.Errorf("listed files = %+v", list.Data)
+	}
+	rec = httptest.NewRecorder()
+	Files(rec, httptest.NewRequest(http.MethodGet, "/v1/files?purpose=batch", nil))
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil || len(list.Data) != 0 {
+		t.Errorf("files listed for another purpose: %s", rec.Body)
+	}
+
+	// Retrieve metadata and content
+	rec = httptest.NewRecorder()
+	Files(rec, httptest.NewRequest(http.MethodGet, "/v1/files/"+file.ID, nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET status = %d, body %s", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	Files(rec, httptest.NewRequest(http.MethodGet, "/v1/files/"+file.ID+"/content", nil))
+	if rec.Body.String() != "# Notes\nShip on Friday\n" || rec.Header().Get("Content-Type") != "text/markdown" {
+		t.Errorf("content = %q (%s)", rec.Body, rec.Header().Get("Content-Type"))
+	}
+
+	// Delete
+	rec = httptest.NewRecorder()
+	Files(rec, httptest.NewRequest(http.MethodDelete, "/v1/files/"+file.ID, nil))
+	var deleted types.FileDeleted
+	if err := json.Unmarshal(rec.Body.Bytes(), &deleted); err != nil || !deleted.Deleted || deleted.ID != file.ID {
+		t.Errorf("DELETE body = %s", rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	Files(rec, httptest.NewRequest(http.MethodGet, "/v1/files/"+file.ID, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET after delete status = %d, want 404", rec.Code)
+	}
+}
+
+func TestFilesRejectsUploadWithoutFile(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("purpose", "user_data")
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/files", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	Files(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rec.Code)
+	}
+	checkOpenAIError(t, decodeObject(t, rec.Body.String()))
+}
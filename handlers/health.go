@@ -5,17 +5,44 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/Tyler-Dinh/z2api-go/services"
 	"github.com/Tyler-Dinh/z2api-go/types"
 )
 
 // HealthHandler handles health check requests
+//
+// The endpoint answers 503 while the upstream circuit breaker is open so that
+// load balancers can take the instance out of rotation.
 func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	breaker := services.GetUpstreamBreaker().Snapshot()
+
+	upstream := &types.UpstreamHealth{
+		Breaker:      breaker.State.String(),
+		Requests:     breaker.Requests,
+		ErrorRate:    breaker.ErrorRate,
+		SlowCallRate: breaker.SlowCallRate,
+	}
+	if !breaker.OpenedAt.IsZero() {
+		upstream.OpenedAt = breaker.OpenedAt.UnixMilli()
+	}
+
+	status := "ok"
+	statusCode := http.StatusOK
+	switch breaker.State {
+	case services.BreakerOpen:
+		status = "unavailable"
+		statusCode = http.StatusServiceUnavailable
+	case services.BreakerHalfOpen:
+		status = "degraded"
+	}
+
 	response := types.HealthResponse{
-		Status:    "ok",
+		Status:    status,
 		Timestamp: time.Now().UnixMilli(),
+		Upstream:  upstream,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(statusCode)
 	json.NewEncoder(w).Encode(response)
 }
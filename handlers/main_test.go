@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/fakezai"
+)
+
+// fake is the fake Z.ai upstream shared by the tests of this package
+var fake *fakezai.Server
+
+// testdataDir is the absolute path of this package's testdata directory
+var testdataDir string
+
+func TestMain(m *testing.M) {
+	dataDir, err := os.MkdirTemp("", "z2api-handlers-test")
+	if err != nil {
+		panic(err)
+	}
+
+	// Configure before the config singleton is loaded
+	os.Setenv("DATA_DIR", dataDir)
+	os.Setenv("TOKEN", "")
+	os.Setenv("BREAKER_ENABLED", "false")
+	os.Setenv("RETRY_MAX_ATTEMPTS", "1")
+
+	// The tokenizer loads its vocabulary from ./tiktoken at the repository root,
+	// which keeps token counts in the golden files stable and offline
+	testdataDir, err = filepath.Abs("testdata")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+
+	fake = fakezai.NewServer()
+	if err := config.GetConfig().SetBaseURL(fake.URL); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+
+	fake.Close()
+	os.RemoveAll(dataDir)
+	os.Exit(code)
+}
@@ -6,8 +6,8 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/Tyler-Dinh/z2api-go/config"
 	"github.com/Tyler-Dinh/z2api-go/services"
+	"github.com/Tyler-Dinh/z2api-go/types"
 	"github.com/Tyler-Dinh/z2api-go/utils"
 )
 
@@ -19,364 +19,326 @@ func AnthropicMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Rejected requests are recorded too, before their model is known
+	info := services.RequestInfoFromContext(r.Context())
+	info.SetDialect(services.DialectAnthropic)
+
 	// Parse request body
-	var requestData map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": {"type": "invalid_request_error", "message": "Invalid JSON: %v"}}`, err), http.StatusBadRequest)
+	var req types.AnthropicMessageRequest
+	if err := services.DecodeRequest(r.Body, &req); err != nil {
+		writeError(w, r, services.DialectAnthropic, err)
 		return
 	}
 
-	// Generate IDs
-	chatID := utils.GenerateID()
-	messageID := utils.GenerateID()
-
-	// Get stream option
-	stream := false
-	if s, ok := requestData["stream"].(bool); ok {
-		stream = s
-	}
-
-	// Format request for Z.ai
-	formattedData, err := services.FormatRequest(requestData, "Anthropic")
+	// Select the thinking tags mode, removing a mode suffix from the model
+	thinkMode, err := services.RequestThinkMode(r.Header.Get(services.ThinkModeHeader), req.ThinkMode, &req.Model)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": {"type": "api_error", "message": "Failed to format request: %v"}}`, err), http.StatusInternalServerError)
+		writeError(w, r, services.DialectAnthropic, err)
 		return
 	}
 
-	formattedData["chat_id"] = chatID
-	formattedData["id"] = messageID
+	// Resume the upstream chat of the conversation, if known
+	userID, _ := req.Metadata["user_id"].(string)
+	session := services.GetSessionStore().Resolve(r.Context(), r.Header.Get(services.ConversationHeader), userID, req.System, req.Messages)
 
-	// Get model and messages
-	cfg := config.GetConfig()
-	model := cfg.Model.Default
-	if m, ok := formattedData["model"].(string); ok && m != "" {
-		model = m
+	// Format request for Z.ai, fitting it into the model's context window
+	zaiReq, err := services.FormatAnthropicRequest(r.Context(), &req, session.ChatID)
+	if err != nil {
+		writeError(w, r, services.DialectAnthropic, err)
+		return
 	}
+	session.Apply(zaiReq)
+	model := zaiReq.Model
 
-	messages := []map[string]interface{}{}
-	if msgs, ok := formattedData["messages"].([]map[string]interface{}); ok {
-		messages = msgs
-	}
+	info.SetRequest(services.DialectAnthropic, model, session.ChatID, req.Stream)
 
 	// Calculate prompt tokens (required for Anthropic format)
-	promptText := services.ExtractTextFromMessages(messages)
-	promptTokens := services.CountTokens(promptText)
+	promptTokens := services.EstimatePromptTokens(zaiReq)
 
 	// Send request to Z.ai
-	resp, err := services.SendChatRequest(formattedData, chatID)
+	resp, err := services.SendChatRequest(r.Context(), zaiReq)
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error": {"type": "api_error", "message": "Failed to send request: %v"}}`, err), http.StatusInternalServerError)
+		writeError(w, r, services.DialectAnthropic, err)
 		return
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		http.Error(w, fmt.Sprintf(`{"error": {"type": "api_error", "message": "Z.ai API error"}}`, resp.StatusCode), resp.StatusCode)
-		return
-	}
+	// One ID for the whole message
+	responseID := utils.GenerateMessageID()
+	formatter := services.NewResponseFormatter(thinkMode)
 
 	// Handle streaming response
-	if stream {
+	if req.Stream {
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
 		w.Header().Set("Connection", "keep-alive")
 
 		flusher, ok := w.(http.Flusher)
 		if !ok {
-			http.Error(w, `{"error": {"type": "api_error", "message": "Streaming not supported"}}`, http.StatusInternalServerError)
+			writeError(w, r, services.DialectAnthropic, services.NewAPIError(services.ErrInternal, "Streaming not supported"))
 			return
 		}
 
-		textParts := []string{}
+		sendEvent := func(event types.AnthropicStreamEvent) {
+			eventJSON, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\n", event.Type)
+			fmt.Fprintf(w, "data: %s\n\n", eventJSON)
+			flusher.Flush()
+		}
+
+		// Content blocks are opened lazily and closed before the next one starts
+		blockIndex := -1
+		blockType := ""
+		startBlock := func(kind string, block interface{}) {
+			blockIndex++
+			blockType = kind
+			index := blockIndex
+			sendEvent(types.AnthropicStreamEvent{
+				Type:         "content_block_start",
+				Index:        &index,
+				ContentBlock: block,
+			})
+		}
+		stopBlock := func() {
+			if blockType == "" {
+				return
+			}
+			index := blockIndex
+			sendEvent(types.AnthropicStreamEvent{
+				Type:  "content_block_stop",
+				Index: &index,
+			})
+			blockType = ""
+		}
+		sendDelta := func(delta interface{}) {
+			index := blockIndex
+			sendEvent(types.AnthropicStreamEvent{
+				Type:  "content_block_delta",
+				Index: &index,
+				Delta: delta,
+			})
+		}
+
+		completionParts := []string{}
 		toolCallParts := []string{}
-		hasToolCall := false
+		var call *toolCall
 
 		// Send message_start event
-		fmt.Fprintf(w, "event: message_start\n")
-		messageStart := map[string]interface{}{
-			"type": "message_start",
-			"message": map[string]interface{}{
-				"id":            utils.GenerateID(),
-				"type":          "message",
-				"role":          "assistant",
-				"model":         model,
-				"stop_reason":   nil,
-				"stop_sequence": nil,
-				"usage": map[string]interface{}{
-					"input_tokens":  promptTokens,
-					"output_tokens": 0,
-				},
-			},
-		}
-		messageStartJSON, _ := json.Marshal(messageStart)
-		fmt.Fprintf(w, "data: %s\n\n", messageStartJSON)
-		flusher.Flush()
-
-		// Send content_block_start event
-		fmt.Fprintf(w, "event: content_block_start\n")
-		contentBlockStart := map[string]interface{}{
-			"type":  "content_block_start",
-			"index": 0,
-			"content_block": map[string]interface{}{
-				"type": "text",
-				"text": "",
+		sendEvent(types.AnthropicStreamEvent{
+			Type: "message_start",
+			Message: &types.AnthropicMessageResponse{
+				ID:      responseID,
+				Type:    "message",
+				Role:    "assistant",
+				Model:   model,
+				Content: []interface{}{},
+				Usage:   types.AnthropicUsage{InputTokens: promptTokens},
 			},
-		}
-		contentBlockStartJSON, _ := json.Marshal(contentBlockStart)
-		fmt.Fprintf(w, "data: %s\n\n", contentBlockStartJSON)
-		flusher.Flush()
+		})
 
 		// Send ping event
-		fmt.Fprintf(w, "event: ping\n")
-		fmt.Fprintf(w, "data: {\"type\": \"ping\"}\n\n")
-		flusher.Flush()
+		sendEvent(types.AnthropicStreamEvent{Type: "ping"})
 
-		// Stream responses
-		for zaiResp := range services.ParseSSEStream(resp) {
-			if zaiResp.Data != nil && zaiResp.Data.Done {
-				break
+		emit := func(delta services.Delta) {
+			// Nothing follows a complete tool call
+			if call != nil {
+				return
 			}
 
-			delta := services.FormatResponse(zaiResp, "Anthropic")
-			if delta == nil {
-				continue
-			}
+			switch delta.Kind {
+			case services.DeltaToolCall:
+				toolCallParts = append(toolCallParts, delta.Text)
+				parsed, ok := parseToolCall(toolCallParts)
+				if !ok {
+					return
+				}
+				call = parsed
+
+				stopBlock()
+				startBlock("tool_use", types.AnthropicToolUseBlock{
+					Type:  "tool_use",
+					ID:    call.ID,
+					Name:  call.Name,
+					Input: map[string]interface{}{},
+				})
 
-			// Handle tool calls
-			if toolCall, ok := delta["tool_call"].(string); ok {
-				toolCallParts = append(toolCallParts, toolCall)
-				toolCallStr := strings.Join(toolCallParts, "")
-
-				// Try to parse complete tool call
-				var toolJSON map[string]interface{}
-				if err := json.Unmarshal([]byte(toolCallStr), &toolJSON); err == nil {
-					// Process arguments -> input
-					if arguments, ok := toolJSON["arguments"].(string); ok {
-						var input map[string]interface{}
-						if err := json.Unmarshal([]byte(arguments), &input); err == nil {
-							toolJSON["input"] = input
-						}
-						delete(toolJSON, "arguments")
-					}
+				// Send input in chunks
+				inputJSON, _ := json.Marshal(call.input())
+				inputStr := string(inputJSON)
+				chunkSize := 5
 
-					hasToolCall = true
-
-					// Close text block
-					fmt.Fprintf(w, "event: content_block_stop\n")
-					fmt.Fprintf(w, "data: {\"type\": \"content_block_stop\", \"index\": 0}\n\n")
-					flusher.Flush()
-
-					// Start tool_use block
-					fmt.Fprintf(w, "event: content_block_start\n")
-					toolBlockStart := map[string]interface{}{
-						"type":  "content_block_start",
-						"index": 1,
-						"content_block": map[string]interface{}{
-							"type":  "tool_use",
-							"id":    toolJSON["id"],
-							"name":  toolJSON["name"],
-							"input": nil,
-						},
-					}
-					toolBlockStartJSON, _ := json.Marshal(toolBlockStart)
-					fmt.Fprintf(w, "data: %s\n\n", toolBlockStartJSON)
-					flusher.Flush()
-
-					// Send input in chunks
-					if input, ok := toolJSON["input"].(map[string]interface{}); ok {
-						inputJSON, _ := json.Marshal(input)
-						inputStr := string(inputJSON)
-						chunkSize := 5
-
-						for i := 0; i < len(inputStr); i += chunkSize {
-							end := i + chunkSize
-							if end > len(inputStr) {
-								end = len(inputStr)
-							}
-							chunk := inputStr[i:end]
-
-							fmt.Fprintf(w, "event: content_block_delta\n")
-							delta := map[string]interface{}{
-								"type":  "content_block_delta",
-								"index": 1,
-								"delta": map[string]interface{}{
-									"type":         "input_json_delta",
-									"partial_json": chunk,
-								},
-							}
-							deltaJSON, _ := json.Marshal(delta)
-							fmt.Fprintf(w, "data: %s\n\n", deltaJSON)
-							flusher.Flush()
-						}
+				for i := 0; i < len(inputStr); i += chunkSize {
+					end := i + chunkSize
+					if end > len(inputStr) {
+						end = len(inputStr)
 					}
+					sendDelta(types.AnthropicInputJSONDelta{
+						Type:        "input_json_delta",
+						PartialJSON: inputStr[i:end],
+					})
+				}
+				stopBlock()
 
-					// Close tool_use block
-					fmt.Fprintf(w, "event: content_block_stop\n")
-					fmt.Fprintf(w, "data: {\"type\": \"content_block_stop\", \"index\": 1}\n\n")
-					flusher.Flush()
-					break
+			case services.DeltaReasoning:
+				completionParts = append(completionParts, delta.Text)
+				if blockType != "thinking" {
+					stopBlock()
+					startBlock("thinking", types.AnthropicThinkingBlock{Type: "thinking"})
 				}
-				continue
-			}
+				sendDelta(types.AnthropicThinkingDelta{Type: "thinking_delta", Thinking: delta.Text})
 
-			// Handle text content
-			if text, ok := delta["text"].(string); ok {
-				textParts = append(textParts, text)
-
-				fmt.Fprintf(w, "event: content_block_delta\n")
-				contentDelta := map[string]interface{}{
-					"type":  "content_block_delta",
-					"index": 0,
-					"delta": map[string]interface{}{
-						"type": "text_delta",
-						"text": text,
-					},
+			default:
+				completionParts = append(completionParts, delta.Text)
+				if blockType != "text" {
+					stopBlock()
+					startBlock("text", types.AnthropicTextBlock{Type: "text"})
 				}
-				contentDeltaJSON, _ := json.Marshal(contentDelta)
-				fmt.Fprintf(w, "data: %s\n\n", contentDeltaJSON)
-				flusher.Flush()
+				sendDelta(types.AnthropicTextDelta{Type: "text_delta", Text: delta.Text})
 			}
 		}
 
-		// Calculate completion tokens
-		completionStr := strings.Join(textParts, "")
-		completionTokens := services.CountTokens(completionStr)
+		// Stream responses
+		done := false
+		for event := range services.ParseSSEStream(resp) {
+			if event.Err != nil {
+				info.SetError(event.Err)
+				writeStreamError(r.Context(), w, flusher, services.DialectAnthropic, event.Err)
+				return
+			}
 
-		// Close text block if no tool call
-		if !hasToolCall {
-			fmt.Fprintf(w, "event: content_block_stop\n")
-			fmt.Fprintf(w, "data: {\"type\": \"content_block_stop\", \"index\": 0}\n\n")
-			flusher.Flush()
+			// The Done frame may still carry content
+			zaiResp := event.Response
+			done = zaiResp.Data != nil && zaiResp.Data.Done
+			for _, delta := range formatter.Format(zaiResp) {
+				emit(delta)
+			}
+
+			// Stop reading at Done or once a tool call is complete
+			if done || call != nil {
+				break
+			}
 		}
+		if call == nil {
+			for _, delta := range formatter.Flush() {
+				emit(delta)
+			}
+		}
+		commitSession(session, done, call)
+
+		// Always send at least one (possibly empty) content block
+		if blockIndex < 0 {
+			startBlock("text", types.AnthropicTextBlock{Type: "text"})
+		}
+		stopBlock()
+
+		// Calculate completion tokens
+		completionStr := strings.Join(completionParts, "")
+		completionTokens := services.CountTokens(completionStr)
+		info.SetUsage(promptTokens, completionTokens)
 
 		// Send message_delta event
-		fmt.Fprintf(w, "event: message_delta\n")
 		stopReason := "end_turn"
-		if hasToolCall {
+		if call != nil {
 			stopReason = "tool_use"
 		}
-		messageDelta := map[string]interface{}{
-			"type": "message_delta",
-			"delta": map[string]interface{}{
-				"stop_reason":   stopReason,
-				"stop_sequence": nil,
-			},
-			"usage": map[string]interface{}{
-				"output_tokens": completionTokens,
-			},
-		}
-		messageDeltaJSON, _ := json.Marshal(messageDelta)
-		fmt.Fprintf(w, "data: %s\n\n", messageDeltaJSON)
-		flusher.Flush()
+		sendEvent(types.AnthropicStreamEvent{
+			Type:  "message_delta",
+			Delta: types.AnthropicMessageDelta{StopReason: &stopReason},
+			Usage: &types.AnthropicUsage{InputTokens: promptTokens, OutputTokens: completionTokens},
+		})
 
 		// Send message_stop event
-		fmt.Fprintf(w, "event: message_stop\n")
-		fmt.Fprintf(w, "data: {\"type\": \"message_stop\"}\n\n")
-		flusher.Flush()
+		sendEvent(types.AnthropicStreamEvent{Type: "message_stop"})
 
 		return
 	}
 
 	// Handle non-streaming response
+	thinkingParts := []string{}
 	textParts := []string{}
 	toolCallParts := []string{}
+	var call *toolCall
 
-	for zaiResp := range services.ParseSSEStream(resp) {
-		if zaiResp.Data != nil && zaiResp.Data.Done {
-			break
+	collect := func(delta services.Delta) {
+		// Nothing follows a complete tool call
+		if call != nil {
+			return
 		}
 
-		delta := services.FormatResponse(zaiResp, "Anthropic")
-		if delta == nil {
-			continue
+		switch delta.Kind {
+		case services.DeltaToolCall:
+			toolCallParts = append(toolCallParts, delta.Text)
+			if parsed, ok := parseToolCall(toolCallParts); ok {
+				call = parsed
+			}
+		case services.DeltaReasoning:
+			thinkingParts = append(thinkingParts, delta.Text)
+		default:
+			textParts = append(textParts, delta.Text)
 		}
+	}
 
-		if toolCall, ok := delta["tool_call"].(string); ok {
-			toolCallParts = append(toolCallParts, toolCall)
-			toolCallStr := strings.Join(toolCallParts, "")
-
-			// Try to parse complete tool call
-			var toolJSON map[string]interface{}
-			if err := json.Unmarshal([]byte(toolCallStr), &toolJSON); err == nil {
-				// Process arguments -> input
-				if arguments, ok := toolJSON["arguments"].(string); ok {
-					var input map[string]interface{}
-					if err := json.Unmarshal([]byte(arguments), &input); err == nil {
-						toolJSON["input"] = input
-					}
-					delete(toolJSON, "arguments")
-				}
-
-				completionTokens := services.CountTokens(strings.Join(textParts, ""))
-
-				// Build content array
-				content := []map[string]interface{}{}
-				if len(textParts) > 0 {
-					content = append(content, map[string]interface{}{
-						"type": "text",
-						"text": strings.Join(textParts, ""),
-					})
-				}
-				content = append(content, map[string]interface{}{
-					"type":  "tool_use",
-					"id":    toolJSON["id"],
-					"name":  toolJSON["name"],
-					"input": toolJSON["input"],
-				})
-
-				result := map[string]interface{}{
-					"id":      utils.GenerateID(),
-					"type":    "message",
-					"role":    "assistant",
-					"model":   model,
-					"content": content,
-					"usage": map[string]interface{}{
-						"input_tokens":  promptTokens,
-						"output_tokens": completionTokens,
-					},
-					"stop_sequence": nil,
-					"stop_reason":   "tool_use",
-				}
+	done := false
+	for event := range services.ParseSSEStream(resp) {
+		if event.Err != nil {
+			writeError(w, r, services.DialectAnthropic, event.Err)
+			return
+		}
 
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(result)
-				return
-			}
-			continue
+		// The Done frame may still carry content
+		zaiResp := event.Response
+		done = zaiResp.Data != nil && zaiResp.Data.Done
+		for _, delta := range formatter.Format(zaiResp) {
+			collect(delta)
 		}
 
-		if content, ok := delta["content"].(string); ok {
-			textParts = append(textParts, content)
+		if done || call != nil {
+			break
 		}
-		if reasoningContent, ok := delta["reasoning_content"].(string); ok {
-			textParts = append(textParts, reasoningContent)
+	}
+	if call == nil {
+		for _, delta := range formatter.Flush() {
+			collect(delta)
 		}
 	}
+	commitSession(session, done, call)
+
+	// Build content array
+	thinkingStr := strings.Join(thinkingParts, "")
+	textStr := strings.Join(textParts, "")
+	content := []interface{}{}
+	if thinkingStr != "" {
+		content = append(content, types.AnthropicThinkingBlock{Type: "thinking", Thinking: thinkingStr})
+	}
+	if textStr != "" {
+		content = append(content, types.AnthropicTextBlock{Type: "text", Text: textStr})
+	}
 
-	// No tool call, pure text response
-	completionStr := strings.Join(textParts, "")
-	completionTokens := services.CountTokens(completionStr)
-
-	content := []map[string]interface{}{}
-	if completionStr != "" {
-		content = append(content, map[string]interface{}{
-			"type": "text",
-			"text": completionStr,
+	stopReason := "end_turn"
+	if call != nil {
+		content = append(content, types.AnthropicToolUseBlock{
+			Type:  "tool_use",
+			ID:    call.ID,
+			Name:  call.Name,
+			Input: call.input(),
 		})
+		stopReason = "tool_use"
 	}
 
-	result := map[string]interface{}{
-		"id":      utils.GenerateID(),
-		"type":    "message",
-		"role":    "assistant",
-		"model":   model,
-		"content": content,
-		"usage": map[string]interface{}{
-			"input_tokens":  promptTokens,
-			"output_tokens": completionTokens,
+	completionTokens := services.CountTokens(thinkingStr + textStr)
+	info.SetUsage(promptTokens, completionTokens)
+
+	result := types.AnthropicMessageResponse{
+		ID:         responseID,
+		Type:       "message",
+		Role:       "assistant",
+		Model:      model,
+		Content:    content,
+		StopReason: &stopReason,
+		Usage: types.AnthropicUsage{
+			InputTokens:  promptTokens,
+			OutputTokens: completionTokens,
 		},
-		"stop_sequence": nil,
-		"stop_reason":   "end_turn",
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -2,11 +2,10 @@ package handlers
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 
 	"github.com/Tyler-Dinh/z2api-go/services"
-	"github.com/Tyler-Dinh/z2api-go/types"
 )
 
 // ModelsHandler handles model listing requests
@@ -19,16 +18,16 @@ func ModelsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Only allow GET and POST
 	if r.Method != "GET" && r.Method != "POST" {
-		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		writeError(w, r, services.DialectOpenAI, services.NewAPIError(services.ErrMethodNotAllow, "Method not allowed"))
 		return
 	}
 
 	// Get models from service
 	modelsService := services.GetModelsService()
-	models, err := modelsService.GetModels()
+	models, err := modelsService.GetModels(r.Context())
 	if err != nil {
-		log.Printf("Error fetching models: %v", err)
-		writeError(w, http.StatusInternalServerError, "Failed to fetch models: "+err.Error())
+		slog.ErrorContext(r.Context(), "Failed to fetch models", "error", err)
+		writeError(w, r, services.DialectOpenAI, err)
 		return
 	}
 
@@ -37,13 +36,3 @@ func ModelsHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(models)
 }
-
-// writeError writes an error response
-func writeError(w http.ResponseWriter, statusCode int, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(types.ErrorResponse{
-		Error:   statusCode,
-		Message: message,
-	})
-}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/fakezai"
+	"github.com/Tyler-Dinh/z2api-go/services"
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+// enableSessions turns on session affinity for one test
+func enableSessions(t *testing.T) {
+	t.Helper()
+	cfg := config.GetConfig()
+	enabled := cfg.Sessions.Enabled
+	cfg.Sessions.Enabled = true
+	t.Cleanup(func() { cfg.Sessions.Enabled = enabled })
+	services.GetSessionStore().Clear()
+	fake.Reset()
+}
+
+// postMessages sends an Anthropic request for a user and returns the upstream request it caused
+func postMessages(t *testing.T, userID string, texts ...string) (*httptest.ResponseRecorder, types.ZaiRequest) {
+	t.Helper()
+	messages := []map[string]interface{}{}
+	for i, text := range texts {
+		role := "user"
+		if i%2 == 1 {
+			role = "assistant"
+		}
+		messages = append(messages, map[string]interface{}{"role": role, "content": text})
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":      "glm-4.6",
+		"max_tokens": 100,
+		"metadata":   map[string]interface{}{"user_id": userID},
+		"messages":   messages,
+	})
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", bytes.NewReader(body))
+	ctx := services.WithCredentials(req.Context(), services.Credentials{UpstreamToken: "client-token"})
+	rec := httptest.NewRecorder()
+	AnthropicMessages(rec, req.WithContext(ctx))
+
+	requests := fake.Requests(fakezai.PathChat)
+	var zaiReq types.ZaiRequest
+	if err := json.Unmarshal(requests[len(requests)-1].Body, &zaiReq); err != nil {
+		t.Fatalf("decode upstream request: %v", err)
+	}
+	return rec, zaiReq
+}
+
+func TestSessionUserIDKeepsConversationsApart(t *testing.T) {
+	enableSessions(t)
+
+	_, first := postMessages(t, "user-1", "Hi")
+	_, other := postMessages(t, "user-1", "Translate this")
+	if other.ChatID == first.ChatID {
+		t.Errorf("two conversations of one user share chat %s", first.ChatID)
+	}
+
+	// The user's conversation continues, another user's identical one does not
+	if _, second := postMessages(t, "user-2", "Hi", "Fake answer", "More"); second.ChatID == first.ChatID {
+		t.Errorf("another user resumed chat %s", first.ChatID)
+	}
+	if _, second := postMessages(t, "user-1", "Hi", "Fake answer", "More"); second.ChatID != first.ChatID || second.ParentID != first.ID {
+		t.Errorf("second turn = chat %s parent %s, want chat %s parent %s", second.ChatID, second.ParentID, first.ChatID, first.ID)
+	}
+}
+
+func TestSessionCommittedOnlyAfterDone(t *testing.T) {
+	enableSessions(t)
+	fake.Queue(fakezai.PathChat, fakezai.Chat(fakezai.Answer("Partial"), fakezai.ErrorFrame(500, "Internal error")))
+
+	rec, failed := postMessages(t, "user-1", "Hi")
+	if rec.Code == http.StatusOK {
+		t.Fatalf("failed turn answered %d", rec.Code)
+	}
+	if _, next := postMessages(t, "user-1", "Hi", "Partial", "More"); next.ChatID == failed.ChatID || next.ParentID != "" {
+		t.Errorf("turn after a failed response resumed chat %s with parent %q", next.ChatID, next.ParentID)
+	}
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/fakezai"
+	"github.com/Tyler-Dinh/z2api-go/services"
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+func TestPerRequestThinkMode(t *testing.T) {
+	tests := []struct {
+		model, header string
+		check         func(msg map[string]interface{}) bool
+	}{
+		// The model suffix wins over the header
+		{"glm-4.6:think", "strip", func(msg map[string]interface{}) bool {
+			return strings.HasPrefix(msg["content"].(string), "<think>") && msg["reasoning_content"] == nil
+		}},
+		{"glm-4.6", "strip", func(msg map[string]interface{}) bool {
+			content := msg["content"].(string)
+			return !strings.Contains(content, "<think>") && strings.HasSuffix(content, "The answer is 4.") && msg["reasoning_content"] == nil
+		}},
+	}
+	for _, tt := range tests {
+		fake.Reset()
+		fake.Queue(fakezai.PathChat, fakezai.Chat(thinkingFrames()...))
+
+		body, _ := json.Marshal(map[string]interface{}{
+			"model":    tt.model,
+			"messages": []interface{}{map[string]interface{}{"role": "user", "content": "What is 2+2?"}},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(body))
+		req.Header.Set(services.ThinkModeHeader, tt.header)
+		rec := httptest.NewRecorder()
+		ChatCompletions(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body %s", tt.model, rec.Code, rec.Body)
+		}
+
+		var completion struct {
+			Choices []struct {
+				Message map[string]interface{} `json:"message"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &completion); err != nil || len(completion.Choices) != 1 {
+			t.Fatalf("%s: decode completion %s: %v", tt.model, rec.Body, err)
+		}
+		if msg := completion.Choices[0].Message; !tt.check(msg) {
+			t.Errorf("%s with %s header: message = %v", tt.model, tt.header, msg)
+		}
+
+		var zaiReq types.ZaiRequest
+		if err := json.Unmarshal(fake.Requests(fakezai.PathChat)[0].Body, &zaiReq); err != nil || zaiReq.Model != "glm-4.6" {
+			t.Errorf("%s: upstream model = %q, %v", tt.model, zaiReq.Model, err)
+		}
+	}
+}
+
+func TestPerRequestThinkModeInvalid(t *testing.T) {
+	fake.Reset()
+	body := `{"model":"glm-4.6","think_mode":"loud","messages":[{"role":"user","content":"Hi"}]}`
+	rec := httptest.NewRecorder()
+	ChatCompletions(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"param":"think_mode"`) {
+		t.Errorf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	if n := len(fake.Requests(fakezai.PathChat)); n != 0 {
+		t.Errorf("invalid request reached upstream %d times", n)
+	}
+}
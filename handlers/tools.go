@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+// toolCall is a complete tool call reassembled from Z.ai's tool_call fragments
+type toolCall struct {
+	ID        string
+	Name      string
+	Arguments string
+}
+
+// parseToolCall joins the fragments received so far, returning false until they form a complete call
+func parseToolCall(parts []string) (*toolCall, bool) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.Join(parts, "")), &raw); err != nil {
+		return nil, false
+	}
+
+	call := &toolCall{}
+	call.ID, _ = raw["id"].(string)
+	call.Name, _ = raw["name"].(string)
+
+	// Arguments arrive as a JSON string, but accept an object as well
+	switch arguments := raw["arguments"].(type) {
+	case string:
+		call.Arguments = arguments
+	case nil:
+		call.Arguments = "{}"
+	default:
+		argumentsJSON, _ := json.Marshal(arguments)
+		call.Arguments = string(argumentsJSON)
+	}
+	return call, true
+}
+
+// input returns the arguments as an object, or an empty object if they are not valid JSON
+func (c *toolCall) input() map[string]interface{} {
+	input := map[string]interface{}{}
+	json.Unmarshal([]byte(c.Arguments), &input)
+	return input
+}
+
+// openAI returns the call in OpenAI's tool_calls format
+func (c *toolCall) openAI() types.ToolCall {
+	return types.ToolCall{
+		ID:   c.ID,
+		Type: "function",
+		Function: &types.FunctionCall{
+			Name:      c.Name,
+			Arguments: c.Arguments,
+		},
+	}
+}
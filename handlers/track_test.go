@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/fakezai"
+	"github.com/Tyler-Dinh/z2api-go/middleware"
+	"github.com/Tyler-Dinh/z2api-go/services"
+	"github.com/Tyler-Dinh/z2api-go/usage"
+)
+
+func TestRejectedRequestsAreRecorded(t *testing.T) {
+	fake.Reset()
+
+	var mutex sync.Mutex
+	records := map[string]usage.Record{}
+	usage.GetLedger().Subscribe(func(record usage.Record) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		records[record.RequestID] = record
+	})
+
+	tests := []struct {
+		path, body string
+		handler    http.HandlerFunc
+		dialect    string
+	}{
+		{"/v1/chat/completions", `{"model": "glm-4.6", "messages": "Hi"`, ChatCompletions, services.DialectOpenAI},
+		{"/v1/chat/completions", `{"model": "glm-4.6", "messages": []}`, ChatCompletions, services.DialectOpenAI},
+		{"/v1/messages", `{"model": "glm-4.6", "max_tokens": 10, "messages": [{"role": "system", "content": "Hi"}]}`, AnthropicMessages, services.DialectAnthropic},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		middleware.Track(tt.handler).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status = %d, want 400", tt.body, rec.Code)
+		}
+
+		mutex.Lock()
+		found := false
+		for id, record := range records {
+			if record.Dialect == tt.dialect && record.Status == http.StatusBadRequest && record.Error != "" {
+				found = true
+				delete(records, id)
+				break
+			}
+		}
+		mutex.Unlock()
+		if !found {
+			t.Errorf("%s: no ledger record with status 400", tt.body)
+		}
+	}
+	if n := len(fake.Requests(fakezai.PathChat)); n != 0 {
+		t.Errorf("rejected requests reached upstream %d times", n)
+	}
+}
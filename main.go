@@ -2,12 +2,16 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
 
 	"github.com/Tyler-Dinh/z2api-go/config"
 	"github.com/Tyler-Dinh/z2api-go/handlers"
+	"github.com/Tyler-Dinh/z2api-go/metrics"
 	"github.com/Tyler-Dinh/z2api-go/middleware"
+	"github.com/Tyler-Dinh/z2api-go/services"
+	"github.com/Tyler-Dinh/z2api-go/usage"
 	"github.com/Tyler-Dinh/z2api-go/utils"
 )
 
@@ -15,49 +19,128 @@ func main() {
 	// Initialize configuration
 	cfg := config.GetConfig()
 
+	// Initialize structured logging, DEBUG enables debug level
+	utils.InitLogger(cfg.API.Debug)
+
 	// Initialize tokenizer
 	if err := utils.InitTokenizer(); err != nil {
-		log.Printf("Warning: Failed to initialize tokenizer: %v", err)
-		log.Println("Token counting will not be available")
+		slog.Warn("Token counting will not be available", "error", err)
 	}
 
+	// Initialize upstream circuit breaker
+	services.GetUpstreamBreaker()
+
+	// Initialize pooled upstream transport
+	if err := services.InitTransport(); err != nil {
+		slog.Error("Failed to initialize upstream transport", "error", err)
+		os.Exit(1)
+	}
+
+	// Initialize token budgets from the usage ledger
+	usage.GetBudgets()
+
+	// Initialize the Files API store and its expiry cleanup
+	services.GetFileStore()
+
 	// Setup routes
 	mux := http.NewServeMux()
 
 	// Register routes
 	mux.HandleFunc("/health", handlers.HealthHandler)
-	mux.HandleFunc("/v1/models", handlers.ModelsHandler)
-	mux.HandleFunc("/v1/chat/completions", handlers.ChatCompletions)
-	mux.HandleFunc("/v1/messages", handlers.AnthropicMessages)
+	mux.HandleFunc("/metrics", metrics.Handler)
+	mux.Handle("/v1/models", api(handlers.ModelsHandler))
+	mux.Handle("/v1/chat/completions", chat(handlers.ChatCompletions))
+	mux.Handle("/v1/messages", chat(handlers.AnthropicMessages))
+	mux.Handle("/v1/files", api(handlers.Files))
+	mux.Handle("/v1/files/", api(handlers.Files))
+
+	// Register admin routes, on their own listener if ADMIN_PORT is set
+	adminMux := http.NewServeMux()
+	adminMux.Handle("/admin/usage", admin(handlers.AdminUsage))
+	adminMux.Handle("/admin/budgets", admin(handlers.AdminBudgets))
+	adminMux.Handle("/admin/cache/clear", admin(handlers.AdminCache))
+	adminMux.Handle("/admin/cache/refresh", admin(handlers.AdminCache))
+	adminMux.Handle("/admin/config", admin(handlers.AdminConfig))
+	adminMux.Handle("/admin/settings", admin(handlers.AdminSettings))
+	adminMux.Handle("/admin/keys", admin(handlers.AdminKeys))
+	adminMux.Handle("/admin/requests", admin(handlers.AdminRequests))
+	if cfg.Admin.Port == 0 {
+		mux.Handle("/admin/", adminMux)
+	}
 
-	// Apply CORS middleware
-	handler := middleware.CORS(mux)
+	// Apply middleware, the request ID is assigned first so every later log line carries it
+	handler := middleware.Logging(middleware.Recover(middleware.CORS(mux)))
 
 	// Print startup info
-	log.Println("---------------------------------------------------------------------")
-	log.Println("Z2api Go - OpenAI/Anthropic Compatible Proxy for Z.ai")
-	log.Println("https://github.com/Tyler-Dinh/z2api-go")
-	log.Println("---------------------------------------------------------------------")
-	log.Printf("Base:           %s//%s", cfg.Source.Protocol, cfg.Source.Host)
-	log.Printf("Port:           %d", cfg.API.Port)
-	log.Printf("Think Mode:     %s", cfg.API.Think)
-	log.Printf("Anonymous Mode: %v", cfg.API.Anonymous)
-	log.Printf("Debug Mode:     %v", cfg.API.Debug)
-	log.Printf("Debug Messages: %v", cfg.API.DebugMsg)
-	log.Println("---------------------------------------------------------------------")
-	log.Println("Available Endpoints:")
-	log.Println("  GET  /health                  - Health check")
-	log.Println("  GET  /v1/models               - List models")
-	log.Println("  POST /v1/chat/completions     - OpenAI chat completions")
-	log.Println("  POST /v1/messages             - Anthropic messages")
-	log.Println("---------------------------------------------------------------------")
+	slog.Info("Z2api Go - OpenAI/Anthropic Compatible Proxy for Z.ai",
+		"repository", "https://github.com/Tyler-Dinh/z2api-go",
+		"base", cfg.Source.BaseURL(),
+		"port", cfg.API.Port,
+		"think_mode", cfg.ThinkMode(),
+		"anonymous", cfg.API.Anonymous,
+		"api_keys", services.GetKeyStore().Enabled(),
+		"client_tokens", cfg.Auth.AllowClientTokens,
+		"usage_ledger", cfg.Usage.Enabled,
+		"admin_api", cfg.Admin.Key != "",
+		"admin_port", cfg.Admin.Port,
+		"debug", cfg.API.Debug,
+		"debug_messages", cfg.API.DebugMsg,
+	)
+	for _, endpoint := range endpoints {
+		slog.Debug("Endpoint available", "route", endpoint[0], "description", endpoint[1])
+	}
+
+	// Start admin server
+	if cfg.Admin.Port != 0 {
+		adminAddr := fmt.Sprintf(":%d", cfg.Admin.Port)
+		slog.Info("Admin server starting", "addr", adminAddr)
+		go func() {
+			if err := http.ListenAndServe(adminAddr, middleware.Logging(middleware.Recover(adminMux))); err != nil {
+				slog.Error("Admin server failed to start", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
 
 	// Start server
 	addr := fmt.Sprintf(":%d", cfg.API.Port)
-	log.Printf("Server starting on %s", addr)
-	log.Println("Press Ctrl+C to stop")
+	slog.Info("Server starting", "addr", addr)
 
 	if err := http.ListenAndServe(addr, handler); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+		slog.Error("Server failed to start", "error", err)
+		os.Exit(1)
 	}
 }
+
+// endpoints lists the routes for the startup log
+var endpoints = [][2]string{
+	{"GET  /health", "Health check"},
+	{"GET  /metrics", "Prometheus metrics"},
+	{"GET  /v1/models", "List models"},
+	{"POST /v1/chat/completions", "OpenAI chat completions"},
+	{"POST /v1/messages", "Anthropic messages"},
+	{"*    /v1/files", "Files API"},
+	{"GET  /admin/usage", "Usage report (requires ADMIN_KEY)"},
+	{"*    /admin/budgets", "Token budgets (requires ADMIN_KEY)"},
+	{"*    /admin/keys", "API keys (requires ADMIN_KEY)"},
+	{"POST /admin/cache/clear", "Clear caches (requires ADMIN_KEY)"},
+	{"POST /admin/cache/refresh", "Refresh caches (requires ADMIN_KEY)"},
+	{"GET  /admin/config", "Effective config (requires ADMIN_KEY)"},
+	{"*    /admin/settings", "Runtime settings (requires ADMIN_KEY)"},
+	{"GET  /admin/requests", "In-flight requests (requires ADMIN_KEY)"},
+}
+
+// api wraps a public API handler with client authentication and usage tracking
+func api(h http.HandlerFunc) http.Handler {
+	return middleware.Auth(middleware.Track(h))
+}
+
+// chat wraps a chat handler like api, enforces token budgets and captures transcripts
+func chat(h http.HandlerFunc) http.Handler {
+	return middleware.Auth(middleware.Budget(middleware.Track(middleware.Transcript(h))))
+}
+
+// admin wraps an admin handler with admin authentication
+func admin(h http.HandlerFunc) http.Handler {
+	return middleware.AdminAuth(h)
+}
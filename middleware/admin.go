@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/services"
+)
+
+// AdminAuth protects admin endpoints with ADMIN_KEY
+//
+// Admin endpoints are disabled entirely when no admin key is configured.
+func AdminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		adminKey := config.GetConfig().Admin.Key
+		if adminKey == "" {
+			services.NewAPIError(services.ErrNotFound, "Admin API is disabled").Write(w, services.DialectOpenAI)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(presentedKey(r)), []byte(adminKey)) != 1 {
+			services.NewAPIError(services.ErrAuthentication, "Invalid admin key").Write(w, services.DialectOpenAI)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/services"
+)
+
+// Auth validates proxy API keys and resolves which Z.ai token serves the request
+//
+// When no keys are configured the proxy stays open. A key may map to its own
+// Z.ai token, and when ALLOW_CLIENT_TOKENS is set the caller can bring their
+// own token in the configured header, which takes precedence.
+func Auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := config.GetConfig()
+		keyStore := services.GetKeyStore()
+		creds := services.Credentials{}
+
+		// Validate proxy API key
+		if keyStore.Enabled() {
+			apiKey, ok := keyStore.Lookup(presentedKey(r))
+			if !ok {
+				services.NewAPIError(services.ErrAuthentication, "Invalid or missing API key").Write(w, dialectFor(r))
+				return
+			}
+			creds.KeyID = apiKey.ID
+			creds.UpstreamToken = apiKey.UpstreamToken
+		}
+
+		// Bring-your-own Z.ai token
+		if cfg.Auth.AllowClientTokens {
+			if token := strings.TrimSpace(r.Header.Get(cfg.Auth.TokenHeader)); token != "" {
+				creds.UpstreamToken = strings.TrimPrefix(token, "Bearer ")
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(services.WithCredentials(r.Context(), creds)))
+	})
+}
+
+// presentedKey extracts the API key from OpenAI or Anthropic style headers
+func presentedKey(r *http.Request) string {
+	if key := strings.TrimSpace(r.Header.Get("X-Api-Key")); key != "" {
+		return key
+	}
+
+	auth := strings.TrimSpace(r.Header.Get("Authorization"))
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// dialectFor returns the error dialect expected by the client of a route
+func dialectFor(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/v1/messages") {
+		return services.DialectAnthropic
+	}
+	return services.DialectOpenAI
+}
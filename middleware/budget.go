@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/Tyler-Dinh/z2api-go/services"
+	"github.com/Tyler-Dinh/z2api-go/usage"
+)
+
+// Budget rejects requests from keys that have used up their token budget
+//
+// Spend is only known once a request completes, so concurrent requests can
+// overshoot a budget by the size of the requests already in flight.
+func Budget(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		keyID := services.CredentialsFromContext(r.Context()).KeyID
+		if err := usage.GetBudgets().Check(keyID); err != nil {
+			apiErr := &services.APIError{
+				Kind:    services.ErrQuotaExceeded,
+				Message: "Token budget exceeded: " + err.Error(),
+				Err:     err,
+			}
+			apiErr.Write(w, dialectFor(r))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
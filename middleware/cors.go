@@ -2,15 +2,25 @@ package middleware
 
 import (
 	"net/http"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/services"
 )
 
 // CORS adds CORS headers to responses and handles preflight requests
 func CORS(next http.Handler) http.Handler {
+	cfg := config.GetConfig()
+	allowHeaders := "Content-Type, Authorization, X-Api-Key, Anthropic-Version, X-Request-ID, " + services.ConversationHeader + ", " + services.ThinkModeHeader + ", " + cfg.Auth.TokenHeader
+	if cfg.Transcript.OptInHeader != "" {
+		allowHeaders += ", " + cfg.Transcript.OptInHeader
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Set CORS headers
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 
 		// Handle preflight requests
 		if r.Method == "OPTIONS" {
@@ -21,4 +31,4 @@ func CORS(next http.Handler) http.Handler {
 		// Call next handler
 		next.ServeHTTP(w, r)
 	})
-}
\ No newline at end of file
+}
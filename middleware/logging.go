@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+// maxRequestIDLength caps client-supplied request IDs
+const maxRequestIDLength = 128
+
+// Logging assigns every request an ID, returns it as X-Request-ID and logs
+// the completed request
+//
+// A well-formed X-Request-ID sent by the client is reused so callers can
+// correlate their own logs with ours.
+func Logging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get("X-Request-ID")
+		if !validRequestID(requestID) {
+			requestID = utils.GenerateRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		ctx := utils.WithRequestID(r.Context(), requestID)
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		level := slog.LevelInfo
+		if r.URL.Path == "/health" || r.URL.Path == "/metrics" || r.Method == http.MethodOptions {
+			level = slog.LevelDebug
+		}
+		slog.Log(ctx, level, "Request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sw.status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
+
+// validRequestID accepts short IDs made of printable ASCII without spaces
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+func TestLoggingRequestID(t *testing.T) {
+	var seen string
+	handler := Logging(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = utils.RequestIDFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name, inbound string
+		reused        bool
+	}{
+		{"valid", "client-req-42", true},
+		{"missing", "", false},
+		{"with spaces", "client req", false},
+		{"non-ASCII", "requête", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		if tt.inbound != "" {
+			req.Header.Set("X-Request-ID", tt.inbound)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		got := rec.Header().Get("X-Request-ID")
+		if got != seen || got == "" {
+			t.Errorf("%s: response ID %q, handler saw %q", tt.name, got, seen)
+		}
+		if reused := got == tt.inbound; reused != tt.reused {
+			t.Errorf("%s: response ID = %q for inbound %q, reused %v, want %v", tt.name, got, tt.inbound, reused, tt.reused)
+		}
+	}
+}
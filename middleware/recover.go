@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"github.com/Tyler-Dinh/z2api-go/services"
+)
+
+// Recover turns a panic in a handler into a 500 error in the client's dialect
+//
+// Once a response has started, an event stream gets a final error event and
+// any other response is aborted, since its status can no longer change.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+
+			slog.ErrorContext(r.Context(), "Handler panicked",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"panic", fmt.Sprint(p),
+				"stack", string(debug.Stack()),
+			)
+
+			apiErr := services.NewAPIError(services.ErrInternal, "Internal server error")
+			dialect := dialectFor(r)
+			if !sw.wroteHeader {
+				apiErr.Write(w, dialect)
+				return
+			}
+			if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+				apiErr.WriteEvent(w, dialect)
+				sw.Flush()
+				return
+			}
+			panic(http.ErrAbortHandler)
+		}()
+
+		next.ServeHTTP(sw, r)
+	})
+}
@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecoverWritesDialectError(t *testing.T) {
+	handler := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var messages []map[string]interface{}
+		_ = messages[0]["role"].(string)
+	}))
+
+	tests := []struct {
+		path      string
+		wantField string
+	}{
+		{"/v1/chat/completions", "error"},
+		{"/v1/messages", "type"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.path, nil))
+
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("%s: status = %d, want 500", tt.path, rec.Code)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: invalid JSON body: %v", tt.path, err)
+		}
+		if _, ok := body[tt.wantField]; !ok {
+			t.Errorf("%s: body %s has no %q field", tt.path, rec.Body, tt.wantField)
+		}
+		if strings.Contains(rec.Body.String(), "index out of range") {
+			t.Errorf("%s: body leaks the panic value: %s", tt.path, rec.Body)
+		}
+	}
+}
+
+func TestRecoverEndsEventStream(t *testing.T) {
+	handler := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("event: message_start\ndata: {}\n\n"))
+		panic("boom")
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/messages", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want the already sent 200", rec.Code)
+	}
+	if !strings.HasSuffix(rec.Body.String(), "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"api_error\",\"message\":\"Internal server error\"}}\n\n") {
+		t.Errorf("stream does not end with an error event:\n%s", rec.Body)
+	}
+}
+
+func TestRecoverAbortsStartedResponse(t *testing.T) {
+	handler := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{"))
+		panic("boom")
+	}))
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", p)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/services"
+	"github.com/Tyler-Dinh/z2api-go/usage"
+)
+
+// Track attaches request info for the handlers and records completed
+// chat requests in the usage ledger
+func Track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := services.NewRequestInfo(r.Context())
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		untrack := services.TrackRequest(info)
+		defer untrack()
+
+		next.ServeHTTP(sw, r.WithContext(services.WithRequestInfo(r.Context(), info)))
+
+		// Only chat requests are recorded, including those rejected before reaching Z.ai
+		snapshot := info.Snapshot()
+		if snapshot.Dialect == "" {
+			return
+		}
+
+		usage.GetLedger().Append(usage.Record{
+			Time:             snapshot.StartedAt.UTC(),
+			RequestID:        snapshot.ID,
+			KeyID:            snapshot.KeyID,
+			Model:            snapshot.Model,
+			Dialect:          snapshot.Dialect,
+			Stream:           snapshot.Stream,
+			PromptTokens:     snapshot.PromptTokens,
+			CompletionTokens: snapshot.CompletionTokens,
+			LatencyMs:        time.Since(snapshot.StartedAt).Milliseconds(),
+			Status:           sw.status,
+			Error:            snapshot.Error,
+			ChatID:           snapshot.ChatID,
+		})
+	})
+}
+
+// statusWriter captures the status code written by a handler
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher for streaming responses
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/Tyler-Dinh/z2api-go/services"
+	"github.com/Tyler-Dinh/z2api-go/transcript"
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+// Transcript captures request/response transcripts when DEBUG_MSG is set or
+// the client opts in with the transcript header
+func Transcript(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || !transcript.Requested(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := transcript.New(r, utils.RequestIDFromContext(r.Context()), services.CredentialsFromContext(r.Context()).KeyID)
+
+		// Buffer the body so the handler can still read it
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err == nil {
+			rec.SetClientRequest(body)
+		}
+
+		cw := &captureWriter{statusWriter: statusWriter{ResponseWriter: w, status: http.StatusOK}, rec: rec}
+		next.ServeHTTP(cw, r.WithContext(transcript.WithRecorder(r.Context(), rec)))
+		rec.Finish(cw.status)
+	})
+}
+
+// captureWriter copies the response body into the transcript
+type captureWriter struct {
+	statusWriter
+	rec *transcript.Recorder
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.rec.WriteResponse(b)
+	return w.statusWriter.Write(b)
+}
@@ -0,0 +1,293 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/metrics"
+)
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+// String returns the state name
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerHalfOpen:
+		return "half_open"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// breakerOutcome is the result of one upstream call as seen by the breaker
+type breakerOutcome int
+
+const (
+	outcomeSuccess breakerOutcome = iota
+	outcomeFailure
+	outcomeIgnored
+)
+
+// BreakerSnapshot describes the current state of a circuit breaker
+type BreakerSnapshot struct {
+	State        BreakerState
+	Requests     int
+	ErrorRate    float64
+	SlowCallRate float64
+	OpenedAt     time.Time
+}
+
+// CircuitBreaker fails fast when the upstream is degraded
+//
+// Outcomes of the last WindowSize calls are kept in a ring. Once at least
+// MinRequests have been observed and either the failure rate or the slow call
+// rate reaches its threshold, the breaker opens. After OpenDuration it lets
+// HalfOpenProbes calls through; if they all succeed it closes again, any
+// failure reopens it.
+type CircuitBreaker struct {
+	settings config.BreakerConfig
+
+	mutex     sync.Mutex
+	state     BreakerState
+	failures  []bool
+	slow      []bool
+	next      int
+	count     int
+	openedAt  time.Time
+	probes    int
+	successes int
+}
+
+var (
+	upstreamBreaker     *CircuitBreaker
+	upstreamBreakerOnce sync.Once
+
+	breakerStateGauge = metrics.NewGaugeVec(
+		"z2api_upstream_breaker_state",
+		"Upstream circuit breaker state (0 closed, 1 half-open, 2 open)",
+	)
+	breakerTransitions = metrics.NewCounterVec(
+		"z2api_upstream_breaker_transitions_total",
+		"Upstream circuit breaker state transitions",
+		"state",
+	)
+	breakerRejections = metrics.NewCounterVec(
+		"z2api_upstream_breaker_rejections_total",
+		"Upstream calls rejected by the open circuit breaker",
+		"op",
+	)
+	upstreamRequests = metrics.NewCounterVec(
+		"z2api_upstream_requests_total",
+		"Upstream call attempts by operation and result",
+		"op", "result",
+	)
+)
+
+// GetUpstreamBreaker returns the circuit breaker guarding Z.ai calls
+func GetUpstreamBreaker() *CircuitBreaker {
+	upstreamBreakerOnce.Do(func() {
+		upstreamBreaker = NewCircuitBreaker(config.GetConfig().Breaker)
+		breakerStateGauge.Set(float64(BreakerClosed))
+	})
+	return upstreamBreaker
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(settings config.BreakerConfig) *CircuitBreaker {
+	if settings.WindowSize < 1 {
+		settings.WindowSize = 1
+	}
+	return &CircuitBreaker{
+		settings: settings,
+		failures: make([]bool, settings.WindowSize),
+		slow:     make([]bool, settings.WindowSize),
+	}
+}
+
+// allow reserves a call slot, or returns an overloaded error when open
+//
+// The returned function must be called with the outcome of the call.
+func (b *CircuitBreaker) allow(op string) (func(breakerOutcome, time.Duration), error) {
+	if !b.settings.Enabled {
+		return func(breakerOutcome, time.Duration) {}, nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.settings.OpenDuration {
+		b.transition(BreakerHalfOpen)
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		breakerRejections.Inc(op)
+		return nil, &APIError{Kind: ErrOverloaded, Message: "Z.ai upstream is unavailable, please retry later"}
+	case BreakerHalfOpen:
+		if b.probes >= b.settings.HalfOpenProbes {
+			breakerRejections.Inc(op)
+			return nil, &APIError{Kind: ErrOverloaded, Message: "Z.ai upstream is recovering, please retry later"}
+		}
+		b.probes++
+	}
+
+	var once sync.Once
+	return func(outcome breakerOutcome, latency time.Duration) {
+		once.Do(func() { b.record(outcome, latency) })
+	}, nil
+}
+
+// Snapshot returns the current breaker statistics
+func (b *CircuitBreaker) Snapshot() BreakerSnapshot {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.settings.OpenDuration {
+		b.transition(BreakerHalfOpen)
+	}
+
+	failures, slow := b.rates()
+	return BreakerSnapshot{
+		State:        b.state,
+		Requests:     b.count,
+		ErrorRate:    failures,
+		SlowCallRate: slow,
+		OpenedAt:     b.openedAt,
+	}
+}
+
+// record stores the outcome of a call admitted by allow
+func (b *CircuitBreaker) record(outcome breakerOutcome, latency time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	isSlow := b.settings.SlowCallThreshold > 0 && latency >= b.settings.SlowCallThreshold
+	failed := outcome == outcomeFailure
+
+	if b.state == BreakerHalfOpen {
+		b.probes--
+		if outcome == outcomeIgnored {
+			return
+		}
+		if failed || isSlow {
+			b.transition(BreakerOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.settings.HalfOpenProbes {
+			b.transition(BreakerClosed)
+		}
+		return
+	}
+
+	if outcome == outcomeIgnored || b.state == BreakerOpen {
+		return
+	}
+
+	b.failures[b.next] = failed
+	b.slow[b.next] = isSlow
+	b.next = (b.next + 1) % len(b.failures)
+	if b.count < len(b.failures) {
+		b.count++
+	}
+
+	if b.count < b.settings.MinRequests {
+		return
+	}
+	failureRate, slowRate := b.rates()
+	if failureRate >= b.settings.ErrorRateThreshold ||
+		(b.settings.SlowCallThreshold > 0 && slowRate >= b.settings.SlowCallRateThreshold) {
+		b.transition(BreakerOpen)
+	}
+}
+
+// rates returns the failure and slow call rates of the current window
+func (b *CircuitBreaker) rates() (float64, float64) {
+	if b.count == 0 {
+		return 0, 0
+	}
+
+	failures, slow := 0, 0
+	for i := 0; i < b.count; i++ {
+		if b.failures[i] {
+			failures++
+		}
+		if b.slow[i] {
+			slow++
+		}
+	}
+	return float64(failures) / float64(b.count), float64(slow) / float64(b.count)
+}
+
+// transition moves the breaker to a new state and resets the relevant counters
+func (b *CircuitBreaker) transition(state BreakerState) {
+	if b.state == state {
+		return
+	}
+
+	slog.Warn("Upstream circuit breaker state changed", "from", b.state.String(), "to", state.String())
+	b.state = state
+	b.probes = 0
+	b.successes = 0
+
+	switch state {
+	case BreakerOpen:
+		b.openedAt = time.Now()
+	case BreakerClosed:
+		b.openedAt = time.Time{}
+		b.next = 0
+		b.count = 0
+		for i := range b.failures {
+			b.failures[i] = false
+			b.slow[i] = false
+		}
+	}
+
+	breakerStateGauge.Set(float64(state))
+	breakerTransitions.Inc(state.String())
+}
+
+// classifyOutcome decides how an upstream attempt counts towards the breaker
+func classifyOutcome(ctx context.Context, resp *http.Response, err error) breakerOutcome {
+	if err != nil {
+		// The client going away says nothing about upstream health
+		if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+			return outcomeIgnored
+		}
+		return outcomeFailure
+	}
+
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout {
+		return outcomeFailure
+	}
+	return outcomeSuccess
+}
+
+// outcomeLabel returns the metrics label for an attempt result
+func outcomeLabel(resp *http.Response, err error) string {
+	if err != nil {
+		return "error"
+	}
+	switch {
+	case resp.StatusCode >= 500:
+		return "5xx"
+	case resp.StatusCode >= 400:
+		return "4xx"
+	default:
+		return "ok"
+	}
+}
@@ -0,0 +1,281 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/metrics"
+	"github.com/Tyler-Dinh/z2api-go/transcript"
+	"github.com/Tyler-Dinh/z2api-go/types"
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+// messageOverheadTokens approximates the role and separator tokens of each message
+const messageOverheadTokens = 4
+
+// summaryPrompt instructs the model summarizing dropped turns
+const summaryPrompt = "Summarize the following earlier part of a conversation for the assistant that continues it. " +
+	"Keep facts, decisions, names, numbers, open questions and the results of tool calls. " +
+	"Reply with the summary only."
+
+var contextOverflows = metrics.NewCounterVec(
+	"z2api_context_overflows_total",
+	"Requests over their model's context limit, by whether they were rejected, truncated or summarized",
+	"result",
+)
+
+// fitContext checks a request against its model's context window and applies CONTEXT_POLICY
+//
+// The limit comes from CONTEXT_LIMITS, then upstream model metadata, then
+// CONTEXT_DEFAULT_LIMIT; requests for models without a limit are sent as
+// they are. max_tokens, or CONTEXT_OUTPUT_RESERVE without it, is kept free
+// for the completion. Over the limit, "reject" fails with
+// context_length_exceeded, "truncate" drops the oldest turns and
+// "summarize" replaces them with a summary written by CONTEXT_SUMMARY_MODEL.
+// System messages, the last turn and tool calls with their results are
+// always kept together.
+func fitContext(ctx context.Context, zaiReq *types.ZaiRequest, models *types.ModelsResponse) error {
+	cfg := config.GetConfig()
+	if cfg.Context.Policy == "off" {
+		return nil
+	}
+	limit := contextLimit(models, zaiReq.Model)
+	if limit == 0 {
+		return nil
+	}
+
+	reserve := cfg.Context.OutputReserve
+	if zaiReq.MaxTokens > 0 {
+		reserve = zaiReq.MaxTokens
+	}
+	fixed := reserve
+	for _, file := range zaiReq.Files {
+		fixed += file.Tokens
+	}
+	if len(zaiReq.Tools) > 0 {
+		if toolBytes, err := json.Marshal(zaiReq.Tools); err == nil {
+			fixed += CountTokens(string(toolBytes))
+		}
+	}
+
+	tokens := make([]int, len(zaiReq.Messages))
+	total := fixed
+	for i, msg := range zaiReq.Messages {
+		tokens[i] = messageTokens(msg)
+		total += tokens[i]
+	}
+	if total <= limit {
+		return nil
+	}
+
+	exceeded := &APIError{
+		Kind:    ErrInvalidRequest,
+		Code:    "context_length_exceeded",
+		Param:   "messages",
+		Message: fmt.Sprintf("This model's maximum context length is %d tokens. However, your messages resulted in %d tokens, including %d reserved for the completion. Please reduce the length of the messages.", limit, total, reserve),
+	}
+	if cfg.Context.Policy == "reject" {
+		contextOverflows.Inc("rejected")
+		return exceeded
+	}
+
+	// Leave room for the summary that replaces the dropped turns
+	budget := limit
+	summarize := cfg.Context.Policy == "summarize"
+	if summarize {
+		budget -= cfg.Context.SummaryMaxTokens + messageOverheadTokens
+	}
+
+	// Drop whole turns, oldest first, but never the last one
+	turns := contextTurns(zaiReq.Messages)
+	lastTurn := 0
+	for _, turn := range turns {
+		lastTurn = max(lastTurn, turn)
+	}
+	firstKept := 0
+	for total > budget && firstKept < lastTurn {
+		for i, turn := range turns {
+			if turn == firstKept {
+				total -= tokens[i]
+			}
+		}
+		firstKept++
+	}
+	if total > budget {
+		contextOverflows.Inc("rejected")
+		return exceeded
+	}
+
+	kept := []types.Message{}
+	dropped := []types.Message{}
+	for i, msg := range zaiReq.Messages {
+		if turns[i] < 0 || turns[i] >= firstKept {
+			kept = append(kept, msg)
+		} else {
+			dropped = append(dropped, msg)
+		}
+	}
+
+	if summarize {
+		summary, err := summarizeMessages(ctx, models, zaiReq.Model, dropped)
+		if err == nil {
+			// The summary follows the leading system messages
+			at := 0
+			for at < len(kept) && kept[at].Role == "system" {
+				at++
+			}
+			summaryMessage := types.Message{
+				Role:    "system",
+				Content: types.TextContent("Summary of the earlier conversation:\n\n" + summary),
+			}
+			kept = append(kept[:at], append([]types.Message{summaryMessage}, kept[at:]...)...)
+			contextOverflows.Inc("summarized")
+			slog.InfoContext(ctx, "Summarized earlier turns to fit the context window",
+				"model", zaiReq.Model, "limit", limit, "dropped_messages", len(dropped), "summary_tokens", CountTokens(summary))
+			zaiReq.Messages = kept
+			return nil
+		}
+		slog.WarnContext(ctx, "Failed to summarize earlier turns, dropping them", "error", err)
+	}
+
+	contextOverflows.Inc("truncated")
+	slog.InfoContext(ctx, "Dropped earlier turns to fit the context window",
+		"model", zaiReq.Model, "limit", limit, "dropped_messages", len(dropped), "tokens", total)
+	zaiReq.Messages = kept
+	return nil
+}
+
+// contextLimit returns the context length of a model, or 0 if unknown
+func contextLimit(models *types.ModelsResponse, model string) int {
+	cfg := config.GetConfig()
+	if limit, ok := cfg.Context.Limits[model]; ok {
+		return limit
+	}
+	if limit, ok := cfg.Context.Limits[cfg.Model.Mapping[model]]; ok {
+		return limit
+	}
+	if limit := modelContextLimit(models, model); limit > 0 {
+		return limit
+	}
+	return cfg.Context.DefaultLimit
+}
+
+// contextTurns assigns every message to a turn, -1 for system messages
+//
+// A turn starts at a user message and holds the replies, tool calls and
+// tool results that follow it, so dropping whole turns keeps tool calls
+// and their results together.
+func contextTurns(messages []types.Message) []int {
+	turns := make([]int, len(messages))
+	turn := -1
+	for i, msg := range messages {
+		switch {
+		case msg.Role == "system":
+			turns[i] = -1
+			continue
+		case msg.Role == "user" || turn < 0:
+			turn++
+		}
+		turns[i] = turn
+	}
+	return turns
+}
+
+// messageTokens estimates the prompt tokens of a message, including its tool calls
+func messageTokens(msg types.Message) int {
+	tokens := messageOverheadTokens + CountTokens(msg.Content.String())
+	for _, call := range msg.ToolCalls {
+		if call.Function != nil {
+			tokens += CountTokens(call.Function.Name + call.Function.Arguments)
+		}
+	}
+	return tokens
+}
+
+// summarizeMessages asks a model for a summary of messages dropped from a conversation
+//
+// The history sent is capped at CONTEXT_SUMMARY_MAX_INPUT_TOKENS, keeping the
+// newest messages, and the call's tokens count towards the caller's usage.
+func summarizeMessages(ctx context.Context, models *types.ModelsResponse, model string, messages []types.Message) (string, error) {
+	cfg := config.GetConfig()
+	if cfg.Context.SummaryModel != "" {
+		model = sourceModelID(models, cfg.Context.SummaryModel)
+	}
+
+	// Walk back from the newest message until the input budget is spent
+	entries := []string{}
+	budget := cfg.Context.SummaryMaxInputTokens
+	for i := len(messages) - 1; i >= 0; i-- {
+		var entry strings.Builder
+		msg := messages[i]
+		fmt.Fprintf(&entry, "%s: %s\n", msg.Role, msg.Content.String())
+		for _, call := range msg.ToolCalls {
+			if call.Function != nil {
+				fmt.Fprintf(&entry, "%s called %s(%s)\n", msg.Role, call.Function.Name, call.Function.Arguments)
+			}
+		}
+		entry.WriteString("\n")
+
+		tokens := CountTokens(entry.String())
+		if tokens > budget {
+			break
+		}
+		budget -= tokens
+		entries = append([]string{entry.String()}, entries...)
+	}
+	if len(entries) == 0 {
+		return "", fmt.Errorf("dropped messages exceed CONTEXT_SUMMARY_MAX_INPUT_TOKENS")
+	}
+
+	summaryReq := &types.ZaiRequest{
+		Model:  model,
+		Stream: true,
+		ChatID: utils.GenerateID(),
+		ID:     utils.GenerateID(),
+		Messages: []types.Message{
+			{Role: "system", Content: types.TextContent(summaryPrompt)},
+			{Role: "user", Content: types.TextContent(strings.Join(entries, ""))},
+		},
+		MaxTokens: cfg.Context.SummaryMaxTokens,
+		Features:  map[string]interface{}{"enable_thinking": false},
+	}
+
+	// The side call is not part of the request's transcript
+	resp, err := SendChatRequest(transcript.WithRecorder(ctx, nil), summaryReq)
+	if err != nil {
+		return "", fmt.Errorf("failed to request summary: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Reasoning is kept apart so that only the answer becomes the summary
+	var summary, output strings.Builder
+	formatter := NewResponseFormatter("reasoning")
+	collect := func(deltas []Delta) {
+		for _, delta := range deltas {
+			output.WriteString(delta.Text)
+			if delta.Kind == DeltaText {
+				summary.WriteString(delta.Text)
+			}
+		}
+	}
+	defer func() {
+		RequestInfoFromContext(ctx).AddSideUsage(EstimatePromptTokens(summaryReq), CountTokens(output.String()))
+	}()
+	for event := range ParseSSEStream(resp) {
+		if event.Err != nil {
+			return "", fmt.Errorf("failed to read summary: %w", event.Err)
+		}
+		collect(formatter.Format(event.Response))
+	}
+	collect(formatter.Flush())
+
+	text := strings.TrimSpace(summary.String())
+	if text == "" {
+		return "", fmt.Errorf("summary is empty")
+	}
+	return text, nil
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/fakezai"
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+func TestContextLimitSources(t *testing.T) {
+	resetUpstream(t)
+	fake.Queue(fakezai.PathModels, fakezai.JSON(200, `{"data":[
+		{"id":"glm-4.6","name":"GLM-4.6","info":{"is_active":true,"params":{"num_ctx":200000},"meta":{}}},
+		{"id":"0727-360B-API","name":"GLM-4.5","info":{"is_active":true,"meta":{"context_length":131072}}}
+	]}`))
+	cfg := config.GetConfig()
+	saved := cfg.Context
+	defer func() { cfg.Context = saved }()
+	cfg.Context.DefaultLimit = 32000
+	cfg.Context.Limits = map[string]int{"0727-360B-API": 64000}
+
+	models, err := GetModelsService().GetModels(context.Background())
+	if err != nil {
+		t.Fatalf("GetModels: %v", err)
+	}
+	for model, want := range map[string]int{
+		"glm-4.6":       200000, // upstream params
+		"0727-360B-API": 64000,  // CONTEXT_LIMITS wins over metadata
+		"unknown":       32000,  // CONTEXT_DEFAULT_LIMIT
+	} {
+		if got := contextLimit(models, model); got != want {
+			t.Errorf("contextLimit(%s) = %d, want %d", model, got, want)
+		}
+	}
+}
+
+func TestFormatRequestFetchesModelsOnce(t *testing.T) {
+	resetUpstream(t)
+	cfg := config.GetConfig()
+	saved := cfg.Context
+	defer func() { cfg.Context = saved }()
+	cfg.Context.SummaryModel = "glm-4.6"
+
+	// With /models failing, the request still makes a single retried fetch
+	attempts := cfg.Retry.Models.MaxAttempts
+	for i := 0; i < 3*attempts; i++ {
+		fake.Queue(fakezai.PathModels, fakezai.JSON(503, `{"detail":"busy"}`))
+	}
+	req := &types.ChatRequest{Model: "glm-4.6", Messages: []types.Message{textMessage("user", "Hi")}}
+	if _, err := FormatOpenAIRequest(context.Background(), req, "chat-1"); err != nil {
+		t.Fatalf("FormatOpenAIRequest: %v", err)
+	}
+	if n := len(fake.Requests(fakezai.PathModels)); n != attempts {
+		t.Errorf("got %d models requests, want %d", n, attempts)
+	}
+}
+
+func TestContextTurnsKeepToolResults(t *testing.T) {
+	messages := []types.Message{
+		{Role: "system"},
+		{Role: "assistant"},
+		{Role: "user"},
+		{Role: "assistant", ToolCalls: []types.ToolCall{{ID: "call_1"}}},
+		{Role: "tool", ToolCallID: "call_1"},
+		{Role: "system"},
+		{Role: "user"},
+	}
+	want := []int{-1, 0, 1, 1, 1, -1, 2}
+	if got := contextTurns(messages); !reflect.DeepEqual(got, want) {
+		t.Errorf("contextTurns = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,33 @@
+package services
+
+import (
+	"context"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+)
+
+type credentialsKey struct{}
+
+// Credentials identifies the caller of a proxied request
+type Credentials struct {
+	// KeyID is the ID of the proxy API key used, empty when auth is disabled
+	KeyID string
+	// UpstreamToken is the Z.ai token to use instead of the configured one
+	UpstreamToken string
+}
+
+// WithCredentials returns a context carrying the caller's credentials
+func WithCredentials(ctx context.Context, creds Credentials) context.Context {
+	return context.WithValue(ctx, credentialsKey{}, creds)
+}
+
+// CredentialsFromContext returns the caller's credentials, if any
+func CredentialsFromContext(ctx context.Context) Credentials {
+	creds, _ := ctx.Value(credentialsKey{}).(Credentials)
+	return creds
+}
+
+// isAnonymous reports whether a request will be served with a guest identity
+func isAnonymous(ctx context.Context) bool {
+	return CredentialsFromContext(ctx).UpstreamToken == "" && config.GetConfig().API.Anonymous
+}
@@ -0,0 +1,244 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"strings"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+// OpenAI and Anthropic message roles accepted from clients
+var (
+	openAIRoles    = []string{"system", "developer", "user", "assistant", "tool", "function"}
+	anthropicRoles = []string{"user", "assistant"}
+)
+
+// Content block types translated for Z.ai, others are dropped unless UNKNOWN_FIELDS=reject
+var (
+	openAIContentTypes    = []string{"text", "image_url", "file"}
+	anthropicContentTypes = []string{"text", "image", "document", "tool_use", "tool_result", "thinking", "redacted_thinking"}
+)
+
+// documentSources are the Anthropic document source types
+var documentSources = []string{"base64", "text", "url", "content", "file"}
+
+// imageDetails are the OpenAI image_url detail levels
+var imageDetails = []string{"", "auto", "low", "high"}
+
+// DecodeRequest decodes a client request body into v
+//
+// With UNKNOWN_FIELDS=reject, fields that v does not declare fail the
+// request; otherwise they are dropped. Malformed JSON and values of the
+// wrong type are returned as invalid_request errors naming the field.
+func DecodeRequest(body io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(body)
+	if rejectUnknown() {
+		decoder.DisallowUnknownFields()
+	}
+
+	if err := decoder.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	return nil
+}
+
+// decodeError converts a JSON decoding error into a client error
+func decodeError(err error) *APIError {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		// Errors from custom unmarshalers carry no field path
+		message := fmt.Sprintf("Invalid type: expected %s, but got %s", describeType(typeErr.Type), typeErr.Value)
+		if typeErr.Field != "" {
+			message = fmt.Sprintf("Invalid type for '%s': expected %s, but got %s", typeErr.Field, describeType(typeErr.Type), typeErr.Value)
+		}
+		return &APIError{Kind: ErrInvalidRequest, Message: message, Param: typeErr.Field, Err: err}
+	}
+
+	// encoding/json has no typed error for unknown fields
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field = strings.Trim(field, `"`)
+		return &APIError{
+			Kind:    ErrInvalidRequest,
+			Message: fmt.Sprintf("Unrecognized request argument supplied: %s", field),
+			Param:   field,
+			Err:     err,
+		}
+	}
+
+	return &APIError{Kind: ErrInvalidRequest, Message: "Invalid JSON: " + err.Error(), Err: err}
+}
+
+// describeType names the JSON type expected for a Go type
+func describeType(t reflect.Type) string {
+	if t == reflect.TypeOf(types.MessageContent{}) {
+		return "a string or an array of content blocks"
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return describeType(t.Elem())
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Interface:
+		return "a value"
+	default:
+		return "a number"
+	}
+}
+
+// InvalidParam returns an invalid_request error for a request parameter
+func InvalidParam(param, format string, args ...interface{}) *APIError {
+	return &APIError{Kind: ErrInvalidRequest, Message: fmt.Sprintf(format, args...), Param: param}
+}
+
+// validateChatRequest checks an OpenAI request before it is translated
+func validateChatRequest(req *types.ChatRequest) error {
+	if len(req.Messages) == 0 {
+		return InvalidParam("messages", "messages must contain at least one message")
+	}
+	if req.MaxTokens < 0 || req.MaxCompletionTokens < 0 {
+		return InvalidParam("max_tokens", "max_tokens must not be negative")
+	}
+	if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > 2) {
+		return InvalidParam("temperature", "temperature must be between 0 and 2")
+	}
+	if req.TopP != nil && (*req.TopP < 0 || *req.TopP > 1) {
+		return InvalidParam("top_p", "top_p must be between 0 and 1")
+	}
+
+	for i, msg := range req.Messages {
+		param := fmt.Sprintf("messages[%d]", i)
+		if !contains(openAIRoles, msg.Role) {
+			return InvalidParam(param+".role", "Invalid role %q, expected one of %s", msg.Role, strings.Join(openAIRoles, ", "))
+		}
+		if msg.Role == "tool" && msg.ToolCallID == "" {
+			return InvalidParam(param+".tool_call_id", "tool messages must have a tool_call_id")
+		}
+		for j, block := range msg.Content.Blocks {
+			blockParam := fmt.Sprintf("%s.content[%d]", param, j)
+			if !contains(openAIContentTypes, block.Type) {
+				if rejectUnknown() {
+					return InvalidParam(blockParam+".type", "Unsupported content part type %q, expected one of %s", block.Type, strings.Join(openAIContentTypes, ", "))
+				}
+				continue
+			}
+			if block.Type == "image_url" && (block.ImageURL == nil || block.ImageURL.URL == "") {
+				return InvalidParam(blockParam+".image_url.url", "image_url parts must have a url")
+			}
+			if block.Type == "image_url" && !contains(imageDetails, block.ImageURL.Detail) {
+				return InvalidParam(blockParam+".image_url.detail", "Unsupported image detail %q, expected auto, low or high", block.ImageURL.Detail)
+			}
+			if block.Type == "file" && (block.File == nil || (block.File.FileData == "" && block.File.FileID == "")) {
+				return InvalidParam(blockParam+".file", "file parts must have file_data or a file_id")
+			}
+		}
+		for j, call := range msg.ToolCalls {
+			if call.Function == nil || call.Function.Name == "" {
+				return InvalidParam(fmt.Sprintf("%s.tool_calls[%d].function.name", param, j), "tool calls must have a function name")
+			}
+		}
+		dropUnsupportedBlocks(&req.Messages[i].Content, openAIContentTypes, param+".content")
+	}
+
+	for i, tool := range req.Tools {
+		if tool.Function == nil || tool.Function.Name == "" {
+			return InvalidParam(fmt.Sprintf("tools[%d].function.name", i), "tools must have a function name")
+		}
+	}
+	return nil
+}
+
+// validateAnthropicRequest checks an Anthropic request before it is translated
+func validateAnthropicRequest(req *types.AnthropicMessageRequest) error {
+	if len(req.Messages) == 0 {
+		return InvalidParam("messages", "messages: at least one message is required")
+	}
+	if req.MaxTokens < 0 {
+		return InvalidParam("max_tokens", "max_tokens: must be greater than or equal to 1")
+	}
+	if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > 1) {
+		return InvalidParam("temperature", "temperature: must be between 0 and 1")
+	}
+	if req.TopP != nil && (*req.TopP < 0 || *req.TopP > 1) {
+		return InvalidParam("top_p", "top_p: must be between 0 and 1")
+	}
+
+	for i, msg := range req.Messages {
+		param := fmt.Sprintf("messages.%d", i)
+		if !contains(anthropicRoles, msg.Role) {
+			return InvalidParam(param+".role", "%s.role: Input should be 'user' or 'assistant'", param)
+		}
+		for j, block := range msg.Content.Blocks {
+			blockParam := fmt.Sprintf("%s.content.%d", param, j)
+			if !contains(anthropicContentTypes, block.Type) {
+				if rejectUnknown() {
+					return InvalidParam(blockParam+".type", "%s.type: unsupported content block type %q", blockParam, block.Type)
+				}
+				continue
+			}
+			if block.Type == "image" && (block.Source == nil || (block.Source.Data == "" && block.Source.URL == "" && block.Source.FileID == "")) {
+				return InvalidParam(blockParam+".source", "%s.source: image blocks must have base64 data, a url or a file_id", blockParam)
+			}
+			if block.Type == "document" && (block.Source == nil || !contains(documentSources, block.Source.Type)) {
+				return InvalidParam(blockParam+".source", "%s.source: document sources must be of type base64, text, url, content or file", blockParam)
+			}
+			if block.Source != nil && block.Source.Type == "file" && block.Source.FileID == "" {
+				return InvalidParam(blockParam+".source.file_id", "%s.source.file_id: Field required", blockParam)
+			}
+			if block.Type == "tool_use" && block.Name == "" {
+				return InvalidParam(blockParam+".name", "%s.name: Field required", blockParam)
+			}
+			if block.Type == "tool_result" && block.ToolUseID == "" {
+				return InvalidParam(blockParam+".tool_use_id", "%s.tool_use_id: Field required", blockParam)
+			}
+		}
+		dropUnsupportedBlocks(&req.Messages[i].Content, anthropicContentTypes, param+".content")
+	}
+
+	for i, tool := range req.Tools {
+		if tool.Name == "" {
+			return InvalidParam(fmt.Sprintf("tools.%d.name", i), "tools.%d.name: Field required", i)
+		}
+	}
+	return nil
+}
+
+// rejectUnknown reports whether unknown fields and content types fail requests
+func rejectUnknown() bool {
+	return config.GetConfig().API.UnknownFields == "reject"
+}
+
+// dropUnsupportedBlocks removes content blocks of types that have no Z.ai equivalent
+func dropUnsupportedBlocks(content *types.MessageContent, supported []string, param string) {
+	kept := []types.ContentBlock{}
+	for j, block := range content.Blocks {
+		if contains(supported, block.Type) {
+			kept = append(kept, block)
+			continue
+		}
+		slog.Debug("Dropped unsupported content block", "param", param, "index", j, "type", block.Type)
+	}
+	if len(kept) < len(content.Blocks) {
+		content.Blocks = kept
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
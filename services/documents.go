@@ -0,0 +1,266 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/metrics"
+	"github.com/Tyler-Dinh/z2api-go/types"
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+// documentTypes maps the document media types accepted from clients to file extensions
+var documentTypes = map[string]string{
+	"application/pdf":    ".pdf",
+	"application/msword": ".doc",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": ".docx",
+	"application/vnd.ms-excel": ".xls",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         ".xlsx",
+	"application/vnd.ms-powerpoint":                                             ".ppt",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": ".pptx",
+	"text/plain":       ".txt",
+	"text/csv":         ".csv",
+	"text/markdown":    ".md",
+	"text/html":        ".html",
+	"application/json": ".json",
+	"application/xml":  ".xml",
+}
+
+// pdfPageTokens estimates the prompt tokens of one PDF page, text and rendering included
+const pdfPageTokens = 1500
+
+// pdfPage matches page objects, but not the page tree, of a PDF
+var pdfPage = regexp.MustCompile(`/Type\s*/Page\b`)
+
+// documentEndTag matches closing document tags in an inlined document, which could end its wrapper early
+var documentEndTag = regexp.MustCompile(`(?i)</\s*document`)
+
+var documentUploads = metrics.NewCounterVec(
+	"z2api_document_uploads_total",
+	"Documents sent by clients, by whether they were inlined, uploaded or served from the upload cache",
+	"result",
+)
+
+// documentData is a validated document
+type documentData struct {
+	Data      []byte
+	MediaType string
+	Name      string
+}
+
+// formatDocument converts an OpenAI file part or Anthropic document block for Z.ai
+//
+// Text documents up to DOCUMENT_INLINE_MAX_BYTES are returned as message
+// text. Other documents are uploaded, once per upstream user while they
+// stay in the upload cache, and returned as a file reference for the
+// request; uploads need an upstream token, so anonymous mode only supports
+// inline documents.
+func formatDocument(ctx context.Context, block types.ContentBlock, chatID string) (string, *types.ZaiFile, error) {
+	doc, err := loadDocument(ctx, block)
+	if err != nil {
+		return "", nil, err
+	}
+	return documentContent(ctx, doc, block.Context, chatID)
+}
+
+// documentContent inlines a validated text document or uploads the document, reusing an earlier upload of the same content
+func documentContent(ctx context.Context, doc *documentData, docContext, chatID string) (string, *types.ZaiFile, error) {
+	cfg := config.GetConfig()
+
+	if isTextDocument(doc.MediaType) && len(doc.Data) <= cfg.Documents.InlineMaxBytes {
+		documentUploads.Inc("inlined")
+		return inlineDocument(doc, docContext), nil, nil
+	}
+
+	if isAnonymous(ctx) {
+		return "", nil, NewAPIError(ErrInvalidRequest, fmt.Sprintf("Document %s cannot be uploaded in anonymous mode, only text documents up to %d bytes are supported", doc.Name, cfg.Documents.InlineMaxBytes))
+	}
+
+	user, err := GetUserService().GetUser(ctx)
+	if err != nil {
+		return "", nil, upstreamTransportError(fmt.Errorf("failed to get user info: %w", err))
+	}
+
+	file := &types.ZaiFile{
+		Type:   "file",
+		Name:   doc.Name,
+		Status: "uploaded",
+		Size:   len(doc.Data),
+		Media:  "file",
+		Tokens: estimateDocumentTokens(doc),
+	}
+
+	// Identical content is only uploaded once per upstream user
+	sum := sha256.Sum256(doc.Data)
+	cacheKey := user.ID + ":" + hex.EncodeToString(sum[:]) + ":document"
+	uploads := GetUploadCache()
+	if fileID, ok := uploads.Get(cacheKey); ok {
+		documentUploads.Inc("cached")
+		file.ID, file.URL = fileID, "/api/v1/files/"+fileID+"/content"
+		return "", file, nil
+	}
+
+	result, err := uploadFile(ctx, doc.Data, doc.MediaType, doc.Name, chatID)
+	if err != nil {
+		return "", nil, err
+	}
+	documentUploads.Inc("uploaded")
+	uploads.Put(cacheKey, result.ID)
+	file.ID, file.URL = result.ID, "/api/v1/files/"+result.ID+"/content"
+	return "", file, nil
+}
+
+// loadDocument reads the content of a document block and validates it
+func loadDocument(ctx context.Context, block types.ContentBlock) (*documentData, error) {
+	cfg := config.GetConfig()
+	maxBytes := cfg.Documents.MaxBytes
+	doc := &documentData{Name: block.Title}
+
+	var err error
+	switch {
+	case block.Type == "file":
+		doc.Name = block.File.Filename
+		if strings.HasPrefix(block.File.FileData, "data:") {
+			doc.Data, doc.MediaType, err = decodeDataURL(block.File.FileData, "document", maxBytes)
+		} else {
+			doc.Data, err = decodeBase64(block.File.FileData, "document", maxBytes)
+		}
+	case block.Source.Type == "base64":
+		doc.MediaType = block.Source.MediaType
+		doc.Data, err = decodeBase64(block.Source.Data, "document", maxBytes)
+	case block.Source.Type == "text":
+		doc.MediaType = block.Source.MediaType
+		if doc.MediaType == "" {
+			doc.MediaType = "text/plain"
+		}
+		doc.Data = []byte(block.Source.Data)
+		if int64(len(doc.Data)) > maxBytes {
+			err = tooLarge("document", maxBytes)
+		}
+	case block.Source.Type == "content":
+		texts := []string{}
+		if block.Source.Content != nil {
+			if !block.Source.Content.IsBlocks() {
+				texts = append(texts, block.Source.Content.Text)
+			}
+			for _, part := range block.Source.Content.Blocks {
+				if part.Type == "text" {
+					texts = append(texts, part.Text)
+				}
+			}
+		}
+		doc.MediaType = "text/plain"
+		doc.Data = []byte(strings.Join(texts, "\n\n"))
+		if int64(len(doc.Data)) > maxBytes {
+			err = tooLarge("document", maxBytes)
+		}
+	case block.Source.Type == "url":
+		if !cfg.Images.FetchRemote {
+			return nil, NewAPIError(ErrInvalidRequest, "Remote document URLs are disabled, send the document as base64 data")
+		}
+		doc.Data, doc.MediaType, err = fetchRemote(ctx, block.Source.URL, "document", "application/pdf, text/*;q=0.9, */*;q=0.5", maxBytes)
+		if doc.Name == "" {
+			doc.Name = path.Base(strings.SplitN(block.Source.URL, "?", 2)[0])
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateDocument(doc); err != nil {
+		return nil, err
+	}
+	if doc.Name == "" || doc.Name == "." || doc.Name == "/" {
+		doc.Name = "document"
+	}
+	if path.Ext(doc.Name) == "" {
+		doc.Name += documentTypes[doc.MediaType]
+	}
+	return doc, nil
+}
+
+// validateDocument resolves the media type of a document and checks its content
+//
+// Without a usable declared type, the file name extension and then the
+// content decide.
+func validateDocument(doc *documentData) error {
+	mediaType, _, _ := strings.Cut(strings.ToLower(doc.MediaType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	if mediaType == "" || mediaType == "application/octet-stream" {
+		mediaType = documentTypeByName(doc.Name)
+	}
+	if mediaType == "" {
+		mediaType, _, _ = strings.Cut(http.DetectContentType(doc.Data), ";")
+	}
+	if mediaType == "text/xml" {
+		mediaType = "application/xml"
+	}
+
+	if _, ok := documentTypes[mediaType]; !ok {
+		return NewAPIError(ErrInvalidRequest, fmt.Sprintf("Unsupported document type %s, expected PDF, Office or text documents", mediaType))
+	}
+	if mediaType == "application/pdf" && !bytes.HasPrefix(doc.Data, []byte("%PDF-")) {
+		return NewAPIError(ErrInvalidRequest, "Document is not a valid PDF")
+	}
+	if isTextDocument(mediaType) && !utf8.Valid(doc.Data) {
+		return NewAPIError(ErrInvalidRequest, fmt.Sprintf("Text document of type %s is not valid UTF-8", mediaType))
+	}
+	doc.MediaType = mediaType
+	return nil
+}
+
+// documentTypeByName returns the media type for a file name's extension, or ""
+func documentTypeByName(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == "" {
+		return ""
+	}
+	for mediaType, typeExt := range documentTypes {
+		if typeExt == ext {
+			return mediaType
+		}
+	}
+	return ""
+}
+
+// isTextDocument reports whether documents of a media type are plain text
+func isTextDocument(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || mediaType == "application/xml"
+}
+
+// inlineDocument wraps a text document for inclusion in the message text
+func inlineDocument(doc *documentData, docContext string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<document name=\"%s\">\n", html.EscapeString(doc.Name))
+	if docContext != "" {
+		fmt.Fprintf(&b, "<context>%s</context>\n", html.EscapeString(docContext))
+	}
+	b.Write(documentEndTag.ReplaceAllFunc(bytes.TrimRight(doc.Data, "\n"), func(tag []byte) []byte {
+		return append([]byte("&lt;"), tag[1:]...)
+	}))
+	b.WriteString("\n</document>")
+	return b.String()
+}
+
+// estimateDocumentTokens estimates the prompt tokens of an uploaded document
+func estimateDocumentTokens(doc *documentData) int {
+	switch {
+	case isTextDocument(doc.MediaType):
+		return utils.CountTokens(string(doc.Data))
+	case doc.MediaType == "application/pdf":
+		return max(1, len(pdfPage.FindAllIndex(doc.Data, -1))) * pdfPageTokens
+	default:
+		// Office documents are compressed, so this leans high
+		return len(doc.Data) / 4
+	}
+}
@@ -0,0 +1,359 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+// ErrorKind classifies an error independently of the client dialect
+type ErrorKind string
+
+const (
+	ErrInvalidRequest ErrorKind = "invalid_request"
+	ErrAuthentication ErrorKind = "authentication"
+	ErrPermission     ErrorKind = "permission"
+	ErrNotFound       ErrorKind = "not_found"
+	ErrMethodNotAllow ErrorKind = "method_not_allowed"
+	ErrRateLimit      ErrorKind = "rate_limit"
+	ErrQuotaExceeded  ErrorKind = "quota_exceeded"
+	ErrOverloaded     ErrorKind = "overloaded"
+	ErrContentFilter  ErrorKind = "content_filter"
+	ErrTimeout        ErrorKind = "timeout"
+	ErrUpstream       ErrorKind = "upstream"
+	ErrInternal       ErrorKind = "internal"
+)
+
+// Dialect names used to render errors and responses
+const (
+	DialectOpenAI    = "OpenAI"
+	DialectAnthropic = "Anthropic"
+)
+
+// APIError is an error that knows how to present itself to API clients
+type APIError struct {
+	Kind    ErrorKind
+	Message string
+	Param   string
+	Code    string
+	// Err is the underlying cause, if any
+	Err error
+}
+
+// NewAPIError creates an APIError of the given kind
+func NewAPIError(kind ErrorKind, message string) *APIError {
+	return &APIError{Kind: kind, Message: message}
+}
+
+// Error implements the error interface
+func (e *APIError) Error() string {
+	if e.Err != nil && e.Err.Error() != e.Message {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+// Unwrap returns the underlying cause
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// StatusCode returns the HTTP status code a client of the given dialect expects
+func (e *APIError) StatusCode(dialect string) int {
+	switch e.Kind {
+	case ErrInvalidRequest, ErrContentFilter:
+		return http.StatusBadRequest
+	case ErrAuthentication:
+		return http.StatusUnauthorized
+	case ErrPermission:
+		return http.StatusForbidden
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrMethodNotAllow:
+		return http.StatusMethodNotAllowed
+	case ErrRateLimit, ErrQuotaExceeded:
+		return http.StatusTooManyRequests
+	case ErrOverloaded:
+		if dialect == DialectAnthropic {
+			return 529
+		}
+		return http.StatusServiceUnavailable
+	case ErrTimeout:
+		return http.StatusGatewayTimeout
+	case ErrUpstream:
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// OpenAIBody renders the error in the OpenAI error format
+func (e *APIError) OpenAIBody() types.OpenAIErrorResponse {
+	body := types.OpenAIErrorResponse{
+		Error: types.OpenAIError{Message: e.Message},
+	}
+	if e.Param != "" {
+		body.Error.Param = &e.Param
+	}
+
+	code := e.Code
+	switch e.Kind {
+	case ErrInvalidRequest, ErrNotFound, ErrMethodNotAllow:
+		body.Error.Type = "invalid_request_error"
+	case ErrContentFilter:
+		body.Error.Type = "invalid_request_error"
+		if code == "" {
+			code = "content_filter"
+		}
+	case ErrAuthentication:
+		body.Error.Type = "authentication_error"
+		if code == "" {
+			code = "invalid_api_key"
+		}
+	case ErrPermission:
+		body.Error.Type = "permission_error"
+	case ErrRateLimit:
+		body.Error.Type = "rate_limit_error"
+		if code == "" {
+			code = "rate_limit_exceeded"
+		}
+	case ErrQuotaExceeded:
+		body.Error.Type = "insufficient_quota"
+		if code == "" {
+			code = "insufficient_quota"
+		}
+	case ErrOverloaded:
+		body.Error.Type = "server_error"
+		if code == "" {
+			code = "server_overloaded"
+		}
+	case ErrTimeout:
+		body.Error.Type = "server_error"
+		if code == "" {
+			code = "timeout"
+		}
+	default:
+		body.Error.Type = "server_error"
+	}
+	if code != "" {
+		body.Error.Code = &code
+	}
+
+	return body
+}
+
+// AnthropicBody renders the error in the Anthropic error format
+func (e *APIError) AnthropicBody() types.AnthropicErrorResponse {
+	errType := "api_error"
+	switch e.Kind {
+	case ErrInvalidRequest, ErrContentFilter, ErrMethodNotAllow:
+		errType = "invalid_request_error"
+	case ErrAuthentication:
+		errType = "authentication_error"
+	case ErrPermission:
+		errType = "permission_error"
+	case ErrNotFound:
+		errType = "not_found_error"
+	case ErrRateLimit, ErrQuotaExceeded:
+		errType = "rate_limit_error"
+	case ErrOverloaded:
+		errType = "overloaded_error"
+	case ErrTimeout:
+		errType = "timeout_error"
+	}
+
+	return types.AnthropicErrorResponse{
+		Type: "error",
+		Error: types.AnthropicError{
+			Type:    errType,
+			Message: e.Message,
+		},
+	}
+}
+
+// Body renders the error for the given dialect
+func (e *APIError) Body(dialect string) interface{} {
+	if dialect == DialectAnthropic {
+		return e.AnthropicBody()
+	}
+	return e.OpenAIBody()
+}
+
+// AsAPIError converts any error into an APIError, classifying transport failures
+func AsAPIError(err error) *APIError {
+	if err == nil {
+		return nil
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var zaiErr *types.ZaiError
+	if errors.As(err, &zaiErr) {
+		return ClassifyZaiError(zaiErr)
+	}
+
+	if errors.Is(err, ErrEventTooLarge) {
+		return &APIError{Kind: ErrUpstream, Message: "Upstream event exceeded the maximum size", Err: err}
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &APIError{Kind: ErrTimeout, Message: "Upstream request timed out", Err: err}
+	}
+
+	// Internal errors may name upstream URLs or local paths, so only logs see them
+	return &APIError{Kind: ErrInternal, Message: "Internal server error", Err: err}
+}
+
+// ClassifyUpstreamResponse reads a failed upstream response and classifies it
+func ClassifyUpstreamResponse(resp *http.Response) *APIError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	return ClassifyUpstreamError(resp.StatusCode, body)
+}
+
+// ClassifyUpstreamError classifies an upstream HTTP status and body
+func ClassifyUpstreamError(status int, body []byte) *APIError {
+	detail := upstreamErrorDetail(body)
+	message := fmt.Sprintf("Z.ai API error (status %d)", status)
+	if detail != "" {
+		message = fmt.Sprintf("Z.ai API error (status %d): %s", status, detail)
+	}
+
+	apiErr := &APIError{Message: message}
+
+	switch {
+	case isContentFilterMessage(detail):
+		apiErr.Kind = ErrContentFilter
+	case status == http.StatusUnauthorized:
+		apiErr.Kind = ErrAuthentication
+	case status == http.StatusForbidden:
+		apiErr.Kind = ErrPermission
+	case status == http.StatusNotFound:
+		apiErr.Kind = ErrNotFound
+	case status == http.StatusTooManyRequests:
+		apiErr.Kind = ErrRateLimit
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		apiErr.Kind = ErrTimeout
+	case status == http.StatusServiceUnavailable || status == 529:
+		apiErr.Kind = ErrOverloaded
+	case status >= 400 && status < 500:
+		apiErr.Kind = ErrInvalidRequest
+	default:
+		apiErr.Kind = ErrUpstream
+	}
+
+	return apiErr
+}
+
+// ClassifyZaiError classifies an error payload sent inside the Z.ai stream
+func ClassifyZaiError(zaiErr *types.ZaiError) *APIError {
+	apiErr := &APIError{Kind: ErrUpstream, Message: zaiErr.Error(), Err: zaiErr}
+
+	code := strings.ToLower(fmt.Sprint(zaiErr.Code))
+	switch {
+	case isContentFilterMessage(zaiErr.Detail) || isContentFilterMessage(zaiErr.Message) || code == "1301":
+		apiErr.Kind = ErrContentFilter
+	case code == "401" || code == "1000" || code == "1001" || code == "1002":
+		apiErr.Kind = ErrAuthentication
+	case code == "429" || code == "1302" || code == "1303":
+		apiErr.Kind = ErrRateLimit
+	case code == "1305" || code == "503":
+		apiErr.Kind = ErrOverloaded
+	case code == "1261":
+		apiErr.Kind = ErrInvalidRequest
+		apiErr.Code = "context_length_exceeded"
+	}
+
+	return apiErr
+}
+
+// upstreamErrorDetail extracts a human readable message from an upstream error body
+func upstreamErrorDetail(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	var payload struct {
+		Detail  interface{}     `json:"detail"`
+		Message string          `json:"message"`
+		Error   json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil {
+		if s, ok := payload.Detail.(string); ok && s != "" {
+			return s
+		}
+		if payload.Message != "" {
+			return payload.Message
+		}
+		if len(payload.Error) > 0 {
+			var zaiErr types.ZaiError
+			if err := json.Unmarshal(payload.Error, &zaiErr); err == nil {
+				if zaiErr.Detail != "" {
+					return zaiErr.Detail
+				}
+				if zaiErr.Message != "" {
+					return zaiErr.Message
+				}
+			}
+			var s string
+			if err := json.Unmarshal(payload.Error, &s); err == nil {
+				return s
+			}
+		}
+	}
+
+	return truncateString(strings.TrimSpace(string(body)), 200)
+}
+
+// isContentFilterMessage reports whether an upstream message indicates moderation
+func isContentFilterMessage(msg string) bool {
+	lower := strings.ToLower(msg)
+	for _, marker := range []string{"sensitive", "content_filter", "content filter", "unsafe", "moderation", "敏感", "违规"} {
+		if strings.Contains(lower, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamTransportError classifies a failure to reach the upstream at all
+func upstreamTransportError(err error) *APIError {
+	apiErr := AsAPIError(err)
+	if apiErr.Kind == ErrInternal {
+		apiErr.Kind = ErrUpstream
+		apiErr.Message = "Failed to reach Z.ai API"
+	}
+	return apiErr
+}
+
+// Write writes the error as a JSON response in the given dialect
+func (e *APIError) Write(w http.ResponseWriter, dialect string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.StatusCode(dialect))
+	json.NewEncoder(w).Encode(e.Body(dialect))
+}
+
+// WriteEvent writes the error as a mid-stream event in the given dialect
+//
+// Anthropic clients get an error event, OpenAI clients an error chunk
+// followed by [DONE] so SDKs stop reading.
+func (e *APIError) WriteEvent(w io.Writer, dialect string) {
+	payload, _ := json.Marshal(e.Body(dialect))
+	if dialect == DialectAnthropic {
+		fmt.Fprintf(w, "event: error\n")
+		fmt.Fprintf(w, "data: %s\n\n", payload)
+		return
+	}
+	fmt.Fprintf(w, "data: %s\n\n", payload)
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+}
@@ -0,0 +1,398 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/types"
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+// fileCleanupInterval is how often expired files are removed
+const fileCleanupInterval = 10 * time.Minute
+
+// StoredFile is a file uploaded through the Files API
+type StoredFile struct {
+	types.FileObject
+	// KeyID is the proxy API key that owns the file, empty when auth is disabled
+	KeyID     string `json:"key_id"`
+	MediaType string `json:"media_type"`
+}
+
+// FileStore keeps files uploaded through the Files API
+//
+// Content lives in DATA_DIR/files next to an index of metadata. Files are
+// only visible to the API key that uploaded them and are removed once they
+// expire. The content stays local so chats can reference it with any
+// upstream identity; uploads to Z.ai go through the upload cache.
+type FileStore struct {
+	dir   string
+	mutex sync.Mutex
+	files map[string]*StoredFile
+	// reserved counts uploads in progress per key against FILES_MAX_PER_KEY
+	reserved map[string]int
+}
+
+var (
+	fileStore     *FileStore
+	fileStoreOnce sync.Once
+)
+
+// GetFileStore returns the singleton file store, loading the index and starting cleanup
+func GetFileStore() *FileStore {
+	fileStoreOnce.Do(func() {
+		fileStore = &FileStore{
+			dir:      filepath.Join(config.GetConfig().Storage.DataDir, "files"),
+			files:    make(map[string]*StoredFile),
+			reserved: make(map[string]int),
+		}
+		if err := fileStore.load(); err != nil {
+			slog.Warn("Failed to load files", "error", err)
+		}
+		fileStore.Cleanup()
+
+		go func() {
+			for range time.Tick(fileCleanupInterval) {
+				fileStore.Cleanup()
+			}
+		}()
+	})
+	return fileStore
+}
+
+// Create validates and stores a file for the caller's API key
+//
+// Unless running anonymously, the file is also uploaded to Z.ai right away,
+// so upstream rejections surface here and the first chat that references
+// it finds the upload cached.
+func (s *FileStore) Create(ctx context.Context, filename, purpose string, data []byte) (*StoredFile, error) {
+	cfg := config.GetConfig()
+	keyID := CredentialsFromContext(ctx).KeyID
+
+	if err := s.reserve(keyID, cfg.Files.MaxPerKey); err != nil {
+		return nil, err
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			s.mutex.Lock()
+			s.release(keyID)
+			s.mutex.Unlock()
+		}
+	}()
+
+	// Images and documents are validated like inline content
+	var mediaType string
+	if imageType := http.DetectContentType(data); imageExtensions[imageType] != "" {
+		if int64(len(data)) > cfg.Images.MaxBytes {
+			return nil, tooLarge("image", cfg.Images.MaxBytes)
+		}
+		mediaType = imageType
+		if !isAnonymous(ctx) {
+			if _, err := uploadImage(ctx, &imageData{Data: data, MimeType: mediaType}, "", ""); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		if int64(len(data)) > cfg.Documents.MaxBytes {
+			return nil, tooLarge("document", cfg.Documents.MaxBytes)
+		}
+		doc := &documentData{Data: data, Name: filename}
+		if err := validateDocument(doc); err != nil {
+			return nil, err
+		}
+		mediaType = doc.MediaType
+		if !isAnonymous(ctx) {
+			if _, _, err := documentContent(ctx, doc, "", ""); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	now := time.Now()
+	file := &StoredFile{
+		FileObject: types.FileObject{
+			ID:        newFileID(),
+			Object:    "file",
+			Bytes:     len(data),
+			CreatedAt: now.Unix(),
+			Filename:  filename,
+			Purpose:   purpose,
+			Status:    "processed",
+		},
+		KeyID:     keyID,
+		MediaType: mediaType,
+	}
+	if cfg.Files.TTL > 0 {
+		file.ExpiresAt = now.Add(cfg.Files.TTL).Unix()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create files directory: %w", err)
+	}
+	if err := os.WriteFile(s.contentPath(file.ID), data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write file: %w", err)
+	}
+	s.files[file.ID] = file
+	if err := s.save(); err != nil {
+		delete(s.files, file.ID)
+		os.Remove(s.contentPath(file.ID))
+		return nil, err
+	}
+
+	// The stored file now takes the slot of its reservation
+	s.release(keyID)
+	stored = true
+
+	slog.InfoContext(ctx, "Stored file", "file_id", file.ID, "key_id", keyID, "media_type", mediaType, "bytes", len(data))
+	return file, nil
+}
+
+// reserve claims one of the key's file slots for an upload in progress
+func (s *FileStore) reserve(keyID string, maxPerKey int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if maxPerKey <= 0 {
+		s.reserved[keyID]++
+		return nil
+	}
+	count := s.reserved[keyID]
+	now := time.Now()
+	for _, file := range s.files {
+		if file.KeyID == keyID && !file.expired(now) {
+			count++
+		}
+	}
+	if count >= maxPerKey {
+		return NewAPIError(ErrInvalidRequest, fmt.Sprintf("File limit of %d reached, delete files before uploading more", maxPerKey))
+	}
+	s.reserved[keyID]++
+	return nil
+}
+
+// release returns a slot claimed by reserve; the caller must hold the mutex
+func (s *FileStore) release(keyID string) {
+	if s.reserved[keyID]--; s.reserved[keyID] <= 0 {
+		delete(s.reserved, keyID)
+	}
+}
+
+// Get returns a file owned by the key, unless it has expired
+func (s *FileStore) Get(keyID, id string) (*StoredFile, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	file, ok := s.files[id]
+	if !ok || file.KeyID != keyID || file.expired(time.Now()) {
+		return nil, false
+	}
+	copied := *file
+	return &copied, true
+}
+
+// Open returns a file owned by the caller's API key and its content
+func (s *FileStore) Open(ctx context.Context, id string) (*StoredFile, []byte, error) {
+	noSuchFile := NewAPIError(ErrInvalidRequest, fmt.Sprintf("No such file: %s", id))
+	file, ok := s.Get(CredentialsFromContext(ctx).KeyID, id)
+	if !ok {
+		return nil, nil, noSuchFile
+	}
+
+	// The file may be deleted between the lookup and the read
+	data, err := os.ReadFile(s.contentPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, noSuchFile
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read file %s: %w", id, err)
+	}
+	return file, data, nil
+}
+
+// List returns the unexpired files owned by the key, newest first
+func (s *FileStore) List(keyID string) []StoredFile {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	files := []StoredFile{}
+	for _, file := range s.files {
+		if file.KeyID == keyID && !file.expired(now) {
+			files = append(files, *file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].CreatedAt != files[j].CreatedAt {
+			return files[i].CreatedAt > files[j].CreatedAt
+		}
+		return files[i].ID < files[j].ID
+	})
+	return files
+}
+
+// Delete removes a file owned by the key
+func (s *FileStore) Delete(keyID, id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	file, ok := s.files[id]
+	if !ok || file.KeyID != keyID {
+		return false, nil
+	}
+	delete(s.files, id)
+	if err := s.save(); err != nil {
+		s.files[id] = file
+		return false, err
+	}
+	if err := os.Remove(s.contentPath(id)); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to remove file content", "file_id", id, "error", err)
+	}
+	return true, nil
+}
+
+// Cleanup removes expired files
+func (s *FileStore) Cleanup() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	expired := []string{}
+	for id, file := range s.files {
+		if file.expired(now) {
+			expired = append(expired, id)
+			delete(s.files, id)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	if err := s.save(); err != nil {
+		slog.Warn("Failed to save file index", "error", err)
+	}
+	for _, id := range expired {
+		if err := os.Remove(s.contentPath(id)); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Failed to remove file content", "file_id", id, "error", err)
+		}
+	}
+	slog.Info("Removed expired files", "count", len(expired))
+}
+
+func (f *StoredFile) expired(now time.Time) bool {
+	return f.ExpiresAt > 0 && now.Unix() >= f.ExpiresAt
+}
+
+// contentPath returns where the content of a file is stored
+func (s *FileStore) contentPath(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+// save writes the index; the caller must hold the lock
+func (s *FileStore) save() error {
+	files := make([]*StoredFile, 0, len(s.files))
+	for _, file := range s.files {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ID < files[j].ID
+	})
+
+	data, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, "index.json")
+	if err := utils.WriteFileAtomic(path, data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// load reads the index
+func (s *FileStore) load() error {
+	path := filepath.Join(s.dir, "index.json")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var files []*StoredFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for _, file := range files {
+		s.files[file.ID] = file
+	}
+	slog.Info("Loaded files", "count", len(s.files))
+	return nil
+}
+
+// newFileID returns a random file ID in the OpenAI style
+func newFileID() string {
+	id := make([]byte, 12)
+	rand.Read(id)
+	return "file-" + hex.EncodeToString(id)
+}
+
+// fileReference returns the Files API ID a content block refers to, or ""
+func fileReference(block types.ContentBlock) string {
+	if block.File != nil {
+		return block.File.FileID
+	}
+	if block.Source != nil && block.Source.Type == "file" {
+		return block.Source.FileID
+	}
+	return ""
+}
+
+// formatFileReference converts a content block that refers to a stored file
+//
+// Stored images become an image part, documents are inlined as text or
+// attached like documents sent inline.
+func formatFileReference(ctx context.Context, block types.ContentBlock, id, chatID string) (string, *types.ContentBlock, *types.ZaiFile, error) {
+	file, data, err := GetFileStore().Open(ctx, id)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	if imageExtensions[file.MediaType] != "" {
+		detail := ""
+		if block.ImageURL != nil {
+			detail = block.ImageURL.Detail
+		}
+		ref, err := imageReference(ctx, &imageData{Data: data, MimeType: file.MediaType}, detail, chatID)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		return "", &types.ContentBlock{Type: "image_url", ImageURL: &types.ImageURL{URL: ref}}, nil, nil
+	}
+	if block.Type == "image" {
+		return "", nil, nil, NewAPIError(ErrInvalidRequest, fmt.Sprintf("File %s is not an image", id))
+	}
+
+	name := file.Filename
+	if block.Title != "" {
+		name = block.Title
+	}
+	text, zaiFile, err := documentContent(ctx, &documentData{Data: data, MediaType: file.MediaType, Name: name}, block.Context, chatID)
+	return text, nil, zaiFile, err
+}
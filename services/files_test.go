@@ -0,0 +1,200 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/fakezai"
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+func TestFileStoreScopesFilesByKey(t *testing.T) {
+	resetUpstream(t)
+	store := GetFileStore()
+	alice := WithCredentials(context.Background(), Credentials{KeyID: "files-alice"})
+	bob := WithCredentials(context.Background(), Credentials{KeyID: "files-bob"})
+
+	file, err := store.Create(alice, "notes.txt", "user_data", []byte("Ship on Friday"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if !strings.HasPrefix(file.ID, "file-") || file.Bytes != 14 || file.MediaType != "text/plain" || file.Object != "file" {
+		t.Errorf("created file = %+v", file)
+	}
+
+	if _, ok := store.Get("files-alice", file.ID); !ok {
+		t.Errorf("owner cannot get the file")
+	}
+	if _, ok := store.Get("files-bob", file.ID); ok {
+		t.Errorf("another key can get the file")
+	}
+	if _, _, err := store.Open(bob, file.ID); err == nil {
+		t.Errorf("another key can open the file")
+	}
+	if files := store.List("files-bob"); len(files) != 0 {
+		t.Errorf("another key lists %d files", len(files))
+	}
+	if deleted, _ := store.Delete("files-bob", file.ID); deleted {
+		t.Errorf("another key deleted the file")
+	}
+
+	if files := store.List("files-alice"); len(files) != 1 || files[0].ID != file.ID {
+		t.Errorf("owner lists %+v", files)
+	}
+	if deleted, err := store.Delete("files-alice", file.ID); !deleted || err != nil {
+		t.Fatalf("Delete = %v, %v", deleted, err)
+	}
+	if _, err := os.Stat(store.contentPath(file.ID)); !os.IsNotExist(err) {
+		t.Errorf("content of a deleted file was kept: %v", err)
+	}
+}
+
+func TestFileStoreValidation(t *testing.T) {
+	resetUpstream(t)
+	ctx := WithCredentials(context.Background(), Credentials{KeyID: "files-validation"})
+
+	_, err := GetFileStore().Create(ctx, "tool.exe", "user_data", []byte("MZ\x90\x00\x03\x00\x00\x00"))
+	if apiErr := AsAPIError(err); apiErr.Kind != ErrInvalidRequest || !strings.Contains(apiErr.Message, "Unsupported document type") {
+		t.Errorf("Create(binary) error = %v", err)
+	}
+
+	cfg := config.GetConfig()
+	defer func(limit int) { cfg.Files.MaxPerKey = limit }(cfg.Files.MaxPerKey)
+	cfg.Files.MaxPerKey = 1
+	if _, err := GetFileStore().Create(ctx, "a.txt", "user_data", []byte("a")); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	_, err = GetFileStore().Create(ctx, "b.txt", "user_data", []byte("b"))
+	if apiErr := AsAPIError(err); apiErr.Kind != ErrInvalidRequest || !strings.Contains(apiErr.Message, "File limit of 1") {
+		t.Errorf("Create over the limit error = %v", err)
+	}
+}
+
+func TestFileStoreLimitUnderConcurrency(t *testing.T) {
+	resetUpstream(t)
+	store := GetFileStore()
+	ctx := WithCredentials(context.Background(), Credentials{KeyID: "files-concurrent"})
+	cfg := config.GetConfig()
+	defer func(limit int) { cfg.Files.MaxPerKey = limit }(cfg.Files.MaxPerKey)
+	cfg.Files.MaxPerKey = 3
+
+	var wg sync.WaitGroup
+	var created atomic.Int32
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := store.Create(ctx, fmt.Sprintf("%d.txt", i), "user_data", []byte("note")); err == nil {
+				created.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := created.Load(); n != 3 || len(store.List("files-concurrent")) != 3 {
+		t.Errorf("created %d files and listed %d, want 3", n, len(store.List("files-concurrent")))
+	}
+
+	// A file whose content disappears, as when deleted concurrently, is not found
+	file := store.List("files-concurrent")[0]
+	os.Remove(store.contentPath(file.ID))
+	if _, _, err := store.Open(ctx, file.ID); err == nil || !strings.Contains(AsAPIError(err).Message, "No such file") {
+		t.Errorf("Open of a deleted file = %v, want no such file", err)
+	}
+}
+
+func TestFileStoreCleanupRemovesExpiredFiles(t *testing.T) {
+	resetUpstream(t)
+	store := GetFileStore()
+	ctx := WithCredentials(context.Background(), Credentials{KeyID: "files-expiry"})
+
+	file, err := store.Create(ctx, "old.txt", "user_data", []byte("old"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if file.ExpiresAt == 0 {
+		t.Errorf("file has no expiry with FILES_TTL_MS set")
+	}
+
+	store.mutex.Lock()
+	store.files[file.ID].ExpiresAt = time.Now().Add(-time.Second).Unix()
+	store.mutex.Unlock()
+
+	if _, ok := store.Get("files-expiry", file.ID); ok {
+		t.Errorf("expired file is still returned")
+	}
+	store.Cleanup()
+	if _, err := os.Stat(store.contentPath(file.ID)); !os.IsNotExist(err) {
+		t.Errorf("content of an expired file was kept: %v", err)
+	}
+}
+
+func TestFormatRequestReferencesFiles(t *testing.T) {
+	resetUpstream(t)
+	ctx := WithCredentials(context.Background(), Credentials{KeyID: "files-chat", UpstreamToken: "client-token"})
+	store := GetFileStore()
+
+	image, err := store.Create(ctx, "pixel.png", "vision", pixelPNG)
+	if err != nil {
+		t.Fatalf("Create(image): %v", err)
+	}
+	pdf, err := store.Create(ctx, "report.pdf", "user_data", []byte(twoPagePDF))
+	if err != nil {
+		t.Fatalf("Create(pdf): %v", err)
+	}
+	// Both files are uploaded when they are created
+	if n := len(fake.Requests(fakezai.PathFiles)); n != 2 {
+		t.Fatalf("upstream uploads after Create = %d, want 2", n)
+	}
+
+	var openAIReq types.ChatRequest
+	body := `{"messages":[{"role":"user","content":[
+		{"type":"text","text":"Summarize"},
+		{"type":"file","file":{"file_id":"` + pdf.ID + `"}}
+	]}]}`
+	if err := DecodeRequest(strings.NewReader(body), &openAIReq); err != nil {
+		t.Fatalf("DecodeRequest: %v", err)
+	}
+	zaiReq, err := FormatOpenAIRequest(ctx, &openAIReq, "chat-1")
+	if err != nil {
+		t.Fatalf("FormatOpenAIRequest: %v", err)
+	}
+	if len(zaiReq.Files) != 1 || zaiReq.Files[0].Name != "report.pdf" || zaiReq.Files[0].ID != "fake-file" {
+		t.Errorf("OpenAI files = %+v", zaiReq.Files)
+	}
+
+	var anthropicReq types.AnthropicMessageRequest
+	body = `{"model":"glm-4.6","max_tokens":100,"messages":[{"role":"user","content":[
+		{"type":"image","source":{"type":"file","file_id":"` + image.ID + `"}},
+		{"type":"text","text":"What is this?"}
+	]}]}`
+	if err := DecodeRequest(strings.NewReader(body), &anthropicReq); err != nil {
+		t.Fatalf("DecodeRequest: %v", err)
+	}
+	zaiReq, err = FormatAnthropicRequest(ctx, &anthropicReq, "chat-1")
+	if err != nil {
+		t.Fatalf("FormatAnthropicRequest: %v", err)
+	}
+	blocks := zaiReq.Messages[0].Content.Blocks
+	if len(blocks) != 2 || blocks[0].ImageURL == nil || blocks[0].ImageURL.URL != "fake-file_upload.png" {
+		t.Errorf("Anthropic content = %+v", blocks)
+	}
+
+	// References are served from the upload cache
+	if n := len(fake.Requests(fakezai.PathFiles)); n != 2 {
+		t.Errorf("upstream uploads after chats = %d, want 2", n)
+	}
+
+	// Files of other keys do not exist for this key
+	other := WithCredentials(context.Background(), Credentials{KeyID: "files-other", UpstreamToken: "client-token"})
+	_, err = FormatOpenAIRequest(other, &openAIReq, "chat-1")
+	if apiErr := AsAPIError(err); apiErr.Kind != ErrInvalidRequest || apiErr.Param != "messages[0].content" {
+		t.Errorf("foreign file_id error = %v (param %q)", err, apiErr.Param)
+	}
+}
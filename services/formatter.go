@@ -0,0 +1,451 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+// ThinkModeHeader is the request header selecting the thinking tags mode of one request
+const ThinkModeHeader = "X-Think-Mode"
+
+// RequestThinkMode resolves the thinking tags mode of a request
+//
+// The think_mode request field wins over a ":mode" suffix of the model name,
+// which wins over the X-Think-Mode header; without any, THINK_TAGS_MODE
+// applies. A mode suffix is removed from model.
+func RequestThinkMode(header, field string, model *string) (string, error) {
+	modes := strings.Join(config.ValidThinkModes, ", ")
+	if field != "" && !contains(config.ValidThinkModes, field) {
+		return "", InvalidParam("think_mode", "Unsupported think_mode %q, expected one of %s", field, modes)
+	}
+	if header != "" && !contains(config.ValidThinkModes, header) {
+		return "", NewAPIError(ErrInvalidRequest, fmt.Sprintf("Unsupported %s header %q, expected one of %s", ThinkModeHeader, header, modes))
+	}
+
+	suffix := ""
+	if i := strings.LastIndex(*model, ":"); i >= 0 && contains(config.ValidThinkModes, (*model)[i+1:]) {
+		*model, suffix = (*model)[:i], (*model)[i+1:]
+	}
+
+	for _, mode := range []string{field, suffix, header} {
+		if mode != "" {
+			return mode, nil
+		}
+	}
+	return config.GetConfig().ThinkMode(), nil
+}
+
+// DeltaKind is the kind of output carried by a Delta
+type DeltaKind int
+
+const (
+	// DeltaText is answer text
+	DeltaText DeltaKind = iota
+	// DeltaReasoning is thinking output, sent separately in the reasoning think mode
+	DeltaReasoning
+	// DeltaToolCall is a fragment of a tool call's JSON
+	DeltaToolCall
+)
+
+// Delta is one piece of assistant output translated from a Z.ai frame
+type Delta struct {
+	Kind DeltaKind
+	Text string
+}
+
+// Z.ai wraps a tool call's JSON in a glm_block envelope
+var (
+	toolCallPrefix = regexp.MustCompile(`\n*<glm_block[^>]*>\{"type": "mcp", "data": \{"metadata": \{`)
+	toolCallSuffix = regexp.MustCompile(`", "result": "".*</glm_block>`)
+	toolCallResult = regexp.MustCompile(`null, "display_result": "".*</glm_block>`)
+)
+
+// Tags that are only recognized inside reasoning
+var reasoningTags = []string{"</details>", "<summary>", "</summary>", "</thinking>", "<Full>", "</Full>"}
+
+// maxTagSize bounds the unterminated tag text held back between frames
+const maxTagSize = 1024
+
+type reasoningState int
+
+const (
+	reasoningNone reasoningState = iota
+	reasoningOpen
+	reasoningDone
+)
+
+// ResponseFormatter translates the Z.ai frames of one response into assistant output
+//
+// Z.ai streams reasoning as a <details type="reasoning"> block of quoted
+// lines that is closed, together with a <summary>, by the first answer
+// frame. The formatter rewrites it for the think mode in a single pass over
+// each frame and holds back tags split across frames, so every response
+// needs its own formatter.
+type ResponseFormatter struct {
+	mode  string
+	phase string
+
+	state        reasoningState
+	skipping     bool // inside a repeat of reasoning that was already streamed
+	inSummary    bool
+	lineStart    bool
+	dropSpace    bool // drop the space after a stripped quote marker
+	trimNewlines bool
+	phaseChanged bool
+	newlines     int    // newlines held back until more reasoning text follows
+	wrote        bool   // reasoning text was written
+	separator    string // written before the first answer text
+
+	pending  []byte
+	summary  []byte
+	duration string
+
+	kind   DeltaKind
+	buf    []byte
+	deltas []Delta
+}
+
+// NewResponseFormatter creates a formatter for the given think mode
+func NewResponseFormatter(thinkMode string) *ResponseFormatter {
+	return &ResponseFormatter{mode: thinkMode}
+}
+
+// Format translates a Z.ai frame into assistant output
+//
+// The returned slice is only valid until the next call to Format or Flush.
+func (f *ResponseFormatter) Format(data *types.ZaiResponse) []Delta {
+	f.deltas = f.deltas[:0]
+	if data == nil || data.Data == nil {
+		return nil
+	}
+
+	phase := data.Data.Phase
+	if phase == "" {
+		phase = "other"
+	}
+
+	content := data.Data.DeltaContent
+	if content == "" {
+		content = data.Data.EditContent
+	}
+	if content == "" {
+		return nil
+	}
+
+	// Handle tool_call phase; the call's last fragment arrives in an "other" frame
+	if phase == "tool_call" || (phase == "other" && f.phase == "tool_call" && strings.Contains(content, "glm_block")) {
+		f.finish()
+		if phase == "tool_call" {
+			content = toolCallPrefix.ReplaceAllString(content, "{")
+			content = toolCallSuffix.ReplaceAllString(content, "")
+		} else {
+			content = toolCallResult.ReplaceAllString(content, `"}`)
+		}
+		f.phase = "tool_call"
+		f.write(DeltaToolCall, content)
+		f.flushDelta()
+		return f.deltas
+	}
+
+	if phase != f.phase {
+		f.phase = phase
+		f.phaseChanged = phase != "thinking"
+	}
+
+	f.scan(content, false)
+	f.flushDelta()
+	return f.deltas
+}
+
+// Flush returns the output held back at the end of the response, closing open reasoning
+func (f *ResponseFormatter) Flush() []Delta {
+	f.deltas = f.deltas[:0]
+	f.finish()
+	f.flushDelta()
+	return f.deltas
+}
+
+// finish writes held back text as is and closes open reasoning
+func (f *ResponseFormatter) finish() {
+	if len(f.pending) > 0 {
+		pending := string(f.pending)
+		f.pending = f.pending[:0]
+		f.scan(pending, true)
+	}
+	f.closeReasoning()
+	f.skipping, f.inSummary = false, false
+}
+
+// scan processes one frame's content; unless final, an incomplete tag at the end is held back
+func (f *ResponseFormatter) scan(s string, final bool) {
+	if len(f.pending) > 0 {
+		f.pending = append(f.pending, s...)
+		s = string(f.pending)
+		f.pending = f.pending[:0]
+	}
+
+	for i := 0; i < len(s); {
+		if s[i] == '<' {
+			n, complete := f.matchTag(s[i:], final)
+			if !complete {
+				f.pending = append(f.pending, s[i:]...)
+				return
+			}
+			if n > 0 {
+				f.handleTag(s[i : i+n])
+				i += n
+				continue
+			}
+		}
+
+		// Consume text up to the next tag candidate
+		n := strings.IndexByte(s[i+1:], '<') + 1
+		if n == 0 {
+			n = len(s) - i
+		}
+		f.text(s[i : i+n])
+		i += n
+	}
+}
+
+// matchTag returns the length of the tag s starts with, or 0 if it is text
+//
+// complete is false when s is the beginning of a tag that continues in the
+// next frame.
+func (f *ResponseFormatter) matchTag(s string, final bool) (n int, complete bool) {
+	if f.inSummary {
+		return matchLiteral(s, "</summary>", final)
+	}
+
+	if f.state == reasoningOpen || f.skipping || (f.state == reasoningNone && f.phase == "thinking") {
+		for _, tag := range reasoningTags {
+			if n, complete := matchLiteral(s, tag, final); n > 0 || !complete {
+				return n, complete
+			}
+		}
+	}
+
+	// Reasoning blocks start with <details type="reasoning" ...>
+	const prefix = "<details"
+	if len(s) <= len(prefix) {
+		return 0, final || !strings.HasPrefix(prefix, s)
+	}
+	if !strings.HasPrefix(s, prefix) || (s[len(prefix)] != ' ' && s[len(prefix)] != '>') {
+		return 0, true
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 0 {
+		return 0, final || len(s) >= maxTagSize
+	}
+	if !strings.Contains(s[:end], `type="reasoning"`) {
+		return 0, true
+	}
+	return end + 1, true
+}
+
+// matchLiteral matches s against a fixed tag
+func matchLiteral(s, tag string, final bool) (int, bool) {
+	if strings.HasPrefix(s, tag) {
+		return len(tag), true
+	}
+	if len(s) < len(tag) {
+		return 0, final || !strings.HasPrefix(tag, s)
+	}
+	return 0, true
+}
+
+func (f *ResponseFormatter) handleTag(tag string) {
+	f.phaseChanged = false
+
+	switch tag {
+	case "</details>":
+		if f.skipping {
+			f.skipping = false
+			if f.state == reasoningDone {
+				return
+			}
+		}
+		f.closeReasoning()
+	case "<summary>":
+		f.inSummary = true
+		f.summary = f.summary[:0]
+	case "</summary>":
+		f.inSummary = false
+	case "</thinking>", "<Full>", "</Full>":
+		// Markers without meaning for clients
+	default:
+		// Answer frames may repeat the whole reasoning block that was streamed already
+		if duration := tagAttr(tag, "duration"); duration != "" {
+			f.duration = duration
+		}
+		if f.state == reasoningNone {
+			f.openReasoning()
+		} else {
+			f.skipping = true
+		}
+	}
+}
+
+// tagAttr returns the value of a double-quoted attribute of a tag
+func tagAttr(tag, name string) string {
+	start := strings.Index(tag, " "+name+`="`)
+	if start < 0 {
+		return ""
+	}
+	value := tag[start+len(name)+3:]
+	if end := strings.IndexByte(value, '"'); end >= 0 {
+		return value[:end]
+	}
+	return ""
+}
+
+// text handles a run of text that contains no tag
+func (f *ResponseFormatter) text(s string) {
+	switch {
+	case f.inSummary:
+		f.summary = append(f.summary, s...)
+	case f.skipping:
+		// Already streamed
+	case f.state == reasoningOpen:
+		f.reasoningText(s)
+	case f.state == reasoningNone && f.phase == "thinking":
+		f.openReasoning()
+		f.reasoningText(s)
+	default:
+		f.answerText(s)
+	}
+}
+
+func (f *ResponseFormatter) reasoningText(s string) {
+	kind := DeltaText
+	if f.mode == "reasoning" {
+		kind = DeltaReasoning
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\n' {
+			f.newlines++
+			f.lineStart, f.dropSpace = true, false
+			continue
+		}
+
+		// A new phase that does not start with a tag ends the reasoning
+		if f.phaseChanged {
+			f.closeReasoning()
+			f.answerText(s[i:])
+			return
+		}
+
+		// Z.ai quotes every line of reasoning as markdown
+		if f.lineStart && c == '>' && f.mode != "strip" {
+			f.lineStart, f.dropSpace = false, true
+			continue
+		}
+		if f.dropSpace && c == ' ' {
+			f.dropSpace = false
+			continue
+		}
+		f.lineStart, f.dropSpace = false, false
+
+		// Newlines right after the opening tag are dropped
+		if f.trimNewlines {
+			f.newlines, f.trimNewlines = 0, false
+		}
+		for ; f.newlines > 0; f.newlines-- {
+			f.write(kind, "\n")
+		}
+
+		end := strings.IndexByte(s[i:], '\n')
+		if end < 0 {
+			end = len(s) - i
+		}
+		f.write(kind, s[i:i+end])
+		f.wrote = true
+		i += end - 1
+	}
+}
+
+func (f *ResponseFormatter) answerText(s string) {
+	f.phaseChanged = false
+	if f.trimNewlines {
+		s = strings.TrimLeft(s, "\n")
+		if s == "" {
+			return
+		}
+		f.trimNewlines = false
+	}
+
+	if f.separator != "" {
+		f.write(DeltaText, f.separator)
+		f.separator = ""
+	}
+	f.write(DeltaText, s)
+}
+
+func (f *ResponseFormatter) openReasoning() {
+	f.state = reasoningOpen
+	f.lineStart, f.trimNewlines = true, true
+
+	switch f.mode {
+	case "think":
+		f.write(DeltaText, "<think>\n\n")
+	case "details":
+		f.write(DeltaText, "<details type=\"reasoning\" open><div>\n\n")
+	}
+}
+
+func (f *ResponseFormatter) closeReasoning() {
+	if f.state != reasoningOpen {
+		return
+	}
+	f.state = reasoningDone
+	f.newlines = 0
+	f.trimNewlines = true
+	f.separator = "\n\n"
+
+	switch f.mode {
+	case "think":
+		f.write(DeltaText, "\n\n</think>")
+	case "details":
+		f.write(DeltaText, "\n\n</div>")
+		if len(f.summary) > 0 {
+			f.write(DeltaText, "\n\n<summary>")
+			f.write(DeltaText, string(f.summary))
+			f.write(DeltaText, "</summary>")
+		} else if f.duration != "" {
+			f.write(DeltaText, "\n\n<summary>Thought for "+f.duration+" seconds</summary>")
+		}
+		f.write(DeltaText, "</details>")
+	case "strip":
+		if !f.wrote {
+			f.separator = ""
+		}
+	default:
+		f.separator = ""
+	}
+}
+
+// write appends output, starting a new delta when the kind changes
+func (f *ResponseFormatter) write(kind DeltaKind, s string) {
+	if s == "" {
+		return
+	}
+	if kind != f.kind {
+		f.flushDelta()
+		f.kind = kind
+	}
+	f.buf = append(f.buf, s...)
+}
+
+func (f *ResponseFormatter) flushDelta() {
+	if len(f.buf) == 0 {
+		return
+	}
+	f.deltas = append(f.deltas, Delta{Kind: f.kind, Text: string(f.buf)})
+	f.buf = f.buf[:0]
+}
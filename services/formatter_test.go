@@ -0,0 +1,210 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/fakezai"
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+// frames builds Z.ai frames from alternating phase and content strings
+func frames(phaseAndContent ...string) []*types.ZaiResponse {
+	var result []*types.ZaiResponse
+	for i := 0; i+1 < len(phaseAndContent); i += 2 {
+		result = append(result, &types.ZaiResponse{Data: &types.ZaiResponseData{
+			Phase:        phaseAndContent[i],
+			DeltaContent: phaseAndContent[i+1],
+		}})
+	}
+	return result
+}
+
+func TestResponseFormatter(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		frames []*types.ZaiResponse
+		want   []Delta
+	}{
+		{
+			name: "tags split across frames",
+			mode: "think",
+			frames: frames(
+				"thinking", "<det",
+				"thinking", `ails type="reasoning" done="false">`+"\n> Hm",
+				"thinking", "m\n",
+				"answer", "\n<sum",
+				"answer", "mary>Thought for 1 second</summary>\n</deta",
+				"answer", "ils>\nYes",
+			),
+			want: []Delta{{DeltaText, "<think>\n\nHmm\n\n</think>\n\nYes"}},
+		},
+		{
+			name: "answer repeats the streamed reasoning",
+			mode: "reasoning",
+			frames: frames(
+				"thinking", `<details type="reasoning" done="false">`+"\n> Hmm",
+				"answer", `<details type="reasoning" done="true" duration="1">`+"\n> Hmm\n<summary>Thought for 1 second</summary>\n</details>\nYes",
+			),
+			want: []Delta{{DeltaReasoning, "Hmm"}, {DeltaText, "Yes"}},
+		},
+		{
+			name: "answer without closing tag ends the reasoning",
+			mode: "details",
+			frames: frames(
+				"thinking", "> Hmm",
+				"answer", "\nYes",
+			),
+			want: []Delta{{DeltaText, "<details type=\"reasoning\" open><div>\n\nHmm\n\n</div></details>\n\nYes"}},
+		},
+		{
+			name: "duration without summary",
+			mode: "details",
+			frames: frames(
+				"answer", `<details type="reasoning" done="true" duration="3">`+"\n> Hmm\n</details>\nYes",
+			),
+			want: []Delta{{DeltaText, "<details type=\"reasoning\" open><div>\n\nHmm\n\n</div>\n\n<summary>Thought for 3 seconds</summary></details>\n\nYes"}},
+		},
+		{
+			name: "strip keeps the quoted reasoning",
+			mode: "strip",
+			frames: frames(
+				"thinking", `<details type="reasoning">`+"\n> Hmm</thinking>",
+				"answer", "\n<summary>Thought for 1 second</summary>\n</details>\nYes",
+			),
+			want: []Delta{{DeltaText, "> Hmm\n\nYes"}},
+		},
+		{
+			name: "answer markup passes through",
+			mode: "think",
+			frames: frames(
+				"answer", "Use <details> and <summary>, not <",
+				"answer", "Full>",
+			),
+			want: []Delta{{DeltaText, "Use <details> and <summary>, not <Full>"}},
+		},
+		{
+			name: "unterminated reasoning is closed on flush",
+			mode: "think",
+			frames: frames(
+				"thinking", `<details type="reasoning">`+"\n> Hmm\n",
+			),
+			want: []Delta{{DeltaText, "<think>\n\nHmm\n\n</think>"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatAll(NewResponseFormatter(tt.mode), tt.frames...)
+			if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+				t.Errorf("got %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseFormatterToolCall(t *testing.T) {
+	formatter := NewResponseFormatter("reasoning")
+
+	var parts []string
+	for _, frame := range fakezai.ToolCall("call_1", "get_weather", `{"city":"Paris"}`) {
+		resp, err := decodeZaiEvent(&SSEEvent{Data: []byte(frame)})
+		if err != nil {
+			t.Fatalf("decodeZaiEvent: %v", err)
+		}
+		for _, delta := range formatter.Format(resp) {
+			if delta.Kind != DeltaToolCall {
+				t.Fatalf("got %v delta %q, want a tool call fragment", delta.Kind, delta.Text)
+			}
+			parts = append(parts, delta.Text)
+		}
+	}
+
+	joined := strings.Join(parts, "")
+	if !strings.HasPrefix(joined, `{"id": "call_1"`) || !strings.HasSuffix(joined, `"}`) {
+		t.Errorf("tool call JSON = %s", joined)
+	}
+}
+
+// benchmarkStream is a reasoning response of 200 thinking and 200 answer frames
+func benchmarkStream() []*types.ZaiResponse {
+	parts := []string{"thinking", `<details type="reasoning" done="false">` + "\n> Let me"}
+	for i := 0; i < 200; i++ {
+		parts = append(parts, "thinking", " think about it")
+		if i%20 == 19 {
+			parts = append(parts, "thinking", "\n> and")
+		}
+	}
+	parts = append(parts, "answer", "\n<summary>Thought for 2 seconds</summary>\n</details>\nThe")
+	for i := 0; i < 200; i++ {
+		parts = append(parts, "answer", " answer <b>is</b>")
+	}
+	return frames(parts...)
+}
+
+// BenchmarkResponseFormatter measures one frame per op, so allocs/op is allocations per chunk
+func BenchmarkResponseFormatter(b *testing.B) {
+	stream := benchmarkStream()
+	for _, mode := range []string{"reasoning", "think", "strip", "details"} {
+		b.Run(mode, func(b *testing.B) {
+			b.ReportAllocs()
+			formatter := NewResponseFormatter(mode)
+			for i := 0; i < b.N; i++ {
+				n := i % len(stream)
+				if n == 0 {
+					formatter.Flush()
+					formatter = NewResponseFormatter(mode)
+				}
+				formatter.Format(stream[n])
+			}
+		})
+	}
+}
+
+// BenchmarkResponseFormatterSplitTags measures frames that end inside a tag
+func BenchmarkResponseFormatterSplitTags(b *testing.B) {
+	stream := frames("thinking", "<det", "thinking", `ails type="reasoning">`+"\n> Hmm", "thinking", "\n<sum", "thinking", "mary>x</summary>", "answer", "</details>\nYes")
+	b.ReportAllocs()
+	formatter := NewResponseFormatter("think")
+	for i := 0; i < b.N; i++ {
+		n := i % len(stream)
+		if n == 0 {
+			formatter = NewResponseFormatter("think")
+		}
+		formatter.Format(stream[n])
+	}
+}
+
+func TestRequestThinkMode(t *testing.T) {
+	global := config.GetConfig().ThinkMode()
+	tests := []struct {
+		header, field, model string
+		wantMode, wantModel  string
+	}{
+		{"", "", "glm-4.6", global, "glm-4.6"},
+		{"think", "", "glm-4.6", "think", "glm-4.6"},
+		{"think", "", "glm-4.6:strip", "strip", "glm-4.6"},
+		{"think", "details", "glm-4.6:strip", "details", "glm-4.6"},
+		{"", "", "custom:model", global, "custom:model"},
+	}
+	for _, tt := range tests {
+		model := tt.model
+		mode, err := RequestThinkMode(tt.header, tt.field, &model)
+		if err != nil || mode != tt.wantMode || model != tt.wantModel {
+			t.Errorf("RequestThinkMode(%q, %q, %q) = %q, %q, %v, want %q, %q", tt.header, tt.field, tt.model, mode, model, err, tt.wantMode, tt.wantModel)
+		}
+	}
+
+	model := "glm-4.6"
+	var apiErr *APIError
+	if _, err := RequestThinkMode("", "loud", &model); !errors.As(err, &apiErr) || apiErr.Param != "think_mode" {
+		t.Errorf("invalid think_mode: got %v", err)
+	}
+	if _, err := RequestThinkMode("loud", "", &model); !errors.As(err, &apiErr) || apiErr.Kind != ErrInvalidRequest {
+		t.Errorf("invalid %s header: got %v", ThinkModeHeader, err)
+	}
+}
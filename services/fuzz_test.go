@@ -0,0 +1,160 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/fakezai"
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+func FuzzFormatRequest(f *testing.F) {
+	seeds := []string{
+		`{"model":"glm-4.6","messages":[{"role":"user","content":"Hello"}]}`,
+		`{"messages":[{"role":"user","content":[{"type":"text","text":"Describe"},{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBORw0KGgo="}}]}]}`,
+		`{"system":[{"type":"text","text":"Be brief"}],"messages":[{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}]},{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"Sunny"}]}]}]}`,
+		`{"model":"0727-360B-API","thinking":{"type":"enabled"},"features":{"web_search":true},"messages":[{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"!!"}}]}]}`,
+		`{"model":1,"system":2,"messages":[null,1,"x",{"role":[],"content":{}},{"content":[1,null,{"type":7}]}],"thinking":"yes","features":[]}`,
+		`{"enable_thinking":"maybe","messages":[{"role":"user","content":[{"type":"image_url"},{"type":"image","source":{"type":"url"}}]}]}`,
+		`{"messages":[{"role":"user","content":[{"type":"file","file":{"filename":"a.csv","file_data":"data:text/csv;base64,YSxiCjEsMgo="}},{"type":"document","source":{"type":"content","content":[{"type":"text","text":"x"}]}}]}]}`,
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	// Translation must not fetch remote images or documents
+	cfg := config.GetConfig()
+	defer func(fetch bool) { cfg.Images.FetchRemote = fetch }(cfg.Images.FetchRemote)
+	cfg.Images.FetchRemote = false
+
+	f.Fuzz(func(t *testing.T, body []byte) {
+		var results []*types.ZaiRequest
+
+		var chatReq types.ChatRequest
+		if err := DecodeRequest(bytes.NewReader(body), &chatReq); err == nil {
+			if result, err := FormatOpenAIRequest(context.Background(), &chatReq, "chat-1"); err == nil {
+				results = append(results, result)
+			}
+		}
+
+		var anthropicReq types.AnthropicMessageRequest
+		if err := DecodeRequest(bytes.NewReader(body), &anthropicReq); err == nil {
+			if result, err := FormatAnthropicRequest(context.Background(), &anthropicReq, "chat-1"); err == nil {
+				results = append(results, result)
+			}
+		}
+
+		for _, result := range results {
+			ExtractTextFromMessages(result.Messages)
+			if _, err := json.Marshal(result); err != nil {
+				t.Fatalf("translated request does not marshal: %v", err)
+			}
+		}
+	})
+}
+
+func FuzzSSEDecode(f *testing.F) {
+	seeds := []string{
+		"data: " + fakezai.Answer("Hello") + "\n\n",
+		"data: " + fakezai.Thinking(`<details type="reasoning" done="false">`+"\n> Hmm") + "\n\ndata: " + fakezai.Done() + "\n\n",
+		"data: " + fakezai.ErrorFrame(500, "boom") + "\n\n",
+		"event: error\ndata: not json\n\n",
+		": comment\nid: 1\nretry: 100\ndata: {\"detail\":\"Unauthorized\"}\n\n",
+		"data: {\"data\":{\"phase\":\"other\",\"edit_content\":\"<glm_block>\"}}\r\ndata: [DONE]\r\n\r\n",
+		"data: {\"data\":null}\n\ndata: {\"error\":{\"code\":\"x\"}}\n\n",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		reader := NewSSEReader(bytes.NewReader(stream), 4096)
+		formatter := NewResponseFormatter("reasoning")
+		for {
+			event, err := reader.Next()
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				return
+			}
+			if len(event.Data) > 4096 {
+				t.Fatalf("event of %d bytes exceeds the maximum size", len(event.Data))
+			}
+
+			zaiResp, err := decodeZaiEvent(event)
+			if err != nil || zaiResp == nil {
+				continue
+			}
+			if zaiResp.Error != nil {
+				AsAPIError(zaiResp.Error).Body(DialectOpenAI)
+				continue
+			}
+			formatter.Format(zaiResp)
+		}
+	})
+}
+
+func FuzzResponseFormatter(f *testing.F) {
+	f.Add(`<details type="reasoning" done="false">`+"\n> Two plus two\n> is four.", "\n<summary>Thought for 2 seconds</summary>\n</details>\nThe answer", uint16(9), uint8(0))
+	f.Add(`<details type="reasoning" done="false">`+"\n> Hmm", `<details type="reasoning" done="true" duration="2">`+"\n> Hmm\n</details>\nDone", uint16(3), uint8(3))
+	f.Add("Plain thinking</thinking><Full>", "Answer with <b>tags</b> and <details>", uint16(40), uint8(1))
+	f.Add("", `<details type="reasoning" duration="1"><summary>x</summary></details>after`, uint16(12), uint8(2))
+	f.Add("\n\n>\n>", "<summ", uint16(1), uint8(1))
+
+	f.Fuzz(func(t *testing.T, thinking, answer string, split uint16, mode uint8) {
+		thinkMode := config.ValidThinkModes[int(mode)%len(config.ValidThinkModes)]
+		frame := func(phase, content string) *types.ZaiResponse {
+			return &types.ZaiResponse{Data: &types.ZaiResponseData{Phase: phase, DeltaContent: content}}
+		}
+
+		whole := formatAll(NewResponseFormatter(thinkMode), frame("thinking", thinking), frame("answer", answer))
+
+		// Splitting a frame anywhere must not change the output
+		content := thinking + answer
+		at := int(split) % (len(content) + 1)
+		var frames []*types.ZaiResponse
+		if at <= len(thinking) {
+			frames = []*types.ZaiResponse{frame("thinking", thinking[:at]), frame("thinking", thinking[at:]), frame("answer", answer)}
+		} else {
+			at -= len(thinking)
+			frames = []*types.ZaiResponse{frame("thinking", thinking), frame("answer", answer[:at]), frame("answer", answer[at:])}
+		}
+		pieces := formatAll(NewResponseFormatter(thinkMode), frames...)
+
+		if len(whole) != len(pieces) {
+			t.Fatalf("mode %s: split output %q differs from %q", thinkMode, pieces, whole)
+		}
+		for i := range whole {
+			if whole[i] != pieces[i] {
+				t.Fatalf("mode %s: split output %q differs from %q", thinkMode, pieces, whole)
+			}
+			if whole[i].Text == "" {
+				t.Fatalf("mode %s: empty delta in %q", thinkMode, whole)
+			}
+		}
+	})
+}
+
+// formatAll formats frames and flushes, merging consecutive deltas of the same kind
+func formatAll(formatter *ResponseFormatter, frames ...*types.ZaiResponse) []Delta {
+	var merged []Delta
+	add := func(deltas []Delta) {
+		for _, delta := range deltas {
+			if n := len(merged); n > 0 && merged[n-1].Kind == delta.Kind {
+				merged[n-1].Text += delta.Text
+				continue
+			}
+			merged = append(merged, delta)
+		}
+	}
+	for _, frame := range frames {
+		add(formatter.Format(frame))
+	}
+	add(formatter.Flush())
+	return merged
+}
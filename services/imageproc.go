@@ -0,0 +1,310 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	_ "image/gif" // register the GIF decoder
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // register the WebP decoder
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/metrics"
+)
+
+// maxImagePixels rejects images whose decoded size would exhaust memory
+const maxImagePixels = 50_000_000
+
+// minImageDimension stops downscaling an image that cannot meet the byte budget
+const minImageDimension = 64
+
+var imagePreprocessed = metrics.NewCounterVec(
+	"z2api_image_preprocess_total",
+	"Images prepared for upload, by whether they were sent unchanged, re-encoded or resized",
+	"result",
+)
+
+// imageDimension returns the maximum length of an image's longer side for an OpenAI detail level
+//
+// "low" selects IMAGE_LOW_DETAIL_DIMENSION; "high", "auto" and no detail
+// select IMAGE_MAX_DIMENSION.
+func imageDimension(detail string) int {
+	cfg := config.GetConfig()
+	if detail == "low" {
+		return cfg.Images.LowDetailDimension
+	}
+	return cfg.Images.MaxDimension
+}
+
+// prepareImage rotates, downscales and re-encodes an image for upload as configured
+//
+// Images that are upright, within maxDimension and within IMAGE_TARGET_BYTES
+// are returned unchanged. Others are re-encoded as PNG when they have
+// transparency or come from PNG or GIF and the result fits the budget, and
+// as JPEG otherwise; animated GIFs keep their first frame only.
+func prepareImage(img *imageData, maxDimension int) (*imageData, error) {
+	cfg := config.GetConfig()
+	if !cfg.Images.Resize {
+		return img, nil
+	}
+
+	header, format, err := image.DecodeConfig(bytes.NewReader(img.Data))
+	if err != nil {
+		return nil, &APIError{Kind: ErrInvalidRequest, Message: fmt.Sprintf("Failed to decode %s image", img.MimeType), Err: err}
+	}
+	if header.Width*header.Height > maxImagePixels {
+		return nil, NewAPIError(ErrInvalidRequest, fmt.Sprintf("Image dimensions %dx%d exceed the maximum of %d pixels", header.Width, header.Height, maxImagePixels))
+	}
+
+	orientation := exifOrientation(img.Data, format)
+	if orientation == 1 && max(header.Width, header.Height) <= maxDimension && int64(len(img.Data)) <= cfg.Images.TargetBytes {
+		imagePreprocessed.Inc("unchanged")
+		return img, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(img.Data))
+	if err != nil {
+		return nil, &APIError{Kind: ErrInvalidRequest, Message: fmt.Sprintf("Failed to decode %s image", img.MimeType), Err: err}
+	}
+
+	// Scale before rotating, so only the smaller image is transformed
+	width, height := src.Bounds().Dx(), src.Bounds().Dy()
+	resized := max(width, height) > maxDimension
+	if resized {
+		width, height = scaleToFit(width, height, maxDimension)
+	}
+	rgba := resizeImage(src, width, height)
+	rgba = orientImage(rgba, orientation)
+
+	preferPNG := format == "png" || format == "gif" || !rgba.Opaque()
+	result, err := encodeWithinBudget(rgba, preferPNG, cfg.Images.TargetBytes, cfg.Images.JPEGQuality)
+	if err != nil {
+		return nil, err
+	}
+
+	if resized {
+		imagePreprocessed.Inc("resized")
+	} else {
+		imagePreprocessed.Inc("reencoded")
+	}
+	return result, nil
+}
+
+// encodeWithinBudget encodes an image, lowering JPEG quality and then the size until it fits budget
+//
+// If even the smallest attempt exceeds the budget, the smallest encoding is returned.
+func encodeWithinBudget(img *image.RGBA, preferPNG bool, budget int64, quality int) (*imageData, error) {
+	var smallest *imageData
+	try := func(data []byte, mimeType string) bool {
+		if smallest == nil || len(data) < len(smallest.Data) {
+			smallest = &imageData{Data: data, MimeType: mimeType}
+		}
+		return int64(len(data)) <= budget
+	}
+
+	for {
+		if preferPNG {
+			data, err := encodePNG(img)
+			if err != nil {
+				return nil, err
+			}
+			if try(data, "image/png") {
+				return smallest, nil
+			}
+		}
+
+		// JPEG has no alpha channel, transparent images are only downscaled
+		if img.Opaque() {
+			for q := quality; q >= 40; q -= 15 {
+				data, err := encodeJPEG(img, q)
+				if err != nil {
+					return nil, err
+				}
+				if try(data, "image/jpeg") {
+					return smallest, nil
+				}
+			}
+		}
+
+		width, height := img.Bounds().Dx()*3/4, img.Bounds().Dy()*3/4
+		if min(width, height) < minImageDimension {
+			return smallest, nil
+		}
+		img = resizeImage(img, width, height)
+	}
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeJPEG(img image.Image, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, fmt.Errorf("failed to encode JPEG: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleToFit shrinks width and height proportionally so the longer side is maxDimension
+func scaleToFit(width, height, maxDimension int) (int, int) {
+	if width >= height {
+		return maxDimension, max(1, height*maxDimension/width)
+	}
+	return max(1, width*maxDimension/height), maxDimension
+}
+
+// resizeImage draws src into a new RGBA image of the given size
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	if src.Bounds().Dx() == width && src.Bounds().Dy() == height {
+		draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Src)
+	} else {
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Src, nil)
+	}
+	return dst
+}
+
+// orientImage applies an EXIF orientation (1-8) so the image displays upright
+func orientImage(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// Source pixel shown at (x, y)
+			var sx, sy int
+			switch orientation {
+			case 2: // mirror horizontally
+				sx, sy = w-1-x, y
+			case 3: // rotate 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirror vertically
+				sx, sy = x, h-1-y
+			case 5: // transpose
+				sx, sy = y, x
+			case 6: // rotate 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // transverse
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotate 90° counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			si := src.PixOffset(sx, sy)
+			di := dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// exifOrientation returns the EXIF orientation of a JPEG or WebP image, 1 when absent
+func exifOrientation(data []byte, format string) int {
+	var exif []byte
+	switch format {
+	case "jpeg":
+		exif = jpegExif(data)
+	case "webp":
+		exif = webpExif(data)
+	}
+	return tiffOrientation(bytes.TrimPrefix(exif, []byte("Exif\x00\x00")))
+}
+
+// jpegExif returns the APP1 Exif segment of a JPEG
+func jpegExif(data []byte) []byte {
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Image data starts, no metadata follows
+			return nil
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+// webpExif returns the EXIF chunk of a WebP RIFF container
+func webpExif(data []byte) []byte {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil
+	}
+	for i := 12; i+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		if size < 0 || i+8+size > len(data) {
+			return nil
+		}
+		if string(data[i:i+4]) == "EXIF" {
+			return data[i+8 : i+8+size]
+		}
+		// Chunks are padded to an even size
+		i += 8 + size + size%2
+	}
+	return nil
+}
+
+// tiffOrientation reads the Orientation tag from the first IFD of TIFF-structured EXIF data
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		// Orientation is tag 0x0112 of type SHORT
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+)
+
+func encodeTestPNG(t *testing.T, img image.Image) *imageData {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return &imageData{Data: buf.Bytes(), MimeType: "image/png"}
+}
+
+func decodeTestImage(t *testing.T, img *imageData) image.Image {
+	t.Helper()
+	decoded, _, err := image.Decode(bytes.NewReader(img.Data))
+	if err != nil {
+		t.Fatalf("decode prepared %s: %v", img.MimeType, err)
+	}
+	return decoded
+}
+
+func TestPrepareImageDownscales(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 3000, 1000))
+	for y := 0; y < 1000; y++ {
+		for x := 0; x < 3000; x++ {
+			src.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	original := encodeTestPNG(t, src)
+
+	tests := []struct {
+		detail     string
+		wantWidth  int
+		wantHeight int
+	}{
+		{"", 2048, 682},
+		{"high", 2048, 682},
+		{"low", 512, 170},
+	}
+	for _, tt := range tests {
+		prepared, err := prepareImage(original, imageDimension(tt.detail))
+		if err != nil {
+			t.Fatalf("detail %q: %v", tt.detail, err)
+		}
+		bounds := decodeTestImage(t, prepared).Bounds()
+		if bounds.Dx() != tt.wantWidth || bounds.Dy() != tt.wantHeight {
+			t.Errorf("detail %q: got %dx%d, want %dx%d", tt.detail, bounds.Dx(), bounds.Dy(), tt.wantWidth, tt.wantHeight)
+		}
+	}
+
+	if prepared, err := prepareImage(&imageData{Data: pixelPNG, MimeType: "image/png"}, 2048); err != nil || !bytes.Equal(prepared.Data, pixelPNG) {
+		t.Errorf("small image was changed: %v", err)
+	}
+}
+
+func TestPrepareImageOrientation(t *testing.T) {
+	// Left half red, right half blue, stored with EXIF orientation 6
+	src := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= 20 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			src.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, src, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	tiff := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x06\x00\x00\x00\x00\x00\x00")
+	app1 := append([]byte{0xFF, 0xE1, 0, byte(len(tiff) + 2)}, tiff...)
+	data := append(append(append([]byte{}, buf.Bytes()[:2]...), app1...), buf.Bytes()[2:]...)
+
+	if got := exifOrientation(data, "jpeg"); got != 6 {
+		t.Fatalf("orientation = %d, want 6", got)
+	}
+
+	prepared, err := prepareImage(&imageData{Data: data, MimeType: "image/jpeg"}, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upright := decodeTestImage(t, prepared)
+	if bounds := upright.Bounds(); bounds.Dx() != 20 || bounds.Dy() != 40 {
+		t.Fatalf("got %dx%d, want 20x40", bounds.Dx(), bounds.Dy())
+	}
+
+	// Rotated clockwise, the left half ends up on top
+	if r, _, b, _ := upright.At(10, 5).RGBA(); r < b {
+		t.Errorf("top is not red")
+	}
+	if r, _, b, _ := upright.At(10, 35).RGBA(); b < r {
+		t.Errorf("bottom is not blue")
+	}
+}
+
+func TestPrepareImageByteBudget(t *testing.T) {
+	cfg := config.GetConfig()
+	defer func(budget int64) { cfg.Images.TargetBytes = budget }(cfg.Images.TargetBytes)
+	cfg.Images.TargetBytes = 64 << 10
+
+	// Noise barely compresses as PNG
+	rng := rand.New(rand.NewSource(1))
+	src := image.NewRGBA(image.Rect(0, 0, 600, 600))
+	rng.Read(src.Pix)
+	for i := 3; i < len(src.Pix); i += 4 {
+		src.Pix[i] = 255
+	}
+	original := encodeTestPNG(t, src)
+
+	prepared, err := prepareImage(original, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(prepared.Data)) > cfg.Images.TargetBytes {
+		t.Errorf("prepared image has %d bytes, want at most %d", len(prepared.Data), cfg.Images.TargetBytes)
+	}
+	if prepared.MimeType != "image/jpeg" {
+		t.Errorf("MIME type = %s, want image/jpeg", prepared.MimeType)
+	}
+	decodeTestImage(t, prepared)
+}
@@ -0,0 +1,514 @@
+package services
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/metrics"
+	"github.com/Tyler-Dinh/z2api-go/types"
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+// imageExtensions lists the image types accepted for upload, by sniffed MIME type
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// maxImageRedirects bounds the redirects followed when fetching a remote image
+const maxImageRedirects = 3
+
+var imageUploads = metrics.NewCounterVec(
+	"z2api_image_uploads_total",
+	"Images sent by clients, by whether they were uploaded or served from the upload cache",
+	"result",
+)
+
+// imageData is a validated image ready for upload
+type imageData struct {
+	Data     []byte
+	MimeType string
+}
+
+// UploadImage uploads an image given as a data URL or an http(s) URL and returns its Z.ai file reference
+//
+// Images are validated and prepared for the OpenAI detail level ("low",
+// "high", "auto" or ""), and identical images are uploaded once per
+// upstream user while they stay in the upload cache. In anonymous mode
+// nothing is uploaded and "" is returned, so the URL is forwarded as-is.
+// Unusable images are reported as invalid_request errors.
+func UploadImage(ctx context.Context, imageURL, detail, chatID string) (string, error) {
+	if isAnonymous(ctx) {
+		return "", nil
+	}
+
+	image, err := loadImage(ctx, imageURL)
+	if err != nil {
+		return "", err
+	}
+	return uploadImage(ctx, image, detail, chatID)
+}
+
+// imageReference returns how a validated image is passed to Z.ai: its file reference, or a data URL in anonymous mode
+func imageReference(ctx context.Context, image *imageData, detail, chatID string) (string, error) {
+	if isAnonymous(ctx) {
+		return "data:" + image.MimeType + ";base64," + base64.StdEncoding.EncodeToString(image.Data), nil
+	}
+	return uploadImage(ctx, image, detail, chatID)
+}
+
+// uploadImage prepares and uploads a validated image, reusing an earlier upload of the same content
+func uploadImage(ctx context.Context, image *imageData, detail, chatID string) (string, error) {
+	user, err := GetUserService().GetUser(ctx)
+	if err != nil {
+		return "", upstreamTransportError(fmt.Errorf("failed to get user info: %w", err))
+	}
+
+	// Identical content is only prepared and uploaded once per upstream user and size
+	maxDimension := imageDimension(detail)
+	sum := sha256.Sum256(image.Data)
+	cacheKey := fmt.Sprintf("%s:%s:%d", user.ID, hex.EncodeToString(sum[:]), maxDimension)
+	uploads := GetUploadCache()
+	if fileRef, ok := uploads.Get(cacheKey); ok {
+		imageUploads.Inc("cached")
+		slog.DebugContext(ctx, "Image upload served from cache", "mime_type", image.MimeType, "bytes", len(image.Data))
+		return fileRef, nil
+	}
+
+	prepared, err := prepareImage(image, maxDimension)
+	if err != nil {
+		return "", err
+	}
+	if prepared != image {
+		slog.DebugContext(ctx, "Image prepared for upload",
+			"mime_type", prepared.MimeType, "bytes", len(prepared.Data), "original_mime_type", image.MimeType, "original_bytes", len(image.Data))
+	}
+
+	filename := utils.GenerateID() + imageExtensions[prepared.MimeType]
+	result, err := uploadFile(ctx, prepared.Data, prepared.MimeType, filename, chatID)
+	if err != nil {
+		return "", err
+	}
+	fileRef := fmt.Sprintf("%s_%s", result.ID, result.Filename)
+	imageUploads.Inc("uploaded")
+	uploads.Put(cacheKey, fileRef)
+	return fileRef, nil
+}
+
+// loadImage decodes a data URL or fetches an http(s) URL and validates the image
+func loadImage(ctx context.Context, imageURL string) (*imageData, error) {
+	cfg := config.GetConfig()
+
+	var data []byte
+	var err error
+	switch {
+	case strings.HasPrefix(imageURL, "data:"):
+		data, _, err = decodeDataURL(imageURL, "image", cfg.Images.MaxBytes)
+	case strings.HasPrefix(imageURL, "http://") || strings.HasPrefix(imageURL, "https://"):
+		if !cfg.Images.FetchRemote {
+			return nil, NewAPIError(ErrInvalidRequest, "Remote image URLs are disabled, send the image as a base64 data URL")
+		}
+		data, _, err = fetchRemote(ctx, imageURL, "image", "image/*", cfg.Images.MaxBytes)
+	default:
+		return nil, NewAPIError(ErrInvalidRequest, "Image URLs must be base64 data URLs or http(s) URLs")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Trust the content, not the declared type
+	mimeType := http.DetectContentType(data)
+	if _, ok := imageExtensions[mimeType]; !ok {
+		return nil, NewAPIError(ErrInvalidRequest, fmt.Sprintf("Unsupported image type %s, expected PNG, JPEG, GIF or WebP", mimeType))
+	}
+	return &imageData{Data: data, MimeType: mimeType}, nil
+}
+
+// decodeDataURL decodes a base64 data URL of at most maxBytes and returns its declared media type
+//
+// what names the content in error messages.
+func decodeDataURL(dataURL, what string, maxBytes int64) ([]byte, string, error) {
+	header, encoded, ok := strings.Cut(dataURL, ",")
+	if !ok || !strings.HasSuffix(header, ";base64") {
+		return nil, "", NewAPIError(ErrInvalidRequest, fmt.Sprintf("Invalid %s data URL, expected data:<type>;base64,<data>", what))
+	}
+	mediaType, _, _ := strings.Cut(strings.TrimPrefix(header, "data:"), ";")
+
+	data, err := decodeBase64(encoded, what, maxBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, mediaType, nil
+}
+
+// decodeBase64 decodes base64 data of at most maxBytes
+func decodeBase64(encoded, what string, maxBytes int64) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	if int64(base64.StdEncoding.DecodedLen(len(encoded))) > maxBytes+2 {
+		return nil, tooLarge(what, maxBytes)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, &APIError{Kind: ErrInvalidRequest, Message: fmt.Sprintf("Invalid base64 %s data", what), Err: err}
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, tooLarge(what, maxBytes)
+	}
+	return data, nil
+}
+
+// tooLarge reports content over its size limit
+func tooLarge(what string, maxBytes int64) *APIError {
+	return NewAPIError(ErrInvalidRequest, fmt.Sprintf("The %s exceeds the maximum size of %d bytes", what, maxBytes))
+}
+
+// fetchRemote downloads remote content of at most maxBytes and returns it with its media type
+//
+// Hosts are checked against IMAGE_URL_ALLOWLIST and fetching is bounded by
+// IMAGE_FETCH_TIMEOUT_MS. what names the content in error messages.
+func fetchRemote(ctx context.Context, rawURL, what, accept string, maxBytes int64) ([]byte, string, error) {
+	cfg := config.GetConfig()
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return nil, "", NewAPIError(ErrInvalidRequest, fmt.Sprintf("Invalid %s URL", what))
+	}
+	if !imageHostAllowed(u.Hostname()) {
+		return nil, "", NewAPIError(ErrInvalidRequest, fmt.Sprintf("Host %s is not allowed for remote %ss", u.Hostname(), what))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Images.FetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, "", NewAPIError(ErrInvalidRequest, fmt.Sprintf("Invalid %s URL", what))
+	}
+	req.Header.Set("Accept", accept)
+
+	resp, err := imageClient().Do(req)
+	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			return nil, "", apiErr
+		}
+		return nil, "", &APIError{Kind: ErrInvalidRequest, Message: fmt.Sprintf("Failed to fetch %s from %s", what, u.Hostname()), Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", NewAPIError(ErrInvalidRequest, fmt.Sprintf("Failed to fetch %s from %s: HTTP %d", what, u.Hostname(), resp.StatusCode))
+	}
+	if resp.ContentLength > maxBytes {
+		return nil, "", tooLarge(what, maxBytes)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, "", &APIError{Kind: ErrInvalidRequest, Message: fmt.Sprintf("Failed to fetch %s from %s", what, u.Hostname()), Err: err}
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, "", tooLarge(what, maxBytes)
+	}
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	return data, strings.TrimSpace(mediaType), nil
+}
+
+// imageHostAllowed checks a host against IMAGE_URL_ALLOWLIST; an empty list allows every host
+func imageHostAllowed(host string) bool {
+	allowed := config.GetConfig().Images.AllowedHosts
+	return len(allowed) == 0 || imageHostListed(host)
+}
+
+// imageHostListed reports whether a host matches an IMAGE_URL_ALLOWLIST entry
+func imageHostListed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range config.GetConfig().Images.AllowedHosts {
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	imageHTTPClient     *http.Client
+	imageHTTPClientOnce sync.Once
+)
+
+// imageClient returns the client for remote images and documents
+//
+// It connects directly rather than through the upstream transport and
+// refuses private, loopback and link-local addresses unless the host is
+// explicitly allowlisted, so client URLs cannot reach internal services.
+func imageClient() *http.Client {
+	imageHTTPClientOnce.Do(func() {
+		dialer := &net.Dialer{Timeout: 10 * time.Second, Control: rejectPrivateAddress}
+		direct := &net.Dialer{Timeout: 10 * time.Second}
+
+		imageHTTPClient = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					if host, _, err := net.SplitHostPort(addr); err == nil && imageHostListed(host) {
+						return direct.DialContext(ctx, network, addr)
+					}
+					return dialer.DialContext(ctx, network, addr)
+				},
+				ForceAttemptHTTP2:     true,
+				MaxIdleConns:          16,
+				IdleConnTimeout:       30 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 10 * time.Second,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxImageRedirects {
+					return NewAPIError(ErrInvalidRequest, "Too many redirects while fetching remote content")
+				}
+				if !imageHostAllowed(req.URL.Hostname()) {
+					return NewAPIError(ErrInvalidRequest, fmt.Sprintf("Host %s is not allowed for remote content", req.URL.Hostname()))
+				}
+				return nil
+			},
+		}
+	})
+	return imageHTTPClient
+}
+
+// nonPublicPrefixes are the special-purpose ranges of the IANA IPv4 and IPv6 registries
+// that must not be reached through client URLs, including ranges that embed IPv4 addresses
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // this network
+	netip.MustParsePrefix("10.0.0.0/8"),      // private
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link-local
+	netip.MustParsePrefix("172.16.0.0/12"),   // private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("192.168.0.0/16"),  // private
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved and broadcast
+	netip.MustParsePrefix("::/127"),          // unspecified and loopback
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local NAT64
+	netip.MustParsePrefix("100::/64"),        // discard
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments, including Teredo
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4
+	netip.MustParsePrefix("fc00::/7"),        // unique local
+	netip.MustParsePrefix("fe80::/10"),       // link-local
+	netip.MustParsePrefix("fec0::/10"),       // site-local
+	netip.MustParsePrefix("ff00::/8"),        // multicast
+}
+
+// rejectPrivateAddress is a dialer control function that refuses non-public IPs
+func rejectPrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !isPublicAddress(addr) {
+		return NewAPIError(ErrInvalidRequest, "Remote URL resolves to a non-public address")
+	}
+	return nil
+}
+
+// isPublicAddress reports whether an address is outside every non-public range, IPv4-mapped IPv6 included
+func isPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// uploadFile uploads a file to Z.ai
+func uploadFile(ctx context.Context, data []byte, mimeType, filename, chatID string) (*types.ImageUploadResponse, error) {
+	cfg := config.GetConfig()
+
+	// Create multipart form
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	partHeader := textproto.MIMEHeader{}
+	partHeader.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, escapeQuotes(filename)))
+	partHeader.Set("Content-Type", mimeType)
+	part, err := writer.CreatePart(partHeader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create form file: %w", err)
+	}
+	if _, err := part.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to write file data: %w", err)
+	}
+	writer.Close()
+
+	// Build request
+	uploadURL := upstreamURL("/api/v1/files/")
+	client := upstreamClient(cfg.Transport.Timeouts.Upload)
+
+	send := func(user *types.UserInfo) (*http.Response, error) {
+		newRequest := func() (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, "POST", uploadURL, bytes.NewReader(body.Bytes()))
+			if err != nil {
+				return nil, fmt.Errorf("failed to create upload request: %w", err)
+			}
+
+			// Set headers
+			for k, v := range cfg.Headers {
+				req.Header.Set(k, v)
+			}
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+			req.Header.Set("Referer", upstreamURL("/c/"+chatID))
+			return req, nil
+		}
+
+		return doWithRetry(ctx, client, cfg.Retry.Upload, "upload", newRequest)
+	}
+
+	// Send request, refreshing credentials once on a 401
+	resp, err := withReauth(ctx, "upload", send)
+	if err != nil {
+		return nil, upstreamTransportError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		apiErr := ClassifyUpstreamResponse(resp)
+		apiErr.Message = "File upload failed: " + apiErr.Message
+		return nil, apiErr
+	}
+
+	// Parse response
+	var result types.ImageUploadResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, upstreamTransportError(fmt.Errorf("failed to parse upload response: %w", err))
+	}
+
+	return &result, nil
+}
+
+// escapeQuotes escapes a multipart filename like mime/multipart does
+var escapeQuotes = strings.NewReplacer("\\", "\\\\", `"`, "\\\"").Replace
+
+// UploadCache remembers uploaded file references by image content
+type UploadCache struct {
+	mutex sync.Mutex
+	items map[string]*list.Element
+	order *list.List
+}
+
+type uploadCacheEntry struct {
+	key       string
+	fileRef   string
+	expiresAt time.Time
+}
+
+var (
+	uploadCache     *UploadCache
+	uploadCacheOnce sync.Once
+)
+
+// GetUploadCache returns the singleton upload cache
+func GetUploadCache() *UploadCache {
+	uploadCacheOnce.Do(func() {
+		uploadCache = &UploadCache{
+			items: make(map[string]*list.Element),
+			order: list.New(),
+		}
+	})
+	return uploadCache
+}
+
+// Get returns a fresh file reference and marks it as recently used
+func (c *UploadCache) Get(key string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return "", false
+	}
+	entry := elem.Value.(*uploadCacheEntry)
+	if !time.Now().Before(entry.expiresAt) {
+		c.order.Remove(elem)
+		delete(c.items, key)
+		return "", false
+	}
+	c.order.MoveToFront(elem)
+	return entry.fileRef, true
+}
+
+// Put stores a file reference, evicting the least recently used ones beyond IMAGE_UPLOAD_CACHE_SIZE
+func (c *UploadCache) Put(key, fileRef string) {
+	cfg := config.GetConfig()
+	if cfg.Images.CacheSize == 0 || cfg.Images.CacheTTL == 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.order.Remove(elem)
+	}
+	c.items[key] = c.order.PushFront(&uploadCacheEntry{
+		key:       key,
+		fileRef:   fileRef,
+		expiresAt: time.Now().Add(cfg.Images.CacheTTL),
+	})
+
+	for c.order.Len() > cfg.Images.CacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*uploadCacheEntry).key)
+	}
+}
+
+// Len returns the number of cached uploads
+func (c *UploadCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
+
+// Clear drops all cached uploads
+func (c *UploadCache) Clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+	slog.Info("Upload cache cleared")
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/fakezai"
+)
+
+// pixelPNG is a 1x1 transparent PNG
+var pixelPNG, _ = base64.StdEncoding.DecodeString("iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg==")
+
+func TestUploadImageDeduplicates(t *testing.T) {
+	resetUpstream(t)
+	ctx := WithCredentials(context.Background(), Credentials{UpstreamToken: "client-token"})
+	dataURL := "data:image/png;base64," + base64.StdEncoding.EncodeToString(pixelPNG)
+
+	for i := 0; i < 2; i++ {
+		if _, err := UploadImage(ctx, dataURL, "", "chat-1"); err != nil {
+			t.Fatalf("UploadImage: %v", err)
+		}
+	}
+	if n := len(fake.Requests(fakezai.PathFiles)); n != 1 {
+		t.Errorf("got %d upload requests, want 1", n)
+	}
+}
+
+func TestUploadImageRemote(t *testing.T) {
+	resetUpstream(t)
+	ctx := WithCredentials(context.Background(), Credentials{UpstreamToken: "client-token"})
+
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/pixel.png":
+			w.Write(pixelPNG)
+		case "/page.html":
+			w.Write([]byte("<html><body>not an image</body></html>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer images.Close()
+
+	cfg := config.GetConfig()
+	defer func(hosts []string) { cfg.Images.AllowedHosts = hosts }(cfg.Images.AllowedHosts)
+	defer func(fetch bool) { cfg.Images.FetchRemote = fetch }(cfg.Images.FetchRemote)
+
+	// Remote fetching is opt-in
+	cfg.Images.FetchRemote = false
+	assertInvalidImage(t, ctx, images.URL+"/pixel.png", "Remote image URLs are disabled")
+	cfg.Images.FetchRemote = true
+
+	// Loopback addresses are only reachable when allowlisted
+	cfg.Images.AllowedHosts = nil
+	assertInvalidImage(t, ctx, images.URL+"/pixel.png", "non-public address")
+
+	cfg.Images.AllowedHosts = []string{"127.0.0.1"}
+	fileID, err := UploadImage(ctx, images.URL+"/pixel.png", "", "chat-1")
+	if err != nil {
+		t.Fatalf("UploadImage: %v", err)
+	}
+	if fileID != "fake-file_upload.png" {
+		t.Errorf("file ID = %q, want %q", fileID, "fake-file_upload.png")
+	}
+
+	assertInvalidImage(t, ctx, images.URL+"/page.html", "Unsupported image type")
+	assertInvalidImage(t, ctx, images.URL+"/missing.png", "HTTP 404")
+
+	cfg.Images.AllowedHosts = []string{"*.example.com"}
+	assertInvalidImage(t, ctx, images.URL+"/pixel.png", "not allowed")
+}
+
+func TestIsPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"100.64.0.1", false},
+		{"169.254.169.254", false},
+		{"192.0.0.170", false},
+		{"198.18.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:8.8.8.8", true},
+		{"::1", false},
+		{"64:ff9b::a00:1", false},
+		{"2002:a00:1::", false},
+		{"fd00::1", false},
+		{"fe80::1%eth0", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicAddress(netip.MustParseAddr(tt.addr)); got != tt.public {
+			t.Errorf("isPublicAddress(%s) = %v, want %v", tt.addr, got, tt.public)
+		}
+	}
+}
+
+func TestUploadImageValidation(t *testing.T) {
+	resetUpstream(t)
+	ctx := WithCredentials(context.Background(), Credentials{UpstreamToken: "client-token"})
+
+	cfg := config.GetConfig()
+	defer func(maxBytes int64) { cfg.Images.MaxBytes = maxBytes }(cfg.Images.MaxBytes)
+	cfg.Images.MaxBytes = 1024
+
+	large := make([]byte, 2048)
+	copy(large, pixelPNG)
+
+	assertInvalidImage(t, ctx, "data:image/png;base64,"+base64.StdEncoding.EncodeToString(large), "maximum size")
+	assertInvalidImage(t, ctx, "data:image/png;base64,"+base64.StdEncoding.EncodeToString([]byte("%PDF-1.7")), "Unsupported image type")
+	assertInvalidImage(t, ctx, "data:image/png;base64,!!", "Invalid base64")
+	assertInvalidImage(t, ctx, "ftp://example.com/pixel.png", "data URLs or http(s) URLs")
+
+	if n := len(fake.Requests(fakezai.PathFiles)); n != 0 {
+		t.Errorf("got %d upload requests for invalid images, want 0", n)
+	}
+}
+
+func assertInvalidImage(t *testing.T, ctx context.Context, imageURL, wantMessage string) {
+	t.Helper()
+	_, err := UploadImage(ctx, imageURL, "", "chat-1")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Kind != ErrInvalidRequest {
+		t.Fatalf("%.60s: got %v, want an invalid_request error", imageURL, err)
+	}
+	if !strings.Contains(apiErr.Message, wantMessage) {
+		t.Errorf("%.60s: message %q does not contain %q", imageURL, apiErr.Message, wantMessage)
+	}
+}
@@ -0,0 +1,244 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+// APIKey is a proxy API key, optionally mapped to its own Z.ai token
+type APIKey struct {
+	ID            string    `json:"id"`
+	Key           string    `json:"key"`
+	UpstreamToken string    `json:"upstream_token,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	Revoked       bool      `json:"revoked,omitempty"`
+
+	// fromEnv marks keys declared in API_KEYS, which are only persisted once revoked
+	fromEnv bool
+}
+
+// KeyStore holds the proxy API keys accepted by the server
+//
+// Keys created or revoked at runtime are written back to API_KEYS_FILE.
+type KeyStore struct {
+	keys  map[string]*APIKey // indexed by key hash
+	path  string
+	mutex sync.RWMutex
+}
+
+var (
+	keyStore     *KeyStore
+	keyStoreOnce sync.Once
+)
+
+// GetKeyStore returns the singleton key store instance
+func GetKeyStore() *KeyStore {
+	keyStoreOnce.Do(func() {
+		keyStore = &KeyStore{
+			keys: make(map[string]*APIKey),
+			path: config.GetConfig().Auth.KeysFile,
+		}
+		if err := keyStore.load(config.GetConfig()); err != nil {
+			slog.Warn("Failed to load API keys", "error", err)
+		}
+	})
+	return keyStore
+}
+
+// Enabled reports whether any key is configured, i.e. whether auth is required
+func (s *KeyStore) Enabled() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.keys) > 0
+}
+
+// Lookup returns the active key matching the presented secret
+func (s *KeyStore) Lookup(key string) (*APIKey, bool) {
+	if key == "" {
+		return nil, false
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	apiKey, ok := s.keys[hashKey(key)]
+	if !ok || apiKey.Revoked {
+		return nil, false
+	}
+	return apiKey, true
+}
+
+// List returns copies of all keys, oldest first
+func (s *KeyStore) List() []APIKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keys := make([]APIKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, *key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
+
+// Create generates and persists a new key; an empty ID is derived from the key
+func (s *KeyStore) Create(id, upstreamToken string) (*APIKey, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	key := &APIKey{
+		ID:            strings.TrimSpace(id),
+		Key:           "sk-z2a-" + hex.EncodeToString(secret),
+		UpstreamToken: strings.TrimSpace(upstreamToken),
+		CreatedAt:     time.Now().UTC(),
+	}
+	if key.ID == "" {
+		key.ID = "key-" + hashKey(key.Key)[:8]
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, existing := range s.keys {
+		if existing.ID == key.ID {
+			return nil, fmt.Errorf("key ID %q already exists", key.ID)
+		}
+	}
+
+	hash := hashKey(key.Key)
+	s.keys[hash] = key
+	if err := s.save(); err != nil {
+		delete(s.keys, hash)
+		return nil, err
+	}
+
+	slog.Info("Created API key", "key_id", key.ID)
+	return key, nil
+}
+
+// Revoke disables every key with the given ID and persists the change
+func (s *KeyStore) Revoke(id string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	revoked := []*APIKey{}
+	for _, key := range s.keys {
+		if key.ID == id && !key.Revoked {
+			key.Revoked = true
+			revoked = append(revoked, key)
+		}
+	}
+	if len(revoked) == 0 {
+		return false, nil
+	}
+
+	if err := s.save(); err != nil {
+		for _, key := range revoked {
+			key.Revoked = false
+		}
+		return false, err
+	}
+
+	slog.Info("Revoked API key", "key_id", id)
+	return true, nil
+}
+
+// save writes file-backed, created and revoked keys; the caller must hold the write lock
+func (s *KeyStore) save() error {
+	if s.path == "" {
+		return fmt.Errorf("no API_KEYS_FILE configured")
+	}
+
+	keys := []*APIKey{}
+	for _, key := range s.keys {
+		if !key.fromEnv || key.Revoked {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := utils.WriteFileAtomic(s.path, data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// load reads keys from API_KEYS and API_KEYS_FILE
+func (s *KeyStore) load(cfg *config.Config) error {
+	for _, entry := range cfg.Auth.Keys {
+		s.add(&APIKey{
+			ID:            entry.ID,
+			Key:           entry.Key,
+			UpstreamToken: entry.UpstreamToken,
+			CreatedAt:     time.Now(),
+			fromEnv:       true,
+		})
+	}
+
+	if cfg.Auth.KeysFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(cfg.Auth.KeysFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", cfg.Auth.KeysFile, err)
+	}
+
+	var keys []*APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", cfg.Auth.KeysFile, err)
+	}
+	// Entries in the file override environment keys with the same secret,
+	// which is how revoking an environment key survives a restart
+	for _, key := range keys {
+		s.add(key)
+	}
+
+	slog.Info("Loaded API keys", "count", len(s.keys))
+	return nil
+}
+
+func (s *KeyStore) add(key *APIKey) {
+	if strings.TrimSpace(key.Key) == "" {
+		return
+	}
+	if key.ID == "" {
+		key.ID = "key-" + hashKey(key.Key)[:8]
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keys[hashKey(key.Key)] = key
+}
+
+// hashKey returns the index under which a key secret is stored
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/fakezai"
+)
+
+// fake is the fake Z.ai upstream shared by the tests of this package
+var fake *fakezai.Server
+
+func TestMain(m *testing.M) {
+	dataDir, err := os.MkdirTemp("", "z2api-services-test")
+	if err != nil {
+		panic(err)
+	}
+
+	// Configure before the config singleton is loaded
+	os.Setenv("DATA_DIR", dataDir)
+	os.Setenv("TOKEN", "")
+	os.Setenv("BREAKER_ENABLED", "false")
+	os.Setenv("RETRY_BASE_DELAY_MS", "1")
+	os.Setenv("RETRY_MAX_DELAY_MS", "2")
+
+	fake = fakezai.NewServer()
+	if err := config.GetConfig().SetBaseURL(fake.URL); err != nil {
+		panic(err)
+	}
+
+	code := m.Run()
+
+	fake.Close()
+	os.RemoveAll(dataDir)
+	os.Exit(code)
+}
+
+// resetUpstream clears the fake's scripts and every upstream cache
+func resetUpstream(t *testing.T) {
+	t.Helper()
+	fake.Reset()
+	GetUserService().ClearCache()
+	GetModelsService().ClearCache()
+	GetUploadCache().Clear()
+}
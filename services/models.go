@@ -1,10 +1,10 @@
 package services
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
@@ -34,7 +34,7 @@ func GetModelsService() *ModelsService {
 }
 
 // GetModels fetches and caches the model list from Z.ai API
-func (s *ModelsService) GetModels() (*types.ModelsResponse, error) {
+func (s *ModelsService) GetModels(ctx context.Context) (*types.ModelsResponse, error) {
 	cfg := config.GetConfig()
 
 	// Check cache
@@ -45,44 +45,38 @@ func (s *ModelsService) GetModels() (*types.ModelsResponse, error) {
 	}
 	s.cacheMutex.RUnlock()
 
-	// Get user token
-	userService := GetUserService()
-	user, err := userService.GetUser()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user: %w", err)
-	}
-
-	currentToken := user.Token
-	if !cfg.API.Anonymous {
-		currentToken = cfg.Source.Token
-	}
-
 	// Fetch models from API
-	url := fmt.Sprintf("%s//%s/api/models", cfg.Source.Protocol, cfg.Source.Host)
+	url := upstreamURL("/api/models")
+	client := upstreamClient(cfg.Transport.Timeouts.Models)
+
+	send := func(user *types.UserInfo) (*http.Response, error) {
+		newRequest := func() (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create request: %w", err)
+			}
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
+			// Add headers
+			for k, v := range cfg.Headers {
+				req.Header.Set(k, v)
+			}
+			req.Header.Set("Authorization", "Bearer "+user.Token)
+			req.Header.Set("Content-Type", "application/json")
+			return req, nil
+		}
 
-	// Add headers
-	for k, v := range cfg.Headers {
-		req.Header.Set(k, v)
+		return doWithRetry(ctx, client, cfg.Retry.Models, "models", newRequest)
 	}
-	req.Header.Set("Authorization", "Bearer "+currentToken)
-	req.Header.Set("Content-Type", "application/json")
 
-	// Send request
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	// Send request, refreshing credentials once on a 401
+	resp, err := withReauth(ctx, "models", send)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch models: %w", err)
+		return nil, upstreamTransportError(err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("fetch models failed: %s", string(body))
+		return nil, ClassifyUpstreamResponse(resp)
 	}
 
 	// Parse response
@@ -187,16 +181,39 @@ func (s *ModelsService) GetModels() (*types.ModelsResponse, error) {
 	s.cache = result
 	s.cacheMutex.Unlock()
 
-	log.Printf("Fetched %d models from Z.ai API", len(models))
+	slog.InfoContext(ctx, "Fetched models from Z.ai API", "count", len(models))
 	return result, nil
 }
 
+// modelContextLimit returns the context length of a model from upstream metadata, or 0 if unknown
+func modelContextLimit(models *types.ModelsResponse, model string) int {
+	if models == nil {
+		return 0
+	}
+
+	for _, m := range models.Data {
+		if m.ID != model && m.Original["id"] != model {
+			continue
+		}
+		info, _ := m.Original["info"].(map[string]interface{})
+		params, _ := info["params"].(map[string]interface{})
+		meta, _ := info["meta"].(map[string]interface{})
+		for _, value := range []interface{}{params["num_ctx"], params["max_context_length"], meta["context_length"], meta["max_context_length"]} {
+			if limit, ok := value.(float64); ok && limit > 0 {
+				return int(limit)
+			}
+		}
+		return 0
+	}
+	return 0
+}
+
 // ClearCache clears the models cache
 func (s *ModelsService) ClearCache() {
 	s.cacheMutex.Lock()
 	defer s.cacheMutex.Unlock()
 	s.cache = nil
-	log.Println("Models cache cleared")
+	slog.Info("Models cache cleared")
 }
 
 // Helper functions for model name formatting
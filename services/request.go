@@ -2,295 +2,365 @@ package services
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"mime/multipart"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/transcript"
 	"github.com/Tyler-Dinh/z2api-go/types"
 	"github.com/Tyler-Dinh/z2api-go/utils"
 )
 
-// FormatRequest converts OpenAI/Anthropic format to Z.ai format
-func FormatRequest(data map[string]interface{}, requestType string) (map[string]interface{}, error) {
-	cfg := config.GetConfig()
-	result := make(map[string]interface{})
+// FormatOpenAIRequest validates an OpenAI chat request and converts it to Z.ai format
+func FormatOpenAIRequest(ctx context.Context, req *types.ChatRequest, chatID string) (*types.ZaiRequest, error) {
+	if err := validateChatRequest(req); err != nil {
+		return nil, err
+	}
 
-	// Copy original data
-	for k, v := range data {
-		result[k] = v
+	zaiReq := &types.ZaiRequest{
+		Model:            req.Model,
+		Messages:         []types.Message{},
+		ChatID:           chatID,
+		Temperature:      req.Temperature,
+		MaxTokens:        req.MaxTokens,
+		TopP:             req.TopP,
+		FrequencyPenalty: req.FrequencyPenalty,
+		PresencePenalty:  req.PresencePenalty,
+		Stop:             req.Stop,
+		Tools:            req.Tools,
+		ToolChoice:       req.ToolChoice,
+	}
+	if zaiReq.MaxTokens == 0 {
+		zaiReq.MaxTokens = req.MaxCompletionTokens
 	}
 
-	// Get model
-	model, ok := result["model"].(string)
-	if !ok || model == "" {
-		model = cfg.Model.Default
+	for i, msg := range req.Messages {
+		// Z.ai predates the developer role
+		role := msg.Role
+		if role == "developer" {
+			role = "system"
+		}
+
+		newMessage := types.Message{
+			Role:       role,
+			Content:    msg.Content,
+			ToolCalls:  msg.ToolCalls,
+			ToolCallID: msg.ToolCallID,
+		}
+		if msg.Content.IsBlocks() {
+			content, files, err := formatContent(ctx, msg.Content.Blocks, chatID, fmt.Sprintf("messages[%d].content", i))
+			if err != nil {
+				return nil, err
+			}
+			newMessage.Content = content
+			zaiReq.Files = append(zaiReq.Files, files...)
+		}
+		zaiReq.Messages = append(zaiReq.Messages, newMessage)
 	}
 
-	// Get chat_id
-	chatID, _ := result["chat_id"].(string)
+	features := map[string]interface{}{}
+	for k, v := range req.Features {
+		features[k] = v
+	}
 
-	// Process messages
-	newMessages := []map[string]interface{}{}
+	if err := finishRequest(ctx, zaiReq, features, enableThinking(req.EnableThinking, req.Thinking, req.ReasoningEffort)); err != nil {
+		return nil, err
+	}
+	return zaiReq, nil
+}
+
+// FormatAnthropicRequest validates an Anthropic messages request and converts it to Z.ai format
+func FormatAnthropicRequest(ctx context.Context, req *types.AnthropicMessageRequest, chatID string) (*types.ZaiRequest, error) {
+	if err := validateAnthropicRequest(req); err != nil {
+		return nil, err
+	}
+
+	zaiReq := &types.ZaiRequest{
+		Model:       req.Model,
+		Messages:    []types.Message{},
+		ChatID:      chatID,
+		Temperature: req.Temperature,
+		MaxTokens:   req.MaxTokens,
+		TopP:        req.TopP,
+		Stop:        req.StopSequences,
+	}
+
+	// Anthropic tools become OpenAI function tools
+	for _, tool := range req.Tools {
+		zaiReq.Tools = append(zaiReq.Tools, types.Tool{
+			Type: "function",
+			Function: &types.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
 
 	// Handle Anthropic system parameter
-	if system, ok := result["system"]; ok {
-		var content string
-		switch v := system.(type) {
-		case string:
-			content = strings.TrimLeft(v, "\n")
-		case []interface{}:
+	if req.System != nil {
+		content := strings.TrimLeft(req.System.Text, "\n")
+		if req.System.IsBlocks() {
 			items := []string{}
-			for _, item := range v {
-				if itemMap, ok := item.(map[string]interface{}); ok {
-					if itemMap["type"] == "text" {
-						if text, ok := itemMap["text"].(string); ok {
-							items = append(items, strings.TrimLeft(text, "\n"))
-						}
-					}
+			for _, block := range req.System.Blocks {
+				if block.Type == "text" {
+					items = append(items, strings.TrimLeft(block.Text, "\n"))
 				}
 			}
 			content = strings.Join(items, "\n\n")
 		}
 		if content != "" {
-			newMessages = append(newMessages, map[string]interface{}{
-				"role":    "system",
-				"content": content,
+			zaiReq.Messages = append(zaiReq.Messages, types.Message{
+				Role:    "system",
+				Content: types.TextContent(content),
 			})
 		}
-		delete(result, "system")
 	}
 
-	// Process messages array
-	if messages, ok := result["messages"].([]interface{}); ok {
-		for _, msg := range messages {
-			message, ok := msg.(map[string]interface{})
-			if !ok {
-				continue
-			}
-
-			role, _ := message["role"].(string)
-			content := message["content"]
-			newMessage := map[string]interface{}{"role": role}
-
-			// Handle string content
-			if contentStr, ok := content.(string); ok {
-				newMessage["content"] = contentStr
-				newMessages = append(newMessages, newMessage)
-				continue
-			}
-
-			// Handle array content
-			if contentArr, ok := content.([]interface{}); ok {
-				dontAppend := false
-				var newContent interface{} = ""
-
-				for _, item := range contentArr {
-					itemMap, ok := item.(map[string]interface{})
-					if !ok {
-						continue
-					}
-
-					itemType, _ := itemMap["type"].(string)
+	for i, msg := range req.Messages {
+		if !msg.Content.IsBlocks() {
+			zaiReq.Messages = append(zaiReq.Messages, types.Message{Role: msg.Role, Content: msg.Content})
+			continue
+		}
 
-					// Text content
-					if itemType == "text" {
-						if text, ok := itemMap["text"].(string); ok {
-							newContent = text
-						}
-						continue
+		// tool_use blocks become tool calls of the assistant message and
+		// tool_result blocks separate tool messages
+		toolCalls := []types.ToolCall{}
+		toolResults := []types.Message{}
+		blocks := []types.ContentBlock{}
+		for _, block := range msg.Content.Blocks {
+			switch block.Type {
+			case "tool_use":
+				if msg.Role != "assistant" {
+					continue
+				}
+				arguments := "{}"
+				if block.Input != nil {
+					if argBytes, err := json.Marshal(block.Input); err == nil {
+						arguments = string(argBytes)
 					}
+				}
+				toolCalls = append(toolCalls, types.ToolCall{
+					ID:   block.ID,
+					Type: "function",
+					Function: &types.FunctionCall{
+						Name:      block.Name,
+						Arguments: arguments,
+					},
+				})
+			case "tool_result":
+				result := ""
+				if block.Content != nil {
+					result = block.Content.String()
+				}
+				toolResults = append(toolResults, types.Message{
+					Role:       "tool",
+					ToolCallID: block.ToolUseID,
+					Content:    types.TextContent(result),
+				})
+			case "thinking", "redacted_thinking":
+				// Earlier reasoning is not sent back upstream
+			default:
+				blocks = append(blocks, block)
+			}
+		}
 
-					// Image content
-					if itemType == "image_url" || itemType == "image" {
-						mediaURL := ""
+		zaiReq.Messages = append(zaiReq.Messages, toolResults...)
+		if len(toolCalls) == 0 && len(blocks) == 0 {
+			continue
+		}
+		content, files, err := formatContent(ctx, blocks, chatID, fmt.Sprintf("messages.%d.content", i))
+		if err != nil {
+			return nil, err
+		}
+		zaiReq.Files = append(zaiReq.Files, files...)
+		if len(toolCalls) > 0 {
+			zaiReq.Messages = append(zaiReq.Messages, types.Message{
+				Role:      msg.Role,
+				Content:   content,
+				ToolCalls: toolCalls,
+			})
+		} else {
+			zaiReq.Messages = append(zaiReq.Messages, types.Message{
+				Role:    msg.Role,
+				Content: content,
+			})
+		}
+	}
 
-						// OpenAI format
-						if imageURL, ok := itemMap["image_url"].(map[string]interface{}); ok {
-							if urlStr, ok := imageURL["url"].(string); ok {
-								mediaURL = urlStr
-							}
-						}
+	if err := finishRequest(ctx, zaiReq, map[string]interface{}{}, enableThinking(nil, req.Thinking, "")); err != nil {
+		return nil, err
+	}
+	return zaiReq, nil
+}
 
-						// Anthropic format
-						if source, ok := itemMap["source"].(map[string]interface{}); ok {
-							if source["type"] == "base64" {
-								if data, ok := source["data"].(string); ok {
-									mediaType, _ := source["media_type"].(string)
-									if mediaType == "" {
-										mediaType = "image/jpeg"
-									}
-									mediaURL = fmt.Sprintf("data:%s;base64,%s", mediaType, data)
-								}
-							}
-						}
+// formatContent converts text, image and document blocks to Z.ai content, uploading images and documents
+//
+// Blocks may also reference files uploaded through the Files API. Parts keep
+// their order. Adjacent text parts are joined by a blank line,
+// and content without images becomes plain text. Uploaded documents are
+// returned as files of the request. Image and document errors are reported
+// for param, the path of the message content.
+func formatContent(ctx context.Context, blocks []types.ContentBlock, chatID, param string) (types.MessageContent, []types.ZaiFile, error) {
+	parts := []types.ContentBlock{}
+	files := []types.ZaiFile{}
+
+	// contentError attributes invalid images and documents to the message content
+	contentError := func(err error) (types.MessageContent, []types.ZaiFile, error) {
+		if apiErr := AsAPIError(err); apiErr.Param == "" && apiErr.Kind == ErrInvalidRequest {
+			apiErr.Param = param
+			return types.MessageContent{}, nil, apiErr
+		}
+		return types.MessageContent{}, nil, err
+	}
 
-						if mediaURL == "" {
-							// Convert newContent to array if needed
-							if contentStr, ok := newContent.(string); ok {
-								newContent = []map[string]interface{}{
-									{"type": "text", "text": contentStr},
-								}
-							}
-							if contentSlice, ok := newContent.([]map[string]interface{}); ok {
-								contentSlice = append(contentSlice, map[string]interface{}{
-									"type": "text",
-									"text": "system: image error - Unsupported format or missing URL",
-								})
-								newContent = contentSlice
-							}
-							continue
-						}
+	// appendText merges text into a directly preceding text part
+	appendText := func(text string) {
+		if text == "" {
+			return
+		}
+		if last := len(parts) - 1; last >= 0 && parts[last].Type == "text" {
+			parts[last].Text += "\n\n" + text
+			return
+		}
+		parts = append(parts, types.ContentBlock{Type: "text", Text: text})
+	}
 
-						// Upload image if it's base64
-						uploadedURL, err := UploadImage(mediaURL, chatID)
-						if err != nil {
-							// Convert newContent to array if needed
-							if contentStr, ok := newContent.(string); ok {
-								newContent = []map[string]interface{}{
-									{"type": "text", "text": contentStr},
-								}
-							}
-							if contentSlice, ok := newContent.([]map[string]interface{}); ok {
-								contentSlice = append(contentSlice, map[string]interface{}{
-									"type": "text",
-									"text": fmt.Sprintf("system: image upload error - %v", err),
-								})
-								newContent = contentSlice
-							}
-							continue
-						}
-						if uploadedURL != "" {
-							mediaURL = uploadedURL
-						}
+	for _, block := range blocks {
+		// Files API uploads are referenced by ID from file, document and image blocks
+		if id := fileReference(block); id != "" && block.Type != "text" {
+			text, part, file, err := formatFileReference(ctx, block, id, chatID)
+			if err != nil {
+				return contentError(err)
+			}
+			if part != nil {
+				parts = append(parts, *part)
+			}
+			if file != nil {
+				files = append(files, *file)
+			}
+			appendText(text)
+			continue
+		}
 
-						// Convert newContent to array if needed
-						if contentStr, ok := newContent.(string); ok {
-							newContent = []map[string]interface{}{
-								{"type": "text", "text": contentStr},
-							}
-						}
-						if contentSlice, ok := newContent.([]map[string]interface{}); ok {
-							contentSlice = append(contentSlice, map[string]interface{}{
-								"type":      "image_url",
-								"image_url": map[string]interface{}{"url": mediaURL},
-							})
-							newContent = contentSlice
-						}
-					}
+		switch block.Type {
+		case "text":
+			appendText(block.Text)
 
-					// Anthropic tool_use
-					if itemType == "tool_use" && role == "assistant" {
-						if newMessage["tool_calls"] == nil {
-							newMessage["tool_calls"] = []map[string]interface{}{}
-						}
+		case "image_url", "image":
+			mediaURL, detail := "", ""
 
-						toolCalls := newMessage["tool_calls"].([]map[string]interface{})
-						arguments := "{}"
-						if input, ok := itemMap["input"].(map[string]interface{}); ok {
-							if argBytes, err := json.Marshal(input); err == nil {
-								arguments = string(argBytes)
-							}
-						}
+			// OpenAI format
+			if block.ImageURL != nil {
+				mediaURL, detail = block.ImageURL.URL, block.ImageURL.Detail
+			}
 
-						toolCalls = append(toolCalls, map[string]interface{}{
-							"id":   itemMap["id"],
-							"type": "function",
-							"function": map[string]interface{}{
-								"name":      itemMap["name"],
-								"arguments": arguments,
-							},
-						})
-						newMessage["tool_calls"] = toolCalls
-						dontAppend = true
+			// Anthropic format
+			if block.Source != nil {
+				switch block.Source.Type {
+				case "base64":
+					mediaType := block.Source.MediaType
+					if mediaType == "" {
+						mediaType = "image/jpeg"
 					}
-
-					// Anthropic tool_result
-					if itemType == "tool_result" {
-						toolResultContent := itemMap["content"]
-						result := ""
-
-						if contentArr, ok := toolResultContent.([]interface{}); ok {
-							parts := []string{}
-							for _, c := range contentArr {
-								if cMap, ok := c.(map[string]interface{}); ok {
-									if cMap["type"] == "text" {
-										if text, ok := cMap["text"].(string); ok && text != "" {
-											parts = append(parts, text)
-										}
-									}
-								}
-							}
-							if len(parts) > 0 {
-								result = strings.Join(parts, "")
-							}
-						} else if resultStr, ok := toolResultContent.(string); ok {
-							result = resultStr
-						}
-
-						newMessages = append(newMessages, map[string]interface{}{
-							"role":         "tool",
-							"tool_call_id": itemMap["tool_use_id"],
-							"content":      result,
-						})
-						dontAppend = true
+					if block.Source.Data != "" {
+						mediaURL = fmt.Sprintf("data:%s;base64,%s", mediaType, block.Source.Data)
 					}
+				case "url":
+					mediaURL = block.Source.URL
 				}
+			}
 
-				if !dontAppend {
-					newMessage["content"] = newContent
-					newMessages = append(newMessages, newMessage)
-				}
+			if mediaURL == "" {
+				return contentError(NewAPIError(ErrInvalidRequest, "Image block has no data or URL"))
 			}
-		}
-	}
 
-	// Reverse model mapping (user-friendly ID -> source ID)
-	modelsService := GetModelsService()
-	models, _ := modelsService.GetModels()
-	if models != nil && models.Data != nil {
-		for _, m := range models.Data {
-			if m.ID == model && m.Original != nil {
-				if sourceID, ok := m.Original["id"].(string); ok && model != sourceID {
-					model = sourceID
-					break
-				}
+			// Upload the image unless running anonymously
+			uploadedURL, err := UploadImage(ctx, mediaURL, detail, chatID)
+			if err != nil {
+				return contentError(err)
+			}
+			if uploadedURL != "" {
+				mediaURL = uploadedURL
+			}
+
+			parts = append(parts, types.ContentBlock{
+				Type:     "image_url",
+				ImageURL: &types.ImageURL{URL: mediaURL},
+			})
+
+		case "file", "document":
+			text, file, err := formatDocument(ctx, block, chatID)
+			if err != nil {
+				return contentError(err)
+			}
+			if file != nil {
+				files = append(files, *file)
 			}
+			appendText(text)
 		}
 	}
 
-	result["model"] = model
-	result["messages"] = newMessages
-	result["stream"] = true
+	switch {
+	case len(parts) == 0:
+		return types.TextContent(""), files, nil
+	case len(parts) == 1 && parts[0].Type == "text":
+		return types.TextContent(parts[0].Text), files, nil
+	}
+	return types.BlockContent(parts...), files, nil
+}
 
-	// Handle features
-	features := map[string]interface{}{
-		"enable_thinking": false,
+// enableThinking resolves whether a request asks for thinking, nil when it does not say
+//
+// An explicit enable_thinking wins over an enabled or disabled thinking
+// config, which wins over reasoning_effort, where only "none" turns
+// thinking off.
+func enableThinking(enable *bool, thinking *types.ThinkingConfig, reasoningEffort string) *bool {
+	if enable != nil {
+		return enable
 	}
-	if existingFeatures, ok := result["features"].(map[string]interface{}); ok {
-		for k, v := range existingFeatures {
-			features[k] = v
+	if thinking != nil {
+		enabled := strings.EqualFold(thinking.Type, "enabled")
+		if enabled || strings.EqualFold(thinking.Type, "disabled") {
+			return &enabled
 		}
 	}
+	if reasoningEffort != "" {
+		enabled := strings.ToLower(reasoningEffort) != "none"
+		return &enabled
+	}
+	return nil
+}
+
+// finishRequest resolves the upstream model and thinking features shared by both dialects and fits the context window
+//
+// The model list is fetched once and shared by every step, so a failing
+// models endpoint costs a single retried fetch per request.
+func finishRequest(ctx context.Context, zaiReq *types.ZaiRequest, features map[string]interface{}, thinking *bool) error {
+	cfg := config.GetConfig()
+	zaiReq.Stream = true
 
-	// Handle enable_thinking from Qwen format
-	if enableThinking, ok := result["enable_thinking"]; ok {
-		features["enable_thinking"] = enableThinking
-		delete(result, "enable_thinking")
+	model := zaiReq.Model
+	if model == "" {
+		model = cfg.DefaultModel()
 	}
 
-	// Handle thinking from Anthropic/CherryStudio format
-	if thinking, ok := result["thinking"].(map[string]interface{}); ok {
-		if thinkType, ok := thinking["type"].(string); ok {
-			features["enable_thinking"] = strings.ToLower(thinkType) == "enabled"
-		}
-		delete(result, "thinking")
+	// Reverse model mapping (user-friendly ID -> source ID)
+	models, _ := GetModelsService().GetModels(ctx)
+	model = sourceModelID(models, model)
+	zaiReq.Model = model
+
+	// Thinking is off unless the client asks for it, directly or in features
+	if thinking != nil {
+		features["enable_thinking"] = *thinking
+	}
+	if _, ok := features["enable_thinking"]; !ok {
+		features["enable_thinking"] = false
 	}
 
 	// Check if model supports thinking
@@ -314,201 +384,136 @@ func FormatRequest(data map[string]interface{}, requestType string) (map[string]
 	}
 
 	if len(features) > 0 {
-		result["features"] = features
+		zaiReq.Features = features
 	}
 
-	return result, nil
+	// Fit the conversation into the model's context window
+	return fitContext(ctx, zaiReq, models)
 }
 
-// SendChatRequest sends a chat request to Z.ai API
-func SendChatRequest(data map[string]interface{}, chatID string) (*http.Response, error) {
-	cfg := config.GetConfig()
-	timestamp := time.Now().UnixMilli()
-	requestID := utils.GenerateID()
-
-	// Get user info
-	userService := GetUserService()
-	user, err := userService.GetUser()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get user info: %w", err)
+// sourceModelID maps a user-friendly model ID to the upstream source ID
+func sourceModelID(models *types.ModelsResponse, model string) string {
+	if models == nil {
+		return model
 	}
-
-	userToken := user.Token
-	userID := user.ID
-
-	// Build query parameters
-	params := url.Values{}
-	params.Set("timestamp", fmt.Sprintf("%d", timestamp))
-	params.Set("requestId", requestID)
-
-	// Build headers
-	headers := make(map[string]string)
-	for k, v := range cfg.Headers {
-		headers[k] = v
-	}
-	headers["Authorization"] = fmt.Sprintf("Bearer %s", userToken)
-	headers["Content-Type"] = "application/json"
-	headers["Referer"] = fmt.Sprintf("%s//%s/c/%s", cfg.Source.Protocol, cfg.Source.Host, chatID)
-
-	// Add signature if user is authenticated
-	if userID != "" {
-		params.Set("user_id", userID)
-
-		// Get last user message for signature
-		lastUserMessage := ""
-		if messages, ok := data["messages"].([]map[string]interface{}); ok {
-			for _, msg := range messages {
-				if role, ok := msg["role"].(string); ok && role == "user" {
-					if content, ok := msg["content"].(string); ok {
-						lastUserMessage = content
-					} else if contentArr, ok := msg["content"].([]interface{}); ok {
-						texts := []string{}
-						for _, item := range contentArr {
-							if itemMap, ok := item.(map[string]interface{}); ok {
-								if itemMap["type"] == "text" {
-									if text, ok := itemMap["text"].(string); ok {
-										texts = append(texts, text)
-										break
-									}
-								}
-							}
-						}
-						lastUserMessage = strings.Join(texts, "")
-					}
-				}
+	for _, m := range models.Data {
+		if m.ID == model && m.Original != nil {
+			if sourceID, ok := m.Original["id"].(string); ok {
+				return sourceID
 			}
 		}
-
-		// Generate signature
-		sigParams := map[string]string{
-			"requestId": requestID,
-			"timestamp": fmt.Sprintf("%d", timestamp),
-			"user_id":   userID,
-		}
-		sigResult, err := GenerateSignature(sigParams, lastUserMessage)
-		if err != nil {
-			return nil, fmt.Errorf("failed to generate signature: %w", err)
-		}
-		headers["X-Signature"] = sigResult.Signature
-		params.Set("signature_timestamp", fmt.Sprintf("%d", sigResult.Timestamp))
-		data["signature_prompt"] = lastUserMessage
-	}
-
-	// Build URL
-	apiURL := fmt.Sprintf("%s//%s/api/chat/completions?%s",
-		cfg.Source.Protocol, cfg.Source.Host, params.Encode())
-
-	// Marshal request body
-	bodyBytes, err := json.Marshal(data)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
-
-	// Create request
-	req, err := http.NewRequest("POST", apiURL, bytes.NewReader(bodyBytes))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	// Set headers
-	for k, v := range headers {
-		req.Header.Set(k, v)
-	}
-
-	// Send request
-	client := &http.Client{
-		Timeout: 0, // No timeout for streaming
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
-	}
-
-	return resp, nil
+	return model
 }
 
-// UploadImage uploads a base64 image to Z.ai API
-func UploadImage(dataURL, chatID string) (string, error) {
+// SendChatRequest sends a chat request to Z.ai API
+func SendChatRequest(ctx context.Context, zaiReq *types.ZaiRequest) (*http.Response, error) {
 	cfg := config.GetConfig()
+	chatID := zaiReq.ChatID
 
-	// Skip upload in anonymous mode or if not base64
-	if cfg.API.Anonymous || !strings.HasPrefix(dataURL, "data:") {
-		return "", nil
-	}
-
-	// Parse data URL
-	parts := strings.SplitN(dataURL, ",", 2)
-	if len(parts) != 2 {
-		return "", fmt.Errorf("invalid data URL format")
+	// Get last user message for signature
+	lastUserMessage := ""
+	for _, msg := range zaiReq.Messages {
+		if msg.Role != "user" {
+			continue
+		}
+		lastUserMessage = msg.Content.Text
+		if msg.Content.IsBlocks() {
+			lastUserMessage = ""
+			for _, block := range msg.Content.Blocks {
+				if block.Type == "text" {
+					lastUserMessage = block.Text
+					break
+				}
+			}
+		}
 	}
 
-	header := parts[0]
-	encoded := parts[1]
+	// Streams are unbounded unless UPSTREAM_TIMEOUT_CHAT_MS is set
+	client := upstreamClient(cfg.Transport.Timeouts.Chat)
 
-	// Extract MIME type (not used but kept for potential future use)
-	_ = header // Suppress unused variable warning
+	send := func(user *types.UserInfo) (*http.Response, error) {
+		userToken := user.Token
+		userID := user.ID
 
-	// Decode base64
-	imageData, err := base64.StdEncoding.DecodeString(encoded)
-	if err != nil {
-		return "", fmt.Errorf("failed to decode base64: %w", err)
-	}
+		if userID != "" {
+			zaiReq.SignaturePrompt = lastUserMessage
+		} else {
+			zaiReq.SignaturePrompt = ""
+		}
 
-	// Generate filename
-	filename := utils.GenerateID()
+		// Marshal request body
+		bodyBytes, err := json.Marshal(zaiReq)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+		transcript.FromContext(ctx).SetUpstreamRequest(bodyBytes)
+
+		// Build a fresh request per attempt so the signature timestamp stays valid
+		newRequest := func() (*http.Request, error) {
+			timestamp := time.Now().UnixMilli()
+			requestID := utils.GenerateID()
+
+			// Build query parameters
+			params := url.Values{}
+			params.Set("timestamp", fmt.Sprintf("%d", timestamp))
+			params.Set("requestId", requestID)
+
+			// Build headers
+			headers := make(map[string]string)
+			for k, v := range cfg.Headers {
+				headers[k] = v
+			}
+			headers["Authorization"] = fmt.Sprintf("Bearer %s", userToken)
+			headers["Content-Type"] = "application/json"
+			headers["Referer"] = upstreamURL("/c/" + chatID)
+
+			// Add signature if user is authenticated
+			if userID != "" {
+				params.Set("user_id", userID)
+
+				sigParams := map[string]string{
+					"requestId": requestID,
+					"timestamp": fmt.Sprintf("%d", timestamp),
+					"user_id":   userID,
+				}
+				sigResult, err := GenerateSignature(sigParams, lastUserMessage)
+				if err != nil {
+					return nil, fmt.Errorf("failed to generate signature: %w", err)
+				}
+				headers["X-Signature"] = sigResult.Signature
+				params.Set("signature_timestamp", fmt.Sprintf("%d", sigResult.Timestamp))
+			}
 
-	// Create multipart form
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	part, err := writer.CreateFormFile("file", filename)
-	if err != nil {
-		return "", fmt.Errorf("failed to create form file: %w", err)
-	}
-	if _, err := io.Copy(part, bytes.NewReader(imageData)); err != nil {
-		return "", fmt.Errorf("failed to write file data: %w", err)
-	}
-	writer.Close()
+			// Build URL
+			apiURL := upstreamURL("/api/chat/completions?" + params.Encode())
 
-	// Get user token
-	userService := GetUserService()
-	user, err := userService.GetUser()
-	if err != nil {
-		return "", fmt.Errorf("failed to get user info: %w", err)
-	}
+			// Create request
+			req, err := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewReader(bodyBytes))
+			if err != nil {
+				return nil, fmt.Errorf("failed to create request: %w", err)
+			}
 
-	// Build request
-	uploadURL := fmt.Sprintf("%s//%s/api/v1/files/", cfg.Source.Protocol, cfg.Source.Host)
-	req, err := http.NewRequest("POST", uploadURL, body)
-	if err != nil {
-		return "", fmt.Errorf("failed to create upload request: %w", err)
-	}
+			// Set headers
+			for k, v := range headers {
+				req.Header.Set(k, v)
+			}
+			return req, nil
+		}
 
-	// Set headers
-	for k, v := range cfg.Headers {
-		req.Header.Set(k, v)
+		return doWithRetry(ctx, client, cfg.Retry.Chat, "chat", newRequest)
 	}
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", user.Token))
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("Referer", fmt.Sprintf("%s//%s/c/%s", cfg.Source.Protocol, cfg.Source.Host, chatID))
 
-	// Send request
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	// Send request, refreshing credentials once on a 401
+	resp, err := withReauth(ctx, "chat", send)
 	if err != nil {
-		return "", fmt.Errorf("failed to send upload request: %w", err)
+		return nil, upstreamTransportError(err)
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("upload failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+		defer resp.Body.Close()
+		return nil, ClassifyUpstreamResponse(resp)
 	}
 
-	// Parse response
-	var result types.ImageUploadResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("failed to parse upload response: %w", err)
-	}
-
-	return fmt.Sprintf("%s_%s", result.ID, result.Filename), nil
+	return resp, nil
 }
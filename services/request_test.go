@@ -0,0 +1,294 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+func TestDecodeRequestTypeErrors(t *testing.T) {
+	tests := []struct {
+		body        string
+		wantParam   string
+		wantMessage string
+	}{
+		{`{"model":1,"messages":[]}`, "model", "expected a string, but got number"},
+		{`{"messages":[],"temperature":"hot"}`, "temperature", "expected a number, but got string"},
+		{`{"messages":[],"stream":"yes"}`, "stream", "expected a boolean, but got string"},
+		{`{"messages":{}}`, "messages", "expected an array, but got object"},
+		{`{"messages":[{"role":"user","content":42}]}`, "", "expected a string or an array of content blocks, but got number"},
+	}
+	for _, tt := range tests {
+		var req types.ChatRequest
+		err := DecodeRequest(strings.NewReader(tt.body), &req)
+
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("%s: got %v, want an APIError", tt.body, err)
+		}
+		if apiErr.Kind != ErrInvalidRequest || apiErr.Param != tt.wantParam {
+			t.Errorf("%s: got %s error for %q, want invalid_request for %q", tt.body, apiErr.Kind, apiErr.Param, tt.wantParam)
+		}
+		if !strings.Contains(apiErr.Message, tt.wantMessage) {
+			t.Errorf("%s: message %q does not contain %q", tt.body, apiErr.Message, tt.wantMessage)
+		}
+	}
+}
+
+func TestDecodeRequestUnknownFields(t *testing.T) {
+	cfg := config.GetConfig()
+	defer func(policy string) { cfg.API.UnknownFields = policy }(cfg.API.UnknownFields)
+
+	body := `{"messages":[{"role":"user","content":"Hi"}],"frobnicate":true}`
+
+	cfg.API.UnknownFields = "ignore"
+	var req types.ChatRequest
+	if err := DecodeRequest(strings.NewReader(body), &req); err != nil {
+		t.Fatalf("ignore policy: %v", err)
+	}
+
+	cfg.API.UnknownFields = "reject"
+	var apiErr *APIError
+	if err := DecodeRequest(strings.NewReader(body), &req); !errors.As(err, &apiErr) || apiErr.Param != "frobnicate" {
+		t.Fatalf("reject policy: got %v, want an error for frobnicate", err)
+	}
+}
+
+func TestFormatAnthropicRequestToolBlocks(t *testing.T) {
+	resetUpstream(t)
+
+	var req types.AnthropicMessageRequest
+	body := `{
+		"model": "glm-4.6",
+		"max_tokens": 100,
+		"system": [{"type": "text", "text": "Be brief"}],
+		"tools": [{"name": "get_weather", "input_schema": {"type": "object"}}],
+		"messages": [
+			{"role": "user", "content": "Weather in Paris?"},
+			{"role": "assistant", "content": [
+				{"type": "thinking", "thinking": "Use the tool", "signature": "sig"},
+				{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "Paris"}}
+			]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "toolu_1", "content": [{"type": "text", "text": "Sunny"}]}
+			]}
+		]
+	}`
+	if err := DecodeRequest(strings.NewReader(body), &req); err != nil {
+		t.Fatalf("DecodeRequest: %v", err)
+	}
+
+	zaiReq, err := FormatAnthropicRequest(context.Background(), &req, "chat-1")
+	if err != nil {
+		t.Fatalf("FormatAnthropicRequest: %v", err)
+	}
+
+	if len(zaiReq.Tools) != 1 || zaiReq.Tools[0].Function.Name != "get_weather" {
+		t.Errorf("tools = %+v, want the get_weather function", zaiReq.Tools)
+	}
+
+	roles := []string{}
+	for _, msg := range zaiReq.Messages {
+		roles = append(roles, msg.Role)
+	}
+	if got := strings.Join(roles, ","); got != "system,user,assistant,tool" {
+		t.Fatalf("roles = %s, want system,user,assistant,tool", got)
+	}
+
+	assistant := zaiReq.Messages[2]
+	if len(assistant.ToolCalls) != 1 || assistant.ToolCalls[0].Function.Arguments != `{"city":"Paris"}` {
+		t.Errorf("assistant tool calls = %+v", assistant.ToolCalls)
+	}
+	if tool := zaiReq.Messages[3]; tool.ToolCallID != "toolu_1" || tool.Content.String() != "Sunny" {
+		t.Errorf("tool message = %+v, want the Sunny result for toolu_1", tool)
+	}
+}
+
+func TestFormatOpenAIRequestValidation(t *testing.T) {
+	tests := []struct {
+		body      string
+		wantParam string
+	}{
+		{`{"messages":[]}`, "messages"},
+		{`{"messages":[{"role":"robot","content":"Hi"}]}`, "messages[0].role"},
+		{`{"messages":[{"role":"tool","content":"42"}]}`, "messages[0].tool_call_id"},
+		{`{"messages":[{"role":"user","content":"Hi"}],"temperature":3}`, "temperature"},
+	}
+	for _, tt := range tests {
+		var req types.ChatRequest
+		if err := DecodeRequest(strings.NewReader(tt.body), &req); err != nil {
+			t.Fatalf("%s: DecodeRequest: %v", tt.body, err)
+		}
+
+		_, err := FormatOpenAIRequest(context.Background(), &req, "chat-1")
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.Param != tt.wantParam {
+			t.Errorf("%s: got %v, want an error for %q", tt.body, err, tt.wantParam)
+		}
+	}
+}
+
+func TestFormatRequestUnsupportedContentTypes(t *testing.T) {
+	resetUpstream(t)
+	cfg := config.GetConfig()
+	defer func(policy string) { cfg.API.UnknownFields = policy }(cfg.API.UnknownFields)
+
+	openAIBody := `{"model":"glm-4.6","messages":[{"role":"user","content":[
+		{"type":"text","text":"Transcribe"},
+		{"type":"input_audio","input_audio":{"data":"UklGRg==","format":"wav"}}
+	]}]}`
+	anthropicBody := `{"model":"glm-4.6","max_tokens":100,"messages":[{"role":"user","content":"Search"},{"role":"assistant","content":[
+		{"type":"server_tool_use","id":"srvtoolu_1","name":"web_search","input":{"query":"weather"}},
+		{"type":"text","text":"It is sunny."}
+	]}]}`
+
+	// Unsupported parts are dropped by default
+	cfg.API.UnknownFields = "ignore"
+	var openAIReq types.ChatRequest
+	if err := DecodeRequest(strings.NewReader(openAIBody), &openAIReq); err != nil {
+		t.Fatalf("DecodeRequest: %v", err)
+	}
+	zaiReq, err := FormatOpenAIRequest(context.Background(), &openAIReq, "chat-1")
+	if err != nil || zaiReq.Messages[0].Content.String() != "Transcribe" {
+		t.Errorf("openai: got %+v, %v", zaiReq, err)
+	}
+	var anthropicReq types.AnthropicMessageRequest
+	if err := DecodeRequest(strings.NewReader(anthropicBody), &anthropicReq); err != nil {
+		t.Fatalf("DecodeRequest: %v", err)
+	}
+	zaiReq, err = FormatAnthropicRequest(context.Background(), &anthropicReq, "chat-1")
+	if err != nil || zaiReq.Messages[len(zaiReq.Messages)-1].Content.String() != "It is sunny." {
+		t.Errorf("anthropic: got %+v, %v", zaiReq, err)
+	}
+
+	// and fail the request with UNKNOWN_FIELDS=reject
+	cfg.API.UnknownFields = "reject"
+	var req types.ChatRequest
+	if err := DecodeRequest(strings.NewReader(`{"messages":[{"role":"user","content":[{"type":"refusal"}]}]}`), &req); err != nil {
+		t.Fatalf("DecodeRequest: %v", err)
+	}
+	var apiErr *APIError
+	if _, err := FormatOpenAIRequest(context.Background(), &req, "chat-1"); !errors.As(err, &apiErr) || apiErr.Param != "messages[0].content[0].type" {
+		t.Errorf("reject policy: got %v, want an error for messages[0].content[0].type", err)
+	}
+}
+
+func TestFormatRequestMultiPartContent(t *testing.T) {
+	resetUpstream(t)
+	image := "data:image/png;base64,iVBORw0KGgo="
+
+	var openAIReq types.ChatRequest
+	openAIBody := `{"messages":[{"role":"user","content":[
+		{"type":"text","text":"Compare"},
+		{"type":"text","text":"these images:"},
+		{"type":"image_url","image_url":{"url":"` + image + `#1"}},
+		{"type":"text","text":"and"},
+		{"type":"image_url","image_url":{"url":"` + image + `#2"}},
+		{"type":"text","text":"Which is larger?"}
+	]}]}`
+	if err := DecodeRequest(strings.NewReader(openAIBody), &openAIReq); err != nil {
+		t.Fatalf("DecodeRequest: %v", err)
+	}
+	openAIZai, err := FormatOpenAIRequest(context.Background(), &openAIReq, "chat-1")
+	if err != nil {
+		t.Fatalf("FormatOpenAIRequest: %v", err)
+	}
+
+	var anthropicReq types.AnthropicMessageRequest
+	anthropicBody := `{"model":"glm-4.6","max_tokens":100,"messages":[{"role":"user","content":[
+		{"type":"text","text":"Compare"},
+		{"type":"text","text":"these images:"},
+		{"type":"image","source":{"type":"url","url":"` + image + `#1"}},
+		{"type":"text","text":"and"},
+		{"type":"image","source":{"type":"url","url":"` + image + `#2"}},
+		{"type":"text","text":"Which is larger?"}
+	]}]}`
+	if err := DecodeRequest(strings.NewReader(anthropicBody), &anthropicReq); err != nil {
+		t.Fatalf("DecodeRequest: %v", err)
+	}
+	anthropicZai, err := FormatAnthropicRequest(context.Background(), &anthropicReq, "chat-1")
+	if err != nil {
+		t.Fatalf("FormatAnthropicRequest: %v", err)
+	}
+
+	want := []string{"text:Compare\n\nthese images:", "image:" + image + "#1", "text:and", "image:" + image + "#2", "text:Which is larger?"}
+	for dialect, zaiReq := range map[string]*types.ZaiRequest{"openai": openAIZai, "anthropic": anthropicZai} {
+		content := zaiReq.Messages[len(zaiReq.Messages)-1].Content
+		got := []string{}
+		for _, block := range content.Blocks {
+			if block.Type == "image_url" {
+				got = append(got, "image:"+block.ImageURL.URL)
+			} else {
+				got = append(got, block.Type+":"+block.Text)
+			}
+		}
+		if strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("%s: parts = %q, want %q", dialect, got, want)
+		}
+	}
+}
+
+func TestFormatRequestMultiPartText(t *testing.T) {
+	resetUpstream(t)
+
+	var req types.AnthropicMessageRequest
+	body := `{"model":"glm-4.6","max_tokens":100,"messages":[{"role":"user","content":[
+		{"type":"text","text":"First"},
+		{"type":"text","text":"Second"}
+	]}]}`
+	if err := DecodeRequest(strings.NewReader(body), &req); err != nil {
+		t.Fatalf("DecodeRequest: %v", err)
+	}
+	zaiReq, err := FormatAnthropicRequest(context.Background(), &req, "chat-1")
+	if err != nil {
+		t.Fatalf("FormatAnthropicRequest: %v", err)
+	}
+
+	content := zaiReq.Messages[0].Content
+	if content.IsBlocks() || content.Text != "First\n\nSecond" {
+		t.Errorf("content = %+v, want the plain text %q", content, "First\n\nSecond")
+	}
+}
+
+func TestFormatRequestEnableThinking(t *testing.T) {
+	resetUpstream(t)
+	tests := []struct {
+		dialect, body string
+		want          bool
+	}{
+		{"openai", `{"model":"glm-4.6","messages":[{"role":"user","content":"Hi"}]}`, false},
+		{"openai", `{"model":"glm-4.6","reasoning_effort":"high","messages":[{"role":"user","content":"Hi"}]}`, true},
+		{"openai", `{"model":"glm-4.6","reasoning_effort":"none","messages":[{"role":"user","content":"Hi"}]}`, false},
+		{"openai", `{"model":"glm-4.6","enable_thinking":false,"reasoning_effort":"high","messages":[{"role":"user","content":"Hi"}]}`, false},
+		{"openai", `{"model":"glm-4.6","thinking":{"type":"disabled"},"reasoning_effort":"high","messages":[{"role":"user","content":"Hi"}]}`, false},
+		{"anthropic", `{"model":"glm-4.6","max_tokens":100,"messages":[{"role":"user","content":"Hi"}]}`, false},
+		{"anthropic", `{"model":"glm-4.6","max_tokens":100,"thinking":{"type":"enabled","budget_tokens":1024},"messages":[{"role":"user","content":"Hi"}]}`, true},
+	}
+	for _, tt := range tests {
+		var zaiReq *types.ZaiRequest
+		var err error
+		if tt.dialect == "openai" {
+			var req types.ChatRequest
+			if err := DecodeRequest(strings.NewReader(tt.body), &req); err != nil {
+				t.Fatalf("%s: DecodeRequest: %v", tt.body, err)
+			}
+			zaiReq, err = FormatOpenAIRequest(context.Background(), &req, "chat-1")
+		} else {
+			var req types.AnthropicMessageRequest
+			if err := DecodeRequest(strings.NewReader(tt.body), &req); err != nil {
+				t.Fatalf("%s: DecodeRequest: %v", tt.body, err)
+			}
+			zaiReq, err = FormatAnthropicRequest(context.Background(), &req, "chat-1")
+		}
+		if err != nil {
+			t.Fatalf("%s: format: %v", tt.body, err)
+		}
+		if got := zaiReq.Features["enable_thinking"]; got != tt.want {
+			t.Errorf("%s: enable_thinking = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
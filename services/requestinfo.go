@@ -0,0 +1,169 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+type requestInfoKey struct{}
+
+// inFlight holds the requests currently being served
+var inFlight = struct {
+	sync.Mutex
+	requests map[*RequestInfo]struct{}
+}{requests: make(map[*RequestInfo]struct{})}
+
+// RequestInfo collects what the handlers learn about a request while serving it
+type RequestInfo struct {
+	mutex            sync.Mutex
+	id               string
+	startedAt        time.Time
+	keyID            string
+	dialect          string
+	model            string
+	chatID           string
+	stream           bool
+	promptTokens     int
+	completionTokens int
+	// Tokens of internal calls made for the request, such as context summaries
+	sidePromptTokens     int
+	sideCompletionTokens int
+	err                  string
+}
+
+// RequestSnapshot is a point-in-time copy of a RequestInfo
+type RequestSnapshot struct {
+	ID               string    `json:"id"`
+	StartedAt        time.Time `json:"started_at"`
+	KeyID            string    `json:"key_id"`
+	Dialect          string    `json:"dialect,omitempty"`
+	Model            string    `json:"model,omitempty"`
+	ChatID           string    `json:"chat_id,omitempty"`
+	Stream           bool      `json:"stream"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Error            string    `json:"error,omitempty"`
+}
+
+// NewRequestInfo creates request info for the caller identified in ctx
+func NewRequestInfo(ctx context.Context) *RequestInfo {
+	id := utils.RequestIDFromContext(ctx)
+	if id == "" {
+		id = utils.GenerateRequestID()
+	}
+	return &RequestInfo{
+		id:        id,
+		startedAt: time.Now(),
+		keyID:     CredentialsFromContext(ctx).KeyID,
+	}
+}
+
+// WithRequestInfo returns a context carrying the request info
+func WithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestInfoFromContext returns the request info, or a detached one if none is set
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo); ok {
+		return info
+	}
+	return NewRequestInfo(ctx)
+}
+
+// TrackRequest lists the request as in flight until the returned function is called
+func TrackRequest(info *RequestInfo) func() {
+	inFlight.Lock()
+	inFlight.requests[info] = struct{}{}
+	inFlight.Unlock()
+
+	return func() {
+		inFlight.Lock()
+		delete(inFlight.requests, info)
+		inFlight.Unlock()
+	}
+}
+
+// InFlightRequests returns the requests currently being served, oldest first
+func InFlightRequests() []RequestSnapshot {
+	inFlight.Lock()
+	snapshots := make([]RequestSnapshot, 0, len(inFlight.requests))
+	for info := range inFlight.requests {
+		snapshots = append(snapshots, info.Snapshot())
+	}
+	inFlight.Unlock()
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].StartedAt.Before(snapshots[j].StartedAt)
+	})
+	return snapshots
+}
+
+// ID returns the unique ID of the request
+func (i *RequestInfo) ID() string {
+	return i.id
+}
+
+// SetDialect records the API dialect of a chat request as soon as it is received
+func (i *RequestInfo) SetDialect(dialect string) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.dialect = dialect
+}
+
+// SetRequest records the translated request parameters
+func (i *RequestInfo) SetRequest(dialect, model, chatID string, stream bool) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.dialect = dialect
+	i.model = model
+	i.chatID = chatID
+	i.stream = stream
+}
+
+// SetUsage records the token counts of the request
+func (i *RequestInfo) SetUsage(promptTokens, completionTokens int) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.promptTokens = promptTokens
+	i.completionTokens = completionTokens
+}
+
+// AddSideUsage records the tokens of an internal upstream call made on the request's behalf
+func (i *RequestInfo) AddSideUsage(promptTokens, completionTokens int) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.sidePromptTokens += promptTokens
+	i.sideCompletionTokens += completionTokens
+}
+
+// SetError records why the request failed
+func (i *RequestInfo) SetError(err error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if err != nil {
+		i.err = err.Error()
+	}
+}
+
+// Snapshot returns a copy of the collected information
+func (i *RequestInfo) Snapshot() RequestSnapshot {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return RequestSnapshot{
+		ID:               i.id,
+		StartedAt:        i.startedAt,
+		KeyID:            i.keyID,
+		Dialect:          i.dialect,
+		Model:            i.model,
+		ChatID:           i.chatID,
+		Stream:           i.stream,
+		PromptTokens:     i.promptTokens + i.sidePromptTokens,
+		CompletionTokens: i.completionTokens + i.sideCompletionTokens,
+		Error:            i.err,
+	}
+}
@@ -1,223 +1,122 @@
 package services
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"regexp"
 	"strings"
 
 	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/transcript"
 	"github.com/Tyler-Dinh/z2api-go/types"
 	"github.com/Tyler-Dinh/z2api-go/utils"
 )
 
-var (
-	phaseBak = "thinking"
-)
+// StreamEvent carries either a decoded Z.ai response or a terminal stream error
+type StreamEvent struct {
+	Response *types.ZaiResponse
+	Err      error
+}
 
 // ParseSSEStream parses Server-Sent Events stream from Z.ai API
-func ParseSSEStream(resp *http.Response) <-chan *types.ZaiResponse {
-	ch := make(chan *types.ZaiResponse)
+//
+// The channel is closed after the upstream body is exhausted. A read failure,
+// an oversized or malformed event, or an error payload sent by Z.ai is
+// delivered as a final StreamEvent with Err set.
+func ParseSSEStream(resp *http.Response) <-chan StreamEvent {
+	ch := make(chan StreamEvent)
+	cfg := config.GetConfig()
+
+	// Stop sending once the consumer's request is gone
+	ctx := context.Background()
+	if resp.Request != nil {
+		ctx = resp.Request.Context()
+	}
+	send := func(event StreamEvent) bool {
+		select {
+		case ch <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
 
 	go func() {
 		defer close(ch)
-		scanner := bufio.NewScanner(resp.Body)
-
-		for scanner.Scan() {
-			line := scanner.Bytes()
+		reader := NewSSEReader(resp.Body, cfg.Source.MaxEventSize)
+		rec := transcript.FromContext(ctx)
 
-			// Skip empty lines or non-data lines
-			if len(line) == 0 || !strings.HasPrefix(string(line), "data: ") {
-				continue
+		for {
+			event, err := reader.Next()
+			if err == io.EOF {
+				return
 			}
+			if err != nil {
+				send(StreamEvent{Err: err})
+				return
+			}
+			rec.AddUpstreamFrame(event.Event, event.Data)
 
-			// Extract JSON data
-			jsonData := line[6:] // Skip "data: " prefix
-
-			var zaiResp types.ZaiResponse
-			if err := json.Unmarshal(jsonData, &zaiResp); err != nil {
+			zaiResp, err := decodeZaiEvent(event)
+			if err != nil {
+				send(StreamEvent{Err: err})
+				return
+			}
+			if zaiResp == nil {
 				continue
 			}
+			if zaiResp.Error != nil {
+				send(StreamEvent{Err: zaiResp.Error})
+				return
+			}
 
-			ch <- &zaiResp
+			if !send(StreamEvent{Response: zaiResp}) {
+				return
+			}
+			if zaiResp.Data != nil && zaiResp.Data.Done {
+				return
+			}
 		}
 	}()
 
 	return ch
 }
 
-// FormatResponse formats Z.ai response to OpenAI/Anthropic format
-func FormatResponse(data *types.ZaiResponse, responseType string) map[string]interface{} {
-	if data == nil || data.Data == nil {
-		return nil
+// decodeZaiEvent decodes one SSE event, returning nil for events without a payload
+func decodeZaiEvent(event *SSEEvent) (*types.ZaiResponse, error) {
+	data := bytes.TrimSpace(event.Data)
+	if len(data) == 0 || bytes.Equal(data, []byte("[DONE]")) {
+		return nil, nil
 	}
 
-	phase := data.Data.Phase
-	if phase == "" {
-		phase = "other"
+	var payload struct {
+		types.ZaiResponse
+		Detail string `json:"detail"`
 	}
-
-	content := data.Data.DeltaContent
-	if content == "" {
-		content = data.Data.EditContent
-	}
-	if content == "" {
-		return nil
-	}
-
-	_ = content // Keep original for potential logging
-
-	// Handle tool_call phase
-	if phase == "tool_call" {
-		content = regexp.MustCompile(`\n*<glm_block[^>]*>\{"type": "mcp", "data": \{"metadata": \{`).ReplaceAllString(content, "{")
-		content = regexp.MustCompile(`", "result": "".*</glm_block>`).ReplaceAllString(content, "")
-	} else if phase == "other" && phaseBak == "tool_call" && strings.Contains(content, "glm_block") {
-		phase = "tool_call"
-		content = regexp.MustCompile(`null, "display_result": "".*</glm_block>`).ReplaceAllString(content, "\"}")
-	}
-
-	// Get config for thinking mode
-	cfg := config.GetConfig()
-	thinkMode := cfg.API.Think
-
-	// Handle thinking/answer phase
-	if phase == "thinking" || (phase == "answer" && strings.Contains(content, "summary>")) {
-		// Remove details tags
-		content = regexp.MustCompile(`(?s)<details[^>]*?>.*?</details>`).ReplaceAllString(content, "")
-		content = strings.ReplaceAll(content, "</thinking>", "")
-		content = strings.ReplaceAll(content, "<Full>", "")
-		content = strings.ReplaceAll(content, "</Full>", "")
-
-		if phase == "thinking" {
-			content = regexp.MustCompile(`\n*<summary>.*?</summary>\n*`).ReplaceAllString(content, "\n\n")
-		}
-
-		// Convert to <reasoning> tags
-		content = regexp.MustCompile(`<details[^>]*>\n*`).ReplaceAllString(content, "<reasoning>\n\n")
-		content = regexp.MustCompile(`\n*</details>`).ReplaceAllString(content, "\n\n</reasoning>")
-
-		if phase == "answer" {
-			// Check if there's content after </reasoning>
-			re := regexp.MustCompile(`(?s)^(.*?</reasoning>)(.*)$`)
-			matches := re.FindStringSubmatch(content)
-			if len(matches) == 3 {
-				before := matches[1]
-				after := matches[2]
-				if strings.TrimSpace(after) != "" {
-					// Has content after </reasoning>
-					if phaseBak == "thinking" {
-						// Thinking pause → end thinking, add answer
-						content = fmt.Sprintf("\n\n</reasoning>\n\n%s", strings.TrimLeft(after, "\n"))
-					} else if phaseBak == "answer" {
-						// Answer pause → clear all
-						content = ""
-					}
-				} else {
-					// Thinking pause → no content after </reasoning>
-					content = "\n\n</reasoning>"
-				}
-				_ = before // Keep before for potential use
-			}
-		}
-
-		// Apply thinking mode transformations
-		switch thinkMode {
-		case "reasoning":
-			if phase == "thinking" {
-				content = regexp.MustCompile(`\n>\s?`).ReplaceAllString(content, "\n")
-			}
-			content = regexp.MustCompile(`\n*<summary>.*?</summary>\n*`).ReplaceAllString(content, "")
-			content = regexp.MustCompile(`<reasoning>\n*`).ReplaceAllString(content, "")
-			content = regexp.MustCompile(`\n*</reasoning>`).ReplaceAllString(content, "")
-
-		case "think":
-			if phase == "thinking" {
-				content = regexp.MustCompile(`\n>\s?`).ReplaceAllString(content, "\n")
-			}
-			content = regexp.MustCompile(`\n*<summary>.*?</summary>\n*`).ReplaceAllString(content, "")
-			content = strings.ReplaceAll(content, "<reasoning>", "<think>")
-			content = strings.ReplaceAll(content, "</reasoning>", "</think>")
-
-		case "strip":
-			content = regexp.MustCompile(`\n*<summary>.*?</summary>\n*`).ReplaceAllString(content, "")
-			content = regexp.MustCompile(`<reasoning>\n*`).ReplaceAllString(content, "")
-			content = regexp.MustCompile(`</reasoning>`).ReplaceAllString(content, "")
-
-		case "details":
-			if phase == "thinking" {
-				content = regexp.MustCompile(`\n>\s?`).ReplaceAllString(content, "\n")
-			}
-			content = strings.ReplaceAll(content, "<reasoning>", "<details type=\"reasoning\" open><div>")
-
-			thoughts := ""
-			if phase == "answer" {
-				// Extract before part for summary/duration
-				re := regexp.MustCompile(`(?s)^(.*?</reasoning>)`)
-				matches := re.FindStringSubmatch(content)
-				var before string
-				if len(matches) >= 2 {
-					before = matches[1]
-				}
-
-				// Check for summary
-				summaryRe := regexp.MustCompile(`(?s)<summary>.*?</summary>`)
-				summaryMatch := summaryRe.FindString(before)
-				if summaryMatch != "" {
-					thoughts = fmt.Sprintf("\n\n%s", summaryMatch)
-				} else {
-					// Check for duration
-					durationRe := regexp.MustCompile(`duration="(\d+)"`)
-					durationMatch := durationRe.FindStringSubmatch(before)
-					if len(durationMatch) >= 2 {
-						thoughts = fmt.Sprintf("\n\n<summary>Thought for %s seconds</summary>", durationMatch[1])
-					}
-				}
-			}
-			content = regexp.MustCompile(`</reasoning>`).ReplaceAllString(content, fmt.Sprintf("</div>%s</details>", thoughts))
-
-		default:
-			content = regexp.MustCompile(`</reasoning>`).ReplaceAllString(content, "</reasoning>\n\n")
+	if err := json.Unmarshal(data, &payload); err != nil {
+		if event.Event == "error" {
+			return &types.ZaiResponse{Error: &types.ZaiError{Message: string(data)}}, nil
 		}
+		return nil, fmt.Errorf("invalid upstream event: %w", err)
 	}
 
-	phaseBak = phase
+	zaiResp := payload.ZaiResponse
 
-	// Return formatted response based on type
-	if phase == "thinking" && thinkMode == "reasoning" {
-		if responseType == "Anthropic" {
-			return map[string]interface{}{
-				"type":     "thinking_delta",
-				"thinking": content,
-			}
-		}
-		return map[string]interface{}{
-			"role":              "assistant",
-			"reasoning_content": content,
-		}
+	// Z.ai reports errors either at the top level or inside data
+	if zaiResp.Error == nil && zaiResp.Data != nil && zaiResp.Data.Error != nil {
+		zaiResp.Error = zaiResp.Data.Error
 	}
-
-	if phase == "tool_call" {
-		return map[string]interface{}{
-			"tool_call": content,
-		}
+	if zaiResp.Error == nil && payload.Detail != "" && zaiResp.Data == nil {
+		zaiResp.Error = &types.ZaiError{Detail: payload.Detail}
 	}
-
-	if content != "" {
-		if responseType == "Anthropic" {
-			return map[string]interface{}{
-				"type": "text_delta",
-				"text": content,
-			}
-		}
-		return map[string]interface{}{
-			"role":    "assistant",
-			"content": content,
-		}
+	if zaiResp.Error == nil && event.Event == "error" {
+		zaiResp.Error = &types.ZaiError{Message: string(data)}
 	}
 
-	return nil
+	return &zaiResp, nil
 }
 
 // CountTokens counts tokens in text using tiktoken
@@ -225,32 +124,20 @@ func CountTokens(text string) int {
 	return utils.CountTokens(text)
 }
 
+// EstimatePromptTokens estimates the prompt tokens of a Z.ai request, including uploaded documents
+func EstimatePromptTokens(zaiReq *types.ZaiRequest) int {
+	tokens := CountTokens(ExtractTextFromMessages(zaiReq.Messages))
+	for _, file := range zaiReq.Files {
+		tokens += file.Tokens
+	}
+	return tokens
+}
+
 // ExtractTextFromMessages extracts all text content from messages for token counting
-func ExtractTextFromMessages(messages []map[string]interface{}) string {
+func ExtractTextFromMessages(messages []types.Message) string {
 	var texts []string
-
 	for _, msg := range messages {
-		content := msg["content"]
-
-		// Handle string content
-		if contentStr, ok := content.(string); ok {
-			texts = append(texts, contentStr)
-			continue
-		}
-
-		// Handle array content
-		if contentArr, ok := content.([]interface{}); ok {
-			for _, item := range contentArr {
-				if itemMap, ok := item.(map[string]interface{}); ok {
-					if itemMap["type"] == "text" {
-						if text, ok := itemMap["text"].(string); ok {
-							texts = append(texts, text)
-						}
-					}
-				}
-			}
-		}
+		texts = append(texts, msg.Content.String())
 	}
-
 	return strings.Join(texts, "")
 }
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+)
+
+// maxRetryAfter caps how long an upstream Retry-After header can make us wait
+const maxRetryAfter = 30 * time.Second
+
+// doWithRetry sends the request built by newRequest, retrying transient failures
+//
+// newRequest is called for every attempt so that time-sensitive parameters such
+// as the signature timestamp are regenerated. Retries only happen before a
+// response is handed back to the caller, so nothing has been streamed to the
+// client yet. Transport errors of non-idempotent requests such as the chat
+// POST are only retried when the request was never written, so a connection
+// lost mid-request cannot start a second completion. The last response is
+// returned as-is when retries are exhausted and the caller owns its body.
+func doWithRetry(ctx context.Context, client *http.Client, policy config.RetryPolicy, op string, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	attempts := policy.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		// Fail fast while the upstream is known to be degraded
+		done, err := GetUpstreamBreaker().allow(op)
+		if err != nil {
+			return nil, err
+		}
+
+		// Note whether the request reached the upstream in full
+		var written atomic.Bool
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			WroteRequest: func(info httptrace.WroteRequestInfo) {
+				written.Store(info.Err == nil)
+			},
+		}))
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		done(classifyOutcome(ctx, resp, err), time.Since(start))
+		upstreamRequests.Inc(op, outcomeLabel(resp, err))
+
+		// Give up on success, permanent failures or when out of attempts
+		replayable := isIdempotent(req.Method) || !written.Load()
+		if attempt >= attempts || !shouldRetry(ctx, replayable, resp, err) {
+			return resp, err
+		}
+
+		delay := backoffDelay(policy, attempt)
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				if retryAfter > maxRetryAfter {
+					// Waiting that long would exceed any sane client timeout
+					return resp, nil
+				}
+				delay = retryAfter
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+
+		slog.WarnContext(ctx, "Upstream attempt failed, retrying", "op", op, "attempt", attempt, "max_attempts", attempts, "reason", reason, "delay_ms", delay.Milliseconds())
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// shouldRetry reports whether an attempt failed in a way that may succeed later
+//
+// replayable tells whether a transport error may be retried because the
+// request is idempotent or was not sent.
+func shouldRetry(ctx context.Context, replayable bool, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if err != nil {
+		return replayable && !errors.Is(err, context.Canceled)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+		529:
+		return true
+	}
+	return false
+}
+
+// isIdempotent reports whether repeating a request of the method has no further effect
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// backoffDelay returns an exponential delay with equal jitter for the given attempt
+func backoffDelay(policy config.RetryPolicy, attempt int) time.Duration {
+	delay := policy.BaseDelay
+	for i := 1; i < attempt && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// parseRetryAfter parses a Retry-After header in seconds or HTTP-date form
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(value); err == nil {
+		delay := time.Until(at)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+
+	return 0, false
+}
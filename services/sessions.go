@@ -0,0 +1,226 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/metrics"
+	"github.com/Tyler-Dinh/z2api-go/types"
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+// ConversationHeader is the request header clients set to identify a conversation
+const ConversationHeader = "X-Conversation-ID"
+
+var sessionsResolved = metrics.NewCounterVec(
+	"z2api_sessions_total",
+	"Chat requests with session affinity, by whether they started or resumed an upstream chat",
+	"result",
+)
+
+// Session links a request to an upstream chat
+type Session struct {
+	ChatID string
+	// MessageID is the ID of this turn's response, UserMessageID that of its user message
+	MessageID     string
+	UserMessageID string
+	// ParentID is the response ID of the previous turn, empty for a new chat
+	ParentID string
+
+	// key stores the session for the next turn, empty without affinity
+	key string
+}
+
+// Apply sets the chat and message IDs of a Z.ai request
+func (s *Session) Apply(zaiReq *types.ZaiRequest) {
+	zaiReq.ChatID = s.ChatID
+	zaiReq.ID = s.MessageID
+	zaiReq.UserMessageID = s.UserMessageID
+	zaiReq.ParentID = s.ParentID
+}
+
+// SessionStore remembers the upstream chat of client conversations
+//
+// A conversation is identified by the X-Conversation-ID header, or
+// otherwise by its messages: a turn resumes the chat whose earlier request
+// had exactly the messages preceding the last assistant message. Sessions
+// are scoped to the caller's credentials and Anthropic metadata.user_id,
+// and bounded by SESSION_TTL_MS and SESSION_MAX.
+type SessionStore struct {
+	mutex sync.Mutex
+	items map[string]*list.Element
+	order *list.List
+}
+
+type sessionEntry struct {
+	key       string
+	chatID    string
+	messageID string
+	expiresAt time.Time
+}
+
+var (
+	sessionStore     *SessionStore
+	sessionStoreOnce sync.Once
+)
+
+// GetSessionStore returns the singleton session store
+func GetSessionStore() *SessionStore {
+	sessionStoreOnce.Do(func() {
+		sessionStore = &SessionStore{
+			items: make(map[string]*list.Element),
+			order: list.New(),
+		}
+	})
+	return sessionStore
+}
+
+// Resolve returns the session of a request, resuming the upstream chat of its conversation if known
+//
+// conversationID is the client's conversation identifier, or empty to match
+// the conversation by its messages. userID is the end user the client named,
+// if any; a user may have several conversations, so it only narrows the
+// match. Without SESSION_AFFINITY, and in anonymous mode where the upstream
+// identity changes, every request starts a new chat.
+func (s *SessionStore) Resolve(ctx context.Context, conversationID, userID string, system *types.MessageContent, messages []types.Message) *Session {
+	session := &Session{
+		ChatID:        utils.GenerateID(),
+		MessageID:     utils.GenerateID(),
+		UserMessageID: utils.GenerateID(),
+	}
+	if !config.GetConfig().Sessions.Enabled || isAnonymous(ctx) {
+		return session
+	}
+
+	scope := sessionScope(ctx)
+	if userID != "" {
+		scope += "user:" + userID + ":"
+	}
+	lookupKey := ""
+	if conversationID != "" {
+		session.key = scope + "conversation:" + conversationID
+		lookupKey = session.key
+	} else {
+		session.key = scope + "prefix:" + conversationFingerprint(system, messages)
+
+		// The previous request ended where the client added our response
+		for i := len(messages) - 1; i >= 0; i-- {
+			if messages[i].Role == "assistant" {
+				lookupKey = scope + "prefix:" + conversationFingerprint(system, messages[:i])
+				break
+			}
+		}
+	}
+
+	if lookupKey != "" {
+		if chatID, parentID, ok := s.get(lookupKey); ok {
+			session.ChatID, session.ParentID = chatID, parentID
+			sessionsResolved.Inc("resumed")
+			slog.DebugContext(ctx, "Resumed upstream chat", "chat_id", chatID, "parent_id", parentID)
+			return session
+		}
+	}
+	sessionsResolved.Inc("new")
+	return session
+}
+
+// Commit remembers a session once its response completed, so the next turn resumes it
+func (s *SessionStore) Commit(session *Session) {
+	if session.key == "" {
+		return
+	}
+	cfg := config.GetConfig()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if elem, ok := s.items[session.key]; ok {
+		s.order.Remove(elem)
+	}
+	s.items[session.key] = s.order.PushFront(&sessionEntry{
+		key:       session.key,
+		chatID:    session.ChatID,
+		messageID: session.MessageID,
+		expiresAt: time.Now().Add(cfg.Sessions.TTL),
+	})
+
+	// Evict the least recently used sessions
+	for s.order.Len() > cfg.Sessions.MaxSessions {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*sessionEntry).key)
+	}
+}
+
+// Len returns the number of stored sessions, including expired ones not yet evicted
+func (s *SessionStore) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.order.Len()
+}
+
+// Clear drops all sessions
+func (s *SessionStore) Clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.items = make(map[string]*list.Element)
+	s.order.Init()
+	slog.Info("Session store cleared")
+}
+
+// get returns the chat and last response IDs of a fresh session and marks it as recently used
+func (s *SessionStore) get(key string) (string, string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	elem, ok := s.items[key]
+	if !ok {
+		return "", "", false
+	}
+	entry := elem.Value.(*sessionEntry)
+	if !time.Now().Before(entry.expiresAt) {
+		s.order.Remove(elem)
+		delete(s.items, key)
+		return "", "", false
+	}
+	s.order.MoveToFront(elem)
+	return entry.chatID, entry.messageID, true
+}
+
+// sessionScope keeps sessions of different API keys and upstream tokens apart
+func sessionScope(ctx context.Context) string {
+	creds := CredentialsFromContext(ctx)
+	token := ""
+	if creds.UpstreamToken != "" {
+		sum := sha256.Sum256([]byte(creds.UpstreamToken))
+		token = hex.EncodeToString(sum[:8])
+	}
+	return creds.KeyID + ":" + token + ":"
+}
+
+// conversationFingerprint hashes the system prompt and the role, text and tool links of messages
+func conversationFingerprint(system *types.MessageContent, messages []types.Message) string {
+	h := sha256.New()
+	if system != nil {
+		fmt.Fprintf(h, "system\x00%s\x00", system.String())
+	}
+	for _, msg := range messages {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00", msg.Role, msg.Content.String(), msg.ToolCallID)
+		for _, call := range msg.ToolCalls {
+			fmt.Fprintf(h, "call\x00%s\x00", call.ID)
+		}
+		for _, block := range msg.Content.Blocks {
+			if block.Type == "tool_use" || block.Type == "tool_result" {
+				fmt.Fprintf(h, "%s\x00%s%s\x00", block.Type, block.ID, block.ToolUseID)
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+// enableSessions turns on session affinity for one test
+func enableSessions(t *testing.T) *SessionStore {
+	t.Helper()
+	cfg := config.GetConfig()
+	enabled := cfg.Sessions.Enabled
+	cfg.Sessions.Enabled = true
+	t.Cleanup(func() { cfg.Sessions.Enabled = enabled })
+
+	store := GetSessionStore()
+	store.Clear()
+	return store
+}
+
+func textMessage(role, text string) types.Message {
+	return types.Message{Role: role, Content: types.TextContent(text)}
+}
+
+func TestSessionResumesByMessagePrefix(t *testing.T) {
+	store := enableSessions(t)
+	ctx := WithCredentials(context.Background(), Credentials{KeyID: "k1", UpstreamToken: "client-token"})
+	system := types.TextContent("Be brief")
+
+	turn1 := []types.Message{textMessage("user", "Hi")}
+	first := store.Resolve(ctx, "", "", &system, turn1)
+	if first.ParentID != "" {
+		t.Errorf("first turn has parent %q", first.ParentID)
+	}
+	store.Commit(first)
+
+	turn2 := append(turn1, textMessage("assistant", "Hello!"), textMessage("user", "How are you?"))
+	second := store.Resolve(ctx, "", "", &system, turn2)
+	if second.ChatID != first.ChatID || second.ParentID != first.MessageID {
+		t.Errorf("second turn = %+v, want chat %s with parent %s", second, first.ChatID, first.MessageID)
+	}
+	store.Commit(second)
+
+	// Regenerating the second turn branches from the same parent
+	again := store.Resolve(ctx, "", "", &system, turn2)
+	if again.ChatID != first.ChatID || again.ParentID != first.MessageID {
+		t.Errorf("regenerated turn = %+v, want parent %s", again, first.MessageID)
+	}
+
+	// A different system prompt, history or API key is another conversation
+	other := types.TextContent("Be verbose")
+	if s := store.Resolve(ctx, "", "", &other, turn2); s.ChatID == first.ChatID {
+		t.Errorf("conversation with another system prompt resumed the chat")
+	}
+	edited := []types.Message{textMessage("user", "Hey"), textMessage("assistant", "Hello!"), textMessage("user", "How are you?")}
+	if s := store.Resolve(ctx, "", "", &system, edited); s.ChatID == first.ChatID {
+		t.Errorf("conversation with an edited history resumed the chat")
+	}
+	otherKey := WithCredentials(context.Background(), Credentials{KeyID: "k2", UpstreamToken: "client-token"})
+	if s := store.Resolve(otherKey, "", "", &system, turn2); s.ChatID == first.ChatID {
+		t.Errorf("another API key resumed the chat")
+	}
+}
+
+func TestSessionResumesByConversationID(t *testing.T) {
+	store := enableSessions(t)
+	ctx := WithCredentials(context.Background(), Credentials{UpstreamToken: "client-token"})
+
+	first := store.Resolve(ctx, "conv-1", "", nil, []types.Message{textMessage("user", "Hi")})
+	store.Commit(first)
+
+	// The conversation ID wins over the messages
+	second := store.Resolve(ctx, "conv-1", "", nil, []types.Message{textMessage("user", "Something else")})
+	if second.ChatID != first.ChatID || second.ParentID != first.MessageID {
+		t.Errorf("second turn = %+v, want chat %s with parent %s", second, first.ChatID, first.MessageID)
+	}
+	if s := store.Resolve(ctx, "conv-2", "", nil, []types.Message{textMessage("user", "Hi")}); s.ChatID == first.ChatID {
+		t.Errorf("another conversation ID resumed the chat")
+	}
+}
+
+func TestSessionStoreBounds(t *testing.T) {
+	store := enableSessions(t)
+	ctx := WithCredentials(context.Background(), Credentials{UpstreamToken: "client-token"})
+	cfg := config.GetConfig()
+	defer func(limit int) { cfg.Sessions.MaxSessions = limit }(cfg.Sessions.MaxSessions)
+	cfg.Sessions.MaxSessions = 2
+
+	first := store.Resolve(ctx, "conv-1", "", nil, nil)
+	store.Commit(first)
+	store.Commit(store.Resolve(ctx, "conv-2", "", nil, nil))
+	store.Commit(store.Resolve(ctx, "conv-3", "", nil, nil))
+	if n := store.Len(); n != 2 {
+		t.Errorf("store holds %d sessions, want 2", n)
+	}
+	if s := store.Resolve(ctx, "conv-1", "", nil, nil); s.ChatID == first.ChatID {
+		t.Errorf("least recently used session was not evicted")
+	}
+}
+
+func TestSessionAffinityDisabled(t *testing.T) {
+	store := enableSessions(t)
+	config.GetConfig().Sessions.Enabled = false
+	ctx := WithCredentials(context.Background(), Credentials{UpstreamToken: "client-token"})
+
+	first := store.Resolve(ctx, "conv-1", "", nil, nil)
+	store.Commit(first)
+	if s := store.Resolve(ctx, "conv-1", "", nil, nil); s.ChatID == first.ChatID || store.Len() != 0 {
+		t.Errorf("session resumed with SESSION_AFFINITY disabled")
+	}
+
+	// Anonymous identities change, so their chats are never resumed
+	config.GetConfig().Sessions.Enabled = true
+	first = store.Resolve(context.Background(), "conv-1", "", nil, nil)
+	store.Commit(first)
+	if s := store.Resolve(context.Background(), "conv-1", "", nil, nil); s.ChatID == first.ChatID {
+		t.Errorf("session resumed in anonymous mode")
+	}
+}
@@ -79,4 +79,4 @@ func hmacSHA256(key, message []byte) string {
 	h := hmac.New(sha256.New, key)
 	h.Write(message)
 	return hex.EncodeToString(h.Sum(nil))
-}
\ No newline at end of file
+}
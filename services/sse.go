@@ -0,0 +1,163 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// DefaultMaxEventSize is the default upper bound for a single SSE event
+const DefaultMaxEventSize = 8 << 20
+
+// maxFieldOverhead is the room left on a line for the "data: " field name and a CRLF line ending
+const maxFieldOverhead = len("data: \r\n")
+
+// ErrEventTooLarge is returned when an SSE event exceeds the configured size
+var ErrEventTooLarge = errors.New("sse: event exceeds maximum size")
+
+// SSEEvent represents a single dispatched Server-Sent Event
+type SSEEvent struct {
+	Event string
+	Data  []byte
+	ID    string
+	Retry int
+}
+
+// SSEReader reads Server-Sent Events as defined by the WHATWG HTML spec
+type SSEReader struct {
+	scanner      *bufio.Scanner
+	maxEventSize int
+	lastID       string
+}
+
+// NewSSEReader creates a reader that rejects events larger than maxEventSize bytes
+func NewSSEReader(r io.Reader, maxEventSize int) *SSEReader {
+	if maxEventSize <= 0 {
+		maxEventSize = DefaultMaxEventSize
+	}
+
+	scanner := bufio.NewScanner(r)
+	initial := 64 * 1024
+	if initial > maxEventSize {
+		initial = maxEventSize
+	}
+	// A line holds at most the whole event data after its field name, plus the line ending
+	scanner.Buffer(make([]byte, 0, initial), maxEventSize+maxFieldOverhead)
+	scanner.Split(scanSSELines)
+
+	return &SSEReader{
+		scanner:      scanner,
+		maxEventSize: maxEventSize,
+	}
+}
+
+// Next returns the next event, io.EOF at the end of the stream, or a read error
+func (r *SSEReader) Next() (*SSEEvent, error) {
+	var (
+		data      bytes.Buffer
+		eventType string
+		retry     int
+		hasData   bool
+	)
+
+	dispatch := func() *SSEEvent {
+		return &SSEEvent{
+			Event: eventType,
+			Data:  bytes.TrimSuffix(data.Bytes(), []byte("\n")),
+			ID:    r.lastID,
+			Retry: retry,
+		}
+	}
+
+	for r.scanner.Scan() {
+		line := r.scanner.Bytes()
+
+		// Blank line dispatches the pending event
+		if len(line) == 0 {
+			if hasData {
+				return dispatch(), nil
+			}
+			eventType = ""
+			continue
+		}
+
+		// Comment line
+		if line[0] == ':' {
+			continue
+		}
+
+		field, value := line, []byte(nil)
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			field = line[:i]
+			value = line[i+1:]
+			if len(value) > 0 && value[0] == ' ' {
+				value = value[1:]
+			}
+		}
+
+		switch string(field) {
+		case "data":
+			// Lines are joined with newlines, so the buffered separators count but the last one does not
+			if data.Len()+len(value) > r.maxEventSize {
+				return nil, ErrEventTooLarge
+			}
+			data.Write(value)
+			data.WriteByte('\n')
+			hasData = true
+		case "event":
+			eventType = string(value)
+		case "id":
+			if bytes.IndexByte(value, 0) < 0 {
+				r.lastID = string(value)
+			}
+		case "retry":
+			if n, err := strconv.Atoi(string(value)); err == nil {
+				retry = n
+			}
+		}
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return nil, ErrEventTooLarge
+		}
+		return nil, fmt.Errorf("sse: read failed: %w", err)
+	}
+
+	// Be lenient with upstreams that close without a trailing blank line
+	if hasData {
+		return dispatch(), nil
+	}
+
+	return nil, io.EOF
+}
+
+// scanSSELines splits input on CRLF, LF or a lone CR
+func scanSSELines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		// A CR at the end of the buffer may be followed by LF in the next read
+		if i+1 == len(data) && !atEOF {
+			return 0, nil, nil
+		}
+		if i+1 < len(data) && data[i+1] == '\n' {
+			return i + 2, data[:i], nil
+		}
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
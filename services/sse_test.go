@@ -0,0 +1,88 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readEvents reads every event of a stream
+func readEvents(t *testing.T, stream string, maxEventSize int) ([]SSEEvent, error) {
+	t.Helper()
+	reader := NewSSEReader(strings.NewReader(stream), maxEventSize)
+	events := []SSEEvent{}
+	for {
+		event, err := reader.Next()
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, *event)
+	}
+}
+
+func TestSSEReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		want   []SSEEvent
+	}{
+		{"single event", "data: {\"a\":1}\n\n", []SSEEvent{{Data: []byte(`{"a":1}`)}}},
+		{"multi-line data", "data: first\ndata:second\ndata:  third\n\n", []SSEEvent{{Data: []byte("first\nsecond\n third")}}},
+		{"CRLF line endings", "event: update\r\ndata: one\r\n\r\ndata: two\r\n\r\n", []SSEEvent{{Event: "update", Data: []byte("one")}, {Data: []byte("two")}}},
+		{"CR line endings", "data: one\r\rdata: two\r\r", []SSEEvent{{Data: []byte("one")}, {Data: []byte("two")}}},
+		{"event type resets per event", "event: error\ndata: bad\n\ndata: good\n\n", []SSEEvent{{Event: "error", Data: []byte("bad")}, {Data: []byte("good")}}},
+		{"comments and unknown fields", ": keep-alive\nfoo: bar\ndata: x\n: more\n\n", []SSEEvent{{Data: []byte("x")}}},
+		{"id and retry", "id: 7\nretry: 1500\ndata: x\n\ndata: y\n\n", []SSEEvent{{Data: []byte("x"), ID: "7", Retry: 1500}, {Data: []byte("y"), ID: "7"}}},
+		{"event without data is ignored", "event: ping\n\ndata: x\n\n", []SSEEvent{{Data: []byte("x")}}},
+		{"final event without trailing blank line", "data: one\n\ndata: last", []SSEEvent{{Data: []byte("one")}, {Data: []byte("last")}}},
+		{"empty stream", "", []SSEEvent{}},
+	}
+	for _, tt := range tests {
+		events, err := readEvents(t, tt.stream, 0)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(events) != len(tt.want) {
+			t.Errorf("%s: got %d events %+v, want %d", tt.name, len(events), events, len(tt.want))
+			continue
+		}
+		for i, event := range events {
+			want := tt.want[i]
+			if event.Event != want.Event || string(event.Data) != string(want.Data) || event.ID != want.ID || event.Retry != want.Retry {
+				t.Errorf("%s: event %d = %+v (data %q), want %+v (data %q)", tt.name, i, event, event.Data, want, want.Data)
+			}
+		}
+	}
+}
+
+func TestSSEReaderMaxEventSize(t *testing.T) {
+	const max = 1024
+	tests := []struct {
+		name    string
+		stream  string
+		tooLong bool
+	}{
+		{"one line at the limit", "data: " + strings.Repeat("a", max) + "\r\n\r\n", false},
+		{"one line over the limit", "data: " + strings.Repeat("a", max+1) + "\n\n", true},
+		{"lines at the limit", "data: " + strings.Repeat("a", max/2) + "\ndata: " + strings.Repeat("b", max/2-1) + "\n\n", false},
+		{"lines over the limit", "data: " + strings.Repeat("a", max/2) + "\ndata: " + strings.Repeat("b", max/2) + "\n\n", true},
+		{"long line that is not data", ": " + strings.Repeat("c", 2*max) + "\ndata: x\n\n", true},
+	}
+	for _, tt := range tests {
+		events, err := readEvents(t, tt.stream, max)
+		if tt.tooLong {
+			if !errors.Is(err, ErrEventTooLarge) {
+				t.Errorf("%s: err = %v, want ErrEventTooLarge", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || len(events) != 1 {
+			t.Errorf("%s: %d events, err %v", tt.name, len(events), err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/metrics"
+)
+
+var (
+	// transport overrides the pooled transport when set
+	transport      http.RoundTripper
+	transportMutex sync.RWMutex
+
+	pooledTransport     *http.Transport
+	pooledTransportErr  error
+	pooledTransportOnce sync.Once
+)
+
+// Connection stats of the pooled transport
+var (
+	upstreamConnsOpen = metrics.NewGaugeVec(
+		"z2api_upstream_connections_open",
+		"Connections to the upstream or its proxy that are currently open",
+	)
+	upstreamDials = metrics.NewCounterVec(
+		"z2api_upstream_dials_total",
+		"New connections dialed to the upstream or its proxy, by result",
+		"result",
+	)
+	upstreamConnsAcquired = metrics.NewCounterVec(
+		"z2api_upstream_connections_acquired_total",
+		"Connections taken for upstream requests, by whether an idle pooled connection was reused",
+		"reused",
+	)
+)
+
+// InitTransport builds the pooled transport shared by all upstream calls
+//
+// It fails if the CA bundle cannot be loaded. Upstream calls made before a
+// successful InitTransport fall back to http.DefaultTransport.
+func InitTransport() error {
+	pooledTransportOnce.Do(func() {
+		pooledTransport, pooledTransportErr = newUpstreamTransport(config.GetConfig().Transport)
+		upstreamConnsOpen.Set(0)
+	})
+	return pooledTransportErr
+}
+
+// SetTransport replaces the HTTP transport used for all upstream calls
+//
+// Tests use it to route requests to a fake upstream or through a cassette
+// recorder; passing nil restores the pooled transport.
+func SetTransport(rt http.RoundTripper) {
+	transportMutex.Lock()
+	defer transportMutex.Unlock()
+	transport = rt
+}
+
+// upstreamClient returns an HTTP client for upstream calls; zero timeout means none
+//
+// Clients are cheap to create, the pooled transport behind them is shared.
+func upstreamClient(timeout time.Duration) *http.Client {
+	transportMutex.RLock()
+	rt := transport
+	transportMutex.RUnlock()
+
+	if rt == nil {
+		if err := InitTransport(); err != nil {
+			rt = http.DefaultTransport
+		} else {
+			rt = pooledTransport
+		}
+	}
+	return &http.Client{Transport: tracingTransport{rt}, Timeout: timeout}
+}
+
+// upstreamURL returns the absolute URL of an upstream path
+func upstreamURL(path string) string {
+	return config.GetConfig().Source.BaseURL() + path
+}
+
+// newUpstreamTransport builds a pooled transport from the configuration
+func newUpstreamTransport(cfg config.TransportConfig) (*http.Transport, error) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: cfg.KeepAlive,
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CABundle != "" {
+		pool, err := loadCABundle(cfg.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// UPSTREAM_PROXY takes precedence over the standard proxy variables
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse upstream proxy: %w", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           countingDialer(dialer.DialContext),
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     cfg.HTTP2,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}, nil
+}
+
+// loadCABundle returns the system roots extended with the certificates of a PEM file
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		slog.Warn("System certificate pool unavailable, trusting only the CA bundle", "error", err)
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// countingDialer wraps dial to track open connections
+func countingDialer(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			upstreamDials.Inc("error")
+			return nil, err
+		}
+		upstreamDials.Inc("success")
+		upstreamConnsOpen.Add(1)
+		return &countedConn{Conn: conn}, nil
+	}
+}
+
+// countedConn decrements the open connection count once when closed
+type countedConn struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (c *countedConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		upstreamConnsOpen.Add(-1)
+	}
+	return c.Conn.Close()
+}
+
+// tracingTransport records whether each request reused a pooled connection
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			upstreamConnsAcquired.Inc(strconv.FormatBool(info.Reused))
+		},
+	}
+	return t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
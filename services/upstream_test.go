@@ -0,0 +1,430 @@
+package services
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/fakezai"
+	"github.com/Tyler-Dinh/z2api-go/metrics"
+	"github.com/Tyler-Dinh/z2api-go/types"
+)
+
+// chatRequest translates a one-message OpenAI request and sends it upstream
+func chatRequest(t *testing.T, ctx context.Context, prompt string) *http.Response {
+	t.Helper()
+
+	zaiReq, err := FormatOpenAIRequest(ctx, &types.ChatRequest{
+		Model:    "glm-4.6",
+		Messages: []types.Message{{Role: "user", Content: types.TextContent(prompt)}},
+	}, "chat-1")
+	if err != nil {
+		t.Fatalf("FormatOpenAIRequest: %v", err)
+	}
+	zaiReq.ID = "message-1"
+
+	resp, err := SendChatRequest(ctx, zaiReq)
+	if err != nil {
+		t.Fatalf("SendChatRequest: %v", err)
+	}
+	return resp
+}
+
+// collectStream drains a chat stream into its concatenated delta content
+func collectStream(resp *http.Response) (string, error) {
+	defer resp.Body.Close()
+
+	var content strings.Builder
+	for event := range ParseSSEStream(resp) {
+		if event.Err != nil {
+			return content.String(), event.Err
+		}
+		if data := event.Response.Data; data != nil {
+			content.WriteString(data.DeltaContent)
+		}
+	}
+	return content.String(), nil
+}
+
+func TestGetModelsFromFakeUpstream(t *testing.T) {
+	resetUpstream(t)
+
+	models, err := GetModelsService().GetModels(context.Background())
+	if err != nil {
+		t.Fatalf("GetModels: %v", err)
+	}
+	if len(models.Data) != 3 {
+		t.Fatalf("got %d models, want 3", len(models.Data))
+	}
+
+	requests := fake.Requests(fakezai.PathModels)
+	if len(requests) != 1 {
+		t.Fatalf("got %d model requests, want 1", len(requests))
+	}
+	if got := requests[0].Header.Get("Authorization"); got != "Bearer fake-token" {
+		t.Errorf("Authorization = %q, want the guest token", got)
+	}
+
+	// Served from cache the second time
+	if _, err := GetModelsService().GetModels(context.Background()); err != nil {
+		t.Fatalf("GetModels: %v", err)
+	}
+	if n := len(fake.Requests(fakezai.PathModels)); n != 1 {
+		t.Errorf("got %d model requests after a cached call, want 1", n)
+	}
+}
+
+func TestSendChatRequestStreamsAndSigns(t *testing.T) {
+	resetUpstream(t)
+	fake.Queue(fakezai.PathChat, fakezai.Chat(
+		fakezai.Answer("Hello"),
+		fakezai.Answer(", world"),
+		fakezai.Done(),
+	))
+
+	content, err := collectStream(chatRequest(t, context.Background(), "Say hello"))
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if content != "Hello, world" {
+		t.Errorf("content = %q, want %q", content, "Hello, world")
+	}
+
+	requests := fake.Requests(fakezai.PathChat)
+	if len(requests) != 1 {
+		t.Fatalf("got %d chat requests, want 1", len(requests))
+	}
+	if requests[0].Header.Get("X-Signature") == "" {
+		t.Error("chat request is not signed")
+	}
+	if !strings.Contains(requests[0].RawQuery, "user_id=fake-user") {
+		t.Errorf("query %q does not carry the user ID", requests[0].RawQuery)
+	}
+	if !strings.Contains(string(requests[0].Body), `"signature_prompt":"Say hello"`) {
+		t.Errorf("body does not carry the signature prompt: %s", requests[0].Body)
+	}
+}
+
+func TestSendChatRequestRetriesTransientFailures(t *testing.T) {
+	resetUpstream(t)
+	fake.Queue(fakezai.PathChat, fakezai.JSON(http.StatusServiceUnavailable, `{"detail":"busy"}`))
+
+	content, err := collectStream(chatRequest(t, context.Background(), "Hi"))
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if content == "" {
+		t.Error("got no content after the retry")
+	}
+	if n := len(fake.Requests(fakezai.PathChat)); n != 2 {
+		t.Errorf("got %d chat requests, want 2", n)
+	}
+}
+
+func TestDoWithRetryReplaysOnlyUnsentPosts(t *testing.T) {
+	// The upstream reads each request, then drops the connection without answering
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.Copy(io.Discard, r.Body)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer server.Close()
+	policy := config.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	for method, want := range map[string]int32{http.MethodPost: 1, http.MethodGet: 3} {
+		hits.Store(0)
+		newRequest := func() (*http.Request, error) {
+			return http.NewRequest(method, server.URL, strings.NewReader("{}"))
+		}
+		if _, err := doWithRetry(context.Background(), &http.Client{}, policy, "test", newRequest); err == nil {
+			t.Fatalf("%s: got no error from a dropped connection", method)
+		}
+		if n := hits.Load(); n != want {
+			t.Errorf("%s: upstream received %d requests, want %d", method, n, want)
+		}
+	}
+
+	// Requests that never reached the upstream are retried whatever their method
+	server.Close()
+	attempts := 0
+	newRequest := func() (*http.Request, error) {
+		attempts++
+		return http.NewRequest(http.MethodPost, server.URL, strings.NewReader("{}"))
+	}
+	if _, err := doWithRetry(context.Background(), &http.Client{}, policy, "test", newRequest); err == nil || attempts != 3 {
+		t.Errorf("POST to a closed server: %d attempts, err %v; want 3 attempts", attempts, err)
+	}
+}
+
+func TestSendChatRequestRefreshesCredentialsOn401(t *testing.T) {
+	resetUpstream(t)
+	fake.Queue(fakezai.PathChat, fakezai.JSON(http.StatusUnauthorized, `{"detail":"token expired"}`))
+
+	if _, err := collectStream(chatRequest(t, context.Background(), "Hi")); err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if n := len(fake.Requests(fakezai.PathAuth)); n != 2 {
+		t.Errorf("got %d auth requests, want 2 (initial and refresh)", n)
+	}
+	if n := len(fake.Requests(fakezai.PathChat)); n != 2 {
+		t.Errorf("got %d chat requests, want 2", n)
+	}
+}
+
+func TestInvalidTokensAreBounded(t *testing.T) {
+	resetUpstream(t)
+	cfg := config.GetConfig()
+	defer func(size int) { cfg.Auth.UserCacheSize = size }(cfg.Auth.UserCacheSize)
+	cfg.Auth.UserCacheSize = 4
+
+	users := GetUserService()
+	for i := 0; i < 10; i++ {
+		users.markInvalid(fmt.Sprintf("bad-token-%d", i), "chat")
+	}
+	users.markInvalid("bad-token-6", "chat")
+	users.markInvalid("bad-token-10", "chat")
+
+	users.mutex.Lock()
+	defer users.mutex.Unlock()
+	if n := len(users.invalid); n != 4 || users.invalidOrder.Len() != 4 {
+		t.Errorf("remembered %d invalid tokens, want 4", n)
+	}
+	if _, ok := users.invalid[tokenFingerprint("bad-token-6")]; !ok {
+		t.Error("recently seen invalid token was evicted")
+	}
+}
+
+func TestParseSSEStreamReportsUpstreamErrors(t *testing.T) {
+	resetUpstream(t)
+	fake.Queue(fakezai.PathChat, fakezai.Chat(
+		fakezai.Answer("partial"),
+		fakezai.ErrorFrame(1305, "The service is busy"),
+	))
+
+	_, err := collectStream(chatRequest(t, context.Background(), "Hi"))
+	var apiErr *APIError
+	if !errors.As(AsAPIError(err), &apiErr) || apiErr.Kind != ErrOverloaded {
+		t.Fatalf("err = %v, want an overloaded APIError", err)
+	}
+}
+
+func TestAsAPIErrorHidesInternalDetails(t *testing.T) {
+	err := fmt.Errorf("failed to read file /var/lib/z2api/files/file-1: %w", os.ErrPermission)
+	apiErr := AsAPIError(err)
+	if apiErr.Kind != ErrInternal || apiErr.Message != "Internal server error" {
+		t.Errorf("AsAPIError = %s %q, want a generic internal error", apiErr.Kind, apiErr.Message)
+	}
+	if !errors.Is(apiErr, os.ErrPermission) || !strings.Contains(apiErr.Error(), "/var/lib/z2api") {
+		t.Errorf("the cause %q is not kept for logging", apiErr.Error())
+	}
+}
+
+func TestUploadImage(t *testing.T) {
+	resetUpstream(t)
+	ctx := WithCredentials(context.Background(), Credentials{UpstreamToken: "client-token"})
+
+	// A 1x1 transparent PNG
+	dataURL := "data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+	fileID, err := UploadImage(ctx, dataURL, "", "chat-1")
+	if err != nil {
+		t.Fatalf("UploadImage: %v", err)
+	}
+	if fileID != "fake-file_upload.png" {
+		t.Errorf("file ID = %q, want %q", fileID, "fake-file_upload.png")
+	}
+
+	requests := fake.Requests(fakezai.PathFiles)
+	if len(requests) != 1 {
+		t.Fatalf("got %d upload requests, want 1", len(requests))
+	}
+	if got := requests[0].Header.Get("Authorization"); got != "Bearer client-token" {
+		t.Errorf("Authorization = %q, want the client token", got)
+	}
+	if !strings.HasPrefix(requests[0].Header.Get("Content-Type"), "multipart/form-data") {
+		t.Errorf("Content-Type = %q, want multipart", requests[0].Header.Get("Content-Type"))
+	}
+}
+
+func TestUploadImageRetriesTransientFailures(t *testing.T) {
+	resetUpstream(t)
+	ctx := WithCredentials(context.Background(), Credentials{UpstreamToken: "client-token"})
+	fake.Queue(fakezai.PathFiles, fakezai.JSON(http.StatusServiceUnavailable, `{"detail":"busy"}`))
+
+	dataURL := "data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+	if _, err := UploadImage(ctx, dataURL, "", "chat-1"); err != nil {
+		t.Fatalf("UploadImage: %v", err)
+	}
+	if n := len(fake.Requests(fakezai.PathFiles)); n != 2 {
+		t.Errorf("got %d upload requests, want 2", n)
+	}
+}
+
+// useCassette replays a recorded upstream session on the fake, or records a
+// new one against the live site when ZAI_RECORD=1
+func useCassette(t *testing.T, name string) {
+	t.Helper()
+	resetUpstream(t)
+	path := filepath.Join("testdata", "cassettes", name+".json")
+
+	if os.Getenv("ZAI_RECORD") != "1" {
+		cassette, err := fakezai.LoadCassette(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake.Replay(cassette)
+		return
+	}
+
+	cfg := config.GetConfig()
+	if err := cfg.SetBaseURL("https://chat.z.ai"); err != nil {
+		t.Fatal(err)
+	}
+	recorder := fakezai.NewRecorder(nil)
+	SetTransport(recorder)
+
+	t.Cleanup(func() {
+		SetTransport(nil)
+		cfg.SetBaseURL(fake.URL)
+		if err := recorder.Cassette().Save(path); err != nil {
+			t.Errorf("failed to save cassette: %v", err)
+		}
+	})
+}
+
+func TestReplayRecordedChat(t *testing.T) {
+	useCassette(t, "chat_basic")
+	ctx := context.Background()
+
+	models, err := GetModelsService().GetModels(ctx)
+	if err != nil {
+		t.Fatalf("GetModels: %v", err)
+	}
+	if len(models.Data) == 0 {
+		t.Fatal("got no models")
+	}
+
+	content, err := collectStream(chatRequest(t, ctx, "Reply with exactly: pong"))
+	if err != nil {
+		t.Fatalf("stream: %v", err)
+	}
+	if !strings.Contains(strings.ToLower(content), "pong") {
+		t.Errorf("content = %q, want it to contain pong", content)
+	}
+}
+
+// metricValue scrapes the value of one metric series, or 0 if it does not exist yet
+func metricValue(t *testing.T, series string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.Handler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if value, ok := strings.CutPrefix(line, series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("metric %s: %v", series, err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestUpstreamClientReusesConnections(t *testing.T) {
+	resetUpstream(t)
+	reusedBefore := metricValue(t, `z2api_upstream_connections_acquired_total{reused="true"}`)
+
+	client := upstreamClient(config.GetConfig().Transport.Timeouts.Models)
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(fake.URL + fakezai.PathModels)
+		if err != nil {
+			t.Fatalf("GET models: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	if reused := metricValue(t, `z2api_upstream_connections_acquired_total{reused="true"}`) - reusedBefore; reused < 2 {
+		t.Errorf("%v requests reused a pooled connection, want 2", reused)
+	}
+	if open := metricValue(t, "z2api_upstream_connections_open"); open < 1 {
+		t.Errorf("open connections = %v, want the pooled connection", open)
+	}
+}
+
+func TestUpstreamTransportCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.GetConfig().Transport
+	untrusted, err := newUpstreamTransport(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&http.Client{Transport: untrusted}).Get(server.URL); err == nil {
+		t.Error("request to a self-signed server succeeded without the CA bundle")
+	}
+
+	cfg.CABundle = bundle
+	trusted, err := newUpstreamTransport(cfg)
+	if err != nil {
+		t.Fatalf("newUpstreamTransport: %v", err)
+	}
+	resp, err := (&http.Client{Transport: trusted}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("request with the CA bundle: %v", err)
+	}
+	resp.Body.Close()
+
+	cfg.CABundle = filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := newUpstreamTransport(cfg); err == nil {
+		t.Error("newUpstreamTransport accepted a missing CA bundle")
+	}
+}
+
+func TestUpstreamTransportProxy(t *testing.T) {
+	var proxiedURL string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedURL = r.URL.String()
+		w.Write([]byte("via proxy"))
+	}))
+	defer proxy.Close()
+
+	cfg := config.GetConfig().Transport
+	cfg.Proxy = proxy.URL
+	rt, err := newUpstreamTransport(cfg)
+	if err != nil {
+		t.Fatalf("newUpstreamTransport: %v", err)
+	}
+
+	resp, err := (&http.Client{Transport: rt}).Get("http://upstream.invalid/api/models")
+	if err != nil {
+		t.Fatalf("request through the proxy: %v", err)
+	}
+	resp.Body.Close()
+
+	if proxiedURL != "http://upstream.invalid/api/models" {
+		t.Errorf("proxy saw %q, want the absolute upstream URL", proxiedURL)
+	}
+}
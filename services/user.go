@@ -1,103 +1,141 @@
 package services
 
 import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/metrics"
 	"github.com/Tyler-Dinh/z2api-go/types"
 )
 
+// userCacheTTL is how long a user lookup is trusted without an upstream 401
+const userCacheTTL = 30 * time.Minute
+
+// guestCacheKey is the cache key of the shared anonymous identity
+const guestCacheKey = ""
+
 // UserService handles user authentication and caching
+//
+// Identities are cached per upstream token in a bounded LRU so that many
+// per-key or client-supplied tokens cannot grow the cache without limit.
+// Fingerprints of rejected tokens are kept in a second LRU of the same size.
 type UserService struct {
-	cache map[string]*CachedUser
-	mutex sync.RWMutex
+	cache        map[string]*list.Element
+	order        *list.List
+	invalid      map[string]*list.Element
+	invalidOrder *list.List
+	mutex        sync.Mutex
 }
 
 // CachedUser represents a cached user with timestamp
 type CachedUser struct {
-	Info     *types.UserInfo
-	CachedAt time.Time
+	Token     string
+	Info      *types.UserInfo
+	CachedAt  time.Time
+	ExpiresAt time.Time
 }
 
 var (
 	userService     *UserService
 	userServiceOnce sync.Once
+
+	authRefreshes = metrics.NewCounterVec(
+		"z2api_upstream_auth_refreshes_total",
+		"Upstream credential refreshes triggered by a 401 response",
+		"op",
+	)
+	invalidTokens = metrics.NewCounterVec(
+		"z2api_upstream_invalid_tokens_total",
+		"Upstream tokens found to be permanently invalid",
+		"op",
+	)
 )
 
 // GetUserService returns the singleton user service instance
 func GetUserService() *UserService {
 	userServiceOnce.Do(func() {
 		userService = &UserService{
-			cache: make(map[string]*CachedUser),
+			cache:        make(map[string]*list.Element),
+			order:        list.New(),
+			invalid:      make(map[string]*list.Element),
+			invalidOrder: list.New(),
 		}
 	})
 	return userService
 }
 
 // GetUser gets user information with caching support
-func (s *UserService) GetUser() (*types.UserInfo, error) {
+func (s *UserService) GetUser(ctx context.Context) (*types.UserInfo, error) {
 	cfg := config.GetConfig()
 
-	// Determine current token
-	var currentToken string
-	if cfg.API.Anonymous {
-		currentToken = "" // Will fetch anonymous token
-	} else {
+	// Determine current token, a per-client token wins over the configured one
+	currentToken := CredentialsFromContext(ctx).UpstreamToken
+	if currentToken == "" && !cfg.API.Anonymous {
 		currentToken = cfg.Source.Token
 	}
+	anonymous := currentToken == "" // Will fetch anonymous token
 
-	// Check cache if token exists
-	if currentToken != "" {
-		s.mutex.RLock()
-		cached, exists := s.cache[currentToken]
-		s.mutex.RUnlock()
-
-		if exists && time.Since(cached.CachedAt) < 30*time.Minute {
-			log.Printf("User info [cached]: id=%s, token=%s...", cached.Info.ID, truncateString(currentToken, 50))
-			return &types.UserInfo{
-				ID:    cached.Info.ID,
-				Name:  cached.Info.Name,
-				Token: currentToken,
-			}, nil
+	// Check cache, the anonymous identity is cached under guestCacheKey
+	if cached, exists := s.cacheGet(currentToken); exists {
+		userToken := currentToken
+		if anonymous {
+			userToken = cached.Info.Token
 		}
+		slog.DebugContext(ctx, "User info from cache", "user_id", cached.Info.ID, "token_fingerprint", tokenFingerprint(userToken))
+		return &types.UserInfo{
+			ID:    cached.Info.ID,
+			Name:  cached.Info.Name,
+			Token: userToken,
+		}, nil
 	}
 
 	// Fetch from API
-	url := fmt.Sprintf("%s//%s/api/v1/auths/", cfg.Source.Protocol, cfg.Source.Host)
+	url := upstreamURL("/api/v1/auths/")
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
 
-	// Add headers
-	for k, v := range cfg.Headers {
-		req.Header.Set(k, v)
-	}
-	req.Header.Set("Content-Type", "application/json")
+		// Add headers
+		for k, v := range cfg.Headers {
+			req.Header.Set(k, v)
+		}
+		req.Header.Set("Content-Type", "application/json")
 
-	// Add authorization if not anonymous
-	if !cfg.API.Anonymous && currentToken != "" {
-		req.Header.Set("Authorization", "Bearer "+currentToken)
+		// Add authorization if not anonymous
+		if !anonymous {
+			req.Header.Set("Authorization", "Bearer "+currentToken)
+		}
+		return req, nil
 	}
 
 	// Send request
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+	client := upstreamClient(cfg.Transport.Timeouts.Auth)
+	resp, err := doWithRetry(ctx, client, cfg.Retry.Auth, "auth", newRequest)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch user info: %w", err)
+		return nil, upstreamTransportError(err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("fetch user info failed: %s", string(body))
+		apiErr := ClassifyUpstreamResponse(resp)
+		if apiErr.Kind == ErrAuthentication && currentToken != "" {
+			s.markInvalid(currentToken, "auth")
+		}
+		return nil, apiErr
 	}
 
 	// Parse response
@@ -111,7 +149,7 @@ func (s *UserService) GetUser() (*types.UserInfo, error) {
 	userToken := getStringFromMap(result, "token")
 
 	// Use provided token if not anonymous
-	if !cfg.API.Anonymous {
+	if !anonymous {
 		userToken = currentToken
 	}
 
@@ -124,27 +162,160 @@ func (s *UserService) GetUser() (*types.UserInfo, error) {
 
 	// Cache result if token exists
 	if userToken != "" && userID != "" {
-		s.mutex.Lock()
-		s.cache[userToken] = &CachedUser{
-			Info: &types.UserInfo{
-				ID:   userID,
-				Name: userName,
-			},
-			CachedAt: time.Now(),
+		now := time.Now()
+		expiresAt := now.Add(userCacheTTL)
+		if exp, ok := tokenExpiry(userToken); ok && exp.Add(-time.Minute).Before(expiresAt) {
+			expiresAt = exp.Add(-time.Minute)
+		}
+
+		cachedInfo := &types.UserInfo{
+			ID:   userID,
+			Name: userName,
+		}
+		if anonymous {
+			cachedInfo.Token = userToken
 		}
-		s.mutex.Unlock()
+
+		s.cachePut(&CachedUser{
+			Token:     currentToken,
+			Info:      cachedInfo,
+			CachedAt:  now,
+			ExpiresAt: expiresAt,
+		}, cfg.Auth.UserCacheSize)
 	}
 
-	log.Printf("User info [live]: name=%s, id=%s, token=%s...", userName, userID, truncateString(userToken, 50))
+	slog.DebugContext(ctx, "User info fetched", "user_id", userID, "user_name", userName, "token_fingerprint", tokenFingerprint(userToken))
 	return userInfo, nil
 }
 
+// Invalidate drops the cached identity for a token, including the guest identity
+func (s *UserService) Invalidate(token string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remove(token)
+	if elem, ok := s.cache[guestCacheKey]; ok {
+		guest := elem.Value.(*CachedUser)
+		if token == "" || guest.Info.Token == token {
+			s.remove(guestCacheKey)
+		}
+	}
+}
+
 // ClearCache clears the user cache
 func (s *UserService) ClearCache() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	s.cache = make(map[string]*CachedUser)
-	log.Println("User cache cleared")
+	s.cache = make(map[string]*list.Element)
+	s.order.Init()
+	s.invalid = make(map[string]*list.Element)
+	s.invalidOrder.Init()
+	slog.Info("User cache cleared")
+}
+
+// cacheGet returns a fresh cache entry and marks it as recently used
+func (s *UserService) cacheGet(token string) (*CachedUser, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	elem, ok := s.cache[token]
+	if !ok {
+		return nil, false
+	}
+	cached := elem.Value.(*CachedUser)
+	if !time.Now().Before(cached.ExpiresAt) {
+		s.remove(token)
+		return nil, false
+	}
+	s.order.MoveToFront(elem)
+	return cached, true
+}
+
+// cachePut stores an entry, evicting the least recently used ones beyond maxSize
+func (s *UserService) cachePut(cached *CachedUser, maxSize int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.remove(cached.Token)
+	s.cache[cached.Token] = s.order.PushFront(cached)
+	fingerprint := tokenFingerprint(cached.Token)
+	if elem, ok := s.invalid[fingerprint]; ok {
+		s.invalidOrder.Remove(elem)
+		delete(s.invalid, fingerprint)
+	}
+
+	for s.order.Len() > maxSize {
+		oldest := s.order.Back()
+		s.remove(oldest.Value.(*CachedUser).Token)
+	}
+}
+
+// remove deletes a cache entry; the caller must hold the mutex
+func (s *UserService) remove(token string) {
+	if elem, ok := s.cache[token]; ok {
+		s.order.Remove(elem)
+		delete(s.cache, token)
+	}
+}
+
+// markInvalid records a token that upstream keeps rejecting, logging it once while it is remembered
+func (s *UserService) markInvalid(token, op string) {
+	fingerprint := tokenFingerprint(token)
+	maxSize := config.GetConfig().Auth.UserCacheSize
+
+	s.mutex.Lock()
+	elem, alreadyKnown := s.invalid[fingerprint]
+	if alreadyKnown {
+		s.invalidOrder.MoveToFront(elem)
+	} else {
+		s.invalid[fingerprint] = s.invalidOrder.PushFront(fingerprint)
+	}
+	for s.invalidOrder.Len() > maxSize {
+		oldest := s.invalidOrder.Back()
+		s.invalidOrder.Remove(oldest)
+		delete(s.invalid, oldest.Value.(string))
+	}
+	s.remove(token)
+	s.mutex.Unlock()
+
+	invalidTokens.Inc(op)
+	if !alreadyKnown {
+		slog.Warn("Z.ai rejected token, it appears to be permanently invalid", "token_fingerprint", fingerprint, "op", op)
+	}
+}
+
+// withReauth runs call with the current user and replays it once after an upstream 401
+//
+// On a 401 the cached identity is dropped and a fresh user (or guest token in
+// anonymous mode) is fetched before the single replay. The caller owns the
+// body of the returned response.
+func withReauth(ctx context.Context, op string, call func(user *types.UserInfo) (*http.Response, error)) (*http.Response, error) {
+	userService := GetUserService()
+	user, err := userService.GetUser(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user info: %w", err)
+	}
+
+	resp, err := call(user)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	slog.InfoContext(ctx, "Upstream returned 401, refreshing credentials", "op", op)
+	authRefreshes.Inc(op)
+	userService.Invalidate(user.Token)
+
+	user, err = userService.GetUser(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh user info: %w", err)
+	}
+
+	resp, err = call(user)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && user.Token != "" {
+		userService.markInvalid(user.Token, op)
+	}
+	return resp, err
 }
 
 // Helper functions
@@ -164,3 +335,31 @@ func truncateString(s string, maxLen int) string {
 	}
 	return s[:maxLen]
 }
+
+// tokenFingerprint returns a short non-reversible identifier for a token
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:4])
+}
+
+// tokenExpiry reads the exp claim of a JWT without verifying it
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var claims struct {
+		Exp float64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(claims.Exp), 0), true
+}
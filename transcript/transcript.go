@@ -0,0 +1,195 @@
+package transcript
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+// Record is the transcript of one request as written to the JSONL file
+type Record struct {
+	Time            time.Time `json:"time"`
+	RequestID       string    `json:"request_id"`
+	KeyID           string    `json:"key_id,omitempty"`
+	Method          string    `json:"method"`
+	Path            string    `json:"path"`
+	Status          int       `json:"status"`
+	DurationMs      int64     `json:"duration_ms"`
+	ClientRequest   string    `json:"client_request"`
+	UpstreamRequest string    `json:"upstream_request,omitempty"`
+	UpstreamFrames  []Frame   `json:"upstream_frames,omitempty"`
+	ClientResponse  string    `json:"client_response"`
+	Truncated       bool      `json:"truncated,omitempty"`
+}
+
+// Frame is one raw upstream SSE event
+type Frame struct {
+	Event string `json:"event,omitempty"`
+	Data  string `json:"data"`
+}
+
+// Recorder collects the transcript of a single request
+//
+// All methods are safe to call on a nil Recorder, which records nothing, so
+// callers can use FromContext without checking whether capture is active.
+type Recorder struct {
+	mutex    sync.Mutex
+	record   Record
+	start    time.Time
+	budget   int
+	response strings.Builder
+}
+
+type recorderKey struct{}
+
+var (
+	writer     *utils.JSONLWriter
+	writerOnce sync.Once
+)
+
+// Requested reports whether the request should be captured, either because
+// DEBUG_MSG is on or because the client sent the opt-in header
+func Requested(r *http.Request) bool {
+	cfg := config.GetConfig()
+	if cfg.API.DebugMsg {
+		return true
+	}
+	if cfg.Transcript.OptInHeader == "" {
+		return false
+	}
+	value := strings.ToLower(strings.TrimSpace(r.Header.Get(cfg.Transcript.OptInHeader)))
+	return value == "1" || value == "true"
+}
+
+// New starts a transcript for the request
+func New(r *http.Request, requestID, keyID string) *Recorder {
+	return &Recorder{
+		start:  time.Now(),
+		budget: config.GetConfig().Transcript.MaxRecordSize,
+		record: Record{
+			Time:      time.Now().UTC(),
+			RequestID: requestID,
+			KeyID:     keyID,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+		},
+	}
+}
+
+// WithRecorder returns a context carrying the recorder
+func WithRecorder(ctx context.Context, rec *Recorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, rec)
+}
+
+// FromContext returns the recorder of the request, or nil if it is not captured
+func FromContext(ctx context.Context) *Recorder {
+	rec, _ := ctx.Value(recorderKey{}).(*Recorder)
+	return rec
+}
+
+// SetClientRequest records the inbound client payload
+func (rec *Recorder) SetClientRequest(body []byte) {
+	if rec == nil {
+		return
+	}
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.record.ClientRequest = rec.take(string(body))
+}
+
+// SetUpstreamRequest records the translated Z.ai payload; a replay overwrites it
+func (rec *Recorder) SetUpstreamRequest(body []byte) {
+	if rec == nil {
+		return
+	}
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.budget += len(rec.record.UpstreamRequest)
+	rec.record.UpstreamRequest = rec.take(string(body))
+}
+
+// AddUpstreamFrame records one raw SSE event received from Z.ai
+func (rec *Recorder) AddUpstreamFrame(event string, data []byte) {
+	if rec == nil {
+		return
+	}
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.budget <= 0 {
+		rec.record.Truncated = true
+		return
+	}
+	rec.record.UpstreamFrames = append(rec.record.UpstreamFrames, Frame{Event: event, Data: rec.take(string(data))})
+}
+
+// WriteResponse records bytes sent to the client
+func (rec *Recorder) WriteResponse(b []byte) {
+	if rec == nil {
+		return
+	}
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.budget <= 0 {
+		rec.record.Truncated = true
+		return
+	}
+	if len(b) > rec.budget {
+		b = b[:rec.budget]
+		rec.record.Truncated = true
+	}
+	rec.budget -= len(b)
+	rec.response.Write(b)
+}
+
+// Finish completes the transcript and appends it to the transcript file
+func (rec *Recorder) Finish(status int) {
+	if rec == nil {
+		return
+	}
+
+	rec.mutex.Lock()
+	rec.record.Status = status
+	rec.record.DurationMs = time.Since(rec.start).Milliseconds()
+	rec.record.ClientResponse = utils.RedactString(rec.response.String())
+	record := rec.record
+	rec.mutex.Unlock()
+
+	if err := getWriter().Append(record); err != nil {
+		slog.Warn("Failed to write transcript", "error", err, "request_id", record.RequestID)
+	}
+}
+
+// take redacts s and truncates it to the remaining budget; the caller must hold the mutex
+func (rec *Recorder) take(s string) string {
+	s = utils.RedactString(s)
+	if rec.budget <= 0 {
+		rec.record.Truncated = true
+		return ""
+	}
+	if len(s) > rec.budget {
+		s = s[:rec.budget]
+		rec.record.Truncated = true
+	}
+	rec.budget -= len(s)
+	return s
+}
+
+func getWriter() *utils.JSONLWriter {
+	writerOnce.Do(func() {
+		cfg := config.GetConfig()
+		writer = utils.NewJSONLWriter(
+			filepath.Join(cfg.Storage.DataDir, "transcripts"),
+			"transcripts",
+			cfg.Transcript.MaxFileSize,
+			cfg.Transcript.MaxFiles,
+		)
+	})
+	return writer
+}
@@ -0,0 +1,116 @@
+package transcript
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+)
+
+func TestMain(m *testing.M) {
+	dataDir, err := os.MkdirTemp("", "z2api-transcript-test")
+	if err != nil {
+		panic(err)
+	}
+
+	// Configure before the config singleton is loaded
+	os.Setenv("DATA_DIR", dataDir)
+	os.Setenv("DEBUG_MSG", "false")
+
+	code := m.Run()
+	os.RemoveAll(dataDir)
+	os.Exit(code)
+}
+
+// lastRecord reads the newest record of the transcript file
+func lastRecord(t *testing.T) Record {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(config.GetConfig().Storage.DataDir, "transcripts", "transcripts.jsonl"))
+	if err != nil {
+		t.Fatalf("read transcripts: %v", err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	var record Record
+	if err := json.Unmarshal(lines[len(lines)-1], &record); err != nil {
+		t.Fatalf("decode transcript: %v", err)
+	}
+	return record
+}
+
+func TestRecorderSharesBudget(t *testing.T) {
+	cfg := config.GetConfig()
+	defer func(size int) { cfg.Transcript.MaxRecordSize = size }(cfg.Transcript.MaxRecordSize)
+	cfg.Transcript.MaxRecordSize = 100
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	rec := New(req, "req-1", "k1")
+
+	// Base64 data is redacted before it is counted
+	rec.SetClientRequest([]byte(`{"url":"data:image/png;base64,` + strings.Repeat("A", 4000) + `"}`))
+
+	// A replayed upstream request replaces the first one and gets its bytes back
+	rec.SetUpstreamRequest([]byte(strings.Repeat("u", 30)))
+	rec.SetUpstreamRequest([]byte(strings.Repeat("v", 30)))
+
+	rec.AddUpstreamFrame("", []byte("frame"))
+	rec.WriteResponse([]byte(strings.Repeat("r", 50)))
+	rec.AddUpstreamFrame("", []byte("late frame"))
+	rec.Finish(http.StatusOK)
+
+	record := lastRecord(t)
+	if record.RequestID != "req-1" || record.KeyID != "k1" || record.Path != "/v1/chat/completions" || record.Status != http.StatusOK {
+		t.Errorf("record = %+v", record)
+	}
+	wantClient := `{"url":"data:image/png;base64,[4000 bytes]"}`
+	if record.ClientRequest != wantClient {
+		t.Errorf("client request = %q, want %q", record.ClientRequest, wantClient)
+	}
+	if record.UpstreamRequest != strings.Repeat("v", 30) {
+		t.Errorf("upstream request = %q", record.UpstreamRequest)
+	}
+	if len(record.UpstreamFrames) != 1 || record.UpstreamFrames[0].Data != "frame" {
+		t.Errorf("upstream frames = %+v", record.UpstreamFrames)
+	}
+
+	// 44 + 30 + 5 bytes leave 21 for the response
+	if record.ClientResponse != strings.Repeat("r", 21) || !record.Truncated {
+		t.Errorf("client response = %q, truncated %v", record.ClientResponse, record.Truncated)
+	}
+}
+
+func TestRequested(t *testing.T) {
+	cfg := config.GetConfig()
+	defer func(debug bool, header string) {
+		cfg.API.DebugMsg, cfg.Transcript.OptInHeader = debug, header
+	}(cfg.API.DebugMsg, cfg.Transcript.OptInHeader)
+
+	tests := []struct {
+		debug     bool
+		optIn     string
+		header    string
+		requested bool
+	}{
+		{false, "X-Debug-Transcript", "", false},
+		{false, "X-Debug-Transcript", "1", true},
+		{false, "X-Debug-Transcript", " TRUE ", true},
+		{false, "X-Debug-Transcript", "0", false},
+		{false, "", "1", false},
+		{true, "X-Debug-Transcript", "", true},
+	}
+	for _, tt := range tests {
+		cfg.API.DebugMsg, cfg.Transcript.OptInHeader = tt.debug, tt.optIn
+		req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		if tt.header != "" {
+			req.Header.Set("X-Debug-Transcript", tt.header)
+		}
+		if got := Requested(req); got != tt.requested {
+			t.Errorf("DEBUG_MSG=%v, header %q: %q: Requested = %v, want %v", tt.debug, tt.optIn, tt.header, got, tt.requested)
+		}
+	}
+}
@@ -1,43 +1,141 @@
 package types
 
-// Message represents a chat message
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Message represents a chat message in the OpenAI, Anthropic or Z.ai format
 type Message struct {
-	Role       string      `json:"role"`
-	Content    interface{} `json:"content"` // Can be string or []ContentBlock
-	ToolCalls  []ToolCall  `json:"tool_calls,omitempty"`
-	ToolCallID string      `json:"tool_call_id,omitempty"`
+	Role       string         `json:"role"`
+	Content    MessageContent `json:"content"`
+	Name       string         `json:"name,omitempty"`
+	ToolCalls  []ToolCall     `json:"tool_calls,omitempty"`
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+}
+
+// MessageContent is message content that is either a plain string or a list of blocks
+type MessageContent struct {
+	Text   string
+	Blocks []ContentBlock
+}
+
+// TextContent returns string content
+func TextContent(text string) MessageContent {
+	return MessageContent{Text: text}
+}
+
+// BlockContent returns content made of blocks
+func BlockContent(blocks ...ContentBlock) MessageContent {
+	if blocks == nil {
+		blocks = []ContentBlock{}
+	}
+	return MessageContent{Blocks: blocks}
+}
+
+// IsBlocks reports whether the content is a list of blocks rather than a string
+func (c MessageContent) IsBlocks() bool {
+	return c.Blocks != nil
+}
+
+// String returns the text of the content, joining text blocks
+func (c MessageContent) String() string {
+	if !c.IsBlocks() {
+		return c.Text
+	}
+	texts := []string{}
+	for _, block := range c.Blocks {
+		if block.Type == "text" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "")
+}
+
+// MarshalJSON encodes the content as a string or an array of blocks
+func (c MessageContent) MarshalJSON() ([]byte, error) {
+	if c.IsBlocks() {
+		return json.Marshal(c.Blocks)
+	}
+	return json.Marshal(c.Text)
+}
+
+// UnmarshalJSON accepts a string, an array of blocks or null
+func (c *MessageContent) UnmarshalJSON(data []byte) error {
+	*c = MessageContent{}
+	switch {
+	case string(data) == "null":
+		return nil
+	case len(data) > 0 && data[0] == '"':
+		return json.Unmarshal(data, &c.Text)
+	case len(data) > 0 && data[0] == '[':
+		c.Blocks = []ContentBlock{}
+		return json.Unmarshal(data, &c.Blocks)
+	}
+	return &json.UnmarshalTypeError{Value: jsonKind(data), Type: reflect.TypeOf(c).Elem()}
 }
 
 // ContentBlock represents a content block (text, image, tool use, etc.)
+//
+// OpenAI content parts and Anthropic content blocks share this type; each
+// dialect uses the subset of fields that belongs to its block types.
 type ContentBlock struct {
-	Type     string                 `json:"type"`
-	Text     string                 `json:"text,omitempty"`
-	ImageURL *ImageURL              `json:"image_url,omitempty"`
-	Source   *ImageSource           `json:"source,omitempty"`
-	ID       string                 `json:"id,omitempty"`
-	Name     string                 `json:"name,omitempty"`
-	Input    map[string]interface{} `json:"input,omitempty"`
+	Type      string                 `json:"type"`
+	Text      string                 `json:"text,omitempty"`
+	ImageURL  *ImageURL              `json:"image_url,omitempty"`
+	Source    *ImageSource           `json:"source,omitempty"`
+	ID        string                 `json:"id,omitempty"`
+	Name      string                 `json:"name,omitempty"`
+	Input     map[string]interface{} `json:"input,omitempty"`
+	ToolUseID string                 `json:"tool_use_id,omitempty"`
+	Content   *MessageContent        `json:"content,omitempty"`
+	IsError   bool                   `json:"is_error,omitempty"`
+	Thinking  string                 `json:"thinking,omitempty"`
+	Signature string                 `json:"signature,omitempty"`
+	Data      string                 `json:"data,omitempty"`
+	File      *FileContent           `json:"file,omitempty"`
+	Title     string                 `json:"title,omitempty"`
+	Context   string                 `json:"context,omitempty"`
+	// CacheControl and Citations are accepted from Anthropic clients and never forwarded
+	CacheControl map[string]interface{} `json:"cache_control,omitempty"`
+	Citations    map[string]interface{} `json:"citations,omitempty"`
 }
 
 // ImageURL represents an image URL (OpenAI format)
 type ImageURL struct {
-	URL string `json:"url"`
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
 }
 
-// ImageSource represents an image source (Anthropic format)
+// ImageSource represents an image or document source (Anthropic format)
+//
+// Data holds base64 data, or the text itself for "text" document sources;
+// Content is only used by "content" document sources and FileID by "file"
+// sources.
 type ImageSource struct {
-	Type      string `json:"type"`
-	MediaType string `json:"media_type"`
-	Data      string `json:"data"`
+	Type      string          `json:"type"`
+	MediaType string          `json:"media_type,omitempty"`
+	Data      string          `json:"data,omitempty"`
+	URL       string          `json:"url,omitempty"`
+	Content   *MessageContent `json:"content,omitempty"`
+	FileID    string          `json:"file_id,omitempty"`
 }
 
-// ToolCall represents a tool call
+// FileContent represents the file of a file content part (OpenAI format)
+type FileContent struct {
+	FileData string `json:"file_data,omitempty"`
+	FileID   string `json:"file_id,omitempty"`
+	Filename string `json:"filename,omitempty"`
+}
+
+// ToolCall represents an OpenAI tool call; Index is only set in stream deltas
 type ToolCall struct {
-	ID       string                 `json:"id"`
-	Type     string                 `json:"type"`
-	Function *FunctionCall          `json:"function,omitempty"`
-	Name     string                 `json:"name,omitempty"`
-	Input    map[string]interface{} `json:"input,omitempty"`
+	Index    *int          `json:"index,omitempty"`
+	ID       string        `json:"id"`
+	Type     string        `json:"type"`
+	Function *FunctionCall `json:"function,omitempty"`
 }
 
 // FunctionCall represents a function call
@@ -46,36 +144,86 @@ type FunctionCall struct {
 	Arguments string `json:"arguments"`
 }
 
-// ChatRequest represents a chat completion request
+// Tool represents an OpenAI tool definition
+type Tool struct {
+	Type     string              `json:"type"`
+	Function *FunctionDefinition `json:"function,omitempty"`
+}
+
+// FunctionDefinition describes a function the model may call
+type FunctionDefinition struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	Strict      *bool                  `json:"strict,omitempty"`
+}
+
+// ChatRequest represents an OpenAI chat completion request
+//
+// Fields the proxy accepts but does not forward are listed so that they are
+// not treated as unknown.
 type ChatRequest struct {
-	Model            string                 `json:"model"`
-	Messages         []Message              `json:"messages"`
-	Stream           bool                   `json:"stream"`
-	Temperature      float64                `json:"temperature,omitempty"`
-	MaxTokens        int                    `json:"max_tokens,omitempty"`
-	TopP             float64                `json:"top_p,omitempty"`
-	System           interface{}            `json:"system,omitempty"`
-	Thinking         map[string]interface{} `json:"thinking,omitempty"`
-	EnableThinking   interface{}            `json:"enable_thinking,omitempty"`
-	StreamOptions    *StreamOptions         `json:"stream_options,omitempty"`
-	Tools            []Tool                 `json:"tools,omitempty"`
-	FrequencyPenalty float64                `json:"frequency_penalty,omitempty"`
-	PresencePenalty  float64                `json:"presence_penalty,omitempty"`
+	Model               string                 `json:"model"`
+	Messages            []Message              `json:"messages"`
+	Stream              bool                   `json:"stream"`
+	StreamOptions       *StreamOptions         `json:"stream_options,omitempty"`
+	Temperature         *float64               `json:"temperature,omitempty"`
+	TopP                *float64               `json:"top_p,omitempty"`
+	MaxTokens           int                    `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int                    `json:"max_completion_tokens,omitempty"`
+	FrequencyPenalty    *float64               `json:"frequency_penalty,omitempty"`
+	PresencePenalty     *float64               `json:"presence_penalty,omitempty"`
+	Stop                StringList             `json:"stop,omitempty"`
+	Tools               []Tool                 `json:"tools,omitempty"`
+	ToolChoice          interface{}            `json:"tool_choice,omitempty"`
+	ParallelToolCalls   *bool                  `json:"parallel_tool_calls,omitempty"`
+	ResponseFormat      interface{}            `json:"response_format,omitempty"`
+	Seed                *int64                 `json:"seed,omitempty"`
+	N                   int                    `json:"n,omitempty"`
+	User                string                 `json:"user,omitempty"`
+	Metadata            map[string]interface{} `json:"metadata,omitempty"`
+	Store               *bool                  `json:"store,omitempty"`
+	LogitBias           map[string]interface{} `json:"logit_bias,omitempty"`
+	Logprobs            *bool                  `json:"logprobs,omitempty"`
+	TopLogprobs         *int                   `json:"top_logprobs,omitempty"`
+	ReasoningEffort     string                 `json:"reasoning_effort,omitempty"`
+
+	// Z.ai and Qwen style extensions
+	Thinking       *ThinkingConfig        `json:"thinking,omitempty"`
+	EnableThinking *bool                  `json:"enable_thinking,omitempty"`
+	Features       map[string]interface{} `json:"features,omitempty"`
+	// ThinkMode selects the thinking tags mode of this request
+	ThinkMode string `json:"think_mode,omitempty"`
 }
 
 // StreamOptions represents streaming options
 type StreamOptions struct {
-	IncludeUsage bool `json:"include_usage"`
+	IncludeUsage *bool `json:"include_usage,omitempty"`
 }
 
-// Tool represents a tool definition
-type Tool struct {
-	Name        string                 `json:"name"`
-	Description string                 `json:"description"`
-	InputSchema map[string]interface{} `json:"input_schema,omitempty"`
+// ThinkingConfig is the Anthropic style switch for extended thinking
+type ThinkingConfig struct {
+	Type         string `json:"type"`
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
 }
 
-// ChatResponse represents a chat completion response
+// StringList is a string or an array of strings
+type StringList []string
+
+// UnmarshalJSON accepts a single string as a one-element list
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*l = StringList{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// ChatResponse represents a chat completion or a chat completion chunk
 type ChatResponse struct {
 	ID      string   `json:"id"`
 	Object  string   `json:"object"`
@@ -85,12 +233,28 @@ type ChatResponse struct {
 	Usage   *Usage   `json:"usage,omitempty"`
 }
 
-// Choice represents a response choice
+// Choice represents a response choice; Message is set in completions, Delta in chunks
 type Choice struct {
-	Index        int      `json:"index"`
-	Message      *Message `json:"message,omitempty"`
-	Delta        *Message `json:"delta,omitempty"`
-	FinishReason *string  `json:"finish_reason"`
+	Index        int          `json:"index"`
+	Message      *ChatMessage `json:"message,omitempty"`
+	Delta        *ChatDelta   `json:"delta,omitempty"`
+	FinishReason *string      `json:"finish_reason"`
+}
+
+// ChatMessage is the assistant message of a chat completion
+type ChatMessage struct {
+	Role             string     `json:"role"`
+	Content          *string    `json:"content"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
+}
+
+// ChatDelta is the incremental message of a chat completion chunk
+type ChatDelta struct {
+	Role             string     `json:"role,omitempty"`
+	Content          *string    `json:"content,omitempty"`
+	ReasoningContent string     `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
 }
 
 // Usage represents token usage
@@ -102,15 +266,15 @@ type Usage struct {
 
 // Model represents a model
 type Model struct {
-	ID           string                 `json:"id"`
-	Object       string                 `json:"object"`
-	Name         string                 `json:"name"`
-	Meta         map[string]interface{} `json:"meta"`
-	Info         map[string]interface{} `json:"info"`
-	Created      int64                  `json:"created"`
-	OwnedBy      string                 `json:"owned_by"`
-	Original     map[string]interface{} `json:"orignal"` // Keep typo for compatibility
-	AccessControl interface{}           `json:"access_control"`
+	ID            string                 `json:"id"`
+	Object        string                 `json:"object"`
+	Name          string                 `json:"name"`
+	Meta          map[string]interface{} `json:"meta"`
+	Info          map[string]interface{} `json:"info"`
+	Created       int64                  `json:"created"`
+	OwnedBy       string                 `json:"owned_by"`
+	Original      map[string]interface{} `json:"orignal"` // Keep typo for compatibility
+	AccessControl interface{}            `json:"access_control"`
 }
 
 // ModelsResponse represents a models list response
@@ -126,16 +290,45 @@ type UserInfo struct {
 	Token string `json:"token"`
 }
 
-// ErrorResponse represents an error response
-type ErrorResponse struct {
-	Error   int    `json:"error"`
+// OpenAIError represents the error object of an OpenAI error response
+type OpenAIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// OpenAIErrorResponse represents an OpenAI error response
+type OpenAIErrorResponse struct {
+	Error OpenAIError `json:"error"`
+}
+
+// AnthropicError represents the error object of an Anthropic error response
+type AnthropicError struct {
+	Type    string `json:"type"`
 	Message string `json:"message"`
 }
 
+// AnthropicErrorResponse represents an Anthropic error response
+type AnthropicErrorResponse struct {
+	Type  string         `json:"type"`
+	Error AnthropicError `json:"error"`
+}
+
 // HealthResponse represents a health check response
 type HealthResponse struct {
-	Status    string `json:"status"`
-	Timestamp int64  `json:"timestamp"`
+	Status    string          `json:"status"`
+	Timestamp int64           `json:"timestamp"`
+	Upstream  *UpstreamHealth `json:"upstream,omitempty"`
+}
+
+// UpstreamHealth represents the upstream circuit breaker state
+type UpstreamHealth struct {
+	Breaker      string  `json:"breaker"`
+	Requests     int     `json:"requests"`
+	ErrorRate    float64 `json:"error_rate"`
+	SlowCallRate float64 `json:"slow_call_rate"`
+	OpenedAt     int64   `json:"opened_at,omitempty"`
 }
 
 // ZaiRequest represents a request to Z.ai API
@@ -147,72 +340,209 @@ type ZaiRequest struct {
 	ID               string                 `json:"id"`
 	Features         map[string]interface{} `json:"features,omitempty"`
 	SignaturePrompt  string                 `json:"signature_prompt,omitempty"`
-	Temperature      float64                `json:"temperature,omitempty"`
+	Temperature      *float64               `json:"temperature,omitempty"`
 	MaxTokens        int                    `json:"max_tokens,omitempty"`
-	TopP             float64                `json:"top_p,omitempty"`
-	FrequencyPenalty float64                `json:"frequency_penalty,omitempty"`
-	PresencePenalty  float64                `json:"presence_penalty,omitempty"`
+	TopP             *float64               `json:"top_p,omitempty"`
+	FrequencyPenalty *float64               `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64               `json:"presence_penalty,omitempty"`
+	Stop             []string               `json:"stop,omitempty"`
+	Tools            []Tool                 `json:"tools,omitempty"`
+	ToolChoice       interface{}            `json:"tool_choice,omitempty"`
+	Files            []ZaiFile              `json:"files,omitempty"`
+	// UserMessageID and ParentID link the turn to the previous turn of the same upstream chat
+	UserMessageID string `json:"current_user_message_id,omitempty"`
+	ParentID      string `json:"current_user_message_parent_id,omitempty"`
+}
+
+// ZaiFile references an uploaded document in a Z.ai chat request
+type ZaiFile struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Size   int    `json:"size"`
+	Media  string `json:"media"`
+	// Tokens estimates the prompt tokens of the document for usage reporting
+	Tokens int `json:"-"`
 }
 
 // ZaiResponse represents a response from Z.ai API
 type ZaiResponse struct {
-	Data *ZaiResponseData `json:"data"`
+	Type  string           `json:"type,omitempty"`
+	Data  *ZaiResponseData `json:"data"`
+	Error *ZaiError        `json:"error,omitempty"`
 }
 
 // ZaiResponseData represents the data field in Z.ai response
 type ZaiResponseData struct {
-	Phase        string `json:"phase"`
-	DeltaContent string `json:"delta_content"`
-	EditContent  string `json:"edit_content"`
-	Done         bool   `json:"done"`
+	Phase        string    `json:"phase"`
+	DeltaContent string    `json:"delta_content"`
+	EditContent  string    `json:"edit_content"`
+	Done         bool      `json:"done"`
+	Error        *ZaiError `json:"error,omitempty"`
+}
+
+// ZaiError represents an error payload sent by Z.ai inside the stream
+type ZaiError struct {
+	Code    interface{} `json:"code,omitempty"` // Can be number or string
+	Detail  string      `json:"detail,omitempty"`
+	Message string      `json:"message,omitempty"`
+}
+
+// Error implements the error interface
+func (e *ZaiError) Error() string {
+	msg := e.Detail
+	if msg == "" {
+		msg = e.Message
+	}
+	if msg == "" {
+		msg = "unknown upstream error"
+	}
+	if e.Code != nil {
+		return fmt.Sprintf("Z.ai error %v: %s", e.Code, msg)
+	}
+	return "Z.ai error: " + msg
 }
 
 // AnthropicMessageRequest represents an Anthropic messages request
 type AnthropicMessageRequest struct {
-	Model     string                 `json:"model"`
-	MaxTokens int                    `json:"max_tokens"`
-	Messages  []Message              `json:"messages"`
-	System    interface{}            `json:"system,omitempty"`
-	Stream    bool                   `json:"stream,omitempty"`
-	Tools     []Tool                 `json:"tools,omitempty"`
-	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Model         string                 `json:"model"`
+	MaxTokens     int                    `json:"max_tokens"`
+	Messages      []Message              `json:"messages"`
+	System        *MessageContent        `json:"system,omitempty"`
+	Stream        bool                   `json:"stream,omitempty"`
+	Temperature   *float64               `json:"temperature,omitempty"`
+	TopP          *float64               `json:"top_p,omitempty"`
+	TopK          *int                   `json:"top_k,omitempty"`
+	StopSequences []string               `json:"stop_sequences,omitempty"`
+	Tools         []AnthropicTool        `json:"tools,omitempty"`
+	ToolChoice    interface{}            `json:"tool_choice,omitempty"`
+	Thinking      *ThinkingConfig        `json:"thinking,omitempty"`
+	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+	ServiceTier   string                 `json:"service_tier,omitempty"`
+	// ThinkMode selects the thinking tags mode of this request, an extension of the Anthropic API
+	ThinkMode string `json:"think_mode,omitempty"`
 }
 
-// AnthropicMessageResponse represents an Anthropic messages response
+// AnthropicTool represents an Anthropic tool definition
+type AnthropicTool struct {
+	Type         string                 `json:"type,omitempty"`
+	Name         string                 `json:"name"`
+	Description  string                 `json:"description,omitempty"`
+	InputSchema  map[string]interface{} `json:"input_schema,omitempty"`
+	CacheControl map[string]interface{} `json:"cache_control,omitempty"`
+}
+
+// AnthropicMessageResponse represents an Anthropic messages response, also sent in message_start
 type AnthropicMessageResponse struct {
 	ID           string         `json:"id"`
 	Type         string         `json:"type"`
 	Role         string         `json:"role"`
 	Model        string         `json:"model"`
-	Content      []ContentBlock `json:"content"`
-	Usage        *Usage         `json:"usage,omitempty"`
+	Content      []interface{}  `json:"content"`
+	StopReason   *string        `json:"stop_reason"`
 	StopSequence *string        `json:"stop_sequence"`
-	StopReason   string         `json:"stop_reason"`
+	Usage        AnthropicUsage `json:"usage"`
 }
 
+// AnthropicUsage represents Anthropic token usage
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// Anthropic response content blocks
+type (
+	AnthropicTextBlock struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	AnthropicThinkingBlock struct {
+		Type      string `json:"type"`
+		Thinking  string `json:"thinking"`
+		Signature string `json:"signature"`
+	}
+	AnthropicToolUseBlock struct {
+		Type  string                 `json:"type"`
+		ID    string                 `json:"id"`
+		Name  string                 `json:"name"`
+		Input map[string]interface{} `json:"input"`
+	}
+)
+
 // AnthropicStreamEvent represents an Anthropic streaming event
 type AnthropicStreamEvent struct {
-	Type         string                 `json:"type"`
-	Message      *AnthropicMessage      `json:"message,omitempty"`
-	Index        int                    `json:"index,omitempty"`
-	ContentBlock *ContentBlock          `json:"content_block,omitempty"`
-	Delta        map[string]interface{} `json:"delta,omitempty"`
-	Usage        *Usage                 `json:"usage,omitempty"`
-}
-
-// AnthropicMessage represents an Anthropic message in streaming
-type AnthropicMessage struct {
-	ID           string  `json:"id"`
-	Type         string  `json:"type"`
-	Role         string  `json:"role"`
-	Model        string  `json:"model"`
-	StopReason   *string `json:"stop_reason"`
-	StopSequence *string `json:"stop_sequence"`
-	Usage        *Usage  `json:"usage"`
-}
-
-// ImageUploadResponse represents an image upload response
+	Type         string                    `json:"type"`
+	Message      *AnthropicMessageResponse `json:"message,omitempty"`
+	Index        *int                      `json:"index,omitempty"`
+	ContentBlock interface{}               `json:"content_block,omitempty"`
+	Delta        interface{}               `json:"delta,omitempty"`
+	Usage        *AnthropicUsage           `json:"usage,omitempty"`
+}
+
+// Anthropic stream deltas
+type (
+	AnthropicTextDelta struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	AnthropicThinkingDelta struct {
+		Type     string `json:"type"`
+		Thinking string `json:"thinking"`
+	}
+	AnthropicInputJSONDelta struct {
+		Type        string `json:"type"`
+		PartialJSON string `json:"partial_json"`
+	}
+	AnthropicMessageDelta struct {
+		StopReason   *string `json:"stop_reason"`
+		StopSequence *string `json:"stop_sequence"`
+	}
+)
+
+// FileObject represents a file of the Files API (OpenAI format)
+type FileObject struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int    `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+	Status    string `json:"status"`
+}
+
+// FileList represents a list of files (OpenAI format)
+type FileList struct {
+	Object string       `json:"object"`
+	Data   []FileObject `json:"data"`
+}
+
+// FileDeleted represents the response to deleting a file (OpenAI format)
+type FileDeleted struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
+// ImageUploadResponse represents the response to an image or document upload
 type ImageUploadResponse struct {
 	ID       string `json:"id"`
 	Filename string `json:"filename"`
-}
\ No newline at end of file
+}
+
+// jsonKind names the JSON type of a raw value for type errors
+func jsonKind(data []byte) string {
+	if len(data) == 0 {
+		return "empty"
+	}
+	switch data[0] {
+	case '{':
+		return "object"
+	case 't', 'f':
+		return "bool"
+	default:
+		return "number"
+	}
+}
@@ -0,0 +1,392 @@
+package usage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+// Budget periods
+const (
+	PeriodDaily   = "daily"
+	PeriodMonthly = "monthly"
+)
+
+// Budget holds the token limits of one proxy API key; zero means unlimited
+type Budget struct {
+	KeyID         string  `json:"key_id"`
+	DailyTokens   int64   `json:"daily_tokens"`
+	MonthlyTokens int64   `json:"monthly_tokens"`
+	SoftThreshold float64 `json:"soft_threshold,omitempty"`
+}
+
+// BudgetStatus is a budget together with the tokens spent in the current periods
+type BudgetStatus struct {
+	Budget
+	Default     bool   `json:"default"`
+	Day         string `json:"day"`
+	DailyUsed   int64  `json:"daily_used"`
+	Month       string `json:"month"`
+	MonthlyUsed int64  `json:"monthly_used"`
+}
+
+// BudgetExceededError is returned when a key has used up one of its budgets
+type BudgetExceededError struct {
+	KeyID  string
+	Period string
+	Limit  int64
+	Used   int64
+}
+
+// Error implements the error interface
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("%s token budget of %d exhausted (%d used)", e.Period, e.Limit, e.Used)
+}
+
+// spend tracks tokens used by one key in the current day and month (UTC)
+type spend struct {
+	day         string
+	dayTokens   int64
+	month       string
+	monthTokens int64
+	// alerted holds the alerts already sent for the current periods
+	alerted map[string]bool
+}
+
+// Budgets enforces per-key token budgets on top of the usage ledger
+//
+// Explicit budgets are persisted in DATA_DIR/budgets.json. Spend is rebuilt
+// from the ledger on startup, so it survives restarts as long as the ledger
+// is enabled.
+type Budgets struct {
+	path     string
+	defaults Budget
+	webhook  string
+	client   *http.Client
+
+	mutex   sync.Mutex
+	budgets map[string]*Budget
+	spend   map[string]*spend
+}
+
+var (
+	budgets     *Budgets
+	budgetsOnce sync.Once
+)
+
+// GetBudgets returns the singleton budget store
+func GetBudgets() *Budgets {
+	budgetsOnce.Do(func() {
+		cfg := config.GetConfig()
+		defaults := Budget{
+			DailyTokens:   cfg.Budget.DailyTokens,
+			MonthlyTokens: cfg.Budget.MonthlyTokens,
+			SoftThreshold: cfg.Budget.SoftThreshold,
+		}
+		budgets = newBudgets(filepath.Join(cfg.Storage.DataDir, "budgets.json"), defaults, cfg.Budget.WebhookURL, GetLedger())
+	})
+	return budgets
+}
+
+// newBudgets loads the budgets stored at path and counts the ledger's spend against them
+func newBudgets(path string, defaults Budget, webhook string, ledger *Ledger) *Budgets {
+	b := &Budgets{
+		path:     path,
+		defaults: defaults,
+		webhook:  webhook,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		budgets:  make(map[string]*Budget),
+		spend:    make(map[string]*spend),
+	}
+
+	if err := b.load(); err != nil {
+		slog.Warn("Failed to load budgets", "error", err)
+	}
+
+	// Rebuild this month's spend from the ledger
+	if !ledger.Enabled() {
+		slog.Warn("Usage ledger is disabled, budget spend resets on restart")
+	}
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if err := ledger.Scan(monthStart, func(r Record) { b.add(r, false) }); err != nil {
+		slog.Warn("Failed to rebuild budget spend", "error", err)
+	}
+
+	ledger.Subscribe(func(r Record) { b.add(r, true) })
+	return b
+}
+
+// Check returns a BudgetExceededError if the key has no budget left
+func (b *Budgets) Check(keyID string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	budget := b.effective(keyID)
+	s := b.current(keyID, time.Now().UTC())
+
+	if budget.DailyTokens > 0 && s.dayTokens >= budget.DailyTokens {
+		return &BudgetExceededError{KeyID: keyID, Period: PeriodDaily, Limit: budget.DailyTokens, Used: s.dayTokens}
+	}
+	if budget.MonthlyTokens > 0 && s.monthTokens >= budget.MonthlyTokens {
+		return &BudgetExceededError{KeyID: keyID, Period: PeriodMonthly, Limit: budget.MonthlyTokens, Used: s.monthTokens}
+	}
+	return nil
+}
+
+// List returns the status of every key with an explicit budget or spend this month
+func (b *Budgets) List() []BudgetStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	keys := map[string]bool{}
+	for keyID := range b.budgets {
+		keys[keyID] = true
+	}
+	for keyID := range b.spend {
+		keys[keyID] = true
+	}
+
+	statuses := make([]BudgetStatus, 0, len(keys))
+	for keyID := range keys {
+		statuses = append(statuses, b.status(keyID))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].KeyID < statuses[j].KeyID
+	})
+	return statuses
+}
+
+// Status returns the budget status of one key
+func (b *Budgets) Status(keyID string) BudgetStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.status(keyID)
+}
+
+// Set creates or replaces the budget of a key and persists it
+func (b *Budgets) Set(budget Budget) error {
+	if budget.DailyTokens < 0 || budget.MonthlyTokens < 0 {
+		return fmt.Errorf("token budgets must not be negative")
+	}
+	if budget.SoftThreshold < 0 || budget.SoftThreshold > 1 {
+		return fmt.Errorf("soft_threshold must be between 0 and 1")
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	previous := b.budgets[budget.KeyID]
+	b.budgets[budget.KeyID] = &budget
+	if err := b.save(); err != nil {
+		if previous != nil {
+			b.budgets[budget.KeyID] = previous
+		} else {
+			delete(b.budgets, budget.KeyID)
+		}
+		return err
+	}
+
+	// Let alerts fire again against the new limits
+	if s, ok := b.spend[budget.KeyID]; ok {
+		s.alerted = make(map[string]bool)
+	}
+	return nil
+}
+
+// Delete removes the explicit budget of a key so the defaults apply again
+func (b *Budgets) Delete(keyID string) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	previous, ok := b.budgets[keyID]
+	if !ok {
+		return false, nil
+	}
+	delete(b.budgets, keyID)
+	if err := b.save(); err != nil {
+		b.budgets[keyID] = previous
+		return false, err
+	}
+	return true, nil
+}
+
+// add counts a ledger record against its key and fires threshold alerts
+func (b *Budgets) add(r Record, notify bool) {
+	if r.TotalTokens == 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	s := b.current(r.KeyID, r.Time.UTC())
+	if r.Time.UTC().Format("2006-01-02") == s.day {
+		s.dayTokens += int64(r.TotalTokens)
+	}
+	if r.Time.UTC().Format("2006-01") == s.month {
+		s.monthTokens += int64(r.TotalTokens)
+	}
+
+	budget := b.effective(r.KeyID)
+	alerts := []budgetAlert{}
+	alerts = append(alerts, s.crossed(r.KeyID, PeriodDaily, s.dayTokens, budget.DailyTokens, budget.SoftThreshold)...)
+	alerts = append(alerts, s.crossed(r.KeyID, PeriodMonthly, s.monthTokens, budget.MonthlyTokens, budget.SoftThreshold)...)
+	b.mutex.Unlock()
+
+	if !notify {
+		return
+	}
+	for _, alert := range alerts {
+		b.alert(alert)
+	}
+}
+
+// effective returns the budget of a key, falling back to the defaults; the caller must hold the mutex
+func (b *Budgets) effective(keyID string) Budget {
+	budget := b.defaults
+	if explicit, ok := b.budgets[keyID]; ok {
+		budget = *explicit
+		if budget.SoftThreshold == 0 {
+			budget.SoftThreshold = b.defaults.SoftThreshold
+		}
+	}
+	budget.KeyID = keyID
+	return budget
+}
+
+// current returns the spend of a key, rolling over finished periods; the caller must hold the mutex
+func (b *Budgets) current(keyID string, now time.Time) *spend {
+	day := now.Format("2006-01-02")
+	month := now.Format("2006-01")
+
+	s, ok := b.spend[keyID]
+	if !ok {
+		s = &spend{day: day, month: month, alerted: make(map[string]bool)}
+		b.spend[keyID] = s
+	}
+	if day > s.day {
+		s.day = day
+		s.dayTokens = 0
+		delete(s.alerted, PeriodDaily+":soft")
+		delete(s.alerted, PeriodDaily+":exceeded")
+	}
+	if month > s.month {
+		s.month = month
+		s.monthTokens = 0
+		delete(s.alerted, PeriodMonthly+":soft")
+		delete(s.alerted, PeriodMonthly+":exceeded")
+	}
+	return s
+}
+
+// status builds the status of a key; the caller must hold the mutex
+func (b *Budgets) status(keyID string) BudgetStatus {
+	_, explicit := b.budgets[keyID]
+	s := b.current(keyID, time.Now().UTC())
+	return BudgetStatus{
+		Budget:      b.effective(keyID),
+		Default:     !explicit,
+		Day:         s.day,
+		DailyUsed:   s.dayTokens,
+		Month:       s.month,
+		MonthlyUsed: s.monthTokens,
+	}
+}
+
+func (b *Budgets) load() error {
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var list []Budget
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", b.path, err)
+	}
+	for i := range list {
+		b.budgets[list[i].KeyID] = &list[i]
+	}
+	return nil
+}
+
+// save writes all explicit budgets atomically; the caller must hold the mutex
+func (b *Budgets) save() error {
+	list := make([]Budget, 0, len(b.budgets))
+	for _, budget := range b.budgets {
+		list = append(list, *budget)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].KeyID < list[j].KeyID
+	})
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(b.path, data)
+}
+
+// budgetAlert is sent when a key crosses its soft threshold or exhausts a budget
+type budgetAlert struct {
+	Event     string    `json:"event"`
+	KeyID     string    `json:"key_id"`
+	Period    string    `json:"period"`
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Threshold float64   `json:"threshold,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// crossed returns the alerts due for one period and marks them as sent
+func (s *spend) crossed(keyID, period string, used, limit int64, threshold float64) []budgetAlert {
+	if limit <= 0 {
+		return nil
+	}
+
+	alerts := []budgetAlert{}
+	if used >= limit && !s.alerted[period+":exceeded"] {
+		s.alerted[period+":exceeded"] = true
+		s.alerted[period+":soft"] = true
+		alerts = append(alerts, budgetAlert{Event: "budget.exceeded", KeyID: keyID, Period: period, Limit: limit, Used: used})
+	} else if threshold > 0 && float64(used) >= threshold*float64(limit) && !s.alerted[period+":soft"] {
+		s.alerted[period+":soft"] = true
+		alerts = append(alerts, budgetAlert{Event: "budget.threshold", KeyID: keyID, Period: period, Limit: limit, Used: used, Threshold: threshold})
+	}
+	for i := range alerts {
+		alerts[i].Time = time.Now().UTC()
+	}
+	return alerts
+}
+
+// alert logs a budget alert and posts it to the webhook, if configured
+func (b *Budgets) alert(alert budgetAlert) {
+	slog.Warn("Token budget alert", "event", alert.Event, "key_id", alert.KeyID, "period", alert.Period, "used", alert.Used, "limit", alert.Limit)
+	if b.webhook == "" {
+		return
+	}
+
+	go func() {
+		body, _ := json.Marshal(alert)
+		resp, err := b.client.Post(b.webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			slog.Warn("Budget webhook failed", "error", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			slog.Warn("Budget webhook returned an error", "status", resp.StatusCode)
+		}
+	}()
+}
@@ -0,0 +1,148 @@
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestBudgets creates a budget store with the given defaults and an empty ledger in a temp dir
+func newTestBudgets(t *testing.T, defaults Budget, webhook string) *Budgets {
+	t.Helper()
+	dir := t.TempDir()
+	return newBudgets(filepath.Join(dir, "budgets.json"), defaults, webhook, newLedger(filepath.Join(dir, "usage"), 0, true))
+}
+
+func TestBudgetCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		budget     Budget
+		used       int
+		wantPeriod string
+	}{
+		{"below the daily limit", Budget{DailyTokens: 100}, 99, ""},
+		{"at the daily limit", Budget{DailyTokens: 100}, 100, PeriodDaily},
+		{"over the daily limit", Budget{DailyTokens: 100}, 150, PeriodDaily},
+		{"at the monthly limit", Budget{MonthlyTokens: 100}, 100, PeriodMonthly},
+		{"daily limit checked first", Budget{DailyTokens: 50, MonthlyTokens: 100}, 120, PeriodDaily},
+		{"unlimited", Budget{}, 1000000, ""},
+	}
+	for _, tt := range tests {
+		b := newTestBudgets(t, tt.budget, "")
+		b.add(Record{Time: time.Now().UTC(), KeyID: "k1", TotalTokens: tt.used}, false)
+
+		err := b.Check("k1")
+		var exceeded *BudgetExceededError
+		switch {
+		case tt.wantPeriod == "" && err != nil:
+			t.Errorf("%s: Check = %v, want nil", tt.name, err)
+		case tt.wantPeriod != "" && (!errors.As(err, &exceeded) || exceeded.Period != tt.wantPeriod || exceeded.Used != int64(tt.used)):
+			t.Errorf("%s: Check = %v, want %s budget exceeded with %d used", tt.name, err, tt.wantPeriod, tt.used)
+		}
+
+		// Other keys have their own spend
+		if err := b.Check("k2"); err != nil {
+			t.Errorf("%s: Check of an unused key = %v", tt.name, err)
+		}
+	}
+}
+
+func TestBudgetRollover(t *testing.T) {
+	b := newTestBudgets(t, Budget{}, "")
+
+	tests := []struct {
+		time               string
+		tokens             int
+		wantDay, wantMonth int64
+	}{
+		{"2026-01-30T23:59:00Z", 50, 50, 50},
+		{"2026-01-31T00:01:00Z", 20, 20, 70},
+		{"2026-01-31T12:00:00Z", 10, 30, 80},
+		{"2026-02-01T00:00:00Z", 5, 5, 5},
+	}
+	for _, tt := range tests {
+		at, _ := time.Parse(time.RFC3339, tt.time)
+		b.add(Record{Time: at, KeyID: "k1", TotalTokens: tt.tokens}, false)
+
+		s := b.current("k1", at)
+		if s.dayTokens != tt.wantDay || s.monthTokens != tt.wantMonth {
+			t.Errorf("after %s: day %d, month %d, want %d and %d", tt.time, s.dayTokens, s.monthTokens, tt.wantDay, tt.wantMonth)
+		}
+	}
+}
+
+func TestBudgetAlertsFireOncePerPeriod(t *testing.T) {
+	events := make(chan string, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert budgetAlert
+		json.NewDecoder(r.Body).Decode(&alert)
+		events <- alert.Event + ":" + alert.Period
+	}))
+	defer webhook.Close()
+
+	b := newTestBudgets(t, Budget{DailyTokens: 100, SoftThreshold: 0.5}, webhook.URL)
+	day1 := time.Date(2026, 3, 10, 8, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	for _, r := range []Record{
+		{Time: day1, TotalTokens: 60},
+		{Time: day1.Add(time.Minute), TotalTokens: 10},
+		{Time: day1.Add(2 * time.Minute), TotalTokens: 40},
+		{Time: day1.Add(3 * time.Minute), TotalTokens: 10},
+		{Time: day2, TotalTokens: 60},
+	} {
+		r.KeyID = "k1"
+		b.add(r, true)
+	}
+
+	// Posts are asynchronous, so only the counts are compared
+	got := map[string]int{}
+	for i := 0; i < 3; i++ {
+		select {
+		case event := <-events:
+			got[event]++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %v, want 3 alerts", got)
+		}
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected alert %s", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got["budget.threshold:daily"] != 2 || got["budget.exceeded:daily"] != 1 {
+		t.Errorf("alerts = %v, want the daily threshold twice and exceeded once", got)
+	}
+}
+
+func TestBudgetsReloadAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "budgets.json")
+	ledgerDir := filepath.Join(dir, "usage")
+
+	ledger := newLedger(ledgerDir, 0, true)
+	b := newBudgets(path, Budget{}, "", ledger)
+	if err := b.Set(Budget{KeyID: "k1", DailyTokens: 100}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := b.Set(Budget{KeyID: "k1", DailyTokens: -1}); err == nil {
+		t.Errorf("Set accepted a negative budget")
+	}
+	ledger.Append(Record{KeyID: "k1", PromptTokens: 60, CompletionTokens: 40})
+	if err := b.Check("k1"); err == nil {
+		t.Fatalf("Check passed with the budget used up")
+	}
+
+	// A new store reads the budget file and rebuilds spend from the ledger files
+	restarted := newBudgets(path, Budget{}, "", newLedger(ledgerDir, 0, true))
+	status := restarted.Status("k1")
+	if status.Default || status.DailyTokens != 100 || status.DailyUsed != 100 || status.MonthlyUsed != 100 {
+		t.Errorf("status after restart = %+v", status)
+	}
+	if err := restarted.Check("k1"); err == nil {
+		t.Errorf("Check passed after restart with the budget used up")
+	}
+}
@@ -0,0 +1,147 @@
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Tyler-Dinh/z2api-go/config"
+	"github.com/Tyler-Dinh/z2api-go/utils"
+)
+
+// Record is one proxied request as stored in the usage ledger
+type Record struct {
+	Time             time.Time `json:"time"`
+	RequestID        string    `json:"request_id,omitempty"`
+	KeyID            string    `json:"key_id"`
+	Model            string    `json:"model"`
+	Dialect          string    `json:"dialect"`
+	Stream           bool      `json:"stream"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	LatencyMs        int64     `json:"latency_ms"`
+	Status           int       `json:"status"`
+	Error            string    `json:"error,omitempty"`
+	ChatID           string    `json:"chat_id,omitempty"`
+}
+
+// Ledger is an append-only JSONL store of usage records with size-based rotation
+//
+// The active file is usage.jsonl; once it exceeds the configured size it is
+// renamed to usage-<timestamp>.jsonl and a new file is started.
+type Ledger struct {
+	writer  *utils.JSONLWriter
+	enabled bool
+
+	mutex     sync.Mutex
+	listeners []func(Record)
+}
+
+var (
+	ledger     *Ledger
+	ledgerOnce sync.Once
+)
+
+// GetLedger returns the singleton usage ledger
+func GetLedger() *Ledger {
+	ledgerOnce.Do(func() {
+		cfg := config.GetConfig()
+		ledger = newLedger(filepath.Join(cfg.Storage.DataDir, "usage"), cfg.Usage.MaxFileSize, cfg.Usage.Enabled)
+	})
+	return ledger
+}
+
+// newLedger creates a ledger storing its files in dir
+func newLedger(dir string, maxFileSize int64, enabled bool) *Ledger {
+	return &Ledger{
+		writer:  utils.NewJSONLWriter(dir, "usage", maxFileSize, 0),
+		enabled: enabled,
+	}
+}
+
+// Enabled reports whether records are persisted
+func (l *Ledger) Enabled() bool {
+	return l.enabled
+}
+
+// Subscribe registers a function called for every appended record
+func (l *Ledger) Subscribe(fn func(Record)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.listeners = append(l.listeners, fn)
+}
+
+// Append writes a record to the active ledger file
+func (l *Ledger) Append(record Record) {
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+	record.TotalTokens = record.PromptTokens + record.CompletionTokens
+
+	if l.enabled {
+		if err := l.writer.Append(record); err != nil {
+			slog.Warn("Failed to write usage record", "error", err)
+		}
+	}
+
+	l.mutex.Lock()
+	listeners := l.listeners
+	l.mutex.Unlock()
+
+	for _, fn := range listeners {
+		fn(record)
+	}
+}
+
+// Scan calls fn for every stored record with a timestamp at or after since
+func (l *Ledger) Scan(since time.Time, fn func(Record)) error {
+	if !l.enabled {
+		return nil
+	}
+
+	files, err := l.writer.Files()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range files {
+		// Skip rotated files that were finished before the range starts
+		if info, err := os.Stat(path); err == nil && !since.IsZero() && info.ModTime().Before(since) {
+			continue
+		}
+		if err := scanFile(path, since, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanFile(path string, since time.Time, fn func(Record)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		if !since.IsZero() && record.Time.Before(since) {
+			continue
+		}
+		fn(record)
+	}
+	return scanner.Err()
+}
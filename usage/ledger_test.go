@@ -0,0 +1,74 @@
+package usage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLedgerAppendAndRotate(t *testing.T) {
+	dir := t.TempDir()
+	ledger := newLedger(dir, 400, true)
+
+	notified := 0
+	ledger.Subscribe(func(Record) { notified++ })
+
+	start := time.Date(2026, 3, 10, 8, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		ledger.Append(Record{Time: start.Add(time.Duration(i) * time.Hour), KeyID: "k1", Model: "glm-4.6", PromptTokens: i, CompletionTokens: 1})
+	}
+	if notified != 5 {
+		t.Errorf("subscriber saw %d records, want 5", notified)
+	}
+
+	rotated, _ := filepath.Glob(filepath.Join(dir, "usage-*.jsonl"))
+	if len(rotated) == 0 {
+		t.Fatalf("no rotated files in %s", dir)
+	}
+	for _, path := range append(rotated, filepath.Join(dir, "usage.jsonl")) {
+		if info, err := os.Stat(path); err != nil || info.Size() > 400 {
+			t.Errorf("%s: %v, size over the limit", path, err)
+		}
+	}
+
+	// Records come back oldest first across files, with their totals
+	records := []Record{}
+	if err := ledger.Scan(time.Time{}, func(r Record) { records = append(records, r) }); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if len(records) != 5 {
+		t.Fatalf("scanned %d records, want 5", len(records))
+	}
+	for i, r := range records {
+		if r.PromptTokens != i || r.TotalTokens != i+1 {
+			t.Errorf("record %d = %+v", i, r)
+		}
+	}
+
+	records = records[:0]
+	ledger.Scan(start.Add(3*time.Hour), func(r Record) { records = append(records, r) })
+	if len(records) != 2 {
+		t.Errorf("scanned %d records since the fourth, want 2", len(records))
+	}
+}
+
+func TestLedgerDisabled(t *testing.T) {
+	dir := t.TempDir()
+	ledger := newLedger(dir, 0, false)
+
+	notified := 0
+	ledger.Subscribe(func(Record) { notified++ })
+	ledger.Append(Record{KeyID: "k1", PromptTokens: 1})
+
+	// Subscribers such as budgets still see records that are not stored
+	if notified != 1 {
+		t.Errorf("subscriber saw %d records, want 1", notified)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("disabled ledger wrote %d files", len(entries))
+	}
+	if err := ledger.Scan(time.Time{}, func(Record) { t.Errorf("disabled ledger returned a record") }); err != nil {
+		t.Errorf("Scan: %v", err)
+	}
+}
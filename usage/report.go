@@ -0,0 +1,186 @@
+package usage
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter selects ledger records
+type Filter struct {
+	KeyID   string
+	Model   string
+	Dialect string
+	From    time.Time
+	To      time.Time
+}
+
+// Match reports whether a record passes the filter
+func (f Filter) Match(r Record) bool {
+	if f.KeyID != "" && r.KeyID != f.KeyID {
+		return false
+	}
+	if f.Model != "" && r.Model != f.Model {
+		return false
+	}
+	if f.Dialect != "" && !strings.EqualFold(r.Dialect, f.Dialect) {
+		return false
+	}
+	if !f.From.IsZero() && r.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !r.Time.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+// Group is an aggregated usage row
+type Group struct {
+	KeyID            string `json:"key_id,omitempty"`
+	Model            string `json:"model,omitempty"`
+	Day              string `json:"day,omitempty"`
+	Requests         int    `json:"requests"`
+	Errors           int    `json:"errors"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	TotalTokens      int    `json:"total_tokens"`
+	AvgLatencyMs     int64  `json:"avg_latency_ms"`
+
+	latencySum int64
+}
+
+// ValidGroupFields are the fields records can be grouped by
+var ValidGroupFields = []string{"key", "model", "day"}
+
+// Query returns the records matching the filter, oldest first
+func (l *Ledger) Query(filter Filter) ([]Record, error) {
+	records := []Record{}
+	err := l.Scan(filter.From, func(r Record) {
+		if filter.Match(r) {
+			records = append(records, r)
+		}
+	})
+	return records, err
+}
+
+// Summarize aggregates records by the given fields (key, model, day)
+func Summarize(records []Record, groupBy []string) []*Group {
+	byKey := map[string]*Group{}
+	order := []string{}
+
+	for _, r := range records {
+		g := Group{}
+		for _, field := range groupBy {
+			switch field {
+			case "key":
+				g.KeyID = r.KeyID
+			case "model":
+				g.Model = r.Model
+			case "day":
+				g.Day = r.Time.UTC().Format("2006-01-02")
+			}
+		}
+
+		id := g.KeyID + "\x00" + g.Model + "\x00" + g.Day
+		group, ok := byKey[id]
+		if !ok {
+			group = &g
+			byKey[id] = group
+			order = append(order, id)
+		}
+
+		group.Requests++
+		if r.Status >= 400 || r.Error != "" {
+			group.Errors++
+		}
+		group.PromptTokens += r.PromptTokens
+		group.CompletionTokens += r.CompletionTokens
+		group.TotalTokens += r.TotalTokens
+		group.latencySum += r.LatencyMs
+	}
+
+	groups := make([]*Group, 0, len(order))
+	for _, id := range order {
+		group := byKey[id]
+		group.AvgLatencyMs = group.latencySum / int64(group.Requests)
+		groups = append(groups, group)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.KeyID != b.KeyID {
+			return a.KeyID < b.KeyID
+		}
+		return a.Model < b.Model
+	})
+	return groups
+}
+
+// WriteRecordsCSV writes records as CSV with a header row
+func WriteRecordsCSV(w io.Writer, records []Record) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"time", "request_id", "key_id", "model", "dialect", "stream",
+		"prompt_tokens", "completion_tokens", "total_tokens",
+		"latency_ms", "status", "error", "chat_id",
+	})
+	for _, r := range records {
+		cw.Write([]string{
+			r.Time.UTC().Format(time.RFC3339Nano),
+			r.RequestID,
+			r.KeyID,
+			r.Model,
+			r.Dialect,
+			strconv.FormatBool(r.Stream),
+			strconv.Itoa(r.PromptTokens),
+			strconv.Itoa(r.CompletionTokens),
+			strconv.Itoa(r.TotalTokens),
+			strconv.FormatInt(r.LatencyMs, 10),
+			strconv.Itoa(r.Status),
+			r.Error,
+			r.ChatID,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteGroupsCSV writes aggregated rows as CSV, including only the grouped columns
+func WriteGroupsCSV(w io.Writer, groups []*Group, groupBy []string) error {
+	cw := csv.NewWriter(w)
+	header := append([]string{}, groupBy...)
+	header = append(header, "requests", "errors", "prompt_tokens", "completion_tokens", "total_tokens", "avg_latency_ms")
+	cw.Write(header)
+
+	for _, g := range groups {
+		row := []string{}
+		for _, field := range groupBy {
+			switch field {
+			case "key":
+				row = append(row, g.KeyID)
+			case "model":
+				row = append(row, g.Model)
+			case "day":
+				row = append(row, g.Day)
+			}
+		}
+		row = append(row,
+			strconv.Itoa(g.Requests),
+			strconv.Itoa(g.Errors),
+			strconv.Itoa(g.PromptTokens),
+			strconv.Itoa(g.CompletionTokens),
+			strconv.Itoa(g.TotalTokens),
+			strconv.FormatInt(g.AvgLatencyMs, 10),
+		)
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
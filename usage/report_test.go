@@ -0,0 +1,101 @@
+package usage
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// reportRecords appends a small mix of keys, models and days to a ledger in a temp dir
+func reportRecords(t *testing.T) *Ledger {
+	t.Helper()
+	ledger := newLedger(t.TempDir(), 0, true)
+	day1 := time.Date(2026, 3, 10, 8, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	for _, r := range []Record{
+		{Time: day1, KeyID: "k1", Model: "glm-4.6", Dialect: "OpenAI", PromptTokens: 10, CompletionTokens: 5, LatencyMs: 100, Status: 200},
+		{Time: day1.Add(time.Hour), KeyID: "k1", Model: "glm-4.5", Dialect: "Anthropic", PromptTokens: 20, LatencyMs: 300, Status: 400, Error: "Invalid JSON"},
+		{Time: day1.Add(2 * time.Hour), KeyID: "k2", Model: "glm-4.6", Dialect: "OpenAI", PromptTokens: 1, CompletionTokens: 1, LatencyMs: 50, Status: 200},
+		{Time: day2, KeyID: "k1", Model: "glm-4.6", Dialect: "OpenAI", PromptTokens: 30, CompletionTokens: 10, LatencyMs: 200, Status: 200, ChatID: "chat-1"},
+	} {
+		ledger.Append(r)
+	}
+	return ledger
+}
+
+func TestLedgerQuery(t *testing.T) {
+	ledger := reportRecords(t)
+	day2 := time.Date(2026, 3, 11, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   int
+	}{
+		{"all", Filter{}, 4},
+		{"key", Filter{KeyID: "k1"}, 3},
+		{"model", Filter{Model: "glm-4.6"}, 3},
+		{"dialect ignores case", Filter{Dialect: "anthropic"}, 1},
+		{"from", Filter{From: day2}, 1},
+		{"to is exclusive", Filter{To: day2}, 3},
+		{"combined", Filter{KeyID: "k1", Model: "glm-4.6", To: day2}, 1},
+	}
+	for _, tt := range tests {
+		records, err := ledger.Query(tt.filter)
+		if err != nil {
+			t.Fatalf("%s: Query: %v", tt.name, err)
+		}
+		if len(records) != tt.want {
+			t.Errorf("%s: got %d records, want %d", tt.name, len(records), tt.want)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	records, _ := reportRecords(t).Query(Filter{})
+
+	byKey := Summarize(records, []string{"key"})
+	if len(byKey) != 2 || byKey[0].KeyID != "k1" || byKey[1].KeyID != "k2" {
+		t.Fatalf("groups by key = %+v", byKey)
+	}
+	k1 := byKey[0]
+	if k1.Requests != 3 || k1.Errors != 1 || k1.PromptTokens != 60 || k1.TotalTokens != 75 || k1.AvgLatencyMs != 200 || k1.Model != "" {
+		t.Errorf("k1 = %+v", k1)
+	}
+
+	byModelAndDay := Summarize(records, []string{"model", "day"})
+	got := []string{}
+	for _, g := range byModelAndDay {
+		got = append(got, g.Day+" "+g.Model)
+	}
+	if strings.Join(got, ", ") != "2026-03-10 glm-4.5, 2026-03-10 glm-4.6, 2026-03-11 glm-4.6" {
+		t.Errorf("groups by model and day = %v", got)
+	}
+	if byModelAndDay[1].Requests != 2 || byModelAndDay[1].KeyID != "" {
+		t.Errorf("glm-4.6 on the first day = %+v", byModelAndDay[1])
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	records, _ := reportRecords(t).Query(Filter{Dialect: "Anthropic"})
+
+	var b strings.Builder
+	if err := WriteRecordsCSV(&b, records); err != nil {
+		t.Fatalf("WriteRecordsCSV: %v", err)
+	}
+	want := "time,request_id,key_id,model,dialect,stream,prompt_tokens,completion_tokens,total_tokens,latency_ms,status,error,chat_id\n" +
+		"2026-03-10T09:00:00Z,,k1,glm-4.5,Anthropic,false,20,0,20,300,400,Invalid JSON,\n"
+	if b.String() != want {
+		t.Errorf("records CSV = %q, want %q", b.String(), want)
+	}
+
+	b.Reset()
+	if err := WriteGroupsCSV(&b, Summarize(records, []string{"key", "day"}), []string{"key", "day"}); err != nil {
+		t.Fatalf("WriteGroupsCSV: %v", err)
+	}
+	want = "key,day,requests,errors,prompt_tokens,completion_tokens,total_tokens,avg_latency_ms\n" +
+		"k1,2026-03-10,1,1,20,0,20,300\n"
+	if b.String() != want {
+		t.Errorf("groups CSV = %q, want %q", b.String(), want)
+	}
+}
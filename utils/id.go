@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"strings"
+
 	"github.com/google/uuid"
 )
 
@@ -26,5 +28,5 @@ func GenerateChatCompletionID() string {
 
 // GenerateMessageID generates a message ID with prefix
 func GenerateMessageID() string {
-	return "msg-" + GenerateID()
-}
\ No newline at end of file
+	return "msg_" + strings.ReplaceAll(GenerateID(), "-", "")
+}
@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JSONLWriter appends JSON lines to <dir>/<name>.jsonl with size-based rotation
+//
+// Once the active file would exceed maxSize it is renamed to
+// <name>-<timestamp>.jsonl and a new file is started. When maxFiles is
+// positive, the oldest rotated files beyond that count are deleted.
+type JSONLWriter struct {
+	dir      string
+	name     string
+	maxSize  int64
+	maxFiles int
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+	// rotatedAt is the timestamp of the newest rotated file
+	rotatedAt time.Time
+}
+
+// NewJSONLWriter creates a writer; files are only created on the first append
+func NewJSONLWriter(dir, name string, maxSize int64, maxFiles int) *JSONLWriter {
+	return &JSONLWriter{dir: dir, name: name, maxSize: maxSize, maxFiles: maxFiles}
+}
+
+// ActivePath returns the path of the file currently written to
+func (w *JSONLWriter) ActivePath() string {
+	return filepath.Join(w.dir, w.name+".jsonl")
+}
+
+// Files returns all files of the writer, rotated files first in chronological order
+func (w *JSONLWriter) Files() ([]string, error) {
+	rotated, err := filepath.Glob(filepath.Join(w.dir, w.name+"-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rotated)
+	return append(rotated, w.ActivePath()), nil
+}
+
+// Append writes v as one JSON line
+func (w *JSONLWriter) Append(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.file != nil && w.maxSize > 0 && w.size+int64(len(line)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if w.file == nil {
+		if err := os.MkdirAll(w.dir, 0755); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(w.ActivePath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.file = f
+		w.size = info.Size()
+	}
+
+	n, err := w.file.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+// rotate closes the active file, renames it with a timestamp suffix and prunes old files
+func (w *JSONLWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	w.size = 0
+
+	// Files rotated within the same millisecond take the next free one, keeping their order
+	at := time.Now().UTC().Truncate(time.Millisecond)
+	if !at.After(w.rotatedAt) {
+		at = w.rotatedAt.Add(time.Millisecond)
+	}
+	rotated := filepath.Join(w.dir, fmt.Sprintf("%s-%s.jsonl", w.name, at.Format("20060102T150405.000")))
+	for {
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		at = at.Add(time.Millisecond)
+		rotated = filepath.Join(w.dir, fmt.Sprintf("%s-%s.jsonl", w.name, at.Format("20060102T150405.000")))
+	}
+	if err := os.Rename(w.ActivePath(), rotated); err != nil {
+		return err
+	}
+	w.rotatedAt = at
+
+	if w.maxFiles <= 0 {
+		return nil
+	}
+	files, err := w.Files()
+	if err != nil {
+		return err
+	}
+	files = files[:len(files)-1]
+	for len(files) > w.maxFiles {
+		if err := os.Remove(files[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
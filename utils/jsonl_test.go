@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestJSONLWriterRotationKeepsEveryLine(t *testing.T) {
+	dir := t.TempDir()
+	w := NewJSONLWriter(dir, "log", 16, 0)
+
+	// Every line rotates, many within the same millisecond
+	for i := 0; i < 50; i++ {
+		if err := w.Append(map[string]int{"line": i}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	files, err := w.Files()
+	if err != nil {
+		t.Fatalf("Files: %v", err)
+	}
+	lines := []string{}
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("open %s: %v", path, err)
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		f.Close()
+	}
+	if len(lines) != 50 {
+		t.Fatalf("read %d lines, want 50", len(lines))
+	}
+	for i, line := range lines {
+		if want := `{"line":` + strconv.Itoa(i) + `}`; line != want {
+			t.Errorf("line %d = %s, want %s", i, line, want)
+		}
+	}
+}
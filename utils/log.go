@@ -0,0 +1,103 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type requestIDKey struct{}
+
+// Patterns for secrets that may appear inside logged values
+var (
+	bearerPattern  = regexp.MustCompile(`(?i)(bearer\s+)[A-Za-z0-9._~+/=-]+`)
+	jwtPattern     = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)
+	apiKeyPattern  = regexp.MustCompile(`sk-[A-Za-z0-9_-]{8,}`)
+	dataURLPattern = regexp.MustCompile(`(data:[a-zA-Z0-9.+/-]+;base64,)[A-Za-z0-9+/=]+`)
+)
+
+// sensitiveKeys are attribute names whose values are never logged
+var sensitiveKeys = []string{"token", "authorization", "signature", "password", "secret", "api_key", "apikey", "x-api-key", "cookie"}
+
+// InitLogger installs a JSON slog logger as the default, at debug level if debug is set
+//
+// The standard log package is redirected to it as well, so every line is
+// JSON, carries the request ID when logged with a context and is redacted.
+func InitLogger(debug bool) {
+	level := slog.LevelInfo
+	if debug {
+		level = slog.LevelDebug
+	}
+
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	})
+	slog.SetDefault(slog.New(&contextHandler{Handler: handler}))
+}
+
+// WithRequestID returns a context carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID, or an empty string if none is set
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RedactString masks bearer tokens, JWTs, API keys and inline base64 data in s
+func RedactString(s string) string {
+	s = dataURLPattern.ReplaceAllStringFunc(s, func(match string) string {
+		prefix := dataURLPattern.FindStringSubmatch(match)[1]
+		return fmt.Sprintf("%s[%d bytes]", prefix, len(match)-len(prefix))
+	})
+	s = bearerPattern.ReplaceAllString(s, "${1}[redacted]")
+	s = jwtPattern.ReplaceAllString(s, "[redacted]")
+	s = apiKeyPattern.ReplaceAllString(s, "[redacted]")
+	return s
+}
+
+// contextHandler adds the request ID from the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := RequestIDFromContext(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
+
+// redactAttr masks sensitive attributes and secrets embedded in string values
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	key := strings.ToLower(attr.Key)
+	for _, sensitive := range sensitiveKeys {
+		if key == sensitive || strings.HasSuffix(key, "_"+sensitive) {
+			return slog.String(attr.Key, "[redacted]")
+		}
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, RedactString(attr.Value.String()))
+	case slog.KindAny:
+		if err, ok := attr.Value.Any().(error); ok {
+			return slog.String(attr.Key, RedactString(err.Error()))
+		}
+	}
+	return attr
+}
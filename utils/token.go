@@ -1,7 +1,7 @@
 package utils
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 
@@ -28,7 +28,7 @@ func InitTokenizer() error {
 		return err
 	}
 
-	log.Println("Tokenizer initialized successfully")
+	slog.Info("Tokenizer initialized")
 	return nil
 }
 
@@ -36,11 +36,11 @@ func InitTokenizer() error {
 func CountTokens(text string) int {
 	if encoder == nil {
 		if err := InitTokenizer(); err != nil {
-			log.Printf("Warning: Failed to initialize tokenizer: %v", err)
+			slog.Warn("Failed to initialize tokenizer", "error", err)
 			return 0
 		}
 	}
 
 	tokens := encoder.Encode(text, nil, nil)
 	return len(tokens)
-}
\ No newline at end of file
+}